@@ -1,17 +1,39 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type nativeConf struct {
-	Activate    bool   `json:"activate"`    // If true starts the Native server.
-	Port        int    `json:"port"`        // Port to listen on.
-	OnLocalhost bool   `json:"onLocalhost"` // If true starts listening on localhost.
-	TLS         bool   `json:"tls"`         // Enables TLS connections (requires cert & key files).
-	CertFile    string `json:"certFile"`    // Path to the TLS/SSL certificate file.
-	KeyFile     string `json:"keyFile"`     // Path to the TLS/SSL key file.
+	Activate        bool           `json:"activate"`        // If true starts the Native server.
+	Port            int            `json:"port"`            // Port to listen on.
+	OnLocalhost     bool           `json:"onLocalhost"`     // If true starts listening on localhost.
+	TLS             bool           `json:"tls"`             // Enables TLS connections (requires cert & key files).
+	CertFile        string         `json:"certFile"`        // Path to the TLS/SSL certificate file.
+	KeyFile         string         `json:"keyFile"`         // Path to the TLS/SSL key file.
+	ConnLogSampling uint64         `json:"connLogSampling"` // If greater than 1, logs only every Nth opened and closed connection.
+	IdleTimeout     string         `json:"idleTimeout"`     // Closes connections idle for longer, e.g. "5m", if empty, never.
+	WriteTimeout    string         `json:"writeTimeout"`    // Closes connections whose response takes longer to write, e.g. "10s", if empty, never.
+	MaxConns        int            `json:"maxConns"`        // Limits the number of connections served at once, if zero, unlimited.
+	ConnLimitPolicy string         `json:"connLimitPolicy"` // Accepted values: "reject" (default) or "wait" for connections over maxConns.
+	Migration       *migrationConf `json:"migration"`       // Redirects writes to matching keys to another server, if nil, none are.
+}
+
+// migrationConf describes keys whose native writes are redirected while they are
+// moved to another server.
+type migrationConf struct {
+	Addr     string   `json:"addr"`     // Address of the server the keys are moved to.
+	Patterns []string `json:"patterns"` // Keys to redirect, in the syntax of path.Match.
 }
 
 type grpcConf struct {
@@ -21,15 +43,22 @@ type grpcConf struct {
 	TLS         bool   `json:"tls"`         // Enables TLS connections (requires cert & key files).
 	CertFile    string `json:"certFile"`    // Path to the TLS/SSL certificate file.
 	KeyFile     string `json:"keyFile"`     // Path to the TLS/SSL key file.
+	Reflection  bool   `json:"reflection"`  // Serves gRPC reflection, e.g. for grpcurl.
 }
 
 type httpConf struct {
-	Activate    bool   `json:"activate"`    // If true starts the HTTP server.
-	Port        int    `json:"port"`        // Port to listen on.
-	OnLocalhost bool   `json:"onLocalhost"` // If true starts listening on localhost.
-	TLS         bool   `json:"tls"`         // Enables TLS connections (requires cert & key files).
-	CertFile    string `json:"certFile"`    // Path to the TLS/SSL certificate file.
-	KeyFile     string `json:"keyFile"`     // Path to the TLS/SSL key file.
+	Activate    bool     `json:"activate"`    // If true starts the HTTP server.
+	Port        int      `json:"port"`        // Port to listen on.
+	OnLocalhost bool     `json:"onLocalhost"` // If true starts listening on localhost.
+	TLS         bool     `json:"tls"`         // Enables TLS connections (requires cert & key files).
+	CertFile    string   `json:"certFile"`    // Path to the TLS/SSL certificate file.
+	KeyFile     string   `json:"keyFile"`     // Path to the TLS/SSL key file.
+	WebSocket   bool     `json:"webSocket"`   // Serves the Native protocol over WebSocket on /ws.
+	NotFound    *bool    `json:"notFound"`    // Responds to GET of a missing key with 404 instead of 200, defaults to true.
+	MaxRawBytes int64    `json:"maxRawBytes"` // Largest value accepted by PUT /RAW/:key, defaults to 16 MiB.
+	GzipLevel   *int     `json:"gzipLevel"`   // Compression level of gzip responses from 1 to 9, 0 disables, defaults to 6.
+	GRPCWeb     bool     `json:"grpcWeb"`     // Serves the gRPC API to gRPC-Web clients, e.g. browsers.
+	CORSOrigins []string `json:"corsOrigins"` // Origins allowed to make cross-origin gRPC-Web requests, "*" allows any.
 }
 
 // config contains configurable settings for the program.
@@ -37,9 +66,18 @@ type config struct {
 	Native          nativeConf `json:"native"`          // Settings for Native server.
 	GRPC            grpcConf   `json:"grpc"`            // Settings for GRPC server.
 	HTTP            httpConf   `json:"http"`            // Settings for HTTP server.
-	Verbosity       string     `json:"verbosity"`       // Accepted values: "prod", "dev", or "none".
+	Verbosity       string     `json:"verbosity"`       // Accepted values: "prod", "dev", "trace", or "none".
 	CleanupInterval string     `json:"cleanupInterval"` // Takes the format: "10s", "5m", or "1h".
+	MaxAge          string     `json:"maxAge"`          // Evicts values older than this regardless of TTL, e.g. "24h".
+	ExpiryPolicy    string     `json:"expiryPolicy"`    // Accepted values: "passive" (default), "lazy", or "aggressive".
+	MaxValueBytes   int64      `json:"maxValueBytes"`   // Largest value accepted by any server, if zero, unlimited.
+	MaxKeyBytes     *int64     `json:"maxKeyBytes"`     // Longest key accepted by any server, 0 means unlimited, defaults to 512.
 	SaveOnShutdown  bool       `json:"saveOnShutdown"`  // Enables data serialization to disk on shutdown.
+	PreStopDelay    string     `json:"preStopDelay"`    // Delay between a shutdown signal and draining, e.g. "5s".
+	AppendLog       string     `json:"appendLog"`       // Path of the append-only log replayed on startup, if empty, writes are not logged.
+	AppendLogFlush  string     `json:"appendLogFlush"`  // How often the append-only log is flushed, defaults to "1s".
+	APIKey          string     `json:"apiKey"`          // Shared secret required by all servers, if empty, authentication is disabled.
+	ConfirmPurge    bool       `json:"confirmPurge"`    // Refuses PURGE requests that are not explicitly confirmed.
 }
 
 // readConfig reads the configurating file and initializes config struct with its
@@ -54,5 +92,179 @@ func readConfig(filename string) (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := applyEnv(conf, os.LookupEnv); err != nil {
+		return nil, err
+	}
 	return conf, nil
 }
+
+// envPrefix starts the names of environment variables that override settings.
+const envPrefix = "RCS_"
+
+// applyEnv overrides settings of conf with environment variables returned by lookup.
+// A variable is named after the JSON keys of the setting in upper snake case, e.g.
+// RCS_VERBOSITY or RCS_HTTP_PORT. Booleans take the values accepted by
+// strconv.ParseBool, and lists, e.g. RCS_HTTP_CORS_ORIGINS, are comma-separated.
+func applyEnv(conf *config, lookup func(string) (string, bool)) error {
+	return applyEnvStruct(reflect.ValueOf(conf).Elem(), envPrefix, lookup)
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + envName(strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0])
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvStruct(field, name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid value %q of %s", value, name)
+		}
+	}
+	return nil
+}
+
+// setField parses value into field according to the type of field.
+func setField(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Pointer {
+		ptr := reflect.New(field.Type().Elem())
+		if err := setField(ptr.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return errors.New("unsupported setting type " + field.Type().String())
+	}
+	return nil
+}
+
+// envName converts a camel case JSON key to upper snake case, e.g. "onLocalhost"
+// to "ON_LOCALHOST".
+func envName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 && !unicode.IsUpper(rune(key[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// durations contains the durations of config parsed from their string form.
+type durations struct {
+	cleanupInterval time.Duration
+	maxAge          time.Duration
+	preStopDelay    time.Duration
+	appendLogFlush  time.Duration
+}
+
+// validate parses the durations of config and checks the settings that cannot be
+// verified while decoding the file.
+func (c *config) validate() (durations, error) {
+	d := durations{appendLogFlush: time.Second}
+	var err error
+	if c.CleanupInterval != "" {
+		if d.cleanupInterval, err = time.ParseDuration(c.CleanupInterval); err != nil {
+			return d, fmt.Errorf("invalid cleanupInterval: %w", err)
+		}
+	}
+	if c.MaxAge != "" {
+		if d.maxAge, err = time.ParseDuration(c.MaxAge); err != nil {
+			return d, fmt.Errorf("invalid maxAge: %w", err)
+		}
+		if d.maxAge > 0 && d.cleanupInterval <= 0 {
+			return d, errors.New("maxAge requires cleanupInterval to be set")
+		}
+	}
+	if c.Native.IdleTimeout != "" {
+		if _, err = time.ParseDuration(c.Native.IdleTimeout); err != nil {
+			return d, fmt.Errorf("invalid native.idleTimeout: %w", err)
+		}
+	}
+	if c.Native.WriteTimeout != "" {
+		if _, err = time.ParseDuration(c.Native.WriteTimeout); err != nil {
+			return d, fmt.Errorf("invalid native.writeTimeout: %w", err)
+		}
+	}
+	if c.PreStopDelay != "" {
+		if d.preStopDelay, err = time.ParseDuration(c.PreStopDelay); err != nil {
+			return d, fmt.Errorf("invalid preStopDelay: %w", err)
+		}
+	}
+	if c.AppendLogFlush != "" {
+		if d.appendLogFlush, err = time.ParseDuration(c.AppendLogFlush); err != nil {
+			return d, fmt.Errorf("invalid appendLogFlush: %w", err)
+		}
+	}
+	if level := c.HTTP.GzipLevel; level != nil && (*level < gzip.NoCompression || *level > gzip.BestCompression) {
+		return d, errors.New("invalid http.gzipLevel")
+	}
+	if c.MaxValueBytes < 0 {
+		return d, errors.New("invalid maxValueBytes")
+	}
+	if c.MaxKeyBytes != nil && *c.MaxKeyBytes < 0 {
+		return d, errors.New("invalid maxKeyBytes")
+	}
+	if c.Native.MaxConns < 0 {
+		return d, errors.New("invalid native.maxConns")
+	}
+	switch c.Native.ConnLimitPolicy {
+	case "", "reject", "wait":
+	default:
+		return d, errors.New("invalid native.connLimitPolicy: " + c.Native.ConnLimitPolicy)
+	}
+	if m := c.Native.Migration; m != nil {
+		if m.Addr == "" {
+			return d, errors.New("invalid native.migration.addr")
+		}
+		for _, pattern := range m.Patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return d, errors.New("invalid native.migration pattern: " + pattern)
+			}
+		}
+	}
+	switch c.ExpiryPolicy {
+	case "", "passive", "lazy", "aggressive":
+	default:
+		return d, errors.New("invalid expiryPolicy: " + c.ExpiryPolicy)
+	}
+	return d, nil
+}
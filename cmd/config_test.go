@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadConfigEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rcs.json")
+	writeConfig(t, path, `{"verbosity": "prod", "http": {"activate": false, "port": 6123, "onLocalhost": true}}`)
+
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to read configuration file: %v", err)
+	}
+	if conf.Verbosity != "prod" || conf.HTTP.Activate || conf.HTTP.Port != 6123 {
+		t.Errorf("Expected settings from the file, got %+v instead", conf)
+	}
+
+	t.Setenv("RCS_VERBOSITY", "trace")
+	t.Setenv("RCS_HTTP_ACTIVATE", "true")
+	t.Setenv("RCS_HTTP_PORT", "8080")
+	t.Setenv("RCS_HTTP_GZIP_LEVEL", "0")
+	t.Setenv("RCS_HTTP_CORS_ORIGINS", "https://a.example, https://b.example")
+	t.Setenv("RCS_NATIVE_CONN_LOG_SAMPLING", "10")
+	t.Setenv("RCS_API_KEY", "secret")
+	conf, err = readConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to read configuration file: %v", err)
+	}
+	if conf.Verbosity != "trace" {
+		t.Errorf("Expected verbosity %q, got %q instead", "trace", conf.Verbosity)
+	}
+	if !conf.HTTP.Activate || conf.HTTP.Port != 8080 {
+		t.Errorf("Expected HTTP to be activated on port 8080, got %+v instead", conf.HTTP)
+	}
+	if !conf.HTTP.OnLocalhost {
+		t.Error("Expected onLocalhost from the file to be kept")
+	}
+	if conf.HTTP.GzipLevel == nil || *conf.HTTP.GzipLevel != 0 {
+		t.Errorf("Expected gzipLevel 0, got %v instead", conf.HTTP.GzipLevel)
+	}
+	if origins := []string{"https://a.example", "https://b.example"}; !reflect.DeepEqual(conf.HTTP.CORSOrigins, origins) {
+		t.Errorf("Expected corsOrigins %v, got %v instead", origins, conf.HTTP.CORSOrigins)
+	}
+	if conf.Native.ConnLogSampling != 10 {
+		t.Errorf("Expected connLogSampling 10, got %d instead", conf.Native.ConnLogSampling)
+	}
+	if conf.APIKey != "secret" {
+		t.Errorf("Expected apiKey %q, got %q instead", "secret", conf.APIKey)
+	}
+}
+
+func TestReadConfigInvalidEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rcs.json")
+	writeConfig(t, path, `{}`)
+
+	testCases := []struct {
+		name  string
+		value string
+	}{
+		{"RCS_HTTP_PORT", "http"},
+		{"RCS_HTTP_ACTIVATE", "maybe"},
+		{"RCS_NATIVE_CONN_LOG_SAMPLING", "-1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.name, tc.value)
+			expected := `invalid value "` + tc.value + `" of ` + tc.name
+			if _, err := readConfig(path); err == nil || err.Error() != expected {
+				t.Errorf("Expected error %q, got %v instead", expected, err)
+			}
+		})
+	}
+}
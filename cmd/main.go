@@ -33,21 +33,26 @@ import (
 	"time"
 
 	"github.com/nmezhenskyi/rcs/internal/cache"
-	"github.com/nmezhenskyi/rcs/internal/grpcsrv"
-	"github.com/nmezhenskyi/rcs/internal/httpsrv"
-	"github.com/nmezhenskyi/rcs/internal/nativesrv"
+	"github.com/nmezhenskyi/rcs/internal/version"
 	"github.com/rs/zerolog"
 )
 
 func main() {
-	// Main logger instance.
-	var logger = zerolog.New(os.Stderr).With().Timestamp().
-		Logger().Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	// Main logger instance. The verbosity from the configuration file is applied
+	// through out, so that it can be changed on reload.
+	out := newSwitchWriter(zerolog.ConsoleWriter{Out: os.Stderr})
+	logger := zerolog.New(out).With().Timestamp().Logger()
 
 	configFile := flag.String("c", "rcs.json", "Configuration file")
 	devMode := flag.Bool("d", false, "Enable development mode")
+	printVersion := flag.Bool("version", false, "Print version information and exit")
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Println("rcs " + version.String())
+		return
+	}
+
 	_, err := os.Stat(*configFile)
 	if os.IsNotExist(err) {
 		logger.Fatal().Err(err).Msg("Configuration file is missing")
@@ -61,96 +66,76 @@ func main() {
 	if *devMode {
 		conf.Verbosity = "dev"
 	}
-
-	switch conf.Verbosity {
-	case "prod":
-		logger = zerolog.New(os.Stderr).
-			With().Timestamp().Logger().Level(zerolog.InfoLevel)
-	case "dev":
-		logger = zerolog.New(os.Stderr).
-			With().Timestamp().Logger().Level(zerolog.DebugLevel).
-			Output(zerolog.ConsoleWriter{Out: os.Stderr})
-	case "none":
-		logger = zerolog.New(os.Stderr).Level(zerolog.Disabled)
+	d, err := conf.validate()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Invalid configuration file")
 	}
+	setVerbosity(out, conf.Verbosity)
 
 	var (
-		globalCache  *cache.CacheMap
-		nativeServer *nativesrv.Server
-		httpServer   *httpsrv.Server
-		grpcServer   *grpcsrv.Server
+		globalCache *cache.CacheMap
+		appendLog   *cache.AppendLog
 
 		shutdownSignal = make(chan os.Signal, 1)
+		reloadSignal   = make(chan os.Signal, 1)
 	)
 	signal.Notify(shutdownSignal, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
 
 	logger.Info().Msg("--- RCS Started ---")
 
-	globalCache = cache.NewCacheMap()
-
-	if conf.Native.Activate {
-		nativeServer = nativesrv.NewServer(globalCache)
-		nativeServer.Logger = logger.With().Str("scope", "native").Logger()
-		go func() {
-			var err error
-			if conf.Native.TLS {
-				err = nativeServer.ListenAndServeTLS(
-					getLocalAddr(conf.Native.Port, conf.Native.OnLocalhost),
-					conf.Native.CertFile, conf.Native.KeyFile)
-			} else {
-				err = nativeServer.ListenAndServe(getLocalAddr(conf.Native.Port, conf.Native.OnLocalhost))
-			}
-			if err != nil {
-				os.Exit(1)
-			}
-		}()
+	globalCache = cache.NewCacheMapWithCleanup(d.cleanupInterval)
+	globalCache.SetMaxAge(d.maxAge)
+	globalCache.SetMaxValueBytes(conf.MaxValueBytes)
+	if conf.MaxKeyBytes != nil {
+		globalCache.SetMaxKeyBytes(*conf.MaxKeyBytes)
 	}
-	if conf.HTTP.Activate {
-		httpServer = httpsrv.NewServer(globalCache)
-		httpServer.Logger = logger.With().Str("scope", "http").Logger()
-		go func() {
-			var err error
-			if conf.HTTP.TLS {
-				err = httpServer.ListenAndServeTLS(
-					getLocalAddr(conf.HTTP.Port, conf.HTTP.OnLocalhost),
-					conf.HTTP.CertFile, conf.HTTP.KeyFile)
-			} else {
-				err = httpServer.ListenAndServe(getLocalAddr(conf.HTTP.Port, conf.HTTP.OnLocalhost))
-			}
-			if err != nil {
-				os.Exit(1)
-			}
-		}()
+	switch conf.ExpiryPolicy {
+	case "", "passive":
+		globalCache.SetExpiryPolicy(cache.ExpiryPassive)
+	case "lazy":
+		globalCache.SetExpiryPolicy(cache.ExpiryLazy)
+	case "aggressive":
+		globalCache.SetExpiryPolicy(cache.ExpiryAggressive)
 	}
-	if conf.GRPC.Activate {
-		grpcServer = grpcsrv.NewServer(globalCache)
-		grpcServer.Logger = logger.With().Str("scope", "grpc").Logger()
-		go func() {
-			var err error
-			if conf.GRPC.TLS {
-				err = grpcServer.ListenAndServeTLS(
-					getLocalAddr(conf.GRPC.Port, conf.GRPC.OnLocalhost),
-					conf.GRPC.CertFile, conf.GRPC.KeyFile)
-			} else {
-				err = grpcServer.ListenAndServe(getLocalAddr(conf.GRPC.Port, conf.GRPC.OnLocalhost))
-			}
-			if err != nil {
-				os.Exit(1)
-			}
-		}()
+	if conf.AppendLog != "" {
+		if err := cache.ReplayAppendLog(conf.AppendLog, globalCache); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to replay append-only log")
+		}
+		appendLog, err = cache.OpenAppendLog(conf.AppendLog, d.appendLogFlush)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open append-only log")
+		}
+		appendLog.SetErrorHandler(func(err error) {
+			logger.Error().Err(err).Msg("Failed to write append-only log, later writes are not logged")
+		})
+		globalCache.SetMutationLogger(appendLog)
+		logger.Info().Msg(fmt.Sprintf("Restored %d keys from append-only log", globalCache.Length()))
 	}
 
-	<-shutdownSignal
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if nativeServer != nil {
-		nativeServer.Shutdown(ctx)
+	sup := &supervisor{
+		configFile: *configFile,
+		devMode:    *devMode,
+		conf:       *conf,
+		cache:      globalCache,
+		logger:     logger,
+		out:        out,
 	}
-	if httpServer != nil {
-		httpServer.Shutdown(ctx)
+	sup.start()
+	sup.run(reloadSignal, shutdownSignal)
+
+	sup.setReady(false)
+	if d.preStopDelay > 0 {
+		logger.Info().Msg("Waiting " + d.preStopDelay.String() + " before shutdown")
+		time.Sleep(d.preStopDelay)
 	}
-	if grpcServer != nil {
-		grpcServer.Shutdown(ctx)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sup.shutdown(ctx)
+	if appendLog != nil {
+		if err := appendLog.Close(); err != nil {
+			logger.Error().Err(err).Msg("Failed to flush append-only log")
+		}
 	}
 
 	logger.Info().Msg("--- RCS Stopped ---")
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/nmezhenskyi/rcs/internal/cache"
+	"github.com/nmezhenskyi/rcs/internal/grpcsrv"
+	"github.com/nmezhenskyi/rcs/internal/httpsrv"
+	"github.com/nmezhenskyi/rcs/internal/nativesrv"
+	"github.com/rs/zerolog"
+)
+
+// stopTimeout limits how long a server stopped by a reload waits for its connections.
+const stopTimeout = 5 * time.Second
+
+// switchWriter is an io.Writer whose destination can be replaced while loggers
+// holding it are in use, so that the log format can change on reload.
+type switchWriter struct {
+	w atomic.Pointer[io.Writer]
+}
+
+func newSwitchWriter(w io.Writer) *switchWriter {
+	sw := &switchWriter{}
+	sw.set(w)
+	return sw
+}
+
+func (sw *switchWriter) set(w io.Writer) {
+	sw.w.Store(&w)
+}
+
+func (sw *switchWriter) Write(p []byte) (int, error) {
+	return (*sw.w.Load()).Write(p)
+}
+
+// setVerbosity applies the verbosity setting to every logger writing to out.
+// Unknown values leave the logging unchanged.
+func setVerbosity(out *switchWriter, verbosity string) {
+	switch verbosity {
+	case "prod":
+		out.set(os.Stderr)
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	case "dev":
+		out.set(zerolog.ConsoleWriter{Out: os.Stderr})
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	case "trace":
+		out.set(zerolog.ConsoleWriter{Out: os.Stderr})
+		zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	case "none":
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+	}
+}
+
+// supervisor owns the servers of the process, so that they can be started and
+// stopped by reloading the configuration file without dropping the cache.
+// Its methods must be called from a single goroutine.
+type supervisor struct {
+	configFile string
+	devMode    bool
+
+	conf   config // Settings the running servers were started with.
+	cache  *cache.CacheMap
+	logger zerolog.Logger
+	out    *switchWriter
+
+	native *nativesrv.Server
+	http   *httpsrv.Server
+	ws     *nativesrv.Server // Serves the Native protocol over the WebSocket end-point of http.
+	grpc   *grpcsrv.Server
+}
+
+// start starts the servers activated in the configuration. The process exits
+// if any of them fails to listen.
+func (s *supervisor) start() {
+	if s.conf.Native.Activate {
+		s.startNative(true)
+	}
+	if s.conf.HTTP.Activate {
+		s.startHTTP(true)
+	}
+	if s.conf.GRPC.Activate {
+		s.startGRPC(true)
+	}
+}
+
+// run reloads the configuration file on every signal received from reload until
+// a signal is received from shutdown.
+func (s *supervisor) run(reload, shutdown <-chan os.Signal) {
+	for {
+		select {
+		case <-reload:
+			s.reload()
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// reload re-reads the configuration file and applies the settings that can change
+// at runtime: the verbosity and which servers are active. Other changes are
+// logged as ignored until restart. An invalid file leaves the configuration as is.
+func (s *supervisor) reload() {
+	s.logger.Info().Msg("Reloading configuration file")
+	conf, err := readConfig(s.configFile)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to parse configuration file, keeping the current configuration")
+		return
+	}
+	if s.devMode {
+		conf.Verbosity = "dev"
+	}
+	if _, err := conf.validate(); err != nil {
+		s.logger.Error().Err(err).Msg("Invalid configuration file, keeping the current configuration")
+		return
+	}
+
+	if conf.Verbosity != s.conf.Verbosity {
+		setVerbosity(s.out, conf.Verbosity)
+		s.conf.Verbosity = conf.Verbosity
+		for _, srv := range []*nativesrv.Server{s.native, s.ws} {
+			if srv != nil {
+				srv.SetTraceFrames(conf.Verbosity == "trace")
+			}
+		}
+		s.logger.Info().Msg("Verbosity changed to " + conf.Verbosity)
+	}
+
+	restartOnly, current := *conf, s.conf
+	restartOnly.Native, restartOnly.GRPC, restartOnly.HTTP, restartOnly.Verbosity = current.Native, current.GRPC, current.HTTP, current.Verbosity
+	if !reflect.DeepEqual(restartOnly, current) {
+		s.logger.Warn().Msg("Ignoring changes to global settings until restart")
+	}
+
+	if !reflect.DeepEqual(conf.Native.Migration, s.conf.Native.Migration) {
+		s.conf.Native.Migration = conf.Native.Migration
+		for _, srv := range []*nativesrv.Server{s.native, s.ws} {
+			if srv != nil {
+				s.applyMigration(srv)
+			}
+		}
+		if conf.Native.Migration == nil {
+			s.logger.Info().Msg("Migration stopped")
+		} else {
+			s.logger.Info().Msg("Migrating keys to " + conf.Native.Migration.Addr)
+		}
+	}
+
+	switch {
+	case conf.Native.Activate && s.native == nil:
+		s.conf.Native = conf.Native
+		s.startNative(false)
+	case !conf.Native.Activate && s.native != nil:
+		s.conf.Native = conf.Native
+		s.stop("native", s.native.Shutdown)
+		s.native = nil
+	case s.native != nil && !sameSettings(conf.Native, s.conf.Native):
+		s.logger.Warn().Msg("Ignoring changes to native settings until the server is restarted")
+	}
+	switch {
+	case conf.HTTP.Activate && s.http == nil:
+		s.conf.HTTP = conf.HTTP
+		s.startHTTP(false)
+	case !conf.HTTP.Activate && s.http != nil:
+		s.conf.HTTP = conf.HTTP
+		s.stopHTTP()
+	case s.http != nil && !sameSettings(conf.HTTP, s.conf.HTTP):
+		s.logger.Warn().Msg("Ignoring changes to http settings until the server is restarted")
+	}
+	switch {
+	case conf.GRPC.Activate && s.grpc == nil:
+		s.conf.GRPC = conf.GRPC
+		s.startGRPC(false)
+	case !conf.GRPC.Activate && s.grpc != nil:
+		s.conf.GRPC = conf.GRPC
+		s.stop("grpc", s.grpc.Shutdown)
+		s.grpc = nil
+	case s.grpc != nil && !sameSettings(conf.GRPC, s.conf.GRPC):
+		s.logger.Warn().Msg("Ignoring changes to grpc settings until the server is restarted")
+	}
+}
+
+// setReady reports to health checks whether the servers accept traffic.
+func (s *supervisor) setReady(ready bool) {
+	if s.http != nil {
+		s.http.SetReady(ready)
+	}
+	if s.grpc != nil {
+		s.grpc.SetReady(ready)
+	}
+}
+
+// shutdown gracefully shuts down the running servers.
+func (s *supervisor) shutdown(ctx context.Context) {
+	if s.native != nil {
+		s.native.Shutdown(ctx)
+	}
+	if s.http != nil {
+		s.http.Shutdown(ctx)
+	}
+	if s.ws != nil {
+		s.ws.Shutdown(ctx)
+	}
+	if s.grpc != nil {
+		s.grpc.Shutdown(ctx)
+	}
+}
+
+func (s *supervisor) startNative(exitOnError bool) {
+	conf := s.conf.Native
+	s.native = s.newNativeServer()
+	serve(getLocalAddr(conf.Port, conf.OnLocalhost), conf.TLS, conf.CertFile, conf.KeyFile,
+		s.native.ListenAndServe, s.native.ListenAndServeTLS, exitOnError)
+}
+
+func (s *supervisor) startHTTP(exitOnError bool) {
+	conf := s.conf.HTTP
+	s.http = httpsrv.NewServer(s.cache)
+	s.http.Logger = s.logger.With().Str("scope", "http").Logger()
+	s.http.APIKey = s.conf.APIKey
+	s.http.ConfirmPurge = s.conf.ConfirmPurge
+	if conf.NotFound != nil {
+		s.http.NotFoundOnMiss = *conf.NotFound
+	}
+	if conf.MaxRawBytes > 0 {
+		s.http.MaxRawBytes = conf.MaxRawBytes
+	}
+	if conf.GzipLevel != nil {
+		s.http.GzipLevel = *conf.GzipLevel
+	}
+	if conf.WebSocket {
+		// Native protocol is reachable through the WebSocket end-point even if
+		// the Native server is not active.
+		s.ws = s.newNativeServer()
+		s.http.EnableWebSocket(s.ws.ServeConn)
+	}
+	if conf.GRPCWeb {
+		// Requests are dispatched to the service directly, without the gRPC listener.
+		webServer := grpcsrv.NewServer(s.cache)
+		webServer.Logger = s.logger.With().Str("scope", "grpc-web").Logger()
+		webServer.APIKey = s.conf.APIKey
+		webServer.ConfirmPurge = s.conf.ConfirmPurge
+		s.http.EnableGRPCWeb(grpcsrv.ServiceName, webServer.WebHandler(conf.CORSOrigins...))
+	}
+	serve(getLocalAddr(conf.Port, conf.OnLocalhost), conf.TLS, conf.CertFile, conf.KeyFile,
+		s.http.ListenAndServe, s.http.ListenAndServeTLS, exitOnError)
+}
+
+func (s *supervisor) stopHTTP() {
+	s.http.SetReady(false)
+	s.stop("http", s.http.Shutdown)
+	s.http = nil
+	if s.ws != nil {
+		s.stop("native", s.ws.Shutdown)
+		s.ws = nil
+	}
+}
+
+func (s *supervisor) startGRPC(exitOnError bool) {
+	conf := s.conf.GRPC
+	s.grpc = grpcsrv.NewServer(s.cache)
+	s.grpc.Logger = s.logger.With().Str("scope", "grpc").Logger()
+	s.grpc.APIKey = s.conf.APIKey
+	s.grpc.ConfirmPurge = s.conf.ConfirmPurge
+	s.grpc.Reflection = conf.Reflection
+	serve(getLocalAddr(conf.Port, conf.OnLocalhost), conf.TLS, conf.CertFile, conf.KeyFile,
+		s.grpc.ListenAndServe, s.grpc.ListenAndServeTLS, exitOnError)
+}
+
+func (s *supervisor) newNativeServer() *nativesrv.Server {
+	srv := nativesrv.NewServer(s.cache)
+	srv.Logger = s.logger.With().Str("scope", "native").Logger()
+	srv.SetTraceFrames(s.conf.Verbosity == "trace")
+	srv.ConnLogSampling = s.conf.Native.ConnLogSampling
+	srv.APIKey = s.conf.APIKey
+	srv.ConfirmPurge = s.conf.ConfirmPurge
+	// The settings have been validated with the rest of the configuration.
+	srv.IdleTimeout, _ = time.ParseDuration(s.conf.Native.IdleTimeout)
+	srv.WriteTimeout, _ = time.ParseDuration(s.conf.Native.WriteTimeout)
+	srv.MaxConns = s.conf.Native.MaxConns
+	if s.conf.Native.ConnLimitPolicy == "wait" {
+		srv.ConnLimitPolicy = nativesrv.WaitOverLimit
+	}
+	s.applyMigration(srv)
+	return srv
+}
+
+// applyMigration starts or stops redirecting writes of srv according to the
+// migration setting.
+func (s *supervisor) applyMigration(srv *nativesrv.Server) {
+	m := s.conf.Native.Migration
+	if m == nil {
+		srv.StopMigration()
+		return
+	}
+	// The patterns have been validated with the rest of the configuration.
+	srv.Migrate(m.Addr, m.Patterns...)
+}
+
+func (s *supervisor) stop(name string, shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to gracefully stop " + name + " server")
+	}
+}
+
+// serve runs the listen function matching the TLS setting in the background. Servers
+// log their own errors, so a failure only terminates the process if exitOnError is set.
+func serve(addr string, tls bool, certFile, keyFile string,
+	listen func(string) error, listenTLS func(string, string, string) error, exitOnError bool) {
+	go func() {
+		var err error
+		if tls {
+			err = listenTLS(addr, certFile, keyFile)
+		} else {
+			err = listen(addr)
+		}
+		if err != nil && exitOnError {
+			os.Exit(1)
+		}
+	}()
+}
+
+// sameSettings reports whether two sections of the same server are equal apart
+// from Activate.
+func sameSettings(a, b any) bool {
+	return reflect.DeepEqual(withoutActivate(a), withoutActivate(b))
+}
+
+func withoutActivate(conf any) any {
+	switch c := conf.(type) {
+	case nativeConf:
+		c.Activate = false
+		return c
+	case grpcConf:
+		c.Activate = false
+		return c
+	case httpConf:
+		c.Activate = false
+		return c
+	}
+	return conf
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nmezhenskyi/rcs/internal/cache"
+	"github.com/rs/zerolog"
+)
+
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write configuration file: %v", err)
+	}
+}
+
+func newTestSupervisor(t *testing.T, path string) *supervisor {
+	t.Helper()
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to read configuration file: %v", err)
+	}
+	var buf bytes.Buffer
+	out := newSwitchWriter(&buf)
+	setVerbosity(out, conf.Verbosity)
+	t.Cleanup(func() { zerolog.SetGlobalLevel(zerolog.TraceLevel) })
+	return &supervisor{
+		configFile: path,
+		conf:       *conf,
+		cache:      cache.NewCacheMap(),
+		logger:     zerolog.New(out),
+		out:        out,
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rcs.json")
+	writeConfig(t, path, `{"verbosity": "prod"}`)
+	sup := newTestSupervisor(t, path)
+	if level := zerolog.GlobalLevel(); level != zerolog.InfoLevel {
+		t.Fatalf("Expected level %v, got %v instead", zerolog.InfoLevel, level)
+	}
+
+	reload, shutdown := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	done := make(chan struct{})
+	go func() {
+		sup.run(reload, shutdown)
+		close(done)
+	}()
+
+	writeConfig(t, path, `{"verbosity": "trace"}`)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to send SIGHUP: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for zerolog.GlobalLevel() != zerolog.TraceLevel && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if level := zerolog.GlobalLevel(); level != zerolog.TraceLevel {
+		t.Errorf("Expected level %v after reload, got %v instead", zerolog.TraceLevel, level)
+	}
+
+	shutdown <- syscall.SIGTERM
+	<-done
+}
+
+func TestReloadServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rcs.json")
+	writeConfig(t, path, `{"verbosity": "none"}`)
+	sup := newTestSupervisor(t, path)
+	sup.cache.Set("key", []byte("value"))
+
+	writeConfig(t, path, `{"verbosity": "none", "http": {"activate": true, "port": 6143, "onLocalhost": true}}`)
+	sup.reload()
+	if sup.http == nil {
+		t.Fatal("Expected reload to start the HTTP server")
+	}
+	var res *http.Response
+	var err error
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		res, err = http.Get("http://localhost:6143/GET/key")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to reach the HTTP server: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d, got %d instead", http.StatusOK, res.StatusCode)
+	}
+
+	// Port changes cannot be applied to a running server.
+	writeConfig(t, path, `{"verbosity": "none", "http": {"activate": true, "port": 6144, "onLocalhost": true}}`)
+	sup.reload()
+	if sup.conf.HTTP.Port != 6143 {
+		t.Errorf("Expected port change to be ignored, got port %d instead", sup.conf.HTTP.Port)
+	}
+
+	writeConfig(t, path, `{"verbosity": "none"}`)
+	sup.reload()
+	if sup.http != nil {
+		t.Fatal("Expected reload to stop the HTTP server")
+	}
+	if _, err := http.Get("http://localhost:6143/GET/key"); err == nil {
+		t.Error("Expected the HTTP server to stop listening")
+	}
+	if v, ok := sup.cache.Get("key"); !ok || string(v) != "value" {
+		t.Errorf("Expected the cache to survive reloads, got %q instead", v)
+	}
+}
+
+func TestReloadMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rcs.json")
+	writeConfig(t, path, `{"verbosity": "none", "native": {"activate": true, "port": 6145, "onLocalhost": true,
+		"migration": {"addr": "10.0.0.2:6121", "patterns": ["user:*"]}}}`)
+	sup := newTestSupervisor(t, path)
+	sup.start()
+	defer sup.shutdown(context.Background())
+
+	var conn net.Conn
+	var err error
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err = net.Dial("tcp", "localhost:6145")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to reach the native server: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	deleteUser := func() string {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("RCSP/1.1 DELETE\r\nKEY: user:1\r\n")); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		var resp strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			resp.WriteString(line)
+			if strings.HasPrefix(line, "KEY: ") {
+				return resp.String()
+			}
+		}
+	}
+
+	if resp := deleteUser(); !strings.Contains(resp, "MESSAGE: MOVED 10.0.0.2:6121") {
+		t.Errorf("Expected DELETE to be redirected, got %q instead", resp)
+	}
+
+	writeConfig(t, path, `{"verbosity": "none", "native": {"activate": true, "port": 6145, "onLocalhost": true}}`)
+	sup.reload()
+	if resp := deleteUser(); !strings.HasPrefix(resp, "RCSP/1.1 DELETE OK") {
+		t.Errorf("Expected DELETE to be served after the migration was stopped, got %q instead", resp)
+	}
+}
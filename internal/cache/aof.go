@@ -0,0 +1,273 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCorruptLog is returned by ReplayAppendLog if a record of the log cannot be parsed.
+const ErrCorruptLog = cacheError("append log is corrupted")
+
+// MutationLogger receives every write to a CacheMap in the order it is applied.
+// Methods are called with the write lock of the map held, so they must not block
+// for long or access the map.
+type MutationLogger interface {
+	// LogSet records that value was stored under key. expires is zero if the key
+	// never expires.
+	LogSet(key string, value []byte, expires time.Time)
+	// LogDelete records that key was removed, e.g. by Delete, cleanup or eviction.
+	LogDelete(key string)
+	// LogPurge records that all keys were removed.
+	LogPurge()
+}
+
+// AppendLog is a MutationLogger that appends every write to a file, so that the
+// state of a CacheMap can be restored with ReplayAppendLog after a restart. Records
+// are buffered and written to the file every flush interval and on Close, writes
+// made since the last flush are lost if the process crashes.
+//
+// The log is never compacted, so it grows with every write.
+type AppendLog struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	err  error // First write error, reported by Flush and Close.
+
+	onError func(error) // Called with the first write error, see SetErrorHandler.
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenAppendLog opens the log file at path for appending, creating it if needed.
+// A truncated last record, e.g. left by a crash in the middle of a write, is cut
+// off first, so that new records do not get appended to it. If flushInterval is
+// positive, buffered records are flushed in the background on that interval.
+func OpenAppendLog(path string, flushInterval time.Duration) (*AppendLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := truncateIncomplete(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	l := &AppendLog{
+		file: file,
+		w:    bufio.NewWriter(file),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if flushInterval > 0 {
+		go l.flushEvery(flushInterval)
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+// LogSet appends a record of the form "SET <key> <expires> <value>", where key
+// and value are base64-encoded and expires is in nanoseconds since the Unix epoch.
+func (l *AppendLog) LogSet(key string, value []byte, expires time.Time) {
+	var deadline int64
+	if !expires.IsZero() {
+		deadline = expires.UnixNano()
+	}
+	rec := "SET " + base64.StdEncoding.EncodeToString([]byte(key)) + " " +
+		strconv.FormatInt(deadline, 10) + " " + base64.StdEncoding.EncodeToString(value) + "\n"
+	l.write(rec)
+}
+
+// LogDelete appends a record of the form "DEL <key>".
+func (l *AppendLog) LogDelete(key string) {
+	l.write("DEL " + base64.StdEncoding.EncodeToString([]byte(key)) + "\n")
+}
+
+// LogPurge appends a "PURGE" record.
+func (l *AppendLog) LogPurge() {
+	l.write("PURGE\n")
+}
+
+// SetErrorHandler sets a function called with the first error writing to the
+// log. Records written after an error are dropped, so the log no longer reflects
+// the map. The function is called with the lock of the log held and must not call
+// its methods.
+func (l *AppendLog) SetErrorHandler(f func(error)) {
+	l.mu.Lock()
+	l.onError = f
+	l.mu.Unlock()
+}
+
+// Flush writes buffered records to the file and commits it to stable storage.
+func (l *AppendLog) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		l.fail(l.w.Flush())
+	}
+	if l.err == nil {
+		l.fail(l.file.Sync())
+	}
+	return l.err
+}
+
+// Close stops the background flushing, flushes buffered records and closes the file.
+func (l *AppendLog) Close() error {
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+	<-l.done
+	err := l.Flush()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (l *AppendLog) write(rec string) {
+	l.mu.Lock()
+	if l.err == nil {
+		_, err := l.w.WriteString(rec)
+		l.fail(err)
+	}
+	l.mu.Unlock()
+}
+
+// fail records err as the first write error and reports it to the error handler.
+// Must be called with l.mu held.
+func (l *AppendLog) fail(err error) {
+	if err == nil || l.err != nil {
+		return
+	}
+	l.err = err
+	if l.onError != nil {
+		l.onError(err)
+	}
+}
+
+// truncateIncomplete cuts the file off after its last newline, removing a record
+// whose write was interrupted.
+func truncateIncomplete(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := file.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == info.Size() {
+		return nil
+	}
+	return file.Truncate(end)
+}
+
+func (l *AppendLog) flushEvery(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Flush()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// ReplayAppendLog applies the records of the log file at path to cm in order.
+// A missing file is treated as an empty log, and a truncated last record, e.g.
+// left by a crash in the middle of a write, is ignored. Keys that have expired
+// since they were logged are not restored.
+//
+// It should be called before a MutationLogger is attached to cm, otherwise the
+// replayed writes are logged again.
+func ReplayAppendLog(path string, cm *CacheMap) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := cm.replay(bytes.TrimSuffix(line, []byte("\n"))); err != nil {
+			return err
+		}
+	}
+}
+
+// replay applies a single record of an append log.
+func (cm *CacheMap) replay(rec []byte) error {
+	fields := bytes.Split(rec, []byte(" "))
+	switch {
+	case len(fields) == 4 && string(fields[0]) == "SET":
+		key, err := base64.StdEncoding.DecodeString(string(fields[1]))
+		if err != nil {
+			return ErrCorruptLog
+		}
+		deadline, err := strconv.ParseInt(string(fields[2]), 10, 64)
+		if err != nil {
+			return ErrCorruptLog
+		}
+		value, err := base64.StdEncoding.DecodeString(string(fields[3]))
+		if err != nil {
+			return ErrCorruptLog
+		}
+		now := cm.now()
+		var expires int64
+		if deadline != 0 {
+			expires = int64(time.Unix(0, deadline).Sub(cm.epoch))
+		}
+		cm.mu.Lock()
+		if it := (item{data: value, expires: expires, created: now, modified: now}); !it.isExpired(now) {
+			cm.store(string(key), it)
+		} else {
+			cm.remove(string(key))
+		}
+		cm.mu.Unlock()
+	case len(fields) == 2 && string(fields[0]) == "DEL":
+		key, err := base64.StdEncoding.DecodeString(string(fields[1]))
+		if err != nil {
+			return ErrCorruptLog
+		}
+		cm.Delete(string(key))
+	case len(fields) == 1 && string(fields[0]) == "PURGE":
+		cm.Purge()
+	default:
+		return ErrCorruptLog
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAppendLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rcs.aof")
+	aof, err := OpenAppendLog(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open the log: %v", err)
+	}
+	cmap := NewCacheMap()
+	cmap.SetMutationLogger(aof)
+
+	cmap.Set("key1", []byte("value1"))
+	cmap.SetEx("key2", []byte("value2"), time.Hour)
+	cmap.Set("key3", []byte("a b\nc"))
+	cmap.Delete("key1")
+	cmap.Set("key4", []byte("old"))
+	cmap.Set("key4", []byte("new"))
+	cmap.ExpireMatching("key3", time.Hour)
+	if err := aof.Flush(); err != nil {
+		t.Fatalf("Failed to flush the log: %v", err)
+	}
+	// Writes after the last flush are lost in a crash.
+	cmap.Set("unflushed", []byte("value"))
+
+	restored := NewCacheMap()
+	if err := ReplayAppendLog(path, restored); err != nil {
+		t.Fatalf("Failed to replay the log: %v", err)
+	}
+	if restored.hasItem("key1") {
+		t.Error("Expected key1 to stay deleted, but it was restored")
+	}
+	if restored.hasItem("unflushed") {
+		t.Error("Expected unflushed key to be lost, but it was restored")
+	}
+	expected := map[string]string{"key2": "value2", "key3": "a b\nc", "key4": "new"}
+	if restored.Length() != len(expected) {
+		t.Errorf("Expected %d keys, got %d instead", len(expected), restored.Length())
+	}
+	for key, value := range expected {
+		if v, ok := restored.Get(key); !ok || !bytes.Equal(v, []byte(value)) {
+			t.Errorf("Expected %s to be %q, got %q instead", key, value, v)
+		}
+	}
+	for _, key := range []string{"key2", "key3"} {
+		if ttl, ok := restored.TTL(key); !ok || ttl <= 59*time.Minute || ttl > time.Hour {
+			t.Errorf("Expected %s to expire in about an hour, got %v instead", key, ttl)
+		}
+	}
+
+	if err := aof.Close(); err != nil {
+		t.Errorf("Failed to close the log: %v", err)
+	}
+	restored = NewCacheMap()
+	if err := ReplayAppendLog(path, restored); err != nil {
+		t.Fatalf("Failed to replay the log: %v", err)
+	}
+	if !restored.hasItem("unflushed") {
+		t.Error("Expected Close to flush the log, but the last key was not restored")
+	}
+}
+
+func TestAppendLogError(t *testing.T) {
+	aof, err := OpenAppendLog(filepath.Join(t.TempDir(), "rcs.aof"), 0)
+	if err != nil {
+		t.Fatalf("Failed to open the log: %v", err)
+	}
+	var reported []error
+	aof.SetErrorHandler(func(err error) { reported = append(reported, err) })
+	aof.file.Close() // Makes every later write to the file fail.
+
+	aof.LogSet("key1", []byte("value1"), time.Time{})
+	if err := aof.Flush(); err == nil {
+		t.Error("Expected Flush to fail on a closed file")
+	}
+	aof.LogDelete("key1")
+	aof.Flush()
+	if len(reported) != 1 {
+		t.Errorf("Expected the first error to be reported once, got %v instead", reported)
+	}
+}
+
+func TestReplayAppendLog(t *testing.T) {
+	dir := t.TempDir()
+	past := time.Now().Add(-time.Minute).UnixNano()
+	path := filepath.Join(dir, "rcs.aof")
+	log := "SET a2V5MQ== 0 dmFsdWUx\n" + // key1 = value1
+		"PURGE\n" +
+		"SET a2V5Mg== 0 dmFsdWUy\n" + // key2 = value2
+		"SET a2V5Mw== " + strconv.FormatInt(past, 10) + " dmFsdWUz\n" + // key3 has expired.
+		"SET a2V5NA== 0 dmFs" // Truncated by a crash.
+	if err := os.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatalf("Failed to write the log: %v", err)
+	}
+	cmap := NewCacheMap()
+	if err := ReplayAppendLog(path, cmap); err != nil {
+		t.Fatalf("Failed to replay the log: %v", err)
+	}
+	if keys := cmap.Keys(); len(keys) != 1 || keys[0] != "key2" {
+		t.Errorf("Expected only key2 to be restored, got %v instead", keys)
+	}
+
+	// Reopening the log cuts off the truncated record, so records written after
+	// the crash can be replayed as well.
+	aof, err := OpenAppendLog(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to open the log: %v", err)
+	}
+	aof.LogSet("key5", []byte("value5"), time.Time{})
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Failed to close the log: %v", err)
+	}
+	cmap = NewCacheMap()
+	if err := ReplayAppendLog(path, cmap); err != nil {
+		t.Fatalf("Failed to replay the log after a restart: %v", err)
+	}
+	if !cmap.hasItem("key2") || !cmap.hasItem("key5") || cmap.Length() != 2 {
+		t.Errorf("Expected key2 and key5 to be restored, got %v instead", cmap.Keys())
+	}
+
+	if err := ReplayAppendLog(filepath.Join(dir, "missing.aof"), NewCacheMap()); err != nil {
+		t.Errorf("Expected a missing log to be treated as empty, got %v instead", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.aof")
+	if err := os.WriteFile(corrupt, []byte("SET !!! 0 dmFsdWUx\n"), 0644); err != nil {
+		t.Fatalf("Failed to write the log: %v", err)
+	}
+	if err := ReplayAppendLog(corrupt, NewCacheMap()); err != ErrCorruptLog {
+		t.Errorf("Expected %v, got %v instead", ErrCorruptLog, err)
+	}
+}
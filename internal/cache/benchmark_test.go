@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+)
+
+// BenchmarkSetLoop and BenchmarkSetMany store the same batch of pairs while
+// other goroutines read from the map, showing the cost of taking the write
+// lock per pair compared to once per batch.
+
+func BenchmarkSetLoop(b *testing.B) {
+	cmap := NewCacheMap()
+	batch := benchmarkBatch(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%2 == 0 {
+				for key, value := range batch {
+					cmap.Set(key, value)
+				}
+			} else {
+				cmap.Get("key0")
+			}
+		}
+	})
+}
+
+func BenchmarkSetMany(b *testing.B) {
+	cmap := NewCacheMap()
+	batch := benchmarkBatch(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%2 == 0 {
+				cmap.SetMany(batch)
+			} else {
+				cmap.Get("key0")
+			}
+		}
+	})
+}
+
+func benchmarkBatch(size int) map[string][]byte {
+	batch := make(map[string][]byte, size)
+	for i := 0; i < size; i++ {
+		batch["key"+strconv.Itoa(i)] = []byte("value" + strconv.Itoa(i))
+	}
+	return batch
+}
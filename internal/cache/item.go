@@ -4,13 +4,31 @@ import "time"
 
 // item represents a value stored in cache, it may have an expiration date.
 type item struct {
-	data    []byte
-	expires int64 // if zero, item never expires.
+	data     []byte
+	expires  int64 // Deadline in nanoseconds since the epoch of the map, if zero, item never expires.
+	created  int64 // Time the value was stored in nanoseconds since the epoch of the map.
+	modified int64 // Time the value was last written, unlike created also updated by Increment and DecrAndReap.
 }
 
-func (i *item) isExpired() bool {
+// isExpired reports whether the item has expired at now, given
+// in nanoseconds since the epoch of the map.
+func (i *item) isExpired(now int64) bool {
 	if i.expires == 0 {
 		return false
 	}
-	return time.Now().UnixNano() > i.expires
+	return now > i.expires
+}
+
+// ttl returns the remaining time to live at now rounded up to whole milliseconds,
+// or zero if the item never expires. An expiring item always reports at least
+// one millisecond, so it cannot be mistaken for one that never expires.
+func (i *item) ttl(now int64) time.Duration {
+	if i.expires == 0 {
+		return 0
+	}
+	d := time.Duration(i.expires - now)
+	if d < time.Millisecond {
+		return time.Millisecond
+	}
+	return (d + time.Millisecond - 1).Truncate(time.Millisecond)
 }
@@ -6,6 +6,7 @@ import (
 )
 
 func TestItemIsExpired(t *testing.T) {
+	now := int64(time.Hour)
 	testCases := []struct {
 		name     string
 		i        item
@@ -13,30 +14,63 @@ func TestItemIsExpired(t *testing.T) {
 	}{
 		{
 			name:     "Zero expiration value",
-			i:        item{[]byte(""), 0},
+			i:        item{data: []byte(""), expires: 0},
 			expected: false,
 		},
 		{
 			name:     "Negative expiration value",
-			i:        item{[]byte(""), -100},
+			i:        item{data: []byte(""), expires: -100},
 			expected: true,
 		},
 		{
 			name:     "Expired",
-			i:        item{[]byte(""), time.Now().UnixNano() - 10000000},
+			i:        item{data: []byte(""), expires: int64(time.Hour) - 10000000},
 			expected: true,
 		},
 		{
 			name:     "Not expired",
-			i:        item{[]byte(""), time.Now().UnixNano() + 10000000},
+			i:        item{data: []byte(""), expires: int64(time.Hour) + 10000000},
 			expected: false,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			if tc.i.isExpired() != tc.expected {
-				t.Errorf("Expected %v, got %v instead", tc.expected, tc.i.isExpired())
+			if tc.i.isExpired(now) != tc.expected {
+				t.Errorf("Expected %v, got %v instead", tc.expected, tc.i.isExpired(now))
+			}
+		})
+	}
+}
+
+func TestItemTTL(t *testing.T) {
+	now := int64(time.Hour)
+	testCases := []struct {
+		name     string
+		i        item
+		expected time.Duration
+	}{
+		{
+			name:     "Never expires",
+			i:        item{data: []byte(""), expires: 0},
+			expected: 0,
+		},
+		{
+			name:     "Less than a millisecond left",
+			i:        item{data: []byte(""), expires: int64(time.Hour) + 100},
+			expected: time.Millisecond,
+		},
+		{
+			name:     "Already expired",
+			i:        item{data: []byte(""), expires: int64(time.Hour) - 100},
+			expected: time.Millisecond,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if ttl := tc.i.ttl(now); ttl != tc.expected {
+				t.Errorf("Expected %v, got %v instead", tc.expected, ttl)
 			}
 		})
 	}
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+)
+
+// EvictionPolicy determines which items are evicted when a write exceeds the byte
+// budget of a map, see NewCacheMapWithPolicy.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently written items, reads do not count as use.
+	// This is the default.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU evicts the least frequently read or written items, and among equally
+	// frequent ones the least recently used. Counts are halved from time to time,
+	// so keys that were popular once but are no longer used do not stay forever.
+	EvictLFU
+
+	// lfuDecayFactor sets how often access counts are halved: whenever the number of
+	// accesses since the last decay reaches lfuDecayFactor times the number of keys.
+	lfuDecayFactor = 10
+)
+
+// lfu tracks how often keys are used for EvictLFU. It has a lock of its own, so
+// that reads, which only hold the read lock of the map, can count accesses. When
+// both locks are held, the lock of the map is acquired first.
+type lfu struct {
+	mu         sync.Mutex
+	entries    map[string]*lfuEntry
+	heap       lfuHeap // Least frequently used entry first.
+	tick       uint64  // Incremented on every access, orders equally frequent entries.
+	sinceDecay int     // Accesses since the counts were last halved.
+}
+
+type lfuEntry struct {
+	key   string
+	count uint32
+	last  uint64 // Tick of the last access.
+	index int    // Position in the heap.
+}
+
+func newLFU() *lfu {
+	return &lfu{entries: make(map[string]*lfuEntry)}
+}
+
+// add counts a write of key, tracking it from now on if it is new.
+func (l *lfu) add(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		l.hit(e)
+		return
+	}
+	l.tick++
+	e := &lfuEntry{key: key, count: 1, last: l.tick}
+	heap.Push(&l.heap, e)
+	l.entries[key] = e
+	l.decay()
+}
+
+// access counts a read of key. Keys that are not tracked, e.g. because they have
+// been deleted since they were read, are ignored.
+func (l *lfu) access(key string) {
+	l.mu.Lock()
+	if e, ok := l.entries[key]; ok {
+		l.hit(e)
+	}
+	l.mu.Unlock()
+}
+
+// remove stops tracking key.
+func (l *lfu) remove(key string) {
+	l.mu.Lock()
+	if e, ok := l.entries[key]; ok {
+		heap.Remove(&l.heap, e.index)
+		delete(l.entries, key)
+	}
+	l.mu.Unlock()
+}
+
+// reset stops tracking all keys.
+func (l *lfu) reset() {
+	l.mu.Lock()
+	l.entries = make(map[string]*lfuEntry)
+	l.heap = nil
+	l.sinceDecay = 0
+	l.mu.Unlock()
+}
+
+// victim returns the least frequently used key other than except, which has
+// just been written and must not be evicted by its own write.
+func (l *lfu) victim(except string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.heap) == 0 {
+		return "", false
+	}
+	if l.heap[0].key != except {
+		return l.heap[0].key, true
+	}
+	// The next least frequently used entry is one of the children of the root.
+	switch {
+	case len(l.heap) > 2 && l.heap.Less(2, 1):
+		return l.heap[2].key, true
+	case len(l.heap) > 1:
+		return l.heap[1].key, true
+	}
+	return "", false
+}
+
+// hit counts an access of e. Must be called with l.mu held.
+func (l *lfu) hit(e *lfuEntry) {
+	if e.count < math.MaxUint32 {
+		e.count++
+	}
+	l.tick++
+	e.last = l.tick
+	heap.Fix(&l.heap, e.index)
+	l.decay()
+}
+
+// decay halves all counts once enough accesses have been counted since the last
+// time. Must be called with l.mu held.
+func (l *lfu) decay() {
+	l.sinceDecay++
+	if l.sinceDecay < lfuDecayFactor*len(l.entries) {
+		return
+	}
+	l.sinceDecay = 0
+	for _, e := range l.heap {
+		e.count /= 2
+	}
+	// Halving can make counts equal that were not, in which case the order is
+	// decided by recency instead, so the heap has to be rebuilt.
+	heap.Init(&l.heap)
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].last < h[j].last
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x any) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEvictLFU(t *testing.T) {
+	// Every item takes 36 bytes, so two of them fit into the budget.
+	cmap := NewCacheMapWithPolicy(100, EvictLFU)
+	large := bytes.Repeat([]byte("x"), 32)
+
+	cmap.Set("hot1", large)
+	cmap.Set("cold", large)
+	for i := 0; i < 5; i++ {
+		cmap.Get("hot1")
+	}
+	cmap.Get("cold")
+
+	// hot1 is the least recently written, but it is read more often than cold.
+	cmap.Set("new1", large)
+	if cmap.hasItem("cold") || !cmap.hasItem("hot1") || !cmap.hasItem("new1") {
+		t.Errorf("Expected only \"cold\" to be evicted, got keys %q instead", cmap.Keys())
+	}
+	if evictions := cmap.Stats().Evictions; evictions != 1 {
+		t.Errorf("Expected 1 eviction, got %d instead", evictions)
+	}
+	if size := cmap.SizeBytes(); size != 72 {
+		t.Errorf("Expected size of 72 bytes, got %d instead", size)
+	}
+
+	// Reads through GetMany count as well.
+	for i := 0; i < 10; i++ {
+		cmap.GetMany([]string{"new1"})
+	}
+	cmap.Set("new2", large)
+	if cmap.hasItem("hot1") || !cmap.hasItem("new1") || !cmap.hasItem("new2") {
+		t.Errorf("Expected only \"hot1\" to be evicted, got keys %q instead", cmap.Keys())
+	}
+}
+
+func TestEvictLFUTies(t *testing.T) {
+	cmap := NewCacheMapWithPolicy(100, EvictLFU)
+	large := bytes.Repeat([]byte("x"), 32)
+
+	cmap.Set("key1", large)
+	cmap.Set("key2", large)
+	cmap.Get("key1")
+	cmap.Get("key2")
+
+	// Both keys are used twice, so the least recently used one is evicted.
+	cmap.Set("key3", large)
+	if cmap.hasItem("key1") || !cmap.hasItem("key2") || !cmap.hasItem("key3") {
+		t.Errorf("Expected only \"key1\" to be evicted, got keys %q instead", cmap.Keys())
+	}
+
+	// A value larger than the budget is kept alone.
+	cmap.Set("huge", bytes.Repeat([]byte("x"), 200))
+	if keys := cmap.Keys(); len(keys) != 1 || keys[0] != "huge" {
+		t.Errorf("Expected only \"huge\" to be kept, got keys %q instead", keys)
+	}
+
+	cmap.Delete("huge")
+	cmap.Set("key4", large)
+	cmap.Purge()
+	if len(cmap.lfu.entries) != 0 || len(cmap.lfu.heap) != 0 {
+		t.Errorf("Expected no keys to be tracked after Delete and Purge, got %d instead", len(cmap.lfu.heap))
+	}
+}
+
+func TestEvictLFUDecay(t *testing.T) {
+	cmap := NewCacheMapWithPolicy(100, EvictLFU)
+	large := bytes.Repeat([]byte("x"), 32)
+
+	cmap.Set("old", large)
+	cmap.Set("recent", large)
+	for i := 0; i < 100; i++ {
+		cmap.Get("old")
+	}
+	for i := 0; i < 60; i++ {
+		cmap.Get("recent")
+	}
+
+	// Without decay old would have been used more often, but its count has been
+	// halved several times while only recent was read.
+	cmap.Set("new", large)
+	if cmap.hasItem("old") || !cmap.hasItem("recent") || !cmap.hasItem("new") {
+		t.Errorf("Expected only \"old\" to be evicted, got keys %q instead", cmap.Keys())
+	}
+}
@@ -2,83 +2,643 @@
 package cache
 
 import (
+	"bytes"
+	"container/heap"
+	"container/list"
+	"math"
+	"path"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ExpiryPolicy determines what happens to an expired item when it is accessed.
+type ExpiryPolicy int
+
+const (
+	// ExpiryPassive leaves expired items for the cleanup routine. This is the default.
+	ExpiryPassive ExpiryPolicy = iota
+	// ExpiryLazy deletes an expired item when it is accessed.
+	ExpiryLazy
+	// ExpiryAggressive deletes an expired item when it is accessed and also sweeps
+	// up to aggressiveSweepLimit other items, deleting those that have expired.
+	ExpiryAggressive
+
+	// aggressiveSweepLimit bounds the number of items checked per access by ExpiryAggressive.
+	aggressiveSweepLimit = 20
+)
+
+// DefaultMaxKeyBytes is the limit on the length of a key enforced by ValidateKey,
+// unless changed with SetMaxKeyBytes.
+const DefaultMaxKeyBytes = 512
+
+const (
+	ErrNotFound   = cacheError("key not found")
+	ErrNotInteger = cacheError("value is not an integer")
+	ErrOverflow   = cacheError("increment or decrement would overflow")
+	ErrEmptyKey   = cacheError("key is empty")
+	// ErrValueTooLarge is returned for a value larger than the limit set by SetMaxValueBytes.
+	ErrValueTooLarge = cacheError("value exceeds the maximum size")
+	// ErrKeyTooLong is returned for a key longer than the limit set by SetMaxKeyBytes.
+	ErrKeyTooLong = cacheError("key exceeds the maximum length")
+)
+
+// Clock provides the current time to CacheMap. It allows tests to control
+// expiration of keys without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
 // CacheMap represents in-memory key-value table safe for concurrent usage.
 // Uses strings as keys. Stores items with byte slices and expiration time.
+//
+// Expiration times are measured from the moment the map was created. With the
+// default clock they use the monotonic clock, so adjustments of the wall clock
+// (e.g. NTP corrections) neither prolong nor shorten TTLs. The monotonic clock may
+// stop while the machine is suspended, in which case TTLs are extended by the time
+// spent in suspension.
 type CacheMap struct {
 	cleanupInterval time.Duration
 	stop            chan struct{}
+	clock           Clock
+	epoch           time.Time    // Carries a monotonic clock reading with the default clock, see now.
+	maxAge          int64        // Age in nanoseconds after which the cleanup routine evicts items, if zero, disabled.
+	expiryPolicy    ExpiryPolicy // Applied by Get to expired items.
+	maxBytes        int64        // Budget for the total size of keys and values, if zero, unlimited.
+	maxValueBytes   atomic.Int64 // Limit on the size of a single value, if zero, unlimited.
+	maxKeyBytes     atomic.Int64 // Limit on the length of a key, if zero, unlimited.
+
+	mu        sync.RWMutex
+	items     map[string]item
+	sizeBytes int64                    // Total size of keys and values in items.
+	order     *list.List               // Keys from the least to the most recently written, only kept with maxBytes and EvictLRU.
+	elems     map[string]*list.Element // Elements of order by key.
+	lfu       *lfu                     // Access counts of the keys, kept instead of order with EvictLFU.
+	mutations MutationLogger           // Receives every write, if nil, writes are not logged.
+	watchers  watchers                 // Subscriptions notified of every write, see Subscribe.
+	scans     scans                    // Snapshots of the scans in progress, see Scan.
 
-	mu    sync.RWMutex
-	items map[string]item
+	// Counters reported by Stats, kept outside of mu so that reading them does not
+	// contend with the map.
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
 }
 
 // NewCacheMap returns pointer to initialized CacheMap without cleanup routine.
 func NewCacheMap() *CacheMap {
-	return &CacheMap{items: make(map[string]item)}
+	return NewCacheMapWithClock(realClock{}, 0)
 }
 
 // NewCacheMap returns pointer to initialized CacheMap with cleanup routine.
 func NewCacheMapWithCleanup(interval time.Duration) *CacheMap {
+	return NewCacheMapWithClock(realClock{}, interval)
+}
+
+// NewCacheMapWithMaxBytes returns pointer to initialized CacheMap without cleanup
+// routine that keeps the total size of keys and values within maxBytes. When a write
+// exceeds the budget, the least recently written items are evicted until it fits.
+// An item larger than the whole budget is kept alone.
+func NewCacheMapWithMaxBytes(maxBytes int64) *CacheMap {
+	return NewCacheMapWithPolicy(maxBytes, EvictLRU)
+}
+
+// NewCacheMapWithPolicy is like NewCacheMapWithMaxBytes, but policy decides which
+// items are evicted when a write exceeds the budget.
+func NewCacheMapWithPolicy(maxBytes int64, policy EvictionPolicy) *CacheMap {
+	c := NewCacheMap()
+	c.maxBytes = maxBytes
+	if policy == EvictLFU {
+		c.lfu = newLFU()
+	} else {
+		c.order = list.New()
+		c.elems = make(map[string]*list.Element)
+	}
+	return c
+}
+
+// NewCacheMapWithClock returns pointer to initialized CacheMap that tells time with
+// the given clock. If interval is positive, the cleanup routine is started as well.
+// The cleanup routine is driven by a real ticker, but decides what has expired
+// according to the clock.
+func NewCacheMapWithClock(clock Clock, interval time.Duration) *CacheMap {
 	c := &CacheMap{
 		cleanupInterval: interval,
+		clock:           clock,
+		epoch:           clock.Now(),
 		items:           make(map[string]item),
 	}
+	c.maxKeyBytes.Store(DefaultMaxKeyBytes)
 	if c.cleanupInterval > 0 {
+		c.stop = make(chan struct{})
 		go c.startCleanup()
 	}
 	return c
 }
 
 // Set sets given value for the given key, possibly overwriting it.
-func (cm *CacheMap) Set(key string, value []byte) {
+// If the value exceeds the limit set by SetMaxValueBytes, ErrValueTooLarge is
+// returned and nothing is stored.
+func (cm *CacheMap) Set(key string, value []byte) error {
+	if err := cm.CheckValueSize(value); err != nil {
+		return err
+	}
+	now := cm.now()
+	cm.mu.Lock()
+	cm.store(key, item{data: value, created: now, modified: now})
+	cm.mu.Unlock()
+	return nil
+}
+
+// SetMany sets all given key-value pairs like Set, taking the write lock once,
+// which avoids contending for it with readers on every pair. If any key is rejected
+// by ValidateKey, its error is returned and none of the pairs is stored, likewise
+// with ErrValueTooLarge if any value exceeds the limit set by SetMaxValueBytes.
+func (cm *CacheMap) SetMany(items map[string][]byte) error {
+	for key, value := range items {
+		if err := cm.ValidateKey(key); err != nil {
+			return err
+		}
+		if err := cm.CheckValueSize(value); err != nil {
+			return err
+		}
+	}
+	now := cm.now()
 	cm.mu.Lock()
-	cm.items[key] = item{data: value}
+	for key, value := range items {
+		cm.store(key, item{data: value, created: now, modified: now})
+	}
 	cm.mu.Unlock()
+	return nil
+}
+
+// SetReportExisting sets given value for the given key like Set, and reports
+// whether a live value has been replaced. Expired values count as missing.
+func (cm *CacheMap) SetReportExisting(key string, value []byte) bool {
+	return cm.SetExReportExisting(key, value, 0)
+}
+
+// SetExReportExisting sets given value for the given key and an expiration
+// time like SetEx, and reports whether a live value has been replaced.
+func (cm *CacheMap) SetExReportExisting(key string, value []byte, expires time.Duration) bool {
+	now := cm.now()
+	cm.mu.Lock()
+	prev, existed := cm.items[key]
+	cm.store(key, item{data: value, expires: deadline(now, expires), created: now, modified: now})
+	cm.mu.Unlock()
+	return existed && !prev.isExpired(now)
+}
+
+// SetKeepTTL sets given value for the given key while retaining the expiration
+// time of the live value it replaces, and reports whether such a value existed.
+// A missing or expired key is stored without expiration, like Set.
+func (cm *CacheMap) SetKeepTTL(key string, value []byte) bool {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	prev, ok := cm.items[key]
+	if !ok || prev.isExpired(now) {
+		cm.store(key, item{data: value, created: now, modified: now})
+		return false
+	}
+	cm.store(key, item{data: value, expires: prev.expires, created: now, modified: now})
+	return true
+}
+
+// SetNXEx sets given value for the given key with an expiration time only if the
+// key is missing or expired, and reports whether the value has been stored.
+// The check and the store are done atomically, which makes it suitable for
+// acquiring locks that are released automatically after expires.
+func (cm *CacheMap) SetNXEx(key string, value []byte, expires time.Duration) bool {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if prev, ok := cm.items[key]; ok && !prev.isExpired(now) {
+		return false
+	}
+	cm.store(key, item{data: value, expires: deadline(now, expires), created: now, modified: now})
+	return true
+}
+
+// SetXX sets given value for the given key only if the key exists and has not
+// expired, and reports whether the value has been stored. Like Set, the stored
+// value never expires.
+func (cm *CacheMap) SetXX(key string, value []byte) bool {
+	return cm.SetXXEx(key, value, 0)
+}
+
+// SetXXEx is like SetXX, but stores value with the given expiration time.
+func (cm *CacheMap) SetXXEx(key string, value []byte, expires time.Duration) bool {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if prev, ok := cm.items[key]; !ok || prev.isExpired(now) {
+		return false
+	}
+	cm.store(key, item{data: value, expires: deadline(now, expires), created: now, modified: now})
+	return true
 }
 
 // SetEx sets given value for the given key, and an expiration time.
-// Overwrites the previous value for the key.
-func (cm *CacheMap) SetEx(key string, value []byte, expires time.Duration) {
-	var expirationInNano int64
-	if expires > 0 {
-		expirationInNano = time.Now().Add(expires).UnixNano()
+// Overwrites the previous value for the key. Like Set, it returns
+// ErrValueTooLarge for a value over the limit.
+func (cm *CacheMap) SetEx(key string, value []byte, expires time.Duration) error {
+	if err := cm.CheckValueSize(value); err != nil {
+		return err
 	}
+	now := cm.now()
 	cm.mu.Lock()
-	cm.items[key] = item{data: value, expires: expirationInNano}
+	cm.store(key, item{data: value, expires: deadline(now, expires), created: now, modified: now})
 	cm.mu.Unlock()
+	return nil
 }
 
 // Get finds the value for given key. The second return value
 // is a bool that specifies whether the key is present.
 func (cm *CacheMap) Get(key string) ([]byte, bool) {
+	value, _, ok := cm.GetWithTTL(key)
+	return value, ok
+}
+
+// GetWithTTL is like Get, but also returns the remaining time to live of the key,
+// or 0 if it never expires. Both are read under the same lock, so the TTL is the
+// one of the returned value even if the key is written concurrently.
+func (cm *CacheMap) GetWithTTL(key string) ([]byte, time.Duration, bool) {
+	value, info, ok := cm.GetInfo(key)
+	return value, info.TTL, ok
+}
+
+// GetInfo is like GetWithTTL, but returns the size, remaining time to live and
+// time of the last write of the key together with its value.
+func (cm *CacheMap) GetInfo(key string) ([]byte, KeyInfo, bool) {
 	cm.mu.RLock()
 	value, ok := cm.items[key]
+	policy := cm.expiryPolicy
 	cm.mu.RUnlock()
-	if value.isExpired() {
+	now := cm.now()
+	if value.isExpired(now) {
+		cm.misses.Add(1)
+		cm.reclaimExpired(key, now, policy)
+		return nil, KeyInfo{}, false
+	}
+	if !ok {
+		cm.misses.Add(1)
+		return nil, KeyInfo{}, false
+	}
+	cm.hits.Add(1)
+	if cm.lfu != nil {
+		cm.lfu.access(key)
+	}
+	return value.data, cm.keyInfo(key, value, now), true
+}
+
+// GetMany returns the values of the given keys that are present and have not
+// expired. The read lock is acquired once for all keys.
+func (cm *CacheMap) GetMany(keys []string) map[string][]byte {
+	values := make(map[string][]byte, len(keys))
+	now := cm.now()
+	cm.mu.RLock()
+	for _, key := range keys {
+		if value, ok := cm.items[key]; ok && !value.isExpired(now) {
+			values[key] = value.data
+		}
+	}
+	cm.mu.RUnlock()
+	cm.hits.Add(uint64(len(values)))
+	cm.misses.Add(uint64(len(keys) - len(values)))
+	if cm.lfu != nil {
+		for key := range values {
+			cm.lfu.access(key)
+		}
+	}
+	return values
+}
+
+// Exists reports whether the key is present and has not expired,
+// without returning its value.
+func (cm *CacheMap) Exists(key string) bool {
+	cm.mu.RLock()
+	value, ok := cm.items[key]
+	cm.mu.RUnlock()
+	return ok && !value.isExpired(cm.now())
+}
+
+// TTL returns the remaining time to live of the key, rounded up to whole
+// milliseconds, or zero if the key never expires. The second return value is
+// false if the key is missing or has expired, consistent with Get.
+func (cm *CacheMap) TTL(key string) (time.Duration, bool) {
+	cm.mu.RLock()
+	value, ok := cm.items[key]
+	cm.mu.RUnlock()
+	now := cm.now()
+	if !ok || value.isExpired(now) {
+		return 0, false
+	}
+	return value.ttl(now), true
+}
+
+// Touch sets the expiration time of the key to the given duration from now without
+// rewriting its value. A non-positive expires makes the key never expire. Touch
+// returns false if the key is missing or has expired.
+func (cm *CacheMap) Touch(key string, expires time.Duration) bool {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	value, ok := cm.items[key]
+	if !ok || value.isExpired(now) {
+		return false
+	}
+	value.expires = deadline(now, expires)
+	cm.items[key] = value // The size is unchanged, so store is not needed.
+	if cm.mutations != nil {
+		cm.mutations.LogSet(key, value.data, cm.expiresAt(value))
+	}
+	cm.watchers.publish(Event{Type: EventSet, Key: key, Value: value.data})
+	return true
+}
+
+// Persist removes the expiration time of the key, so that it never expires. Persist
+// returns false if the key is missing or has expired. The key may still be evicted
+// because of its age or the byte budget.
+func (cm *CacheMap) Persist(key string) bool {
+	return cm.Touch(key, 0)
+}
+
+// GetSet stores value for the given key like Set and returns the value it replaced.
+// The second return value is false if the key was missing or had expired, the new
+// value is stored either way. The read and the store are done atomically, so every
+// replaced value is returned to exactly one caller.
+func (cm *CacheMap) GetSet(key string, value []byte) ([]byte, bool) {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	old, ok := cm.items[key]
+	cm.store(key, item{data: value, created: now, modified: now})
+	if !ok || old.isExpired(now) {
 		return nil, false
 	}
-	return value.data, ok
+	return old.data, true
+}
+
+// CompareAndSwap stores new for the given key only if the value currently stored
+// for it equals expected, and reports whether the value has been stored. An empty
+// expected matches only a missing or expired key, so it can be used to set a value
+// only if absent. Like Set, the stored value never expires.
+func (cm *CacheMap) CompareAndSwap(key string, expected, new []byte) bool {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	old, ok := cm.items[key]
+	if ok && old.isExpired(now) {
+		ok = false
+	}
+	if len(expected) == 0 {
+		if ok {
+			return false
+		}
+	} else if !ok || !bytes.Equal(old.data, expected) {
+		return false
+	}
+	cm.store(key, item{data: new, created: now, modified: now})
+	return true
+}
+
+// GetOrSet returns the value stored for the given key, or stores deflt for it
+// and returns deflt if the key is missing or expired. The second return value
+// is true if the existing value has been returned. The check and the store are
+// done atomically, so concurrent callers all observe the same value.
+func (cm *CacheMap) GetOrSet(key string, deflt []byte) ([]byte, bool) {
+	return cm.GetOrSetEx(key, deflt, 0)
+}
+
+// GetOrSetEx is like GetOrSet, but stores deflt with the given expiration time.
+// The expiration time of an existing value is left unchanged.
+func (cm *CacheMap) GetOrSetEx(key string, deflt []byte, expires time.Duration) ([]byte, bool) {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if value, ok := cm.items[key]; ok && !value.isExpired(now) {
+		return value.data, true
+	}
+	cm.store(key, item{data: deflt, expires: deadline(now, expires), created: now, modified: now})
+	return deflt, false
+}
+
+// DecrAndReap decrements the integer value stored at key by one and deletes
+// the key once the result drops to zero or below, which makes it suitable
+// for reference counting. Returns the new value and whether the key was deleted.
+// The expiration time of the key is preserved.
+//
+// A missing or expired key is reported as ErrNotFound rather than treated as zero,
+// a value that is not a base-10 integer results in ErrNotInteger, and decrementing
+// math.MinInt64 results in ErrOverflow. The value is left unchanged in both cases.
+func (cm *CacheMap) DecrAndReap(key string) (int64, bool, error) {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	value, ok := cm.items[key]
+	if !ok || value.isExpired(now) {
+		return 0, false, ErrNotFound
+	}
+	n, err := strconv.ParseInt(string(value.data), 10, 64)
+	if err != nil {
+		return 0, false, ErrNotInteger
+	}
+	if n == math.MinInt64 {
+		return 0, false, ErrOverflow
+	}
+	n--
+	if n <= 0 {
+		cm.remove(key)
+		return n, true, nil
+	}
+	value.data = strconv.AppendInt(nil, n, 10)
+	value.modified = now
+	cm.store(key, value)
+	return n, false, nil
+}
+
+// Increment adds delta to the integer value stored at key and returns the new value.
+// A missing or expired key is treated as zero and stored without expiration, while
+// the expiration time of an existing key is preserved.
+//
+// A value that is not a base-10 integer results in ErrNotInteger, and a result
+// that does not fit into int64 results in ErrOverflow. The value is left unchanged
+// in both cases.
+func (cm *CacheMap) Increment(key string, delta int64) (int64, error) {
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	value, ok := cm.items[key]
+	if !ok || value.isExpired(now) {
+		value = item{created: now, modified: now}
+	}
+	var n int64
+	if value.data != nil {
+		var err error
+		n, err = strconv.ParseInt(string(value.data), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	n += delta
+	value.data = strconv.AppendInt(nil, n, 10)
+	value.modified = now
+	cm.store(key, value)
+	return n, nil
+}
+
+// Decrement subtracts delta from the integer value stored at key and returns
+// the new value. See Increment.
+func (cm *CacheMap) Decrement(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrOverflow
+	}
+	return cm.Increment(key, -delta)
 }
 
 // Delete removes the key and associated value from the map.
 // If key is not present, Delete is a no-op.
 func (cm *CacheMap) Delete(key string) {
 	cm.mu.Lock()
-	delete(cm.items, key)
+	cm.remove(key)
 	cm.mu.Unlock()
 }
 
+// DeleteMany removes the given keys under a single write lock and returns how many
+// of them were present and had not expired. Missing keys are skipped.
+func (cm *CacheMap) DeleteMany(keys []string) int {
+	now := cm.now()
+	deleted := 0
+	cm.mu.Lock()
+	for _, key := range keys {
+		value, ok := cm.items[key]
+		if !ok {
+			continue
+		}
+		if value.isExpired(now) {
+			cm.expire(key)
+			continue
+		}
+		cm.remove(key)
+		deleted++
+	}
+	cm.mu.Unlock()
+	return deleted
+}
+
 // Purge removes all keys from the map making it empty.
 func (cm *CacheMap) Purge() {
 	cm.mu.Lock()
+	if cm.watchers.active() {
+		for k := range cm.items {
+			cm.watchers.publish(Event{Type: EventDelete, Key: k})
+		}
+	}
 	cm.items = make(map[string]item)
+	cm.sizeBytes = 0
+	if cm.order != nil {
+		cm.order.Init()
+		cm.elems = make(map[string]*list.Element)
+	}
+	if cm.lfu != nil {
+		cm.lfu.reset()
+	}
+	if cm.mutations != nil {
+		cm.mutations.LogPurge()
+	}
 	cm.mu.Unlock()
 }
 
+// Stats holds usage statistics of a CacheMap.
+type Stats struct {
+	Hits      uint64 // Number of keys read by Get, GetWithTTL and GetMany that were present.
+	Misses    uint64 // Number of keys read by Get, GetWithTTL and GetMany that were missing or expired.
+	Length    int    // Number of stored items, see Length.
+	Evictions uint64 // Number of live items removed to respect the byte budget or max age.
+}
+
+// Stats returns usage statistics of the map. Counters are read atomically one by
+// one, so they may be slightly out of sync with each other under concurrent use.
+func (cm *CacheMap) Stats() Stats {
+	return Stats{
+		Hits:      cm.hits.Load(),
+		Misses:    cm.misses.Load(),
+		Length:    cm.Length(),
+		Evictions: cm.evictions.Load(),
+	}
+}
+
+// Keys of the map returned by TTLHistogram that are not bucket bounds.
+const (
+	NoExpiryBucket time.Duration = 0             // Counts live keys that never expire.
+	OverflowBucket time.Duration = math.MaxInt64 // Counts live keys beyond the largest bound.
+)
+
+// DefaultTTLBuckets are the bucket bounds used when a front end does not specify any.
+var DefaultTTLBuckets = []time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+
+// TTLHistogram counts live keys by remaining time to live in a single locked pass.
+// Each key is counted under the smallest bound greater than or equal to its TTL,
+// under OverflowBucket if its TTL exceeds every bound, or under NoExpiryBucket if
+// it never expires. Non-positive bounds are ignored. Every bucket is present in
+// the result, even if empty.
+func (cm *CacheMap) TTLHistogram(buckets []time.Duration) map[time.Duration]int {
+	bounds := make([]time.Duration, 0, len(buckets))
+	for _, b := range buckets {
+		if b > 0 {
+			bounds = append(bounds, b)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	result := make(map[time.Duration]int, len(bounds)+2)
+	for _, b := range bounds {
+		result[b] = 0
+	}
+	result[NoExpiryBucket] = 0
+	result[OverflowBucket] = 0
+
+	now := cm.now()
+	cm.mu.RLock()
+	for _, v := range cm.items {
+		if v.isExpired(now) {
+			continue
+		}
+		if v.expires == 0 {
+			result[NoExpiryBucket]++
+			continue
+		}
+		ttl := v.ttl(now)
+		i := sort.Search(len(bounds), func(i int) bool { return bounds[i] >= ttl })
+		if i == len(bounds) {
+			result[OverflowBucket]++
+		} else {
+			result[bounds[i]]++
+		}
+	}
+	cm.mu.RUnlock()
+	return result
+}
+
+// SizeBytes returns the total size of keys and values stored in the map.
+// Expired items that have not been deleted yet are included.
+func (cm *CacheMap) SizeBytes() int64 {
+	cm.mu.RLock()
+	size := cm.sizeBytes
+	cm.mu.RUnlock()
+	return size
+}
+
 // Length returns number of items stored in the map.
 func (cm *CacheMap) Length() int {
 	cm.mu.RLock()
@@ -100,6 +660,161 @@ func (cm *CacheMap) Keys() []string {
 	return keys
 }
 
+// KeysMatching returns the live keys matching the pattern, in no particular order.
+// Patterns use the syntax of path.Match, e.g. "user:*" selects keys by prefix.
+// A malformed pattern matches nothing.
+func (cm *CacheMap) KeysMatching(pattern string) []string {
+	var keys []string
+	now := cm.now()
+	cm.mu.RLock()
+	for k, v := range cm.items {
+		if v.isExpired(now) {
+			continue
+		}
+		if ok, _ := path.Match(pattern, k); ok {
+			keys = append(keys, k)
+		}
+	}
+	cm.mu.RUnlock()
+	return keys
+}
+
+// KeyInfo describes a stored key and its value for capacity analysis.
+type KeyInfo struct {
+	Key      string
+	Size     int           // Size of the value in bytes.
+	TTL      time.Duration // Remaining time to live, zero if the key never expires.
+	Modified time.Time     // Time the value was last written, or restored from an append log.
+}
+
+// KeysInfo returns the keys in the map together with the size of their values
+// and remaining time to live. Expired keys are skipped. If limit is positive,
+// at most limit entries are returned, in no particular order.
+func (cm *CacheMap) KeysInfo(limit int) []KeyInfo {
+	cm.mu.RLock()
+	size := len(cm.items)
+	if limit > 0 && limit < size {
+		size = limit
+	}
+	infos := make([]KeyInfo, 0, size)
+	now := cm.now()
+	for k, v := range cm.items {
+		if len(infos) == size {
+			break
+		}
+		if v.isExpired(now) {
+			continue
+		}
+		infos = append(infos, cm.keyInfo(k, v, now))
+	}
+	cm.mu.RUnlock()
+	return infos
+}
+
+// KeyTTL describes a stored key and its remaining time to live.
+type KeyTTL struct {
+	Key string
+	TTL time.Duration
+}
+
+// ExpiringSoon returns up to n keys that will expire soonest, ordered by remaining
+// time to live. Keys that never expire are excluded. Only n entries are kept
+// in memory while scanning the map, so the whole key set is never sorted.
+func (cm *CacheMap) ExpiringSoon(n int) []KeyTTL {
+	if n <= 0 {
+		return []KeyTTL{}
+	}
+	now := cm.now()
+	cm.mu.RLock()
+	if n > len(cm.items) {
+		n = len(cm.items)
+	}
+	h := make(deadlineHeap, 0, n)
+	for k, v := range cm.items {
+		if v.expires == 0 || v.isExpired(now) {
+			continue
+		}
+		if len(h) < n {
+			heap.Push(&h, deadlineEntry{key: k, expires: v.expires})
+		} else if v.expires < h[0].expires {
+			h[0] = deadlineEntry{key: k, expires: v.expires}
+			heap.Fix(&h, 0)
+		}
+	}
+	cm.mu.RUnlock()
+
+	result := make([]KeyTTL, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		e := heap.Pop(&h).(deadlineEntry)
+		it := item{expires: e.expires}
+		result[i] = KeyTTL{Key: e.key, TTL: it.ttl(now)}
+	}
+	return result
+}
+
+// SetMaxAge makes the cleanup routine evict every item stored more than maxAge
+// ago, regardless of its expiration time. Overwriting a value restarts its age.
+// Items are evicted only by the cleanup routine, so they may outlive maxAge by up
+// to the cleanup interval. A zero maxAge disables eviction by age.
+func (cm *CacheMap) SetMaxAge(maxAge time.Duration) {
+	cm.mu.Lock()
+	cm.maxAge = int64(maxAge)
+	cm.mu.Unlock()
+}
+
+// SetMaxValueBytes limits the size of a single value to maxValueBytes. Set, SetEx
+// and SetMany reject larger values with ErrValueTooLarge, while the other writes
+// leave it to the caller to check values with CheckValueSize first. Values stored
+// before the limit was set are kept. A zero maxValueBytes removes the limit.
+func (cm *CacheMap) SetMaxValueBytes(maxValueBytes int64) {
+	cm.maxValueBytes.Store(maxValueBytes)
+}
+
+// CheckValueSize returns ErrValueTooLarge if value exceeds the limit set by
+// SetMaxValueBytes, and nil otherwise.
+func (cm *CacheMap) CheckValueSize(value []byte) error {
+	if limit := cm.maxValueBytes.Load(); limit > 0 && int64(len(value)) > limit {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// SetMaxKeyBytes limits the length of a key accepted by ValidateKey to maxKeyBytes,
+// which defaults to DefaultMaxKeyBytes. A zero maxKeyBytes removes the limit.
+func (cm *CacheMap) SetMaxKeyBytes(maxKeyBytes int64) {
+	cm.maxKeyBytes.Store(maxKeyBytes)
+}
+
+// ValidateKey returns ErrEmptyKey for an empty key and ErrKeyTooLong for a key
+// over the limit set by SetMaxKeyBytes. The servers validate keys with it before
+// reading or writing them, so that all of them accept the same keys.
+func (cm *CacheMap) ValidateKey(key string) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if limit := cm.maxKeyBytes.Load(); limit > 0 && int64(len(key)) > limit {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// SetMutationLogger attaches l to the map, so that it receives every following
+// write, including deletions by the cleanup routine and evictions. A nil l
+// detaches the current logger.
+func (cm *CacheMap) SetMutationLogger(l MutationLogger) {
+	cm.mu.Lock()
+	cm.mutations = l
+	cm.mu.Unlock()
+}
+
+// SetExpiryPolicy sets what Get does when it finds an expired item, see ExpiryPolicy.
+// Deployments without the cleanup routine can use it to reclaim memory.
+func (cm *CacheMap) SetExpiryPolicy(policy ExpiryPolicy) {
+	cm.mu.Lock()
+	cm.expiryPolicy = policy
+	cm.mu.Unlock()
+}
+
 // StopCleanup stops the cache's cleanup routine if it was active.
 // This is useful for tests and potentially for manually
 // controlling cleanup cycles.
@@ -110,8 +825,6 @@ func (cm *CacheMap) StopCleanup() {
 }
 
 func (cm *CacheMap) startCleanup() {
-	cm.stop = make(chan struct{})
-
 	ticker := time.NewTicker(cm.cleanupInterval)
 	for {
 		select {
@@ -126,11 +839,226 @@ func (cm *CacheMap) startCleanup() {
 }
 
 func (cm *CacheMap) deleteExpired() {
+	now := cm.now()
+	cm.mu.Lock()
+	for k, v := range cm.items {
+		if v.isExpired(now) {
+			cm.expire(k)
+		} else if cm.maxAge > 0 && now-v.created > cm.maxAge {
+			cm.expire(k)
+			cm.evictions.Add(1)
+		}
+	}
+	cm.mu.Unlock()
+}
+
+// DeleteExpiredMatching deletes expired keys matching the pattern and returns their
+// number. Patterns use the syntax of path.Match, a malformed pattern matches nothing.
+// Every key is still visited, but live keys and keys outside the pattern are left
+// alone, which keeps the write lock short when only one namespace needs cleanup.
+func (cm *CacheMap) DeleteExpiredMatching(pattern string) int {
+	now := cm.now()
+	deleted := 0
 	cm.mu.Lock()
 	for k, v := range cm.items {
-		if v.isExpired() {
-			delete(cm.items, k)
+		if !v.isExpired(now) && !(cm.maxAge > 0 && now-v.created > cm.maxAge) {
+			continue
+		}
+		if ok, _ := path.Match(pattern, k); ok {
+			cm.expire(k)
+			deleted++
+		}
+	}
+	cm.mu.Unlock()
+	return deleted
+}
+
+// ExpireMatching sets the expiration of all live keys matching the pattern to d
+// from now and returns their number. A non-positive d makes them never expire.
+// Patterns use the syntax of path.Match, a malformed pattern matches nothing.
+func (cm *CacheMap) ExpireMatching(pattern string, d time.Duration) int {
+	now := cm.now()
+	expires := deadline(now, d)
+	updated := 0
+	cm.mu.Lock()
+	for k, v := range cm.items {
+		if v.isExpired(now) {
+			continue
+		}
+		if ok, _ := path.Match(pattern, k); ok {
+			v.expires = expires
+			cm.items[k] = v // The size is unchanged, so store is not needed.
+			if cm.mutations != nil {
+				cm.mutations.LogSet(k, v.data, cm.expiresAt(v))
+			}
+			cm.watchers.publish(Event{Type: EventSet, Key: k, Value: v.data})
+			updated++
 		}
 	}
 	cm.mu.Unlock()
+	return updated
+}
+
+// reclaimExpired applies the expiry policy after the expired key has been accessed.
+func (cm *CacheMap) reclaimExpired(key string, now int64, policy ExpiryPolicy) {
+	if policy == ExpiryPassive {
+		return
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	// The key may have been set again since it was read.
+	if value, ok := cm.items[key]; ok && value.isExpired(now) {
+		cm.expire(key)
+	}
+	if policy != ExpiryAggressive {
+		return
+	}
+	checked := 0
+	for k, v := range cm.items {
+		if checked == aggressiveSweepLimit {
+			break
+		}
+		if v.isExpired(now) {
+			cm.expire(k)
+		}
+		checked++
+	}
+}
+
+// store puts the item under the key, keeping sizeBytes up to date and evicting
+// items according to the eviction policy if the map is over its byte budget.
+// Must be called with the write lock held.
+func (cm *CacheMap) store(key string, value item) {
+	if prev, ok := cm.items[key]; ok {
+		cm.sizeBytes -= itemSize(key, prev)
+	}
+	cm.items[key] = value
+	cm.sizeBytes += itemSize(key, value)
+	if cm.mutations != nil {
+		cm.mutations.LogSet(key, value.data, cm.expiresAt(value))
+	}
+	cm.watchers.publish(Event{Type: EventSet, Key: key, Value: value.data})
+	switch {
+	case cm.lfu != nil:
+		cm.lfu.add(key)
+	case cm.order != nil:
+		if elem, ok := cm.elems[key]; ok {
+			cm.order.MoveToBack(elem)
+		} else {
+			cm.elems[key] = cm.order.PushBack(key)
+		}
+	default:
+		return
+	}
+	for cm.sizeBytes > cm.maxBytes {
+		victim, ok := cm.victim(key)
+		if !ok {
+			break
+		}
+		cm.remove(victim)
+		cm.evictions.Add(1)
+	}
+}
+
+// remove deletes the key, keeping sizeBytes up to date.
+// Must be called with the write lock held.
+func (cm *CacheMap) remove(key string) {
+	cm.removeAs(key, EventDelete)
+}
+
+// expire is like remove, but reports the removal to subscribers as EventExpire.
+func (cm *CacheMap) expire(key string) {
+	cm.removeAs(key, EventExpire)
+}
+
+func (cm *CacheMap) removeAs(key string, event EventType) {
+	prev, ok := cm.items[key]
+	if !ok {
+		return
+	}
+	delete(cm.items, key)
+	cm.sizeBytes -= itemSize(key, prev)
+	if cm.mutations != nil {
+		cm.mutations.LogDelete(key)
+	}
+	cm.watchers.publish(Event{Type: event, Key: key})
+	if cm.order != nil {
+		cm.order.Remove(cm.elems[key])
+		delete(cm.elems, key)
+	}
+	if cm.lfu != nil {
+		cm.lfu.remove(key)
+	}
+}
+
+// victim returns the key to evict next according to the eviction policy, other
+// than except, which has just been written. Must be called with the write lock held.
+func (cm *CacheMap) victim(except string) (string, bool) {
+	if cm.lfu != nil {
+		return cm.lfu.victim(except)
+	}
+	front := cm.order.Front().Value.(string)
+	return front, front != except
+}
+
+// keyInfo describes the item stored under key at now.
+func (cm *CacheMap) keyInfo(key string, value item, now int64) KeyInfo {
+	return KeyInfo{
+		Key:      key,
+		Size:     len(value.data),
+		TTL:      value.ttl(now),
+		Modified: cm.epoch.Add(time.Duration(value.modified)).Round(0),
+	}
 }
+
+// expiresAt returns the wall clock time at which the item expires, or the zero
+// time if it never expires.
+func (cm *CacheMap) expiresAt(value item) time.Time {
+	if value.expires == 0 {
+		return time.Time{}
+	}
+	return cm.epoch.Add(time.Duration(value.expires)).Round(0)
+}
+
+func itemSize(key string, value item) int64 {
+	return int64(len(key) + len(value.data))
+}
+
+// now returns the time elapsed since the epoch of the map in nanoseconds.
+// If epoch carries a monotonic clock reading, so does the result.
+func (cm *CacheMap) now() int64 {
+	return int64(cm.clock.Now().Sub(cm.epoch))
+}
+
+// deadline returns the expiration time for an item stored at now that expires
+// after the given duration, or zero if it never expires.
+func deadline(now int64, expires time.Duration) int64 {
+	if expires <= 0 {
+		return 0
+	}
+	return now + int64(expires)
+}
+
+type deadlineEntry struct {
+	key     string
+	expires int64
+}
+
+// deadlineHeap is a max-heap of deadlines, so the latest one can be replaced
+// when a key expiring sooner is found.
+type deadlineHeap []deadlineEntry
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].expires > h[j].expires }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x any)        { *h = append(*h, x.(deadlineEntry)) }
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+type cacheError string
+
+func (err cacheError) Error() string { return string(err) }
@@ -2,8 +2,11 @@ package cache
 
 import (
 	"bytes"
-	"fmt"
+	"math"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -62,11 +65,126 @@ func TestSet(t *testing.T) {
 	}
 }
 
+func TestSetReportExisting(t *testing.T) {
+	cmap := NewCacheMap()
+
+	if existed := cmap.SetReportExisting("key1", []byte("value1")); existed {
+		t.Error("Expected new key to be reported as created")
+	}
+	if existed := cmap.SetReportExisting("key1", []byte("value2")); !existed {
+		t.Error("Expected overwritten key to be reported as existing")
+	}
+	if retrieved, _ := cmap.Get("key1"); !bytes.Equal(retrieved, []byte("value2")) {
+		t.Errorf("Expected value \"value2\", got \"%s\" instead", string(retrieved))
+	}
+
+	clock := newFakeClock()
+	cmap = NewCacheMapWithClock(clock, 0)
+	cmap.SetEx("key2", []byte("value1"), time.Millisecond)
+	clock.Advance(5 * time.Millisecond)
+	if existed := cmap.SetReportExisting("key2", []byte("value2")); existed {
+		t.Error("Expected expired key to be reported as created")
+	}
+}
+
+func TestSetNXEx(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+
+	const n = 50
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		acquired []int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if cmap.SetNXEx("lock", []byte(strconv.Itoa(i)), time.Minute) {
+				mu.Lock()
+				acquired = append(acquired, i)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(acquired) != 1 {
+		t.Fatalf("Expected exactly one acquirer to succeed, got %d instead", len(acquired))
+	}
+	if owner, _ := cmap.Get("lock"); string(owner) != strconv.Itoa(acquired[0]) {
+		t.Errorf("Expected lock to be owned by %d, got \"%s\" instead", acquired[0], owner)
+	}
+	if info := cmap.KeysInfo(0); len(info) != 1 || info[0].TTL != time.Minute {
+		t.Errorf("Expected lock to carry a TTL of 1m, got %v instead", info)
+	}
+
+	clock.Advance(time.Minute + time.Nanosecond)
+	if !cmap.SetNXEx("lock", []byte("next"), time.Minute) {
+		t.Error("Expected expired lock to be acquired again")
+	}
+}
+
+func TestSetKeepTTL(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+
+	cmap.SetEx("key1", []byte("value1"), time.Minute)
+	clock.Advance(10 * time.Second)
+	if !cmap.SetKeepTTL("key1", []byte("value2")) {
+		t.Error("Expected SetKeepTTL to report replaced value")
+	}
+	if info := cmap.KeysInfo(0); len(info) != 1 || info[0].TTL != 50*time.Second {
+		t.Errorf("Expected TTL of 50s to survive the overwrite, got %v instead", info)
+	}
+	if value, _ := cmap.Get("key1"); string(value) != "value2" {
+		t.Errorf("Expected value \"value2\", got \"%s\" instead", value)
+	}
+
+	cmap.Set("key1", []byte("value3"))
+	if info := cmap.KeysInfo(0); len(info) != 1 || info[0].TTL != 0 {
+		t.Errorf("Expected Set to clear the TTL, got %v instead", info)
+	}
+
+	if cmap.SetKeepTTL("key2", []byte("value1")) {
+		t.Error("Expected SetKeepTTL not to report a missing key as replaced")
+	}
+	if expiring := cmap.ExpiringSoon(10); len(expiring) != 0 {
+		t.Errorf("Expected missing key to be stored without TTL, got %v instead", expiring)
+	}
+}
+
+func TestSetXX(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+
+	if cmap.SetXX("key1", []byte("value1")) {
+		t.Error("Expected SetXX to refuse a missing key")
+	}
+	if cmap.hasItem("key1") {
+		t.Error("Expected missing key not to be created")
+	}
+
+	cmap.Set("key1", []byte("value1"))
+	if !cmap.SetXXEx("key1", []byte("value2"), time.Second) {
+		t.Error("Expected SetXXEx to update an existing key")
+	}
+	if value, _ := cmap.Get("key1"); string(value) != "value2" {
+		t.Errorf("Expected value \"value2\", got \"%s\" instead", value)
+	}
+
+	clock.Advance(time.Second + time.Nanosecond)
+	if cmap.SetXX("key1", []byte("value3")) {
+		t.Error("Expected SetXX to refuse an expired key")
+	}
+}
+
 func TestSetEx(t *testing.T) {
 	cmap := NewCacheMap()
 	key := "key1"
 	value := []byte("value1")
-	expectedExp := time.Now().Add(1000 * time.Millisecond).UnixNano()
+	expectedExp := cmap.now() + int64(1000*time.Millisecond)
 	cmap.SetEx(key, value, 1000*time.Millisecond)
 
 	retrieved, ok := cmap.items[key]
@@ -81,6 +199,31 @@ func TestSetEx(t *testing.T) {
 	}
 }
 
+func TestMonotonicExpiration(t *testing.T) {
+	if !strings.Contains(NewCacheMap().epoch.String(), "m=") {
+		t.Fatal("Expected epoch to carry a monotonic clock reading")
+	}
+
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.SetEx("key1", []byte("value1"), time.Minute)
+
+	// A wall clock stepped back by an hour must not resurrect or prolong the key,
+	// and one stepped forward must not expire it. Deadlines only depend on time
+	// elapsed since the epoch, which the fake clock advances steadily.
+	clock.Advance(30 * time.Second)
+	if _, ok := cmap.Get("key1"); !ok {
+		t.Error("Expected \"key1\" to be present after 30s, didn't find it instead")
+	}
+	if info := cmap.KeysInfo(0); len(info) != 1 || info[0].TTL != 30*time.Second {
+		t.Errorf("Expected TTL to be 30s, got %v instead", info)
+	}
+	clock.Advance(31 * time.Second)
+	if _, ok := cmap.Get("key1"); ok {
+		t.Error("Expected \"key1\" to be expired after 61s, found it instead")
+	}
+}
+
 func TestGet(t *testing.T) {
 	cmap := NewCacheMap()
 	key := "key1"
@@ -113,6 +256,379 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestGetWithTTL(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.SetEx("expiring", []byte("value1"), 10*time.Second)
+	cmap.Set("persistent", []byte("value2"))
+
+	clock.Advance(4 * time.Second)
+	value, ttl, ok := cmap.GetWithTTL("expiring")
+	if !ok || string(value) != "value1" || ttl != 6*time.Second {
+		t.Errorf("Expected value1 with 6s left, got %q, %v, %t instead", value, ttl, ok)
+	}
+	value, ttl, ok = cmap.GetWithTTL("persistent")
+	if !ok || string(value) != "value2" || ttl != 0 {
+		t.Errorf("Expected value2 with a TTL of 0, got %q, %v, %t instead", value, ttl, ok)
+	}
+	if _, _, ok := cmap.GetWithTTL("missing"); ok {
+		t.Error("Expected a missing key to report not-ok")
+	}
+
+	clock.Advance(7 * time.Second)
+	if value, ttl, ok := cmap.GetWithTTL("expiring"); ok || value != nil || ttl != 0 {
+		t.Errorf("Expected an expired key to report not-ok, got %q, %v, %t instead", value, ttl, ok)
+	}
+	if stats := cmap.Stats(); stats.Hits != 2 || stats.Misses != 2 {
+		t.Errorf("Expected 2 hits and 2 misses, got %d and %d instead", stats.Hits, stats.Misses)
+	}
+}
+
+func TestGetInfoModified(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	written := clock.Now()
+	cmap.SetEx("key1", []byte("1"), time.Minute)
+
+	clock.Advance(time.Second)
+	cmap.Get("key1")
+	cmap.Touch("key1", time.Hour)
+	_, info, ok := cmap.GetInfo("key1")
+	if !ok || !info.Modified.Equal(written) {
+		t.Errorf("Expected reads and TTL changes to keep the time of the last write %v, got %v instead", written, info.Modified)
+	}
+
+	clock.Advance(time.Second)
+	cmap.Set("key1", []byte("2"))
+	if _, info, _ := cmap.GetInfo("key1"); !info.Modified.Equal(clock.Now()) {
+		t.Errorf("Expected an overwrite to update the modified time to %v, got %v instead", clock.Now(), info.Modified)
+	}
+
+	clock.Advance(time.Second)
+	cmap.Increment("key1", 1)
+	if _, info, _ := cmap.GetInfo("key1"); !info.Modified.Equal(clock.Now()) {
+		t.Errorf("Expected Increment to update the modified time to %v, got %v instead", clock.Now(), info.Modified)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("key1", []byte("value1"))
+	cmap.SetEx("key2", []byte("value2"), time.Second)
+	cmap.SetEx("expired", []byte("value3"), time.Millisecond)
+	clock.Advance(time.Millisecond + time.Nanosecond)
+
+	values := cmap.GetMany([]string{"key1", "missing", "key2", "expired"})
+	if len(values) != 2 || string(values["key1"]) != "value1" || string(values["key2"]) != "value2" {
+		t.Errorf("Expected only \"key1\" and \"key2\", got %q instead", values)
+	}
+}
+
+func TestSetMany(t *testing.T) {
+	cmap := NewCacheMap()
+	cmap.Set("key1", []byte("old"))
+
+	err := cmap.SetMany(map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v instead", err)
+	}
+	values := cmap.GetMany([]string{"key1", "key2"})
+	if len(values) != 2 || string(values["key1"]) != "value1" || string(values["key2"]) != "value2" {
+		t.Errorf("Expected both pairs to be stored, got %q instead", values)
+	}
+
+	err = cmap.SetMany(map[string][]byte{"key3": []byte("value3"), "": []byte("value4")})
+	if err != ErrEmptyKey {
+		t.Errorf("Expected ErrEmptyKey, got %v instead", err)
+	}
+	if cmap.Length() != 2 {
+		t.Errorf("Expected no pairs of the rejected batch to be stored, got length %d instead", cmap.Length())
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("key1", []byte("value1"))
+	cmap.Set("key2", []byte("value2"))
+	cmap.Set("key3", []byte("value3"))
+	cmap.SetEx("expired", []byte("value4"), time.Millisecond)
+	clock.Advance(time.Millisecond + time.Nanosecond)
+
+	deleted := cmap.DeleteMany([]string{"key1", "missing", "key2", "expired", "key1"})
+	if deleted != 2 {
+		t.Errorf("Expected 2 deleted keys, got %d instead", deleted)
+	}
+	if cmap.Length() != 1 || !cmap.Exists("key3") {
+		t.Errorf("Expected only \"key3\" to remain, got length %d instead", cmap.Length())
+	}
+	if deleted := cmap.DeleteMany(nil); deleted != 0 {
+		t.Errorf("Expected 0 deleted keys, got %d instead", deleted)
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	cmap := NewCacheMap()
+	cmap.SetMaxValueBytes(4)
+
+	if err := cmap.Set("key1", []byte("1234")); err != nil {
+		t.Errorf("Expected a value at the limit to be stored, got %v instead", err)
+	}
+	if err := cmap.Set("key2", []byte("12345")); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v instead", err)
+	}
+	if err := cmap.SetEx("key3", []byte("12345"), time.Minute); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v instead", err)
+	}
+	if err := cmap.SetMany(map[string][]byte{"key4": []byte("1"), "key5": []byte("12345")}); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v instead", err)
+	}
+	if cmap.Length() != 1 {
+		t.Errorf("Expected only the value at the limit to be stored, got length %d instead", cmap.Length())
+	}
+
+	cmap.SetMaxValueBytes(0)
+	if err := cmap.Set("key2", []byte("12345")); err != nil {
+		t.Errorf("Expected a zero limit to be unlimited, got %v instead", err)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	cmap := NewCacheMap()
+	if err := cmap.ValidateKey(""); err != ErrEmptyKey {
+		t.Errorf("Expected ErrEmptyKey, got %v instead", err)
+	}
+	if err := cmap.ValidateKey(strings.Repeat("k", DefaultMaxKeyBytes)); err != nil {
+		t.Errorf("Expected a key at the default limit to be valid, got %v instead", err)
+	}
+	if err := cmap.ValidateKey(strings.Repeat("k", DefaultMaxKeyBytes+1)); err != ErrKeyTooLong {
+		t.Errorf("Expected ErrKeyTooLong, got %v instead", err)
+	}
+	if err := cmap.SetMany(map[string][]byte{strings.Repeat("k", DefaultMaxKeyBytes+1): []byte("value")}); err != ErrKeyTooLong {
+		t.Errorf("Expected SetMany to return ErrKeyTooLong, got %v instead", err)
+	}
+
+	cmap.SetMaxKeyBytes(0)
+	if err := cmap.ValidateKey(strings.Repeat("k", DefaultMaxKeyBytes+1)); err != nil {
+		t.Errorf("Expected a zero limit to be unlimited, got %v instead", err)
+	}
+}
+
+func TestDeleteExpiredMatching(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.SetEx("session:1", []byte("value1"), time.Millisecond)
+	cmap.SetEx("session:2", []byte("value2"), time.Millisecond)
+	cmap.SetEx("session:3", []byte("value3"), time.Minute)
+	cmap.SetEx("user:1", []byte("value4"), time.Millisecond)
+	cmap.Set("user:2", []byte("value5"))
+	clock.Advance(time.Millisecond + time.Nanosecond)
+
+	if deleted := cmap.DeleteExpiredMatching("session:*"); deleted != 2 {
+		t.Errorf("Expected 2 deleted keys, got %d instead", deleted)
+	}
+	for key, expected := range map[string]bool{
+		"session:1": false, "session:2": false, "session:3": true, "user:1": true, "user:2": true,
+	} {
+		if cmap.hasItem(key) != expected {
+			t.Errorf("Expected key %q to be present: %t", key, expected)
+		}
+	}
+
+	if deleted := cmap.DeleteExpiredMatching("[session"); deleted != 0 {
+		t.Errorf("Expected malformed pattern to delete nothing, got %d instead", deleted)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	cmap := NewCacheMapWithMaxBytes(100)
+	large := bytes.Repeat([]byte("x"), 36)
+
+	cmap.Set("key1", large)
+	cmap.SetEx("key2", large, time.Minute)
+	if size := cmap.SizeBytes(); size != 80 {
+		t.Errorf("Expected size of 80 bytes, got %d instead", size)
+	}
+
+	// Overwriting key1 makes key2 the oldest, so it is the one evicted.
+	cmap.Set("key1", []byte("small"))
+	if size := cmap.SizeBytes(); size != 49 {
+		t.Errorf("Expected size of 49 bytes after overwrite, got %d instead", size)
+	}
+	cmap.Set("key3", large)
+	cmap.Set("key4", large)
+	if cmap.hasItem("key2") || !cmap.hasItem("key1") || !cmap.hasItem("key3") || !cmap.hasItem("key4") {
+		t.Errorf("Expected only key2 to be evicted, got keys %q instead", cmap.Keys())
+	}
+	if size := cmap.SizeBytes(); size != 89 {
+		t.Errorf("Expected size of 89 bytes, got %d instead", size)
+	}
+
+	cmap.Delete("key3")
+	if size := cmap.SizeBytes(); size != 49 {
+		t.Errorf("Expected size of 49 bytes after delete, got %d instead", size)
+	}
+
+	cmap.Set("huge", bytes.Repeat([]byte("x"), 200))
+	if cmap.Length() != 1 || !cmap.hasItem("huge") {
+		t.Errorf("Expected an item over budget to be kept alone, got keys %q instead", cmap.Keys())
+	}
+
+	cmap.Purge()
+	if size := cmap.SizeBytes(); size != 0 {
+		t.Errorf("Expected size of 0 bytes after purge, got %d instead", size)
+	}
+	for i := 0; i < 10; i++ {
+		cmap.Set("key"+strconv.Itoa(i), large)
+		if size := cmap.SizeBytes(); size > 100 {
+			t.Fatalf("Expected size to stay within budget, got %d bytes instead", size)
+		}
+	}
+}
+
+func TestSizeBytesWithoutBudget(t *testing.T) {
+	cmap := NewCacheMap()
+	cmap.Set("key1", []byte("value1"))
+	cmap.Set("key1", []byte("value"))
+	if _, err := cmap.Increment("counter", 100); err != nil {
+		t.Fatalf("Expected no error, got %v instead", err)
+	}
+	if size := cmap.SizeBytes(); size != 9+10 {
+		t.Errorf("Expected size of 19 bytes, got %d instead", size)
+	}
+	cmap.Delete("counter")
+	cmap.Delete("missing")
+	if size := cmap.SizeBytes(); size != 9 {
+		t.Errorf("Expected size of 9 bytes, got %d instead", size)
+	}
+}
+
+func TestExpireMatching(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("tenant:5:a", []byte("value1"))
+	cmap.SetEx("tenant:5:b", []byte("value2"), time.Hour)
+	cmap.SetEx("tenant:5:expired", []byte("value3"), time.Millisecond)
+	cmap.Set("tenant:6:a", []byte("value4"))
+	clock.Advance(time.Millisecond + time.Nanosecond)
+
+	if updated := cmap.ExpireMatching("tenant:5:*", time.Minute); updated != 2 {
+		t.Errorf("Expected 2 updated keys, got %d instead", updated)
+	}
+	for _, key := range []string{"tenant:5:a", "tenant:5:b"} {
+		if ttl, ok := cmap.TTL(key); !ok || ttl != time.Minute {
+			t.Errorf("Expected TTL of %q to be 1m, got %v instead", key, ttl)
+		}
+	}
+	if ttl, ok := cmap.TTL("tenant:6:a"); !ok || ttl != 0 {
+		t.Errorf("Expected non-matching key to keep no TTL, got %v instead", ttl)
+	}
+	if _, ok := cmap.TTL("tenant:5:expired"); ok {
+		t.Error("Expected expired key to stay expired")
+	}
+
+	clock.Advance(time.Minute + time.Nanosecond)
+	if cmap.Exists("tenant:5:a") || cmap.Exists("tenant:5:b") || !cmap.Exists("tenant:6:a") {
+		t.Errorf("Expected only matching keys to expire, got keys %q instead", cmap.Keys())
+	}
+}
+
+func TestExists(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.SetEx("key1", []byte("value1"), time.Second)
+
+	if !cmap.Exists("key1") {
+		t.Error("Expected live key to exist")
+	}
+	if cmap.Exists("missing") {
+		t.Error("Expected missing key not to exist")
+	}
+	clock.Advance(time.Second + time.Nanosecond)
+	if cmap.Exists("key1") {
+		t.Error("Expected expired key not to exist")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("permanent", []byte("value1"))
+	cmap.SetEx("expiring", []byte("value2"), time.Second)
+
+	if ttl, ok := cmap.TTL("permanent"); !ok || ttl != 0 {
+		t.Errorf("Expected TTL 0 for a key without expiration, got %v, %t instead", ttl, ok)
+	}
+	clock.Advance(400 * time.Millisecond)
+	if ttl, ok := cmap.TTL("expiring"); !ok || ttl != 600*time.Millisecond {
+		t.Errorf("Expected TTL 600ms, got %v, %t instead", ttl, ok)
+	}
+	clock.Advance(600*time.Millisecond + time.Nanosecond)
+	if _, ok := cmap.TTL("expiring"); ok {
+		t.Error("Expected expired key to be reported as missing")
+	}
+	if _, ok := cmap.TTL("missing"); ok {
+		t.Error("Expected missing key to be reported as missing")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.SetEx("session", []byte("value1"), time.Second)
+	cmap.SetEx("expired", []byte("value2"), time.Millisecond)
+	clock.Advance(500 * time.Millisecond)
+
+	if !cmap.Touch("session", time.Minute) {
+		t.Error("Expected Touch of an existing key to succeed")
+	}
+	if ttl, ok := cmap.TTL("session"); !ok || ttl != time.Minute {
+		t.Errorf("Expected TTL 1m, got %v, %t instead", ttl, ok)
+	}
+	if value, ok := cmap.Get("session"); !ok || !bytes.Equal(value, []byte("value1")) {
+		t.Errorf("Expected value to be unchanged, got %q instead", value)
+	}
+	if cmap.Touch("expired", time.Minute) {
+		t.Error("Expected Touch of an expired key to fail")
+	}
+	if cmap.Touch("missing", time.Minute) {
+		t.Error("Expected Touch of a missing key to fail")
+	}
+	if !cmap.Touch("session", 0) {
+		t.Error("Expected Touch of an existing key to succeed")
+	}
+	if ttl, ok := cmap.TTL("session"); !ok || ttl != 0 {
+		t.Errorf("Expected the key to never expire, got TTL %v, %t instead", ttl, ok)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 1*time.Millisecond)
+	defer cmap.StopCleanup()
+	cmap.SetEx("key1", []byte("value1"), 25*time.Millisecond)
+	cmap.SetEx("key2", []byte("value2"), 25*time.Millisecond)
+
+	if !cmap.Persist("key1") {
+		t.Error("Expected Persist of an existing key to succeed")
+	}
+	if cmap.Persist("missing") {
+		t.Error("Expected Persist of a missing key to fail")
+	}
+	clock.Advance(30 * time.Millisecond)
+	waitForLength(cmap, 1, t)
+	if value, ok := cmap.Get("key1"); !ok || !bytes.Equal(value, []byte("value1")) {
+		t.Errorf("Expected persisted key to resolve to \"value1\", got %q, %t instead", value, ok)
+	}
+	if ttl, ok := cmap.TTL("key1"); !ok || ttl != 0 {
+		t.Errorf("Expected TTL 0 for a persisted key, got %v, %t instead", ttl, ok)
+	}
+	if cmap.Persist("key2") {
+		t.Error("Expected Persist of an expired key to fail")
+	}
+}
+
 func TestDelete(t *testing.T) {
 	cmap := NewCacheMap()
 	cmap.items = map[string]item{
@@ -190,57 +706,567 @@ func TestKeys(t *testing.T) {
 	}
 }
 
+func TestKeysMatching(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("user:1", []byte("v"))
+	cmap.Set("user:2", []byte("v"))
+	cmap.SetEx("user:3", []byte("v"), time.Second)
+	cmap.Set("session:1", []byte("v"))
+	cmap.Set("users", []byte("v"))
+	clock.Advance(2 * time.Second)
+
+	testCases := []struct {
+		pattern  string
+		expected []string
+	}{
+		{pattern: "user:*", expected: []string{"user:1", "user:2"}},
+		{pattern: "user?", expected: []string{"users"}},
+		{pattern: "*:1", expected: []string{"session:1", "user:1"}},
+		{pattern: "users", expected: []string{"users"}},
+		{pattern: "[", expected: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			keys := cmap.KeysMatching(tc.pattern)
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("Expected keys %v, got %v instead", tc.expected, keys)
+			}
+		})
+	}
+}
+
+func TestExpiringSoon(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("permanent", []byte("v"))
+	cmap.SetEx("key5", []byte("v"), 5*time.Second)
+	cmap.SetEx("key1", []byte("v"), 1*time.Second)
+	cmap.SetEx("key4", []byte("v"), 4*time.Second)
+	cmap.SetEx("key2", []byte("v"), 2*time.Second)
+	cmap.SetEx("key3", []byte("v"), 3*time.Second)
+	cmap.SetEx("expired", []byte("v"), time.Millisecond)
+	clock.Advance(500 * time.Millisecond)
+
+	expiring := cmap.ExpiringSoon(3)
+	expected := []KeyTTL{
+		{Key: "key1", TTL: 500 * time.Millisecond},
+		{Key: "key2", TTL: 1500 * time.Millisecond},
+		{Key: "key3", TTL: 2500 * time.Millisecond},
+	}
+	if len(expiring) != len(expected) {
+		t.Fatalf("Expected %d keys, got %d instead", len(expected), len(expiring))
+	}
+	for i := range expected {
+		if expiring[i] != expected[i] {
+			t.Errorf("Expected %v at position %d, got %v instead", expected[i], i, expiring[i])
+		}
+	}
+
+	if all := cmap.ExpiringSoon(math.MaxInt); len(all) != 5 {
+		t.Errorf("Expected 5 expiring keys, got %d instead", len(all))
+	}
+	if none := cmap.ExpiringSoon(0); len(none) != 0 {
+		t.Errorf("Expected no keys for n = 0, got %d instead", len(none))
+	}
+}
+
+func TestTTLHistogram(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("permanent1", []byte("v"))
+	cmap.Set("permanent2", []byte("v"))
+	cmap.SetEx("seconds1", []byte("v"), 10*time.Second)
+	cmap.SetEx("seconds2", []byte("v"), time.Minute)
+	cmap.SetEx("minutes", []byte("v"), 30*time.Minute)
+	cmap.SetEx("hours1", []byte("v"), 2*time.Hour)
+	cmap.SetEx("hours2", []byte("v"), 12*time.Hour)
+	cmap.SetEx("days", []byte("v"), 48*time.Hour)
+	cmap.SetEx("expired", []byte("v"), time.Millisecond)
+	clock.Advance(time.Second)
+
+	histogram := cmap.TTLHistogram([]time.Duration{24 * time.Hour, time.Minute, 0, time.Hour})
+	expected := map[time.Duration]int{
+		time.Minute:    2,
+		time.Hour:      1,
+		24 * time.Hour: 2,
+		OverflowBucket: 1,
+		NoExpiryBucket: 2,
+	}
+	if len(histogram) != len(expected) {
+		t.Fatalf("Expected %d buckets, got %v instead", len(expected), histogram)
+	}
+	for bucket, count := range expected {
+		if histogram[bucket] != count {
+			t.Errorf("Expected %d keys in bucket %v, got %d instead", count, bucket, histogram[bucket])
+		}
+	}
+
+	empty := NewCacheMap().TTLHistogram(DefaultTTLBuckets)
+	if len(empty) != len(DefaultTTLBuckets)+2 {
+		t.Errorf("Expected %d empty buckets, got %v instead", len(DefaultTTLBuckets)+2, empty)
+	}
+}
+
 func TestCleanup(t *testing.T) {
-	cmap := NewCacheMapWithCleanup(1 * time.Millisecond)
-	noExpiration := time.Duration(0)
-	shouldExpire := 25 * time.Millisecond
-	shouldNotExpire := 150 * time.Millisecond
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 1*time.Millisecond)
+	defer cmap.StopCleanup()
 
-	cmap.SetEx("key1", []byte("value1"), noExpiration)
-	cmap.SetEx("key2", []byte("value2"), shouldExpire)
-	cmap.SetEx("key3", []byte("value3"), shouldNotExpire)
+	cmap.SetEx("key1", []byte("value1"), 0)
+	cmap.SetEx("key2", []byte("value2"), 25*time.Millisecond)
+	cmap.SetEx("key3", []byte("value3"), 150*time.Millisecond)
 
-	<-time.After(30 * time.Millisecond)
-	_, ok := cmap.Get("key1")
-	if !ok {
+	clock.Advance(30 * time.Millisecond)
+	waitForLength(cmap, 2, t)
+	if !cmap.hasItem("key1") {
 		t.Errorf("Expected \"key1\" to be present, didn't find it instead")
 	}
-	_, ok = cmap.Get("key2")
-	if ok {
+	if cmap.hasItem("key2") {
 		t.Errorf("Expected \"key2\" to be deleted, found it instead")
 	}
-	_, ok = cmap.Get("key3")
-	if !ok {
+	if !cmap.hasItem("key3") {
 		t.Errorf("Expected \"key3\" to be present, didn't find it instead")
 	}
 }
 
+func TestStats(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("key1", []byte("value1"))
+	cmap.SetEx("expired", []byte("value2"), time.Millisecond)
+	clock.Advance(time.Millisecond + time.Nanosecond)
+
+	cmap.Get("key1")
+	cmap.Get("key1")
+	cmap.Get("missing")
+	cmap.Get("expired")
+	cmap.GetMany([]string{"key1", "missing"})
+
+	expected := Stats{Hits: 3, Misses: 3, Length: 2}
+	if stats := cmap.Stats(); stats != expected {
+		t.Errorf("Expected %+v, got %+v instead", expected, stats)
+	}
+
+	budgeted := NewCacheMapWithMaxBytes(10)
+	budgeted.Set("key1", []byte("val"))
+	budgeted.Set("key2", []byte("val"))
+	if evictions := budgeted.Stats().Evictions; evictions != 1 {
+		t.Errorf("Expected 1 eviction, got %d instead", evictions)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 1*time.Millisecond)
+	defer cmap.StopCleanup()
+	cmap.SetMaxAge(time.Minute)
+
+	cmap.Set("permanent", []byte("value1"))
+	cmap.SetEx("ttl", []byte("value2"), time.Hour)
+	clock.Advance(30 * time.Second)
+	cmap.Set("young", []byte("value3"))
+
+	clock.Advance(30*time.Second + time.Nanosecond)
+	waitForLength(cmap, 1, t)
+	if cmap.hasItem("permanent") {
+		t.Errorf("Expected \"permanent\" to be evicted, found it instead")
+	}
+	if cmap.hasItem("ttl") {
+		t.Errorf("Expected \"ttl\" to be evicted, found it instead")
+	}
+	if !cmap.hasItem("young") {
+		t.Errorf("Expected \"young\" to be present, didn't find it instead")
+	}
+}
+
+func TestExpiryPolicy(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         ExpiryPolicy
+		expectedLength int
+	}{
+		{name: "Passive", policy: ExpiryPassive, expectedLength: 3},
+		{name: "Lazy", policy: ExpiryLazy, expectedLength: 2},
+		{name: "Aggressive", policy: ExpiryAggressive, expectedLength: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			cmap := NewCacheMapWithClock(clock, 0)
+			cmap.SetExpiryPolicy(tc.policy)
+			cmap.SetEx("key1", []byte("value1"), time.Second)
+			cmap.SetEx("key2", []byte("value2"), time.Second)
+			cmap.SetEx("key3", []byte("value3"), time.Second)
+
+			clock.Advance(time.Second + time.Nanosecond)
+			if _, ok := cmap.Get("key1"); ok {
+				t.Errorf("Expected \"key1\" to be expired, got it instead")
+			}
+			if length := cmap.Length(); length != tc.expectedLength {
+				t.Errorf("Expected length %d, got %d instead", tc.expectedLength, length)
+			}
+			if tc.policy != ExpiryPassive && cmap.hasItem("key1") {
+				t.Errorf("Expected \"key1\" to be deleted, found it instead")
+			}
+		})
+	}
+}
+
 func TestStopCleanup(t *testing.T) {
-	cmap := NewCacheMapWithCleanup(10 * time.Millisecond)
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 1*time.Millisecond)
 
 	cmap.SetEx("key1", []byte("value1"), 25*time.Millisecond)
 	cmap.SetEx("key2", []byte("value2"), 25*time.Millisecond)
 	cmap.SetEx("key3", []byte("value3"), 50*time.Millisecond)
 
-	<-time.After(30 * time.Millisecond)
-	_, ok := cmap.Get("key1")
-	if ok {
-		t.Errorf("Expected \"key1\" to be deleted, found it instead")
-	}
-	_, ok = cmap.Get("key2")
-	if ok {
-		t.Errorf("Expected \"key2\" to be deleted, found it instead")
-	}
-	val, ok := cmap.Get("key3")
-	if !ok {
+	clock.Advance(30 * time.Millisecond)
+	waitForLength(cmap, 1, t)
+	if _, ok := cmap.Get("key3"); !ok {
 		t.Errorf("Expected \"key3\" to be present, didn't find it instead")
 	}
-	fmt.Printf("Key3: %s\n", string(val))
 
 	cmap.StopCleanup()
-	<-time.After(100 * time.Millisecond)
-	_, ok = cmap.items["key3"] // Check in the map directly because Get() will not return expired.
-	if !ok {
+	clock.Advance(time.Hour)
+	<-time.After(10 * time.Millisecond) // Several ticks of the stopped routine.
+	if !cmap.hasItem("key3") {          // Check in the map directly because Get() will not return expired.
 		t.Errorf("Expected \"key3\" to be present, didn't find it instead")
 	}
 }
+
+func TestFakeClockExpiration(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+
+	cmap.SetEx("key1", []byte("value1"), time.Hour)
+	clock.Advance(time.Hour)
+	if _, ok := cmap.Get("key1"); !ok {
+		t.Error("Expected \"key1\" to be present at its deadline, didn't find it instead")
+	}
+	clock.Advance(time.Nanosecond)
+	if _, ok := cmap.Get("key1"); ok {
+		t.Error("Expected \"key1\" to be expired right after its deadline, found it instead")
+	}
+}
+
+func TestDecrAndReap(t *testing.T) {
+	cmap := NewCacheMap()
+	cmap.items = map[string]item{
+		"counter":  {data: []byte("2")},
+		"text":     {data: []byte("abc")},
+		"expired":  {data: []byte("5"), expires: -100},
+		"negative": {data: []byte("-3")},
+		"min":      {data: []byte("-9223372036854775808")},
+	}
+
+	n, reaped, err := cmap.DecrAndReap("counter")
+	if err != nil || n != 1 || reaped {
+		t.Errorf("Expected (1, false, nil), got (%d, %v, %v) instead", n, reaped, err)
+	}
+	if !bytes.Equal(cmap.items["counter"].data, []byte("1")) {
+		t.Errorf("Expected stored value \"1\", got \"%s\" instead", cmap.items["counter"].data)
+	}
+	n, reaped, err = cmap.DecrAndReap("counter")
+	if err != nil || n != 0 || !reaped {
+		t.Errorf("Expected (0, true, nil), got (%d, %v, %v) instead", n, reaped, err)
+	}
+	if _, ok := cmap.items["counter"]; ok {
+		t.Error("Expected \"counter\" to be deleted, found it instead")
+	}
+
+	_, reaped, err = cmap.DecrAndReap("negative")
+	if err != nil || !reaped {
+		t.Errorf("Expected \"negative\" to be deleted, got (%v, %v) instead", reaped, err)
+	}
+	if _, _, err = cmap.DecrAndReap("counter"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing key, got %v instead", err)
+	}
+	if _, _, err = cmap.DecrAndReap("expired"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for an expired key, got %v instead", err)
+	}
+	if _, _, err = cmap.DecrAndReap("text"); err != ErrNotInteger {
+		t.Errorf("Expected ErrNotInteger, got %v instead", err)
+	}
+	if !bytes.Equal(cmap.items["text"].data, []byte("abc")) {
+		t.Error("Non-integer value has been modified")
+	}
+	if _, _, err = cmap.DecrAndReap("min"); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v instead", err)
+	}
+	if !bytes.Equal(cmap.items["min"].data, []byte("-9223372036854775808")) {
+		t.Errorf("Expected \"min\" to be unchanged, got \"%s\" instead", cmap.items["min"].data)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	cmap := NewCacheMap()
+
+	if n, err := cmap.Increment("counter", 5); err != nil || n != 5 {
+		t.Errorf("Expected missing key to be incremented to 5, got %d, %v instead", n, err)
+	}
+	if n, err := cmap.Decrement("counter", 7); err != nil || n != -2 {
+		t.Errorf("Expected counter to be decremented to -2, got %d, %v instead", n, err)
+	}
+	cmap.Set("text", []byte("abc"))
+	if _, err := cmap.Increment("text", 1); err != ErrNotInteger {
+		t.Errorf("Expected ErrNotInteger, got %v instead", err)
+	}
+	cmap.Set("max", []byte(strconv.FormatInt(math.MaxInt64, 10)))
+	if _, err := cmap.Increment("max", 1); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v instead", err)
+	}
+	if _, err := cmap.Decrement("counter", math.MinInt64); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v instead", err)
+	}
+}
+
+func TestIncrementConcurrent(t *testing.T) {
+	cmap := NewCacheMap()
+	const n = 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cmap.Increment("counter", 2); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := cmap.Get("counter"); string(value) != strconv.Itoa(2*n) {
+		t.Errorf("Expected counter to be %d, got \"%s\" instead", 2*n, value)
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	cmap := NewCacheMap()
+
+	value, existed := cmap.GetOrSet("key1", []byte("default"))
+	if existed || !bytes.Equal(value, []byte("default")) {
+		t.Errorf("Expected default to be stored, got \"%s\" (existed: %t) instead", value, existed)
+	}
+	value, existed = cmap.GetOrSet("key1", []byte("other"))
+	if !existed || !bytes.Equal(value, []byte("default")) {
+		t.Errorf("Expected existing value to be returned, got \"%s\" (existed: %t) instead", value, existed)
+	}
+
+	clock := newFakeClock()
+	cmap = NewCacheMapWithClock(clock, 0)
+	cmap.GetOrSetEx("key2", []byte("default"), time.Millisecond)
+	clock.Advance(5 * time.Millisecond)
+	if _, existed = cmap.GetOrSet("key2", []byte("fresh")); existed {
+		t.Error("Expected expired value to be replaced by the default")
+	}
+}
+
+func TestGetOrSetConcurrent(t *testing.T) {
+	cmap := NewCacheMap()
+	const n = 50
+
+	var wg sync.WaitGroup
+	results := make([][]byte, n)
+	created := make([]bool, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, existed := cmap.GetOrSet("key", []byte(strconv.Itoa(i)))
+			results[i] = value
+			created[i] = !existed
+		}(i)
+	}
+	wg.Wait()
+
+	stored, _ := cmap.Get("key")
+	creators := 0
+	for i := 0; i < n; i++ {
+		if !bytes.Equal(results[i], stored) {
+			t.Errorf("Goroutine %d observed \"%s\", expected \"%s\"", i, results[i], stored)
+		}
+		if created[i] {
+			creators++
+		}
+	}
+	if creators != 1 {
+		t.Errorf("Expected exactly one goroutine to store the default, got %d instead", creators)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+
+	if old, ok := cmap.GetSet("key1", []byte("value1")); ok || old != nil {
+		t.Errorf("Expected no previous value, got \"%s\" (ok: %t) instead", old, ok)
+	}
+	if old, ok := cmap.GetSet("key1", []byte("value2")); !ok || !bytes.Equal(old, []byte("value1")) {
+		t.Errorf("Expected \"value1\" to be returned, got \"%s\" (ok: %t) instead", old, ok)
+	}
+	if value, _ := cmap.Get("key1"); !bytes.Equal(value, []byte("value2")) {
+		t.Errorf("Expected \"value2\" to be stored, got \"%s\" instead", value)
+	}
+
+	cmap.SetEx("key2", []byte("expiring"), time.Millisecond)
+	clock.Advance(5 * time.Millisecond)
+	if old, ok := cmap.GetSet("key2", []byte("fresh")); ok {
+		t.Errorf("Expected expired value not to be returned, got \"%s\" instead", old)
+	}
+	if value, ok := cmap.Get("key2"); !ok || !bytes.Equal(value, []byte("fresh")) {
+		t.Errorf("Expected \"fresh\" to be stored without expiration, got \"%s\" (ok: %t) instead", value, ok)
+	}
+}
+
+func TestGetSetConcurrent(t *testing.T) {
+	cmap := NewCacheMap()
+	const n = 50
+
+	var wg sync.WaitGroup
+	olds := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if old, ok := cmap.GetSet("key", []byte(strconv.Itoa(i))); ok {
+				olds[i] = old
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every write is either replaced and returned exactly once, or is the final value.
+	seen := make(map[string]int, n)
+	for _, old := range olds {
+		if old != nil {
+			seen[string(old)]++
+		}
+	}
+	final, _ := cmap.Get("key")
+	seen[string(final)]++
+	for i := 0; i < n; i++ {
+		if count := seen[strconv.Itoa(i)]; count != 1 {
+			t.Errorf("Expected write %d to be accounted for once, got %d instead", i, count)
+		}
+	}
+	if len(seen) != n {
+		t.Errorf("Expected %d distinct values, got %d instead", n, len(seen))
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+
+	if cmap.CompareAndSwap("key1", []byte("value1"), []byte("value2")) {
+		t.Error("Expected swap of a missing key with non-empty expected value to fail")
+	}
+	if cmap.hasItem("key1") {
+		t.Error("Expected missing key to stay missing after a failed swap")
+	}
+	if !cmap.CompareAndSwap("key1", nil, []byte("value1")) {
+		t.Error("Expected empty expected value to set a missing key")
+	}
+	if cmap.CompareAndSwap("key1", nil, []byte("other")) {
+		t.Error("Expected empty expected value not to overwrite an existing key")
+	}
+	if cmap.CompareAndSwap("key1", []byte("wrong"), []byte("other")) {
+		t.Error("Expected swap with mismatched value to fail")
+	}
+	if value, _ := cmap.Get("key1"); !bytes.Equal(value, []byte("value1")) {
+		t.Errorf("Expected \"value1\" to be kept, got \"%s\" instead", value)
+	}
+	if !cmap.CompareAndSwap("key1", []byte("value1"), []byte("value2")) {
+		t.Error("Expected swap with matching value to succeed")
+	}
+	if value, _ := cmap.Get("key1"); !bytes.Equal(value, []byte("value2")) {
+		t.Errorf("Expected \"value2\" to be stored, got \"%s\" instead", value)
+	}
+
+	cmap.SetEx("key2", []byte("expiring"), time.Millisecond)
+	clock.Advance(5 * time.Millisecond)
+	if cmap.CompareAndSwap("key2", []byte("expiring"), []byte("fresh")) {
+		t.Error("Expected swap of an expired value to fail")
+	}
+	if !cmap.CompareAndSwap("key2", nil, []byte("fresh")) {
+		t.Error("Expected empty expected value to set an expired key")
+	}
+	if value, ok := cmap.Get("key2"); !ok || !bytes.Equal(value, []byte("fresh")) {
+		t.Errorf("Expected \"fresh\" to be stored, got \"%s\" (ok: %t) instead", value, ok)
+	}
+}
+
+func TestKeysInfo(t *testing.T) {
+	cmap := NewCacheMap()
+	cmap.Set("key1", []byte("v"))
+	cmap.Set("key2", []byte("value2"))
+	cmap.SetEx("key3", []byte("value_three"), time.Minute)
+	cmap.items["key4"] = item{data: []byte("expired"), expires: -100}
+
+	infos := cmap.KeysInfo(0)
+	if len(infos) != 3 {
+		t.Fatalf("Expected 3 entries, got %d instead", len(infos))
+	}
+	for _, info := range infos {
+		stored := cmap.items[info.Key]
+		if info.Size != len(stored.data) {
+			t.Errorf("Expected size of \"%s\" to be %d, got %d instead",
+				info.Key, len(stored.data), info.Size)
+		}
+		if info.Key == "key3" {
+			if info.TTL <= 0 || info.TTL > time.Minute {
+				t.Errorf("Expected TTL of \"key3\" to be within (0, 1m], got %s instead", info.TTL)
+			}
+		} else if info.TTL != 0 {
+			t.Errorf("Expected TTL of \"%s\" to be 0, got %s instead", info.Key, info.TTL)
+		}
+	}
+
+	if infos = cmap.KeysInfo(2); len(infos) != 2 {
+		t.Errorf("Expected 2 entries with limit, got %d instead", len(infos))
+	}
+}
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func (cm *CacheMap) hasItem(key string) bool {
+	cm.mu.RLock()
+	_, ok := cm.items[key]
+	cm.mu.RUnlock()
+	return ok
+}
+
+// waitForLength waits for the cleanup routine to bring the map down to length items.
+func waitForLength(cm *CacheMap, length int, t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for cm.Length() != length {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d items after cleanup, got %d instead", length, cm.Length())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrInvalidCursor is returned by Scan for a cursor it did not return or whose
+// snapshot has expired.
+const ErrInvalidCursor = cacheError("cursor is invalid or has expired")
+
+const (
+	// DefaultScanCount is the number of keys returned by Scan for a non-positive count.
+	DefaultScanCount = 10
+	// MaxScanCount is the largest number of keys returned by Scan, larger counts are capped.
+	MaxScanCount = 10000
+	// scanSnapshotTTL is how long a snapshot is kept after it was last used.
+	scanSnapshotTTL = time.Minute
+	// maxScanSnapshots bounds the number of scans in progress. Starting another one
+	// drops the snapshot of the least recently used scan.
+	maxScanSnapshots = 64
+)
+
+// scanSnapshot holds the keys iterated by a single scan.
+type scanSnapshot struct {
+	keys     []string
+	lastUsed int64
+}
+
+// scans holds the snapshots of the scans in progress, guarded by its own mutex so
+// that paging does not contend with the map.
+type scans struct {
+	mu        sync.Mutex
+	snapshots map[int]*scanSnapshot
+	lastID    int
+}
+
+// Scan iterates the keys of the map in pages of at most count keys. Iteration
+// starts with cursor 0 and continues with the returned next cursor until it is 0.
+//
+// The first call takes a snapshot of the live keys, sorted, so that every key
+// present at that moment is returned exactly once, regardless of writes made
+// during the iteration. Keys deleted since may still be returned, and keys added
+// since are not. A snapshot is kept for a minute after it was last used, after
+// which its cursors result in ErrInvalidCursor. At most 64 snapshots are kept, so
+// the cursors of the least recently used scan become invalid once that many other
+// scans have been started.
+func (cm *CacheMap) Scan(cursor int, count int) (keys []string, next int, err error) {
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+	if count > MaxScanCount {
+		count = MaxScanCount
+	}
+	now := cm.now()
+	cm.scans.mu.Lock()
+	defer cm.scans.mu.Unlock()
+	for id, snap := range cm.scans.snapshots {
+		if time.Duration(now-snap.lastUsed) > scanSnapshotTTL {
+			delete(cm.scans.snapshots, id)
+		}
+	}
+
+	id, offset := cursor>>32, cursor&(1<<32-1)
+	var snap *scanSnapshot
+	if cursor == 0 {
+		snap = &scanSnapshot{keys: cm.liveKeys(now)}
+		if cm.scans.snapshots == nil {
+			cm.scans.snapshots = make(map[int]*scanSnapshot)
+		}
+		if len(cm.scans.snapshots) >= maxScanSnapshots {
+			cm.scans.dropLeastRecentlyUsed()
+		}
+		cm.scans.lastID++
+		id = cm.scans.lastID
+		cm.scans.snapshots[id] = snap
+	} else if snap = cm.scans.snapshots[id]; snap == nil || offset > len(snap.keys) {
+		return nil, 0, ErrInvalidCursor
+	}
+	snap.lastUsed = now
+
+	if count >= len(snap.keys)-offset {
+		delete(cm.scans.snapshots, id)
+		return snap.keys[offset:], 0, nil
+	}
+	end := offset + count
+	return snap.keys[offset:end], id<<32 | end, nil
+}
+
+// dropLeastRecentlyUsed deletes the snapshot that was used the longest time ago.
+// Must be called with s.mu held.
+func (s *scans) dropLeastRecentlyUsed() {
+	oldest := -1
+	for id, snap := range s.snapshots {
+		if oldest < 0 || snap.lastUsed < s.snapshots[oldest].lastUsed {
+			oldest = id
+		}
+	}
+	delete(s.snapshots, oldest)
+}
+
+// liveKeys returns the sorted keys that have not expired.
+func (cm *CacheMap) liveKeys(now int64) []string {
+	cm.mu.RLock()
+	keys := make([]string, 0, len(cm.items))
+	for k, v := range cm.items {
+		if !v.isExpired(now) {
+			keys = append(keys, k)
+		}
+	}
+	cm.mu.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScan(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	for i := 0; i < 1000; i++ {
+		cmap.Set("key"+strconv.Itoa(i), []byte("value"))
+	}
+	cmap.SetEx("expired", []byte("value"), time.Second)
+	clock.Advance(2 * time.Second)
+
+	seen := make(map[string]bool)
+	cursor, pages := 0, 0
+	for {
+		keys, next, err := cmap.Scan(cursor, 100)
+		if err != nil {
+			t.Fatalf("Failed to scan page %d: %v", pages, err)
+		}
+		pages++
+		if len(keys) > 100 {
+			t.Errorf("Expected at most 100 keys per page, got %d instead", len(keys))
+		}
+		for _, k := range keys {
+			if seen[k] {
+				t.Errorf("Key %s returned more than once", k)
+			}
+			seen[k] = true
+		}
+		if pages == 1 {
+			// Writes during the iteration do not affect the snapshot.
+			cmap.Set("added", []byte("value"))
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if pages != 10 {
+		t.Errorf("Expected 10 pages, got %d instead", pages)
+	}
+	if len(seen) != 1000 {
+		t.Errorf("Expected 1000 keys, got %d instead", len(seen))
+	}
+	if seen["expired"] || seen["added"] {
+		t.Error("Expected only the live keys present at the start of the scan")
+	}
+
+	if _, _, err := cmap.Scan(cursor, 100); err != ErrInvalidCursor {
+		t.Errorf("Expected a finished scan to be invalid, got %v instead", err)
+	}
+	_, next, _ := cmap.Scan(0, 100)
+	clock.Advance(scanSnapshotTTL + time.Second)
+	if _, _, err := cmap.Scan(next, 100); err != ErrInvalidCursor {
+		t.Errorf("Expected an expired snapshot to be invalid, got %v instead", err)
+	}
+	if _, _, err := cmap.Scan(12345, 100); err != ErrInvalidCursor {
+		t.Errorf("Expected an unknown cursor to be invalid, got %v instead", err)
+	}
+	if keys, _, _ := cmap.Scan(0, 0); len(keys) != DefaultScanCount {
+		t.Errorf("Expected %d keys for a non-positive count, got %d instead", DefaultScanCount, len(keys))
+	}
+}
+
+func TestScanLimits(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	for i := 0; i < MaxScanCount+10; i++ {
+		cmap.Set("key"+strconv.Itoa(i), []byte("value"))
+	}
+
+	// Huge counts are capped instead of overflowing the end of the page.
+	keys, next, err := cmap.Scan(0, math.MaxInt)
+	if err != nil || len(keys) != MaxScanCount || next == 0 {
+		t.Fatalf("Expected a page of %d keys, got %d keys and error %v instead", MaxScanCount, len(keys), err)
+	}
+	if keys, next, err := cmap.Scan(next, math.MaxInt); err != nil || len(keys) != 10 || next != 0 {
+		t.Errorf("Expected the last 10 keys, got %d keys and error %v instead", len(keys), err)
+	}
+
+	_, first, _ := cmap.Scan(0, 1)
+	clock.Advance(time.Millisecond)
+	cursors := []int{}
+	for i := 0; i < maxScanSnapshots; i++ {
+		_, next, _ := cmap.Scan(0, 1)
+		cursors = append(cursors, next)
+	}
+	if n := len(cmap.scans.snapshots); n != maxScanSnapshots {
+		t.Errorf("Expected %d snapshots to be kept, got %d instead", maxScanSnapshots, n)
+	}
+	if _, _, err := cmap.Scan(first, 1); err != ErrInvalidCursor {
+		t.Errorf("Expected the least recently used scan to be dropped, got %v instead", err)
+	}
+	if _, _, err := cmap.Scan(cursors[0], 1); err != nil {
+		t.Errorf("Expected a recent scan to continue, got %v instead", err)
+	}
+}
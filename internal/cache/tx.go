@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"bytes"
+	"time"
+)
+
+const (
+	// ErrPreconditionFailed is returned by Transaction when the precondition of an
+	// OpSetNX or OpCAS does not hold.
+	ErrPreconditionFailed = cacheError("transaction precondition failed")
+	// ErrUnknownOp is returned by Transaction for an Op of an unknown type.
+	ErrUnknownOp = cacheError("unknown operation")
+)
+
+// OpType is the kind of write performed by an Op.
+type OpType int
+
+const (
+	// OpSet stores the value like SetEx.
+	OpSet OpType = iota
+	// OpDelete deletes the key like Delete. A missing key is not an error.
+	OpDelete
+	// OpSetNX stores the value only if the key is missing or expired, like SetNXEx.
+	OpSetNX
+	// OpCAS stores the value only if the current value equals Expected, like
+	// CompareAndSwap. An empty Expected requires the key to be missing or expired.
+	OpCAS
+)
+
+// Op is a single write applied by Transaction.
+type Op struct {
+	Type     OpType
+	Key      string
+	Value    []byte        // Stored by every type except OpDelete.
+	Expected []byte        // Compared by OpCAS.
+	TTL      time.Duration // Expiration of the stored value, if zero, it never expires.
+}
+
+// pendingValue is the value of a key as left by the ops of a transaction checked
+// so far.
+type pendingValue struct {
+	data    []byte
+	present bool
+}
+
+// Transaction applies all ops in order under a single write lock, so that no other
+// reader or writer observes a state in which only some of them are applied.
+//
+// The preconditions of OpSetNX and OpCAS are checked before anything is written,
+// each against the value left by the preceding ops, e.g. an OpSetNX following an
+// OpDelete of the same key succeeds. If any precondition fails, none of the ops is
+// applied and Transaction returns the index of the failing op together with
+// ErrPreconditionFailed. Ops rejected by ValidateKey or CheckValueSize, or of an
+// unknown type, are reported the same way with the corresponding error. Once all
+// ops have been applied, Transaction returns len(ops) and nil.
+//
+// The ops are applied one by one, so with a byte budget a value stored by an op
+// may be evicted by a later op of the same transaction.
+func (cm *CacheMap) Transaction(ops []Op) (int, error) {
+	for i, op := range ops {
+		if op.Type < OpSet || op.Type > OpCAS {
+			return i, ErrUnknownOp
+		}
+		if err := cm.ValidateKey(op.Key); err != nil {
+			return i, err
+		}
+		if op.Type != OpDelete {
+			if err := cm.CheckValueSize(op.Value); err != nil {
+				return i, err
+			}
+		}
+	}
+
+	now := cm.now()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	pending := make(map[string]pendingValue)
+	for i, op := range ops {
+		current, ok := pending[op.Key]
+		if !ok {
+			if value, found := cm.items[op.Key]; found && !value.isExpired(now) {
+				current = pendingValue{data: value.data, present: true}
+			}
+		}
+		switch op.Type {
+		case OpSetNX:
+			if current.present {
+				return i, ErrPreconditionFailed
+			}
+		case OpCAS:
+			if len(op.Expected) == 0 && current.present {
+				return i, ErrPreconditionFailed
+			}
+			if len(op.Expected) > 0 && (!current.present || !bytes.Equal(current.data, op.Expected)) {
+				return i, ErrPreconditionFailed
+			}
+		}
+		if op.Type == OpDelete {
+			pending[op.Key] = pendingValue{}
+		} else {
+			pending[op.Key] = pendingValue{data: op.Value, present: true}
+		}
+	}
+
+	for _, op := range ops {
+		if op.Type == OpDelete {
+			cm.remove(op.Key)
+			continue
+		}
+		cm.store(op.Key, item{data: op.Value, expires: deadline(now, op.TTL), created: now, modified: now})
+	}
+	return len(ops), nil
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransaction(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	cmap.Set("counter", []byte("1"))
+	cmap.Set("stale", []byte("x"))
+
+	applied, err := cmap.Transaction([]Op{
+		{Type: OpCAS, Key: "counter", Expected: []byte("1"), Value: []byte("2")},
+		{Type: OpSetNX, Key: "lock", Value: []byte("owner"), TTL: time.Second},
+		{Type: OpDelete, Key: "stale"},
+		// Checked against the state left by the preceding ops.
+		{Type: OpSetNX, Key: "stale", Value: []byte("y")},
+		{Type: OpCAS, Key: "counter", Expected: []byte("2"), Value: []byte("3")},
+		{Type: OpSet, Key: "plain", Value: []byte("z")},
+	})
+	if err != nil || applied != 6 {
+		t.Fatalf("Expected all 6 ops to be applied, got %d and error %v instead", applied, err)
+	}
+	expected := map[string]string{"counter": "3", "lock": "owner", "stale": "y", "plain": "z"}
+	for key, value := range expected {
+		if got, ok := cmap.Get(key); !ok || string(got) != value {
+			t.Errorf("Expected %s to be %q, got %q instead", key, value, got)
+		}
+	}
+	if ttl, _ := cmap.TTL("lock"); ttl != time.Second {
+		t.Errorf("Expected lock to expire in 1s, got %v instead", ttl)
+	}
+
+	// An expired key satisfies OpSetNX.
+	clock.Advance(2 * time.Second)
+	if _, err := cmap.Transaction([]Op{{Type: OpSetNX, Key: "lock", Value: []byte("other")}}); err != nil {
+		t.Errorf("Expected SETNX of an expired key to succeed, got error %v instead", err)
+	}
+}
+
+func TestTransactionAborted(t *testing.T) {
+	cmap := NewCacheMap()
+	cmap.Set("counter", []byte("1"))
+	cmap.Set("lock", []byte("owner"))
+
+	tests := []struct {
+		name   string
+		ops    []Op
+		failed int
+		err    error
+	}{
+		{
+			name: "SETNX of existing key",
+			ops: []Op{
+				{Type: OpSet, Key: "new", Value: []byte("a")},
+				{Type: OpDelete, Key: "counter"},
+				{Type: OpSetNX, Key: "lock", Value: []byte("b")},
+			},
+			failed: 2,
+			err:    ErrPreconditionFailed,
+		},
+		{
+			name: "CAS with wrong value",
+			ops: []Op{
+				{Type: OpSet, Key: "new", Value: []byte("a")},
+				{Type: OpCAS, Key: "counter", Expected: []byte("5"), Value: []byte("6")},
+			},
+			failed: 1,
+			err:    ErrPreconditionFailed,
+		},
+		{
+			name: "CAS of key written earlier",
+			ops: []Op{
+				{Type: OpSet, Key: "counter", Value: []byte("2")},
+				{Type: OpCAS, Key: "counter", Expected: []byte("1"), Value: []byte("3")},
+			},
+			failed: 1,
+			err:    ErrPreconditionFailed,
+		},
+		{
+			name: "CAS of key deleted earlier",
+			ops: []Op{
+				{Type: OpDelete, Key: "counter"},
+				{Type: OpCAS, Key: "counter", Expected: []byte("1"), Value: []byte("3")},
+			},
+			failed: 1,
+			err:    ErrPreconditionFailed,
+		},
+		{
+			name: "empty key",
+			ops: []Op{
+				{Type: OpDelete, Key: "lock"},
+				{Type: OpSet, Key: "", Value: []byte("a")},
+			},
+			failed: 1,
+			err:    ErrEmptyKey,
+		},
+		{
+			name:   "unknown type",
+			ops:    []Op{{Type: OpCAS + 1, Key: "lock"}},
+			failed: 0,
+			err:    ErrUnknownOp,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			failed, err := cmap.Transaction(tc.ops)
+			if failed != tc.failed || err != tc.err {
+				t.Errorf("Expected op %d to fail with %v, got %d and %v instead", tc.failed, tc.err, failed, err)
+			}
+			// None of the ops may have been applied.
+			if cmap.Exists("new") || cmap.Length() != 2 {
+				t.Errorf("Expected no op to be applied, got keys %q instead", cmap.Keys())
+			}
+			if value, _ := cmap.Get("counter"); string(value) != "1" {
+				t.Errorf("Expected counter to remain \"1\", got %q instead", value)
+			}
+		})
+	}
+}
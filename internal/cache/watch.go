@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// EventType is the kind of mutation reported by an Event.
+type EventType int
+
+const (
+	EventSet    EventType = iota + 1 // The key was written, including changes of its expiration.
+	EventDelete                      // The key was deleted, purged or evicted to respect the byte budget.
+	EventExpire                      // The key was removed after expiring or exceeding the max age.
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "SET"
+	case EventDelete:
+		return "DELETE"
+	case EventExpire:
+		return "EXPIRE"
+	}
+	return "UNKNOWN"
+}
+
+// Event describes a mutation of a single key.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value []byte // Stored value for EventSet, nil otherwise. Must not be modified.
+}
+
+// Subscription receives the events of a CacheMap matching its filter, see Subscribe.
+type Subscription struct {
+	ch      chan Event
+	match   func(key string) bool
+	w       *watchers
+	dropped atomic.Bool
+}
+
+// Events returns the channel that receives the events. It is closed by Close, or
+// once the subscriber falls behind, see Dropped.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped reports whether the subscription was closed because its buffer was full.
+func (s *Subscription) Dropped() bool {
+	return s.dropped.Load()
+}
+
+// Close stops the delivery of events and closes the channel returned by Events.
+// It is safe to call Close more than once.
+func (s *Subscription) Close() {
+	s.w.unsubscribe(s)
+}
+
+// watchers is the registry of subscriptions of a CacheMap. It is guarded by its
+// own mutex, so that subscribing does not contend with the map.
+type watchers struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	n    atomic.Int32 // Number of subscriptions, lets writers skip publish without locking.
+}
+
+// Subscribe registers a subscription to mutations of keys for which match returns
+// true, or of all keys if match is nil. Events are buffered up to buffer, and a
+// subscriber that falls further behind is dropped rather than stalling writers.
+//
+// Only removals of expired keys by the cleanup routine, the expiry policy or
+// DeleteExpiredMatching are reported as EventExpire, keys that expire without
+// being removed produce no event.
+func (cm *CacheMap) Subscribe(match func(key string) bool, buffer int) *Subscription {
+	sub := &Subscription{ch: make(chan Event, buffer), match: match, w: &cm.watchers}
+	cm.watchers.mu.Lock()
+	if cm.watchers.subs == nil {
+		cm.watchers.subs = make(map[*Subscription]struct{})
+	}
+	cm.watchers.subs[sub] = struct{}{}
+	cm.watchers.n.Add(1)
+	cm.watchers.mu.Unlock()
+	return sub
+}
+
+func (w *watchers) unsubscribe(sub *Subscription) {
+	w.mu.Lock()
+	if _, ok := w.subs[sub]; ok {
+		delete(w.subs, sub)
+		w.n.Add(-1)
+		close(sub.ch)
+	}
+	w.mu.Unlock()
+}
+
+// publish delivers ev to the matching subscriptions without blocking and drops
+// the ones whose buffer is full.
+func (w *watchers) publish(ev Event) {
+	if w.n.Load() == 0 {
+		return
+	}
+	var slow []*Subscription
+	w.mu.RLock()
+	for sub := range w.subs {
+		if sub.match != nil && !sub.match(ev.Key) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	w.mu.RUnlock()
+	for _, sub := range slow {
+		sub.dropped.Store(true)
+		w.unsubscribe(sub)
+	}
+}
+
+// active reports whether any subscription is registered.
+func (w *watchers) active() bool {
+	return w.n.Load() > 0
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	clock := newFakeClock()
+	cmap := NewCacheMapWithClock(clock, 0)
+	sub := cmap.Subscribe(func(key string) bool { return strings.HasPrefix(key, "user:") }, 16)
+	defer sub.Close()
+
+	cmap.Set("user:1", []byte("a"))
+	cmap.Set("other", []byte("b")) // Filtered out.
+	cmap.SetEx("user:2", []byte("c"), time.Second)
+	cmap.Delete("user:1")
+	clock.Advance(2 * time.Second)
+	cmap.deleteExpired()
+	cmap.Set("user:3", []byte("d"))
+	cmap.Purge()
+
+	expected := []Event{
+		{Type: EventSet, Key: "user:1", Value: []byte("a")},
+		{Type: EventSet, Key: "user:2", Value: []byte("c")},
+		{Type: EventDelete, Key: "user:1"},
+		{Type: EventExpire, Key: "user:2"},
+		{Type: EventSet, Key: "user:3", Value: []byte("d")},
+		{Type: EventDelete, Key: "user:3"},
+	}
+	for i, want := range expected {
+		select {
+		case got := <-sub.Events():
+			if got.Type != want.Type || got.Key != want.Key || string(got.Value) != string(want.Value) {
+				t.Errorf("Expected event %d to be %v %s %q, got %v %s %q instead",
+					i, want.Type, want.Key, want.Value, got.Type, got.Key, got.Value)
+			}
+		default:
+			t.Fatalf("Expected event %d to be %v %s, got none", i, want.Type, want.Key)
+		}
+	}
+	select {
+	case ev := <-sub.Events():
+		t.Errorf("Expected no more events, got %v %s instead", ev.Type, ev.Key)
+	default:
+	}
+
+	sub.Close()
+	sub.Close()
+	if _, ok := <-sub.Events(); ok {
+		t.Error("Expected Close to close the channel")
+	}
+	if sub.Dropped() {
+		t.Error("Expected a closed subscription not to be reported as dropped")
+	}
+	cmap.Set("user:4", []byte("e")) // Must not panic on the closed channel.
+}
+
+func TestSubscribeSlow(t *testing.T) {
+	cmap := NewCacheMap()
+	slow := cmap.Subscribe(nil, 2)
+	fast := cmap.Subscribe(nil, 8)
+	defer fast.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		cmap.Set(key, []byte("value"))
+	}
+	if !slow.Dropped() {
+		t.Fatal("Expected the slow subscription to be dropped")
+	}
+	n := 0
+	for range slow.Events() {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("Expected the buffered 2 events before the channel is closed, got %d instead", n)
+	}
+	if fast.Dropped() || len(fast.Events()) != 3 {
+		t.Errorf("Expected the fast subscription to receive 3 events, got %d instead", len(fast.Events()))
+	}
+}
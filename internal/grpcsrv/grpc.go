@@ -7,28 +7,70 @@ package grpcsrv
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nmezhenskyi/rcs/internal/cache"
 	pb "github.com/nmezhenskyi/rcs/internal/genproto"
+	"github.com/nmezhenskyi/rcs/internal/version"
 	"github.com/rs/zerolog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
 )
 
+// ErrNotStarted is returned by Shutdown if the server has not been started.
+var ErrNotStarted = errors.New("grpc server has not been started")
+
 // Server implements RCS gRPC service.
 type Server struct {
 	pb.UnimplementedCacheServiceServer // Embed for forward compatibility.
 
-	server *grpc.Server
-	cache  *cache.CacheMap
-	opts   []grpc.ServerOption
+	mu       sync.Mutex
+	server   *grpc.Server // Created by ListenAndServe and ListenAndServeTLS, guarded by mu.
+	cache    *cache.CacheMap
+	opts     []grpc.ServerOption
+	conns    connCounter
+	health   *health.Server // Serves grpc.health.v1.Health, reports NOT_SERVING once stopping.
+	done     chan struct{}  // Closed by Shutdown and Close to end Watch streams.
+	doneOnce sync.Once
 
 	Logger zerolog.Logger // By defaut Logger is disabled, but can be manually attached.
+
+	// APIKey, if set, must be sent by every call in the "authorization" metadata
+	// as "Bearer <key>". Empty by default, which disables authentication.
+	APIKey string
+
+	// ConfirmPurge, if set, makes Purge refuse to empty the cache unless the request
+	// sets confirm, so that a stray call cannot wipe it. Disabled by default for
+	// compatibility with existing clients.
+	ConfirmPurge bool
+
+	// Reflection registers the gRPC reflection service, so that tools like grpcurl
+	// can list and call methods without the proto files. Disabled by default to
+	// avoid exposing the schema. Calls to it require APIKey like any other.
+	Reflection bool
 }
 
 // NewServer initializes a new grpc Server instance ready to be used and returns a pointer to it.
@@ -40,24 +82,136 @@ func NewServer(c *cache.CacheMap, opts ...grpc.ServerOption) *Server {
 	srv := &Server{
 		server: nil, // Will be initialized in ListenAndServe / ListenAndServeTLS
 		cache:  c,
-		opts:   opts,
+		health: health.NewServer(),
+		done:   make(chan struct{}),
 		Logger: zerolog.New(os.Stderr).Level(zerolog.Disabled),
 	}
+	srv.opts = append([]grpc.ServerOption{
+		grpc.StatsHandler(&srv.conns),
+		grpc.ChainUnaryInterceptor(srv.logCall, srv.recoverCall, srv.authenticate),
+		grpc.ChainStreamInterceptor(srv.logStream, srv.recoverStream, srv.authenticateStream),
+	}, opts...)
 	return srv
 }
 
+// intercept applies the unary interceptors registered by NewServer in the same
+// order, for calls dispatched without the gRPC server, e.g. by WebHandler.
+func (s *Server) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return s.logCall(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.recoverCall(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return s.authenticate(ctx, req, info, handler)
+		})
+	})
+}
+
+// logCall is a unary interceptor that logs the method, peer, duration, and status
+// code of every call once it completes.
+func (s *Server) logCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	s.logDone(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+// logStream is the stream counterpart of logCall.
+func (s *Server) logStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	s.logDone(ss.Context(), info.FullMethod, start, err)
+	return err
+}
+
+func (s *Server) logDone(ctx context.Context, method string, start time.Time, err error) {
+	addr := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	s.Logger.Debug().
+		Str("method", method).
+		Str("peer", addr).
+		Dur("duration", time.Since(start)).
+		Str("code", status.Code(err).String()).
+		Msg("handled grpc request")
+}
+
+// recoverCall is a unary interceptor that turns a panic of the handler into a
+// codes.Internal error, so that a single call cannot crash the server.
+func (s *Server) recoverCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer s.recoverPanic(info.FullMethod, &err)
+	return handler(ctx, req)
+}
+
+// recoverStream is the stream counterpart of recoverCall.
+func (s *Server) recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer s.recoverPanic(info.FullMethod, &err)
+	return handler(srv, ss)
+}
+
+func (s *Server) recoverPanic(method string, err *error) {
+	if r := recover(); r != nil {
+		s.Logger.Error().
+			Str("method", method).
+			Str("panic", fmt.Sprint(r)).
+			Bytes("stack", debug.Stack()).
+			Msg("recovered from panic in grpc handler")
+		*err = status.Error(codes.Internal, "internal server error")
+	}
+}
+
+// authenticate is a unary interceptor that rejects calls without a valid API key
+// with codes.Unauthenticated. Health checks are always accepted.
+func (s *Server) authenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !s.authorized(ctx, info.FullMethod) {
+		return nil, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	return handler(ctx, req)
+}
+
+// authenticateStream is the stream counterpart of authenticate.
+func (s *Server) authenticateStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !s.authorized(ss.Context(), info.FullMethod) {
+		return status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	return handler(srv, ss)
+}
+
+func (s *Server) authorized(ctx context.Context, fullMethod string) bool {
+	if s.APIKey == "" || strings.HasPrefix(fullMethod, "/grpc.health.v1.Health/") {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(v), []byte("Bearer "+s.APIKey)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// register registers the services of the Server on s.server.
+func (s *Server) register() {
+	pb.RegisterCacheServiceServer(s.server, s)
+	healthpb.RegisterHealthServer(s.server, s.health)
+	if s.Reflection {
+		reflection.Register(s.server)
+	}
+}
+
 // ListenAndServe listens on the given TCP network address addr and
 // handles gRPC requests on incoming connections according to CacheService specification.
 func (s *Server) ListenAndServe(addr string) error {
 	s.Logger.Info().Msg("Starting grpc server on " + addr)
-	s.server = grpc.NewServer(s.opts...)
-	pb.RegisterCacheServiceServer(s.server, s)
+	server := s.start(s.opts...)
+	if server == nil {
+		s.Logger.Info().Msg("ListenAndServe aborted: Server is in shutdown mode")
+		return nil
+	}
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		s.Logger.Error().Err(err).Msg("failed to start listener")
 		return err
 	}
-	return s.server.Serve(lis)
+	return server.Serve(lis)
 }
 
 // ListenAndServeTLS listens on the given TCP network address addr and
@@ -71,139 +225,660 @@ func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
 		return err
 	}
 	creds := credentials.NewServerTLSFromCert(&cert)
-	s.opts = append(s.opts, grpc.Creds(creds))
-	s.server = grpc.NewServer(s.opts...)
-	pb.RegisterCacheServiceServer(s.server, s)
+	server := s.start(append(s.opts, grpc.Creds(creds))...)
+	if server == nil {
+		s.Logger.Info().Msg("ListenAndServeTLS aborted: Server is in shutdown mode")
+		return nil
+	}
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		s.Logger.Error().Err(err).Msg("failed to start tls listener")
 		return err
 	}
-	return s.server.Serve(lis)
+	return server.Serve(lis)
+}
+
+// start creates the gRPC server with the given options and registers the services
+// on it. It returns nil if Shutdown or Close has already been called.
+func (s *Server) start(opts ...grpc.ServerOption) *grpc.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	s.server = grpc.NewServer(opts...)
+	s.register()
+	return s.server
+}
+
+// stopping marks the server as shutting down and returns the gRPC server, which
+// is nil if the server has not been started.
+func (s *Server) stopping() *grpc.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health.Shutdown()
+	s.doneOnce.Do(func() { close(s.done) })
+	return s.server
 }
 
 // Shutdown gracefully shuts down the server without interrupting any
-// active connections. Accepts context with timeout that will forcefully close
-// the server if timeout runs out.
+// active connections. If ctx is done before the connections finish, they are
+// closed forcefully and the context's error is returned. If the server has not
+// been started, Shutdown returns ErrNotStarted and it will not start anymore.
 func (s *Server) Shutdown(ctx context.Context) error {
-	stopped := make(chan struct{}, 1)
+	server := s.stopping()
+	if server == nil {
+		return ErrNotStarted
+	}
+	stopped := make(chan struct{})
 	go func() {
-		s.server.GracefulStop()
+		server.GracefulStop()
 		close(stopped)
-		s.Logger.Info().Msg("grpc server has been shutdown")
 	}()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-stopped:
-			return nil
-		default:
-			time.Sleep(50 * time.Millisecond)
-			continue
-		}
+	select {
+	case <-stopped:
+		s.Logger.Info().Msg("grpc server has been shutdown")
+		return nil
+	case <-ctx.Done():
+		// Stop closes the remaining connections, which also ends GracefulStop.
+		server.Stop()
+		<-stopped
+		s.Logger.Info().Msg("grpc server has been stopped before its connections finished")
+		return ctx.Err()
 	}
 }
 
 // Close immediately closes all active connections and listeners.
-// For a graceful shutdown, use Shutdown.
+// For a graceful shutdown, use Shutdown. A server closed before it was started
+// will not start anymore.
 func (s *Server) Close() {
-	s.server.Stop()
+	if server := s.stopping(); server != nil {
+		server.Stop()
+	}
 	s.Logger.Info().Msg("grpc server has been closed")
 }
 
-func (s *Server) Set(ctx context.Context, in *pb.SetRequest) (*pb.SetReply, error) {
-	p, ok := peer.FromContext(ctx)
-	if ok {
-		s.Logger.Debug().Msg("received grpc SET request from " + p.Addr.String())
+// SetReady changes the status reported by the health service. A server is ready
+// once created, marking it as not ready reports NOT_SERVING, so that load balancers
+// stop routing to it before Shutdown starts draining connections.
+func (s *Server) SetReady(ready bool) {
+	if ready {
+		s.health.Resume()
 	} else {
-		s.Logger.Debug().Msg("received grpc SET request, peer information unavailable")
+		s.health.Shutdown()
 	}
+}
+
+// ActiveConns returns the number of open client connections.
+func (s *Server) ActiveConns() int {
+	return int(s.conns.n.Load())
+}
+
+func (s *Server) Set(ctx context.Context, in *pb.SetRequest) (*pb.SetReply, error) {
 	key := in.GetKey()
 	value := in.GetValue()
-	if len(key) == 0 {
-		return &pb.SetReply{Key: key, Ok: false, Message: "Key cannot be empty"}, nil
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.SetReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
 	}
 	if len(value) == 0 {
 		return &pb.SetReply{Key: key, Ok: false, Message: "Value cannot be empty"}, nil
 	}
-	s.cache.Set(key, value)
-	return &pb.SetReply{Key: key, Ok: true}, nil
+	if err := s.checkValueSize(value); err != nil {
+		return nil, err
+	}
+	if in.GetKeepTtl() && in.GetXx() {
+		return &pb.SetReply{Key: key, Ok: false, Message: "KeepTtl cannot be combined with Xx"}, nil
+	}
+	if in.GetTtlMs() < 0 {
+		return &pb.SetReply{Key: key, Ok: false, Message: "TTL cannot be negative"}, nil
+	}
+	if in.GetTtlMs() > maxTTLMillis {
+		return &pb.SetReply{Key: key, Ok: false, Message: "TTL is too large"}, nil
+	}
+	if in.GetKeepTtl() && in.GetTtlMs() > 0 {
+		return &pb.SetReply{Key: key, Ok: false, Message: "KeepTtl cannot be combined with TTL"}, nil
+	}
+	ttl := time.Duration(in.GetTtlMs()) * time.Millisecond
+	var existed bool
+	if in.GetXx() {
+		if !s.cache.SetXXEx(key, value, ttl) {
+			return &pb.SetReply{Key: key, Ok: false, Message: "Key does not exist"}, nil
+		}
+		existed = true
+	} else if in.GetKeepTtl() {
+		existed = s.cache.SetKeepTTL(key, value)
+	} else {
+		existed = s.cache.SetExReportExisting(key, value, ttl)
+	}
+	return &pb.SetReply{Key: key, Ok: true, Existed: existed}, nil
 }
 
-func (s *Server) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetReply, error) {
-	p, ok := peer.FromContext(ctx)
-	if ok {
-		s.Logger.Debug().Msg("received grpc GET request from " + p.Addr.String())
-	} else {
-		s.Logger.Debug().Msg("received grpc GET request, peer information unavailable")
+func (s *Server) SetNX(ctx context.Context, in *pb.SetNXRequest) (*pb.SetNXReply, error) {
+	key := in.GetKey()
+	value := in.GetValue()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.SetNXReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
 	}
+	if len(value) == 0 {
+		return &pb.SetNXReply{Key: key, Ok: false, Message: "Value cannot be empty"}, nil
+	}
+	if err := s.checkValueSize(value); err != nil {
+		return nil, err
+	}
+	if in.GetTtl() < 0 {
+		return &pb.SetNXReply{Key: key, Ok: false, Message: "TTL cannot be negative"}, nil
+	}
+	if in.GetTtl() > maxTTLMillis {
+		return &pb.SetNXReply{Key: key, Ok: false, Message: "TTL is too large"}, nil
+	}
+	stored := s.cache.SetNXEx(key, value, time.Duration(in.GetTtl())*time.Millisecond)
+	return &pb.SetNXReply{Key: key, Ok: true, Stored: stored}, nil
+}
+
+func (s *Server) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetReply, error) {
 	key := in.GetKey()
-	if len(key) == 0 {
-		return &pb.GetReply{Key: key, Ok: false, Message: "Key cannot be empty"}, nil
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.GetReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
 	}
-	value, ok := s.cache.Get(key)
+	value, info, ok := s.cache.GetInfo(key)
 	if !ok {
 		return &pb.GetReply{Key: key, Value: value, Ok: ok, Message: "Value not found"}, nil
 	}
-	return &pb.GetReply{Key: key, Value: value, Ok: ok}, nil
+	return &pb.GetReply{
+		Key:        key,
+		Value:      value,
+		TtlMs:      info.TTL.Milliseconds(),
+		ModifiedMs: info.Modified.UnixMilli(),
+		Ok:         ok,
+	}, nil
 }
 
-func (s *Server) Delete(ctx context.Context, in *pb.DeleteRequest) (*pb.DeleteReply, error) {
-	p, ok := peer.FromContext(ctx)
-	if ok {
-		s.Logger.Debug().Msg("received grpc DELETE request from " + p.Addr.String())
-	} else {
-		s.Logger.Debug().Msg("received grpc DELETE request, peer information unavailable")
+func (s *Server) GetMany(ctx context.Context, in *pb.GetManyRequest) (*pb.GetManyReply, error) {
+	keys := in.GetKeys()
+	if len(keys) > maxBatchKeys {
+		return &pb.GetManyReply{Ok: false, Message: "Too many keys"}, nil
+	}
+	for _, key := range keys {
+		if err := s.cache.ValidateKey(key); err != nil {
+			return &pb.GetManyReply{Ok: false, Message: keyMessage(err)}, nil
+		}
+	}
+	values := s.cache.GetMany(keys)
+	entries := make([]*pb.Entry, 0, len(values))
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			entries = append(entries, &pb.Entry{Key: key, Value: value})
+		}
+	}
+	return &pb.GetManyReply{Entries: entries, Ok: true}, nil
+}
+
+func (s *Server) SetMany(ctx context.Context, in *pb.SetManyRequest) (*pb.SetManyReply, error) {
+	if len(in.GetEntries()) > maxBatchKeys {
+		return &pb.SetManyReply{Ok: false, Message: "Too many keys"}, nil
+	}
+	items := make(map[string][]byte, len(in.GetEntries()))
+	for _, entry := range in.GetEntries() {
+		if len(entry.GetValue()) == 0 {
+			return &pb.SetManyReply{Ok: false, Message: "Value cannot be empty"}, nil
+		}
+		if err := s.checkValueSize(entry.GetValue()); err != nil {
+			return nil, err
+		}
+		items[entry.GetKey()] = entry.GetValue()
+	}
+	if err := s.cache.SetMany(items); err != nil {
+		return &pb.SetManyReply{Ok: false, Message: keyMessage(err)}, nil
+	}
+	return &pb.SetManyReply{Ok: true}, nil
+}
+
+func (s *Server) DeleteMany(ctx context.Context, in *pb.DeleteManyRequest) (*pb.DeleteManyReply, error) {
+	keys := in.GetKeys()
+	if len(keys) > maxBatchKeys {
+		return &pb.DeleteManyReply{Ok: false, Message: "Too many keys"}, nil
 	}
+	for _, key := range keys {
+		if err := s.cache.ValidateKey(key); err != nil {
+			return &pb.DeleteManyReply{Ok: false, Message: keyMessage(err)}, nil
+		}
+	}
+	deleted := s.cache.DeleteMany(keys)
+	return &pb.DeleteManyReply{Ok: true, Count: int64(deleted)}, nil
+}
+
+func (s *Server) Exec(ctx context.Context, in *pb.ExecRequest) (*pb.ExecReply, error) {
+	if len(in.GetOps()) > maxBatchKeys {
+		return &pb.ExecReply{Ok: false, Message: "Too many ops"}, nil
+	}
+	ops := make([]cache.Op, 0, len(in.GetOps()))
+	for _, op := range in.GetOps() {
+		opType, ok := execOpTypes[op.GetType()]
+		if !ok {
+			return &pb.ExecReply{Ok: false, Message: "Unknown op type"}, nil
+		}
+		if err := s.cache.ValidateKey(op.GetKey()); err != nil {
+			return &pb.ExecReply{Ok: false, Message: keyMessage(err)}, nil
+		}
+		if op.GetType() != pb.Op_DELETE {
+			if len(op.GetValue()) == 0 {
+				return &pb.ExecReply{Ok: false, Message: "Value cannot be empty"}, nil
+			}
+			if err := s.checkValueSize(op.GetValue()); err != nil {
+				return nil, err
+			}
+		}
+		if op.GetTtlMs() < 0 {
+			return &pb.ExecReply{Ok: false, Message: "Ttl cannot be negative"}, nil
+		}
+		if op.GetTtlMs() > maxTTLMillis {
+			return &pb.ExecReply{Ok: false, Message: "Ttl is too large"}, nil
+		}
+		ops = append(ops, cache.Op{
+			Type:     opType,
+			Key:      op.GetKey(),
+			Value:    op.GetValue(),
+			Expected: op.GetExpected(),
+			TTL:      time.Duration(op.GetTtlMs()) * time.Millisecond,
+		})
+	}
+	failed, err := s.cache.Transaction(ops)
+	if err != nil {
+		return &pb.ExecReply{Ok: true, Applied: false, Failed: int64(failed)}, nil
+	}
+	return &pb.ExecReply{Ok: true, Applied: true}, nil
+}
+
+func (s *Server) Exists(ctx context.Context, in *pb.ExistsRequest) (*pb.ExistsReply, error) {
 	key := in.GetKey()
-	if len(key) == 0 {
-		return &pb.DeleteReply{Key: key, Ok: false, Message: "Key cannot be empty"}, nil
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.ExistsReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	if !s.cache.Exists(key) {
+		return &pb.ExistsReply{Key: key, Ok: false, Message: "Value not found"}, nil
+	}
+	return &pb.ExistsReply{Key: key, Ok: true}, nil
+}
+
+func (s *Server) TTL(ctx context.Context, in *pb.TTLRequest) (*pb.TTLReply, error) {
+	key := in.GetKey()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.TTLReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	ttl, ok := s.cache.TTL(key)
+	if !ok {
+		return &pb.TTLReply{Key: key, Ok: false, Message: "Value not found"}, nil
+	}
+	return &pb.TTLReply{Key: key, Ttl: ttl.Milliseconds(), Ok: true}, nil
+}
+
+func (s *Server) Touch(ctx context.Context, in *pb.TouchRequest) (*pb.TouchReply, error) {
+	key := in.GetKey()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.TouchReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	if in.GetTtl() <= 0 || in.GetTtl() > maxTTLMillis {
+		return &pb.TouchReply{Key: key, Ok: false, Message: "Ttl must be positive"}, nil
+	}
+	if !s.cache.Touch(key, time.Duration(in.GetTtl())*time.Millisecond) {
+		return &pb.TouchReply{Key: key, Ok: false, Message: "Value not found"}, nil
+	}
+	return &pb.TouchReply{Key: key, Ok: true}, nil
+}
+
+func (s *Server) Persist(ctx context.Context, in *pb.PersistRequest) (*pb.PersistReply, error) {
+	key := in.GetKey()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.PersistReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	if !s.cache.Persist(key) {
+		return &pb.PersistReply{Key: key, Ok: false, Message: "Value not found"}, nil
+	}
+	return &pb.PersistReply{Key: key, Ok: true}, nil
+}
+
+func (s *Server) Delete(ctx context.Context, in *pb.DeleteRequest) (*pb.DeleteReply, error) {
+	key := in.GetKey()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.DeleteReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
 	}
 	s.cache.Delete(key)
 	return &pb.DeleteReply{Key: key, Ok: true}, nil
 }
 
-func (s *Server) Purge(ctx context.Context, in *pb.PurgeRequest) (*pb.PurgeReply, error) {
-	p, ok := peer.FromContext(ctx)
-	if ok {
-		s.Logger.Debug().Msg("received grpc PURGE request from " + p.Addr.String())
+func (s *Server) GetOrSet(ctx context.Context, in *pb.GetOrSetRequest) (*pb.GetOrSetReply, error) {
+	key := in.GetKey()
+	value := in.GetValue()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.GetOrSetReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	if len(value) == 0 {
+		return &pb.GetOrSetReply{Key: key, Ok: false, Message: "Value cannot be empty"}, nil
+	}
+	if err := s.checkValueSize(value); err != nil {
+		return nil, err
+	}
+	value, existed := s.cache.GetOrSet(key, value)
+	return &pb.GetOrSetReply{Key: key, Value: value, Existed: existed, Ok: true}, nil
+}
+
+func (s *Server) GetSet(ctx context.Context, in *pb.GetSetRequest) (*pb.GetSetReply, error) {
+	key := in.GetKey()
+	value := in.GetValue()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.GetSetReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	if len(value) == 0 {
+		return &pb.GetSetReply{Key: key, Ok: false, Message: "Value cannot be empty"}, nil
+	}
+	if err := s.checkValueSize(value); err != nil {
+		return nil, err
+	}
+	old, existed := s.cache.GetSet(key, value)
+	return &pb.GetSetReply{Key: key, Value: old, Existed: existed, Ok: true}, nil
+}
+
+func (s *Server) CompareAndSwap(ctx context.Context, in *pb.CompareAndSwapRequest) (*pb.CompareAndSwapReply, error) {
+	key := in.GetKey()
+	value := in.GetValue()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.CompareAndSwapReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	if len(value) == 0 {
+		return &pb.CompareAndSwapReply{Key: key, Ok: false, Message: "Value cannot be empty"}, nil
+	}
+	if err := s.checkValueSize(value); err != nil {
+		return nil, err
+	}
+	swapped := s.cache.CompareAndSwap(key, in.GetExpected(), value)
+	return &pb.CompareAndSwapReply{Key: key, Ok: true, Swapped: swapped}, nil
+}
+
+func (s *Server) DecrAndReap(ctx context.Context, in *pb.DecrAndReapRequest) (*pb.DecrAndReapReply, error) {
+	key := in.GetKey()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.DecrAndReapReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	value, deleted, err := s.cache.DecrAndReap(key)
+	if err == cache.ErrNotFound {
+		return &pb.DecrAndReapReply{Key: key, Ok: false, Message: "Value not found"}, nil
+	}
+	if err == cache.ErrOverflow {
+		return &pb.DecrAndReapReply{Key: key, Ok: false, Message: "Value would overflow"}, nil
+	}
+	if err != nil {
+		return &pb.DecrAndReapReply{Key: key, Ok: false, Message: "Value is not an integer"}, nil
+	}
+	return &pb.DecrAndReapReply{Key: key, Value: value, Deleted: deleted, Ok: true}, nil
+}
+
+func (s *Server) Incr(ctx context.Context, in *pb.IncrRequest) (*pb.IncrReply, error) {
+	return s.incrDecr(ctx, "INCR", in)
+}
+
+func (s *Server) Decr(ctx context.Context, in *pb.IncrRequest) (*pb.IncrReply, error) {
+	return s.incrDecr(ctx, "DECR", in)
+}
+
+// incrDecr handles both Incr and Decr, which only differ in the sign of the delta.
+func (s *Server) incrDecr(ctx context.Context, command string, in *pb.IncrRequest) (*pb.IncrReply, error) {
+	key := in.GetKey()
+	if err := s.cache.ValidateKey(key); err != nil {
+		return &pb.IncrReply{Key: key, Ok: false, Message: keyMessage(err)}, nil
+	}
+	delta := in.GetDelta()
+	if delta == 0 {
+		delta = 1
+	}
+	var value int64
+	var err error
+	if command == "INCR" {
+		value, err = s.cache.Increment(key, delta)
 	} else {
-		s.Logger.Debug().Msg("received grpc PURGE request, peer information unavailable")
+		value, err = s.cache.Decrement(key, delta)
+	}
+	if err == cache.ErrOverflow {
+		return &pb.IncrReply{Key: key, Ok: false, Message: "Value would overflow"}, nil
+	}
+	if err != nil {
+		return &pb.IncrReply{Key: key, Ok: false, Message: "Value is not an integer"}, nil
+	}
+	return &pb.IncrReply{Key: key, Value: value, Ok: true}, nil
+}
+
+func (s *Server) Purge(ctx context.Context, in *pb.PurgeRequest) (*pb.PurgeReply, error) {
+	if s.ConfirmPurge && !in.GetConfirm() {
+		return &pb.PurgeReply{Ok: false, Message: "Purge must be confirmed"}, nil
 	}
 	s.cache.Purge()
 	return &pb.PurgeReply{Ok: true}, nil
 }
 
 func (s *Server) Length(ctx context.Context, in *pb.LengthRequest) (*pb.LengthReply, error) {
-	p, ok := peer.FromContext(ctx)
-	if ok {
-		s.Logger.Debug().Msg("received grpc LENGTH request from " + p.Addr.String())
-	} else {
-		s.Logger.Debug().Msg("received grpc LENGTH request, peer information unavailable")
-	}
 	length := s.cache.Length()
 	return &pb.LengthReply{Length: int64(length), Ok: true}, nil
 }
 
 func (s *Server) Keys(ctx context.Context, in *pb.KeysRequest) (*pb.KeysReply, error) {
-	p, ok := peer.FromContext(ctx)
-	if ok {
-		s.Logger.Debug().Msg("received grpc KEYS request from " + p.Addr.String())
-	} else {
-		s.Logger.Debug().Msg("received grpc KEYS request, peer information unavailable")
+	pattern := in.GetPattern()
+	if len(pattern) == 0 {
+		return &pb.KeysReply{Keys: s.cache.Keys(), Ok: true}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return &pb.KeysReply{Ok: false, Message: "Invalid pattern"}, nil
 	}
-	keys := s.cache.Keys()
-	return &pb.KeysReply{Keys: keys, Ok: true}, nil
+	return &pb.KeysReply{Keys: s.cache.KeysMatching(pattern), Ok: true}, nil
 }
 
-func (s *Server) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingReply, error) {
-	p, ok := peer.FromContext(ctx)
-	if ok {
-		s.Logger.Debug().Msg("received grpc PING request from " + p.Addr.String())
-	} else {
-		s.Logger.Debug().Msg("received grpc PING request, peer information unavailable")
+func (s *Server) Scan(ctx context.Context, in *pb.ScanRequest) (*pb.ScanReply, error) {
+	if in.GetCursor() < 0 {
+		return &pb.ScanReply{Ok: false, Message: "Cursor cannot be negative"}, nil
 	}
+	keys, next, err := s.cache.Scan(int(in.GetCursor()), int(in.GetCount()))
+	if err != nil {
+		return &pb.ScanReply{Ok: false, Message: "Invalid or expired cursor"}, nil
+	}
+	return &pb.ScanReply{Keys: keys, Cursor: int64(next), Ok: true}, nil
+}
+
+func (s *Server) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingReply, error) {
 	return &pb.PingReply{Message: "PONG", Ok: true}, nil
 }
+
+func (s *Server) ExpireMatching(ctx context.Context, in *pb.ExpireMatchingRequest) (*pb.ExpireMatchingReply, error) {
+	pattern := in.GetPattern()
+	if len(pattern) == 0 {
+		return &pb.ExpireMatchingReply{Ok: false, Message: "Pattern cannot be empty"}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return &pb.ExpireMatchingReply{Ok: false, Message: "Invalid pattern"}, nil
+	}
+	if in.GetTtl() <= 0 || in.GetTtl() > maxTTLMillis {
+		return &pb.ExpireMatchingReply{Ok: false, Message: "Ttl must be positive"}, nil
+	}
+	updated := s.cache.ExpireMatching(pattern, time.Duration(in.GetTtl())*time.Millisecond)
+	return &pb.ExpireMatchingReply{Ok: true, Count: int64(updated)}, nil
+}
+
+func (s *Server) Stats(ctx context.Context, in *pb.StatsRequest) (*pb.StatsReply, error) {
+	stats := s.cache.Stats()
+	return &pb.StatsReply{
+		Ok:        true,
+		Hits:      stats.Hits,
+		Misses:    stats.Misses,
+		Length:    int64(stats.Length),
+		Evictions: stats.Evictions,
+
+		TtlHistogram: ttlBuckets(s.cache.TTLHistogram(cache.DefaultTTLBuckets)),
+	}, nil
+}
+
+// ttlBuckets orders a TTL histogram by bucket bound, followed by the keys beyond
+// the largest bound and the keys that never expire.
+func ttlBuckets(histogram map[time.Duration]int) []*pb.TTLBucket {
+	bounds := make([]time.Duration, 0, len(histogram))
+	for b := range histogram {
+		if b != cache.NoExpiryBucket && b != cache.OverflowBucket {
+			bounds = append(bounds, b)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	buckets := make([]*pb.TTLBucket, 0, len(histogram))
+	for _, b := range bounds {
+		buckets = append(buckets, &pb.TTLBucket{Bucket: strconv.FormatInt(b.Milliseconds(), 10), Count: int64(histogram[b])})
+	}
+	buckets = append(buckets,
+		&pb.TTLBucket{Bucket: "+Inf", Count: int64(histogram[cache.OverflowBucket])},
+		&pb.TTLBucket{Bucket: "never", Count: int64(histogram[cache.NoExpiryBucket])},
+	)
+	return buckets
+}
+
+func (s *Server) Info(ctx context.Context, in *pb.InfoRequest) (*pb.InfoReply, error) {
+	return &pb.InfoReply{
+		Ok:          true,
+		Version:     version.Version,
+		Commit:      version.Commit,
+		BuildDate:   version.BuildDate,
+		Connections: int64(s.ActiveConns()),
+	}, nil
+}
+
+// keyMessage returns the message of the reply to a key rejected by ValidateKey.
+func keyMessage(err error) string {
+	if err == cache.ErrKeyTooLong {
+		return "Key is too long"
+	}
+	return "Key cannot be empty"
+}
+
+// checkValueSize returns an InvalidArgument error for a value over the limit of the cache.
+func (s *Server) checkValueSize(value []byte) error {
+	if s.cache.CheckValueSize(value) != nil {
+		return status.Error(codes.InvalidArgument, "value is too large")
+	}
+	return nil
+}
+
+// Stream applies the operations received on the stream in order and sends a reply
+// to each before reading the next one, so a client that does not read its replies
+// is slowed down by flow control instead of growing buffers on the server.
+func (s *Server) Stream(stream pb.CacheService_StreamServer) error {
+	ctx := stream.Context()
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply := &pb.StreamReply{}
+		switch op := in.GetOp().(type) {
+		case *pb.StreamRequest_Set:
+			res, err := s.Set(ctx, op.Set)
+			if err != nil {
+				return err
+			}
+			reply.Reply = &pb.StreamReply_Set{Set: res}
+		case *pb.StreamRequest_Get:
+			res, _ := s.Get(ctx, op.Get)
+			reply.Reply = &pb.StreamReply_Get{Get: res}
+		case *pb.StreamRequest_Delete:
+			res, _ := s.Delete(ctx, op.Delete)
+			reply.Reply = &pb.StreamReply_Delete{Delete: res}
+		default:
+			return status.Error(codes.InvalidArgument, "operation is missing")
+		}
+		if err := stream.Send(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// Watch streams the mutations of the requested key, or of all keys starting with it
+// if Prefix is set, until the client cancels the call. The header is sent once the
+// watch is registered. A client that falls more than watchBuffer events behind is
+// disconnected with codes.ResourceExhausted.
+func (s *Server) Watch(in *pb.WatchRequest, stream pb.CacheService_WatchServer) error {
+	ctx := stream.Context()
+	key := in.GetKey()
+	if len(key) == 0 && !in.GetPrefix() {
+		return status.Error(codes.InvalidArgument, "key cannot be empty")
+	}
+	match := func(k string) bool { return k == key }
+	if in.GetPrefix() {
+		match = func(k string) bool { return strings.HasPrefix(k, key) }
+	}
+	sub := s.cache.Subscribe(match, watchBuffer)
+	defer sub.Close()
+	// Clients may wait for the header to know that no later mutation is missed.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher fell behind")
+			}
+			if err := stream.Send(&pb.WatchEvent{Type: watchEventTypes[ev.Type], Key: ev.Key, Value: ev.Value}); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+// watchBuffer is the number of events buffered for each Watch stream.
+const watchBuffer = 1024
+
+// maxBatchKeys bounds the number of keys of GetMany, SetMany and DeleteMany
+// requests and the number of ops of Exec requests.
+const maxBatchKeys = 10000
+
+// maxTTLMillis is the largest TTL in milliseconds that fits in a time.Duration.
+const maxTTLMillis = math.MaxInt64 / int64(time.Millisecond)
+
+var watchEventTypes = map[cache.EventType]pb.WatchEvent_Type{
+	cache.EventSet:    pb.WatchEvent_SET,
+	cache.EventDelete: pb.WatchEvent_DELETE,
+	cache.EventExpire: pb.WatchEvent_EXPIRE,
+}
+
+var execOpTypes = map[pb.Op_Type]cache.OpType{
+	pb.Op_SET:    cache.OpSet,
+	pb.Op_DELETE: cache.OpDelete,
+	pb.Op_SETNX:  cache.OpSetNX,
+	pb.Op_CAS:    cache.OpCAS,
+}
+
+// connCounter is a stats.Handler that tracks the number of open connections.
+type connCounter struct {
+	n atomic.Int64
+}
+
+func (c *connCounter) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (c *connCounter) HandleRPC(context.Context, stats.RPCStats) {}
+
+func (c *connCounter) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (c *connCounter) HandleConn(_ context.Context, st stats.ConnStats) {
+	switch st.(type) {
+	case *stats.ConnBegin:
+		c.n.Add(1)
+	case *stats.ConnEnd:
+		c.n.Add(-1)
+	}
+}
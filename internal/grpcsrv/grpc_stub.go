@@ -4,13 +4,19 @@ package grpcsrv
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/nmezhenskyi/rcs/internal/cache"
 	"github.com/rs/zerolog"
 )
 
+const ServiceName = "rcs.CacheService"
+
 type Server struct {
-	Logger zerolog.Logger
+	Logger       zerolog.Logger
+	APIKey       string
+	ConfirmPurge bool
+	Reflection   bool
 }
 
 func NewServer(_ *cache.CacheMap) *Server {
@@ -25,6 +31,16 @@ func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
 	return nil
 }
 
+func (s *Server) WebHandler(allowedOrigins ...string) http.Handler {
+	return http.NotFoundHandler()
+}
+
+func (s *Server) SetReady(ready bool) {}
+
+func (s *Server) ActiveConns() int {
+	return 0
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
 	return nil
 }
@@ -5,13 +5,26 @@ package grpcsrv
 import (
 	"bytes"
 	"context"
+	"io"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/nmezhenskyi/rcs/internal/cache"
 	pb "github.com/nmezhenskyi/rcs/internal/genproto"
+	"github.com/nmezhenskyi/rcs/internal/version"
+	"github.com/rs/zerolog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 func TestNewServer(t *testing.T) {
@@ -52,6 +65,60 @@ func TestShutdown(t *testing.T) {
 	}
 }
 
+func TestShutdownTimeout(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	// An open stream keeps GracefulStop waiting until it is closed.
+	stream, err := client.Stream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open the stream: %v", err)
+	}
+	get := &pb.StreamRequest{Op: &pb.StreamRequest_Get{Get: &pb.GetRequest{Key: "key"}}}
+	if err := stream.Send(get); err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Failed to receive the reply: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to return %v, got %v instead", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Shutdown to stop the server once the context is done, took %v instead", elapsed)
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Error("Expected the stream to be closed by the forced stop")
+	}
+}
+
+func TestStopNotStarted(t *testing.T) {
+	server := NewServer(nil)
+	server.Close()
+	server.Close()
+
+	server = NewServer(nil)
+	if err := server.Shutdown(context.Background()); err != ErrNotStarted {
+		t.Errorf("Expected Shutdown to return ErrNotStarted, got %v instead", err)
+	}
+	// A server that has been shut down does not start anymore.
+	if err := server.ListenAndServe("localhost:6122"); err != nil {
+		t.Errorf("Expected ListenAndServe to be aborted, got %v instead", err)
+	}
+}
+
 func TestSet(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6122"
@@ -67,10 +134,11 @@ func TestSet(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 
 	testCases := []struct {
-		name  string
-		key   string
-		value []byte
-		ok    bool
+		name    string
+		key     string
+		value   []byte
+		ok      bool
+		existed bool
 	}{
 		{
 			name:  "Empty key, no value",
@@ -90,6 +158,13 @@ func TestSet(t *testing.T) {
 			value: []byte("10"),
 			ok:    true,
 		},
+		{
+			name:    "Valid key, valid value, overwrite",
+			key:     "key1",
+			value:   []byte("20"),
+			ok:      true,
+			existed: true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -105,11 +180,14 @@ func TestSet(t *testing.T) {
 			if reply.Key != tc.key {
 				t.Errorf("Expected key \"%s\", got \"%s\" instead", tc.key, reply.Key)
 			}
+			if reply.Existed != tc.existed {
+				t.Errorf("Expected Existed to be %t, got %t instead", tc.existed, reply.Existed)
+			}
 		})
 	}
 }
 
-func TestGet(t *testing.T) {
+func TestSetKeepTTL(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6122"
 	go func() {
@@ -121,51 +199,99 @@ func TestGet(t *testing.T) {
 	defer conn.Close()
 	defer server.Close()
 
-	time.Sleep(500 * time.Millisecond)
+	server.cache.SetEx("key1", []byte("value1"), time.Minute)
+
+	reply, err := client.Set(context.Background(), &pb.SetRequest{Key: "key1", Value: []byte("value2"), KeepTtl: true})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || !reply.Existed {
+		t.Errorf("Expected Ok and Existed to be true, got %t and %t instead", reply.Ok, reply.Existed)
+	}
+	if info := server.cache.KeysInfo(0); len(info) != 1 || info[0].TTL <= 0 || info[0].TTL > time.Minute {
+		t.Errorf("Expected TTL within (0, 1m] to survive the overwrite, got %v instead", info)
+	}
+
+	if _, err = client.Set(context.Background(), &pb.SetRequest{Key: "key1", Value: []byte("value3")}); err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if info := server.cache.KeysInfo(0); len(info) != 1 || info[0].TTL != 0 {
+		t.Errorf("Expected SET without KeepTtl to clear the TTL, got %v instead", info)
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
 
 	testCases := []struct {
-		name  string
-		key   string
-		value []byte
-		ok    bool
+		name    string
+		req     *pb.SetRequest
+		ok      bool
+		message string
 	}{
 		{
-			name:  "Valid key, valid value",
-			key:   "key1",
-			value: []byte("10"),
-			ok:    true,
+			name:    "Negative TTL",
+			req:     &pb.SetRequest{Key: "key1", Value: []byte("value"), TtlMs: -1},
+			message: "TTL cannot be negative",
+		},
+		{
+			name:    "TTL overflowing time.Duration",
+			req:     &pb.SetRequest{Key: "key1", Value: []byte("value"), TtlMs: 9223372036855},
+			message: "TTL is too large",
+		},
+		{
+			name:    "TTL with KeepTtl",
+			req:     &pb.SetRequest{Key: "key1", Value: []byte("value"), TtlMs: 100, KeepTtl: true},
+			message: "KeepTtl cannot be combined with TTL",
+		},
+		{
+			name: "Valid TTL",
+			req:  &pb.SetRequest{Key: "key1", Value: []byte("value"), TtlMs: 50},
+			ok:   true,
 		},
 	}
-
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			if tc.key != "" {
-				server.cache.Set(tc.key, tc.value)
-			}
-			reqData := &pb.GetRequest{Key: tc.key}
-			reply, err := client.Get(context.Background(), reqData)
+			reply, err := client.Set(context.Background(), tc.req)
 			if err != nil {
-				t.Errorf("Failed to send the request: %v", err)
-			}
-			if reply.Ok != tc.ok {
-				t.Errorf("Expected Ok to be %t, got %t instead", tc.ok, reply.Ok)
-			}
-			if reply.Key != tc.key {
-				t.Errorf("Expected key \"%s\", got \"%s\" instead", tc.key, reply.Key)
+				t.Fatalf("Failed to send the request: %v", err)
 			}
-			if !bytes.Equal(reply.Value, tc.value) {
-				t.Errorf("Expected value to be %v, got %v instead", tc.value, reply.Value)
+			if reply.Ok != tc.ok || reply.Message != tc.message {
+				t.Errorf("Expected Ok %t and message %q, got %t and %q instead", tc.ok, tc.message, reply.Ok, reply.Message)
 			}
 		})
 	}
+
+	if reply, _ := client.Get(context.Background(), &pb.GetRequest{Key: "key1"}); !reply.GetOk() {
+		t.Fatal("Expected the key to be present before its TTL elapses")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if reply, _ := client.Get(context.Background(), &pb.GetRequest{Key: "key1"}); reply.GetOk() {
+		t.Error("Expected the key to expire after its TTL")
+	}
+
+	reply, err := client.Set(context.Background(), &pb.SetRequest{Key: "key2", Value: []byte("value")})
+	if err != nil || !reply.Ok {
+		t.Fatalf("Expected Set without TTL to succeed, got %v, %v instead", reply, err)
+	}
+	if ttl, ok := server.cache.TTL("key2"); !ok || ttl != 0 {
+		t.Errorf("Expected a key set without TTL to never expire, got %v instead", ttl)
+	}
 }
 
-func TestDelete(t *testing.T) {
+func TestMaxValueBytes(t *testing.T) {
 	server := NewServer(nil)
+	server.cache.SetMaxValueBytes(5)
 	serverAddr := "localhost:6122"
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
 	go func() {
 		if err := server.ListenAndServe(serverAddr); err != nil {
 			t.Errorf("Server failed: %v", err)
@@ -175,28 +301,48 @@ func TestDelete(t *testing.T) {
 	defer conn.Close()
 	defer server.Close()
 
-	time.Sleep(500 * time.Millisecond)
+	ctx := context.Background()
+	reply, err := client.Set(ctx, &pb.SetRequest{Key: "key1", Value: []byte("12345")})
+	if err != nil || !reply.Ok {
+		t.Fatalf("Expected a value at the limit to be stored, got %v, %v instead", reply, err)
+	}
 
-	lengthBefore := server.cache.Length()
-	reqData := &pb.DeleteRequest{Key: "key1"}
-	reply, err := client.Delete(context.Background(), reqData)
-	if err != nil {
-		t.Errorf("Failed to send the request: %v", err)
+	calls := map[string]func() error{
+		"Set": func() error {
+			_, err := client.Set(ctx, &pb.SetRequest{Key: "key2", Value: []byte("123456")})
+			return err
+		},
+		"SetNX": func() error {
+			_, err := client.SetNX(ctx, &pb.SetNXRequest{Key: "key2", Value: []byte("123456")})
+			return err
+		},
+		"SetMany": func() error {
+			_, err := client.SetMany(ctx, &pb.SetManyRequest{Entries: []*pb.Entry{{Key: "key2", Value: []byte("123456")}}})
+			return err
+		},
+		"GetSet": func() error {
+			_, err := client.GetSet(ctx, &pb.GetSetRequest{Key: "key1", Value: []byte("123456")})
+			return err
+		},
 	}
-	if !reply.Ok {
-		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			if code := status.Code(call()); code != codes.InvalidArgument {
+				t.Errorf("Expected code %v, got %v instead", codes.InvalidArgument, code)
+			}
+		})
 	}
-	if server.cache.Length() != lengthBefore-1 {
-		t.Errorf("Cache length has not changed")
+	if value, _ := server.cache.Get("key1"); string(value) != "12345" {
+		t.Errorf("Expected the value at the limit to be kept, got %q instead", value)
+	}
+	if server.cache.Exists("key2") {
+		t.Error("Expected no value over the limit to be stored")
 	}
 }
 
-func TestPurge(t *testing.T) {
+func TestKeyTooLong(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6122"
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
 	go func() {
 		if err := server.ListenAndServe(serverAddr); err != nil {
 			t.Errorf("Server failed: %v", err)
@@ -206,29 +352,30 @@ func TestPurge(t *testing.T) {
 	defer conn.Close()
 	defer server.Close()
 
-	time.Sleep(500 * time.Millisecond)
-
-	reqData := &pb.PurgeRequest{}
-	reply, err := client.Purge(context.Background(), reqData)
+	ctx := context.Background()
+	longKey := strings.Repeat("k", cache.DefaultMaxKeyBytes+1)
+	setReply, err := client.Set(ctx, &pb.SetRequest{Key: longKey, Value: []byte("value")})
 	if err != nil {
-		t.Errorf("Failed to send the request: %v", err)
+		t.Fatalf("Failed to send the request: %v", err)
 	}
-	if !reply.Ok {
-		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	if setReply.Ok || setReply.Message != "Key is too long" {
+		t.Errorf("Expected Set to reject the key, got %v instead", setReply)
+	}
+	getReply, err := client.Get(ctx, &pb.GetRequest{Key: longKey})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if getReply.Ok || getReply.Message != "Key is too long" {
+		t.Errorf("Expected Get to reject the key, got %v instead", getReply)
 	}
 	if server.cache.Length() != 0 {
-		t.Errorf("Cache is not empty")
+		t.Error("Expected the over-long key not to be stored")
 	}
 }
 
-func TestLength(t *testing.T) {
+func TestGetTTL(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6122"
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
-	server.cache.Set("key4", []byte("40"))
-	server.cache.Set("key5", []byte("50"))
 	go func() {
 		if err := server.ListenAndServe(serverAddr); err != nil {
 			t.Errorf("Server failed: %v", err)
@@ -238,30 +385,30 @@ func TestLength(t *testing.T) {
 	defer conn.Close()
 	defer server.Close()
 
-	time.Sleep(500 * time.Millisecond)
+	server.cache.SetEx("expiring", []byte("value"), time.Minute)
+	server.cache.Set("persistent", []byte("value"))
+	server.cache.SetEx("expired", []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
 
-	actualLength := server.cache.Length()
-	reqData := &pb.LengthRequest{}
-	reply, err := client.Length(context.Background(), reqData)
+	ctx := context.Background()
+	reply, err := client.Get(ctx, &pb.GetRequest{Key: "expiring"})
 	if err != nil {
-		t.Errorf("Failed to send the request: %v", err)
+		t.Fatalf("Failed to send the request: %v", err)
 	}
-	if !reply.Ok {
-		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	if !reply.Ok || reply.TtlMs <= 0 || reply.TtlMs > time.Minute.Milliseconds() {
+		t.Errorf("Expected the value with a TTL of up to a minute, got %v instead", reply)
 	}
-	if reply.Length != int64(actualLength) {
-		t.Errorf("Expected length %d, got %d instead", actualLength, reply.Length)
+	if reply, _ := client.Get(ctx, &pb.GetRequest{Key: "persistent"}); !reply.GetOk() || reply.GetTtlMs() != 0 {
+		t.Errorf("Expected a TTL of 0 for a key that never expires, got %v instead", reply)
+	}
+	if reply, _ := client.Get(ctx, &pb.GetRequest{Key: "expired"}); reply.GetOk() {
+		t.Errorf("Expected an expired key to report not-ok, got %v instead", reply)
 	}
 }
 
-func TestKeys(t *testing.T) {
+func TestSetXX(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6122"
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
-	server.cache.Set("key4", []byte("40"))
-	server.cache.Set("key5", []byte("50"))
 	go func() {
 		if err := server.ListenAndServe(serverAddr); err != nil {
 			t.Errorf("Server failed: %v", err)
@@ -271,34 +418,28 @@ func TestKeys(t *testing.T) {
 	defer conn.Close()
 	defer server.Close()
 
-	time.Sleep(500 * time.Millisecond)
-
-	expectedKeys := server.cache.Keys()
-	reqData := &pb.KeysRequest{}
-	reply, err := client.Keys(context.Background(), reqData)
+	reqData := &pb.SetRequest{Key: "key1", Value: []byte("value1"), Xx: true}
+	reply, err := client.Set(context.Background(), reqData)
 	if err != nil {
-		t.Errorf("Failed to send the request: %v", err)
+		t.Fatalf("Failed to send the request: %v", err)
 	}
-	if !reply.Ok {
-		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	if reply.Ok || reply.Message != "Key does not exist" {
+		t.Errorf("Expected SET with Xx to refuse a missing key, got %v instead", reply)
 	}
-	if len(reply.Keys) != len(expectedKeys) {
-		t.Errorf("Expected %d keys, got %d instead", len(expectedKeys), len(reply.Keys))
+
+	server.cache.Set("key1", []byte("value0"))
+	reply, err = client.Set(context.Background(), reqData)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
 	}
-	receivedKeys := strings.Join(reply.Keys, ",")
-	for i := range expectedKeys {
-		if !strings.Contains(receivedKeys, expectedKeys[i]) {
-			t.Errorf("Key \"%s\" not found", expectedKeys[i])
-		}
+	if !reply.Ok || !reply.Existed {
+		t.Errorf("Expected Ok and Existed to be true, got %t and %t instead", reply.Ok, reply.Existed)
 	}
 }
 
-func TestPing(t *testing.T) {
+func TestSetNX(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6122"
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
 	go func() {
 		if err := server.ListenAndServe(serverAddr); err != nil {
 			t.Errorf("Server failed: %v", err)
@@ -310,25 +451,1477 @@ func TestPing(t *testing.T) {
 
 	time.Sleep(500 * time.Millisecond)
 
-	reqData := &pb.PingRequest{}
-	reply, err := client.Ping(context.Background(), reqData)
-	if err != nil {
-		t.Errorf("Failed to send the request: %v", err)
+	testCases := []struct {
+		name   string
+		value  []byte
+		ttl    int64
+		ok     bool
+		stored bool
+	}{
+		{name: "No value", value: nil, ok: false},
+		{name: "Negative TTL", value: []byte("owner1"), ttl: -1, ok: false},
+		{name: "Missing key", value: []byte("owner1"), ttl: 60000, ok: true, stored: true},
+		{name: "Existing key", value: []byte("owner2"), ttl: 60000, ok: true, stored: false},
 	}
-	if !reply.Ok {
-		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reqData := &pb.SetNXRequest{Key: "lock", Value: tc.value, Ttl: tc.ttl}
+			reply, err := client.SetNX(context.Background(), reqData)
+			if err != nil {
+				t.Fatalf("Failed to send the request: %v", err)
+			}
+			if reply.Ok != tc.ok {
+				t.Errorf("Expected Ok to be %t, got %t instead", tc.ok, reply.Ok)
+			}
+			if reply.Stored != tc.stored {
+				t.Errorf("Expected Stored to be %t, got %t instead", tc.stored, reply.Stored)
+			}
+		})
 	}
-	if reply.Message != "PONG" {
-		t.Errorf("Expected Message to PONG, got %s instead", reply.Message)
+
+	if owner, _ := server.cache.Get("lock"); string(owner) != "owner1" {
+		t.Errorf("Expected lock to be owned by \"owner1\", got \"%s\" instead", owner)
 	}
 }
 
-func newTestClient(serverAddr string, t *testing.T) (pb.CacheServiceClient, *grpc.ClientConn) {
-	var opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
-	conn, err := grpc.Dial(serverAddr, opts...)
-	if err != nil {
-		t.Errorf("Failed to connect to the server: %v", err)
+func TestGet(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	testCases := []struct {
+		name  string
+		key   string
+		value []byte
+		ok    bool
+	}{
+		{
+			name:  "Valid key, valid value",
+			key:   "key1",
+			value: []byte("10"),
+			ok:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.key != "" {
+				server.cache.Set(tc.key, tc.value)
+			}
+			reqData := &pb.GetRequest{Key: tc.key}
+			reply, err := client.Get(context.Background(), reqData)
+			if err != nil {
+				t.Errorf("Failed to send the request: %v", err)
+			}
+			if reply.Ok != tc.ok {
+				t.Errorf("Expected Ok to be %t, got %t instead", tc.ok, reply.Ok)
+			}
+			if reply.Key != tc.key {
+				t.Errorf("Expected key \"%s\", got \"%s\" instead", tc.key, reply.Key)
+			}
+			if !bytes.Equal(reply.Value, tc.value) {
+				t.Errorf("Expected value to be %v, got %v instead", tc.value, reply.Value)
+			}
+		})
+	}
+}
+
+func TestGetModified(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	modified := func() int64 {
+		reply, err := client.Get(context.Background(), &pb.GetRequest{Key: "key1"})
+		if err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+		if !reply.Ok || reply.ModifiedMs == 0 {
+			t.Fatalf("Expected the value with its modified time, got %v instead", reply)
+		}
+		return reply.ModifiedMs
+	}
+
+	server.cache.Set("key1", []byte("value1"))
+	first := modified()
+	time.Sleep(5 * time.Millisecond)
+	if again := modified(); again != first {
+		t.Errorf("Expected modified_ms to stay %d on read, got %d instead", first, again)
+	}
+	server.cache.Set("key1", []byte("value2"))
+	if next := modified(); next <= first {
+		t.Errorf("Expected modified_ms to advance past %d on overwrite, got %d instead", first, next)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("key1", []byte("value1"))
+	server.cache.Set("key2", []byte("value2"))
+	server.cache.SetEx("expired", []byte("value3"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	reqData := &pb.GetManyRequest{Keys: []string{"key2", "missing", "key1", "expired"}}
+	reply, err := client.GetMany(context.Background(), reqData)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	entries := reply.GetEntries()
+	if !reply.Ok || len(entries) != 2 ||
+		entries[0].Key != "key2" || string(entries[0].Value) != "value2" ||
+		entries[1].Key != "key1" || string(entries[1].Value) != "value1" {
+		t.Errorf("Expected entries for \"key2\" and \"key1\", got %v instead", entries)
+	}
+
+	for name, keys := range map[string][]string{
+		"Empty key": {"key1", ""},
+		"Too many":  make([]string, maxBatchKeys+1),
+	} {
+		reply, err := client.GetMany(context.Background(), &pb.GetManyRequest{Keys: keys})
+		if err != nil {
+			t.Fatalf("%s: failed to send the request: %v", name, err)
+		}
+		if reply.Ok {
+			t.Errorf("%s: expected the request to be rejected", name)
+		}
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("key1", []byte("value1"))
+	server.cache.Set("key2", []byte("value2"))
+	server.cache.Set("key3", []byte("value3"))
+
+	reqData := &pb.DeleteManyRequest{Keys: []string{"key1", "missing", "key2"}}
+	reply, err := client.DeleteMany(context.Background(), reqData)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || reply.Count != 2 {
+		t.Errorf("Expected 2 deleted keys, got %v instead", reply)
+	}
+	if server.cache.Length() != 1 {
+		t.Errorf("Expected only \"key3\" to remain, got length %d instead", server.cache.Length())
+	}
+
+	for name, keys := range map[string][]string{
+		"Empty key": {"key3", ""},
+		"Too many":  append(make([]string, maxBatchKeys), "key3"),
+	} {
+		reply, err := client.DeleteMany(context.Background(), &pb.DeleteManyRequest{Keys: keys})
+		if err != nil {
+			t.Fatalf("%s: failed to send the request: %v", name, err)
+		}
+		if reply.Ok || !server.cache.Exists("key3") {
+			t.Errorf("%s: expected the request to be rejected, got %v instead", name, reply)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("counter", []byte("1"))
+	server.cache.Set("lock", []byte("owner"))
+
+	// The SETNX fails, so neither the SET nor the DELETE is applied.
+	reqData := &pb.ExecRequest{Ops: []*pb.Op{
+		{Type: pb.Op_SET, Key: "new", Value: []byte("a")},
+		{Type: pb.Op_DELETE, Key: "counter"},
+		{Type: pb.Op_SETNX, Key: "lock", Value: []byte("other")},
+	}}
+	reply, err := client.Exec(context.Background(), reqData)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || reply.Applied || reply.Failed != 2 {
+		t.Errorf("Expected op 2 to fail, got %v instead", reply)
+	}
+	if server.cache.Exists("new") || !server.cache.Exists("counter") {
+		t.Errorf("Expected no op to be applied, got keys %q instead", server.cache.Keys())
+	}
+
+	reqData = &pb.ExecRequest{Ops: []*pb.Op{
+		{Type: pb.Op_CAS, Key: "counter", Expected: []byte("1"), Value: []byte("2")},
+		{Type: pb.Op_DELETE, Key: "lock"},
+		{Type: pb.Op_SETNX, Key: "lock", Value: []byte("other"), TtlMs: 60000},
+	}}
+	reply, err = client.Exec(context.Background(), reqData)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || !reply.Applied {
+		t.Errorf("Expected all ops to be applied, got %v instead", reply)
+	}
+	if value, _ := server.cache.Get("counter"); string(value) != "2" {
+		t.Errorf("Expected counter to be \"2\", got %q instead", value)
+	}
+	if value, ttl, _ := server.cache.GetWithTTL("lock"); string(value) != "other" || ttl <= 0 {
+		t.Errorf("Expected lock to be \"other\" with a TTL, got %q and %v instead", value, ttl)
+	}
+
+	reply, err = client.Exec(context.Background(), &pb.ExecRequest{Ops: []*pb.Op{{Type: pb.Op_SET, Key: "empty"}}})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Ok || reply.Message != "Value cannot be empty" {
+		t.Errorf("Expected an empty value to be rejected, got %v instead", reply)
+	}
+}
+
+func TestSetMany(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	reqData := &pb.SetManyRequest{Entries: []*pb.Entry{
+		{Key: "key1", Value: []byte("value1")},
+		{Key: "key2", Value: []byte("value2")},
+	}}
+	reply, err := client.SetMany(context.Background(), reqData)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok {
+		t.Errorf("Expected ok, got %v instead", reply)
+	}
+	values := server.cache.GetMany([]string{"key1", "key2"})
+	if len(values) != 2 || string(values["key1"]) != "value1" || string(values["key2"]) != "value2" {
+		t.Errorf("Expected both pairs to be stored, got %q instead", values)
+	}
+
+	reqData = &pb.SetManyRequest{Entries: []*pb.Entry{
+		{Key: "key3", Value: []byte("value3")},
+		{Key: "", Value: []byte("value4")},
+	}}
+	reply, err = client.SetMany(context.Background(), reqData)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Ok || reply.Message != "Key cannot be empty" {
+		t.Errorf("Expected empty key to be rejected, got %v instead", reply)
+	}
+	if server.cache.Length() != 2 {
+		t.Errorf("Expected no pairs of the rejected batch to be stored, got length %d instead", server.cache.Length())
+	}
+}
+
+func TestExists(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("live", []byte("value1"))
+	server.cache.SetEx("expired", []byte("value2"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	for key, expected := range map[string]bool{"live": true, "expired": false} {
+		reply, err := client.Exists(context.Background(), &pb.ExistsRequest{Key: key})
+		if err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+		if reply.Ok != expected {
+			t.Errorf("Expected Ok for %q to be %t, got %t instead", key, expected, reply.Ok)
+		}
+	}
+	if value, _ := server.cache.Get("live"); string(value) != "value1" || server.cache.Length() != 2 {
+		t.Error("Expected EXISTS not to mutate the cache")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("permanent", []byte("value1"))
+	server.cache.SetEx("expiring", []byte("value2"), time.Minute)
+	server.cache.SetEx("expired", []byte("value3"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	testCases := []struct {
+		key    string
+		ok     bool
+		minTTL int64
+		maxTTL int64
+	}{
+		{key: "permanent", ok: true},
+		{key: "expiring", ok: true, minTTL: 1, maxTTL: 60000},
+		{key: "expired", ok: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			reply, err := client.TTL(context.Background(), &pb.TTLRequest{Key: tc.key})
+			if err != nil {
+				t.Fatalf("Failed to send the request: %v", err)
+			}
+			if reply.Ok != tc.ok {
+				t.Errorf("Expected Ok to be %t, got %t instead", tc.ok, reply.Ok)
+			}
+			if reply.Ttl < tc.minTTL || reply.Ttl > tc.maxTTL {
+				t.Errorf("Expected Ttl within [%d, %d], got %d instead", tc.minTTL, tc.maxTTL, reply.Ttl)
+			}
+		})
+	}
+}
+
+func TestTouch(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.SetEx("session", []byte("value1"), time.Second)
+	server.cache.SetEx("expired", []byte("value2"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	testCases := []struct {
+		key string
+		ttl int64
+		ok  bool
+	}{
+		{key: "session", ttl: 60000, ok: true},
+		{key: "expired", ttl: 60000, ok: false},
+		{key: "missing", ttl: 60000, ok: false},
+		{key: "session", ttl: 0, ok: false},
+	}
+	for _, tc := range testCases {
+		reply, err := client.Touch(context.Background(), &pb.TouchRequest{Key: tc.key, Ttl: tc.ttl})
+		if err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+		if reply.Ok != tc.ok {
+			t.Errorf("%s with ttl %d: expected Ok to be %t, got %t instead", tc.key, tc.ttl, tc.ok, reply.Ok)
+		}
+	}
+
+	if ttl, ok := server.cache.TTL("session"); !ok || ttl <= time.Second {
+		t.Errorf("Expected expiration to move forward, got TTL %v instead", ttl)
+	}
+	if value, _ := server.cache.Get("session"); !bytes.Equal(value, []byte("value1")) {
+		t.Errorf("Expected value to be unchanged, got %q instead", value)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.SetEx("key1", []byte("value1"), 50*time.Millisecond)
+
+	reply, err := client.Persist(context.Background(), &pb.PersistRequest{Key: "key1"})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok {
+		t.Errorf("Expected Ok to be true, got false instead (message: %s)", reply.Message)
+	}
+	reply, err = client.Persist(context.Background(), &pb.PersistRequest{Key: "missing"})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Ok {
+		t.Error("Expected Ok to be false for a missing key, got true instead")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	ttlReply, err := client.TTL(context.Background(), &pb.TTLRequest{Key: "key1"})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !ttlReply.Ok || ttlReply.Ttl != 0 {
+		t.Errorf("Expected TTL 0 for a persisted key, got %v instead", ttlReply)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	lengthBefore := server.cache.Length()
+	reqData := &pb.DeleteRequest{Key: "key1"}
+	reply, err := client.Delete(context.Background(), reqData)
+	if err != nil {
+		t.Errorf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok {
+		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	}
+	if server.cache.Length() != lengthBefore-1 {
+		t.Errorf("Cache length has not changed")
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	testCases := []struct {
+		name     string
+		value    []byte
+		ok       bool
+		existed  bool
+		expected []byte
+	}{
+		{name: "No value", value: nil, ok: false},
+		{name: "Missing key", value: []byte("default"), ok: true, expected: []byte("default")},
+		{name: "Existing key", value: []byte("other"), ok: true, existed: true, expected: []byte("default")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := client.GetOrSet(context.Background(), &pb.GetOrSetRequest{Key: "key1", Value: tc.value})
+			if err != nil {
+				t.Fatalf("Failed to send the request: %v", err)
+			}
+			if reply.Ok != tc.ok {
+				t.Errorf("Expected Ok to be %t, got %t instead", tc.ok, reply.Ok)
+			}
+			if reply.Existed != tc.existed {
+				t.Errorf("Expected Existed to be %t, got %t instead", tc.existed, reply.Existed)
+			}
+			if !bytes.Equal(reply.Value, tc.expected) {
+				t.Errorf("Expected value \"%s\", got \"%s\" instead", tc.expected, reply.Value)
+			}
+		})
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	testCases := []struct {
+		name     string
+		value    []byte
+		ok       bool
+		existed  bool
+		expected []byte
+	}{
+		{name: "No value", value: nil, ok: false},
+		{name: "Missing key", value: []byte("value1"), ok: true},
+		{name: "Existing key", value: []byte("value2"), ok: true, existed: true, expected: []byte("value1")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := client.GetSet(context.Background(), &pb.GetSetRequest{Key: "key1", Value: tc.value})
+			if err != nil {
+				t.Fatalf("Failed to send the request: %v", err)
+			}
+			if reply.Ok != tc.ok {
+				t.Errorf("Expected Ok to be %t, got %t instead", tc.ok, reply.Ok)
+			}
+			if reply.Existed != tc.existed {
+				t.Errorf("Expected Existed to be %t, got %t instead", tc.existed, reply.Existed)
+			}
+			if !bytes.Equal(reply.Value, tc.expected) {
+				t.Errorf("Expected value \"%s\", got \"%s\" instead", tc.expected, reply.Value)
+			}
+		})
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	testCases := []struct {
+		name     string
+		expected []byte
+		value    []byte
+		ok       bool
+		swapped  bool
+		stored   []byte
+	}{
+		{name: "No value", expected: nil, value: nil, ok: false},
+		{name: "Missing key", expected: []byte("value1"), value: []byte("value2"), ok: true, swapped: false},
+		{name: "Set if absent", expected: nil, value: []byte("value1"), ok: true, swapped: true, stored: []byte("value1")},
+		{name: "Already present", expected: nil, value: []byte("value2"), ok: true, swapped: false, stored: []byte("value1")},
+		{name: "Mismatch", expected: []byte("other"), value: []byte("value2"), ok: true, swapped: false, stored: []byte("value1")},
+		{name: "Match", expected: []byte("value1"), value: []byte("value2"), ok: true, swapped: true, stored: []byte("value2")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := client.CompareAndSwap(context.Background(), &pb.CompareAndSwapRequest{Key: "key1", Expected: tc.expected, Value: tc.value})
+			if err != nil {
+				t.Fatalf("Failed to send the request: %v", err)
+			}
+			if reply.Ok != tc.ok {
+				t.Errorf("Expected Ok to be %t, got %t instead", tc.ok, reply.Ok)
+			}
+			if reply.Swapped != tc.swapped {
+				t.Errorf("Expected Swapped to be %t, got %t instead", tc.swapped, reply.Swapped)
+			}
+			if value, _ := server.cache.Get("key1"); !bytes.Equal(value, tc.stored) {
+				t.Errorf("Expected stored value \"%s\", got \"%s\" instead", tc.stored, value)
+			}
+		})
+	}
+}
+
+func TestDecrAndReap(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	server.cache.Set("refs", []byte("2"))
+	server.cache.Set("text", []byte("abc"))
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	testCases := []struct {
+		name    string
+		key     string
+		ok      bool
+		value   int64
+		deleted bool
+	}{
+		{name: "Empty key", key: "", ok: false},
+		{name: "Decrement above zero", key: "refs", ok: true, value: 1},
+		{name: "Decrement to zero", key: "refs", ok: true, value: 0, deleted: true},
+		{name: "Missing key", key: "refs", ok: false},
+		{name: "Non-integer value", key: "text", ok: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := client.DecrAndReap(context.Background(), &pb.DecrAndReapRequest{Key: tc.key})
+			if err != nil {
+				t.Fatalf("Failed to send the request: %v", err)
+			}
+			if reply.Ok != tc.ok {
+				t.Errorf("Expected Ok to be %t, got %t instead", tc.ok, reply.Ok)
+			}
+			if reply.Value != tc.value {
+				t.Errorf("Expected value %d, got %d instead", tc.value, reply.Value)
+			}
+			if reply.Deleted != tc.deleted {
+				t.Errorf("Expected Deleted to be %t, got %t instead", tc.deleted, reply.Deleted)
+			}
+		})
+	}
+
+	if _, ok := server.cache.Get("refs"); ok {
+		t.Error("Expected \"refs\" to be deleted, found it instead")
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("text", []byte("abc"))
+
+	reply, err := client.Incr(context.Background(), &pb.IncrRequest{Key: "counter"})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || reply.Value != 1 {
+		t.Errorf("Expected counter to be incremented to 1, got %v instead", reply)
+	}
+	reply, err = client.Decr(context.Background(), &pb.IncrRequest{Key: "counter", Delta: 5})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || reply.Value != -4 {
+		t.Errorf("Expected counter to be decremented to -4, got %v instead", reply)
+	}
+	reply, err = client.Incr(context.Background(), &pb.IncrRequest{Key: "text"})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Ok || reply.Message != "Value is not an integer" {
+		t.Errorf("Expected non-integer value to be refused, got %v instead", reply)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	reqData := &pb.PurgeRequest{}
+	reply, err := client.Purge(context.Background(), reqData)
+	if err != nil {
+		t.Errorf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok {
+		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	}
+	if server.cache.Length() != 0 {
+		t.Errorf("Cache is not empty")
+	}
+}
+
+func TestConfirmPurge(t *testing.T) {
+	server := NewServer(nil)
+	server.ConfirmPurge = true
+	serverAddr := "localhost:6122"
+	server.cache.Set("key1", []byte("10"))
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	reply, err := client.Purge(context.Background(), &pb.PurgeRequest{})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Ok || reply.Message != "Purge must be confirmed" {
+		t.Errorf("Expected an unconfirmed purge to be refused, got %v instead", reply)
+	}
+	if server.cache.Length() != 1 {
+		t.Fatalf("Expected an unconfirmed purge to keep the cache, got length %d instead", server.cache.Length())
+	}
+
+	reply, err = client.Purge(context.Background(), &pb.PurgeRequest{Confirm: true})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || server.cache.Length() != 0 {
+		t.Errorf("Expected a confirmed purge to empty the cache, got %v and length %d instead", reply, server.cache.Length())
+	}
+}
+
+func TestLength(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+	server.cache.Set("key4", []byte("40"))
+	server.cache.Set("key5", []byte("50"))
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	actualLength := server.cache.Length()
+	reqData := &pb.LengthRequest{}
+	reply, err := client.Length(context.Background(), reqData)
+	if err != nil {
+		t.Errorf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok {
+		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	}
+	if reply.Length != int64(actualLength) {
+		t.Errorf("Expected length %d, got %d instead", actualLength, reply.Length)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+	server.cache.Set("key4", []byte("40"))
+	server.cache.Set("key5", []byte("50"))
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	expectedKeys := server.cache.Keys()
+	reqData := &pb.KeysRequest{}
+	reply, err := client.Keys(context.Background(), reqData)
+	if err != nil {
+		t.Errorf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok {
+		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	}
+	if len(reply.Keys) != len(expectedKeys) {
+		t.Errorf("Expected %d keys, got %d instead", len(expectedKeys), len(reply.Keys))
+	}
+	receivedKeys := strings.Join(reply.Keys, ",")
+	for i := range expectedKeys {
+		if !strings.Contains(receivedKeys, expectedKeys[i]) {
+			t.Errorf("Key \"%s\" not found", expectedKeys[i])
+		}
+	}
+}
+
+func TestKeysPattern(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("user:1", []byte("value"))
+	server.cache.Set("session:1", []byte("value"))
+	server.cache.SetEx("user:2", []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	reply, err := client.Keys(context.Background(), &pb.KeysRequest{Pattern: "user:*"})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || len(reply.Keys) != 1 || reply.Keys[0] != "user:1" {
+		t.Errorf("Expected only key user:1, got %v instead", reply)
+	}
+
+	reply, err = client.Keys(context.Background(), &pb.KeysRequest{Pattern: "["})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Ok || reply.Message != "Invalid pattern" {
+		t.Errorf("Expected an invalid pattern to fail, got %v instead", reply)
+	}
+}
+
+func TestScan(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	for i := 0; i < 1000; i++ {
+		server.cache.Set("key"+strconv.Itoa(i), []byte("value"))
+	}
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	seen := make(map[string]bool)
+	var cursor int64
+	for pages := 1; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Expected the scan to complete in 10 pages")
+		}
+		reply, err := client.Scan(context.Background(), &pb.ScanRequest{Cursor: cursor, Count: 100})
+		if err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+		if !reply.Ok {
+			t.Fatalf("Expected Ok to be true, got message %q instead", reply.Message)
+		}
+		for _, k := range reply.Keys {
+			if seen[k] {
+				t.Errorf("Key %s returned more than once", k)
+			}
+			seen[k] = true
+		}
+		if cursor = reply.Cursor; cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != 1000 {
+		t.Errorf("Expected 1000 keys, got %d instead", len(seen))
+	}
+
+	reply, err := client.Scan(context.Background(), &pb.ScanRequest{Cursor: 12345})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Ok || reply.Message != "Invalid or expired cursor" {
+		t.Errorf("Expected an unknown cursor to fail, got %v instead", reply)
+	}
+}
+
+func TestActiveConns(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	var conns []*grpc.ClientConn
+	for i := 0; i < 3; i++ {
+		_, conn := newTestClient(serverAddr, t)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitForConns(server, 3, t)
+
+	conns[0].Close()
+	waitForConns(server, 2, t)
+}
+
+func TestExpireMatching(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("tenant:5:a", []byte("value1"))
+	server.cache.Set("tenant:6:a", []byte("value2"))
+
+	reqData := &pb.ExpireMatchingRequest{Pattern: "tenant:5:*", Ttl: 60000}
+	reply, err := client.ExpireMatching(context.Background(), reqData)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || reply.Count != 1 {
+		t.Errorf("Expected 1 updated key, got %v instead", reply)
+	}
+	if ttl, _ := server.cache.TTL("tenant:5:a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected matching key to expire within a minute, got TTL %v instead", ttl)
+	}
+	if ttl, _ := server.cache.TTL("tenant:6:a"); ttl != 0 {
+		t.Errorf("Expected non-matching key to keep no TTL, got %v instead", ttl)
+	}
+
+	reply, err = client.ExpireMatching(context.Background(), &pb.ExpireMatchingRequest{Pattern: "[tenant"})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Ok || reply.Message != "Invalid pattern" {
+		t.Errorf("Expected malformed pattern to be rejected, got %v instead", reply)
+	}
+}
+
+func TestStats(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	server.cache.Set("key1", []byte("value1"))
+	for _, key := range []string{"key1", "key1", "missing"} {
+		if _, err := client.Get(context.Background(), &pb.GetRequest{Key: key}); err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+	}
+
+	reply, err := client.Stats(context.Background(), &pb.StatsRequest{})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok || reply.Hits != 2 || reply.Misses != 1 || reply.Length != 1 || reply.Evictions != 0 {
+		t.Errorf("Expected 2 hits, 1 miss and length 1, got %v instead", reply)
+	}
+
+	server.cache.SetEx("key2", []byte("value2"), 30*time.Minute)
+	server.cache.SetEx("key3", []byte("value3"), 48*time.Hour)
+	reply, err = client.Stats(context.Background(), &pb.StatsRequest{})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	expected := []string{"60000:0", "3600000:1", "86400000:0", "+Inf:1", "never:1"}
+	var histogram []string
+	for _, b := range reply.TtlHistogram {
+		histogram = append(histogram, b.Bucket+":"+strconv.FormatInt(b.Count, 10))
+	}
+	if strings.Join(histogram, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected histogram %v, got %v instead", expected, histogram)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	server := NewServer(nil)
+	reply, err := server.Info(context.Background(), &pb.InfoRequest{})
+	if err != nil {
+		t.Fatalf("Failed to get info: %v", err)
+	}
+	if !reply.Ok || reply.Version != version.Version ||
+		reply.Commit != version.Commit || reply.BuildDate != version.BuildDate {
+		t.Errorf("Expected build information, got %v instead", reply)
+	}
+	if reply.Connections != 0 {
+		t.Errorf("Expected no connections, got %d instead", reply.Connections)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	reqData := &pb.PingRequest{}
+	reply, err := client.Ping(context.Background(), reqData)
+	if err != nil {
+		t.Errorf("Failed to send the request: %v", err)
+	}
+	if !reply.Ok {
+		t.Errorf("Expected Ok to be true, got %t instead", reply.Ok)
+	}
+	if reply.Message != "PONG" {
+		t.Errorf("Expected Message to PONG, got %s instead", reply.Message)
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	stream, err := client.Stream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open the stream: %v", err)
+	}
+	const n = 1000
+	// Replies are read concurrently, otherwise both sides could block on flow control.
+	sendErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			key := "key" + strconv.Itoa(i)
+			op := &pb.StreamRequest_Set{Set: &pb.SetRequest{Key: key, Value: []byte("value" + strconv.Itoa(i))}}
+			if err := stream.Send(&pb.StreamRequest{Op: op}); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		for i := 0; i < n; i++ {
+			op := &pb.StreamRequest_Get{Get: &pb.GetRequest{Key: "key" + strconv.Itoa(i)}}
+			if err := stream.Send(&pb.StreamRequest{Op: op}); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- stream.CloseSend()
+	}()
+
+	for i := 0; i < n; i++ {
+		reply, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive reply %d: %v", i, err)
+		}
+		if set := reply.GetSet(); !set.GetOk() || set.GetKey() != "key"+strconv.Itoa(i) {
+			t.Fatalf("Expected successful SET of key%d, got %v instead", i, reply)
+		}
+	}
+	for i := 0; i < n; i++ {
+		reply, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive reply %d: %v", n+i, err)
+		}
+		get := reply.GetGet()
+		if !get.GetOk() || get.GetKey() != "key"+strconv.Itoa(i) || string(get.GetValue()) != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value%d for key%d, got %v instead", i, i, reply)
+		}
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("Failed to send the requests: %v", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Expected the stream to end, got %v instead", err)
+	}
+	if server.cache.Length() != n {
+		t.Errorf("Expected %d keys, got %d instead", n, server.cache.Length())
+	}
+
+	stream, err = client.Stream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open the stream: %v", err)
+	}
+	stream.Send(&pb.StreamRequest{})
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected code %v for a missing operation, got %v instead", codes.InvalidArgument, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Watch(ctx, &pb.WatchRequest{Key: "user:", Prefix: true})
+	if err != nil {
+		t.Fatalf("Failed to start watching: %v", err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("Failed to receive the header: %v", err)
+	}
+
+	client.Set(context.Background(), &pb.SetRequest{Key: "user:1", Value: []byte("a")})
+	client.Set(context.Background(), &pb.SetRequest{Key: "other", Value: []byte("b")})
+	client.Set(context.Background(), &pb.SetRequest{Key: "user:2", Value: []byte("c")})
+	client.Delete(context.Background(), &pb.DeleteRequest{Key: "user:1"})
+	server.cache.SetEx("user:3", []byte("d"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	server.cache.DeleteExpiredMatching("user:*")
+
+	expected := []*pb.WatchEvent{
+		{Type: pb.WatchEvent_SET, Key: "user:1", Value: []byte("a")},
+		{Type: pb.WatchEvent_SET, Key: "user:2", Value: []byte("c")},
+		{Type: pb.WatchEvent_DELETE, Key: "user:1"},
+		{Type: pb.WatchEvent_SET, Key: "user:3", Value: []byte("d")},
+		{Type: pb.WatchEvent_EXPIRE, Key: "user:3"},
+	}
+	for i, want := range expected {
+		got, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive event %d: %v", i, err)
+		}
+		if got.Type != want.Type || got.Key != want.Key || !bytes.Equal(got.Value, want.Value) {
+			t.Errorf("Expected event %d to be %v, got %v instead", i, want, got)
+		}
+	}
+
+	cancel()
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Errorf("Expected the stream to be canceled, got %v instead", err)
+	}
+
+	stream, err = client.Watch(context.Background(), &pb.WatchRequest{})
+	if err != nil {
+		t.Fatalf("Failed to start watching: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected code %v for an empty key, got %v instead", codes.InvalidArgument, err)
+	}
+}
+
+func TestReflection(t *testing.T) {
+	testCases := []struct {
+		name    string
+		enabled bool
+	}{
+		{name: "Enabled", enabled: true},
+		{name: "Disabled", enabled: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(nil)
+			server.Reflection = tc.enabled
+			serverAddr := "localhost:6122"
+			go func() {
+				if err := server.ListenAndServe(serverAddr); err != nil {
+					t.Errorf("Server failed: %v", err)
+				}
+			}()
+			_, conn := newTestClient(serverAddr, t)
+			defer conn.Close()
+			defer server.Close()
+
+			stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+			if err != nil {
+				t.Fatalf("Failed to open the reflection stream: %v", err)
+			}
+			err = stream.Send(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: ServiceName},
+			})
+			if err != nil {
+				t.Fatalf("Failed to send the request: %v", err)
+			}
+			res, err := stream.Recv()
+			if !tc.enabled {
+				if status.Code(err) != codes.Unimplemented {
+					t.Errorf("Expected code %v, got %v instead", codes.Unimplemented, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to receive the response: %v", err)
+			}
+			methods := map[string]bool{}
+			for _, raw := range res.GetFileDescriptorResponse().GetFileDescriptorProto() {
+				file := &descriptorpb.FileDescriptorProto{}
+				if err := proto.Unmarshal(raw, file); err != nil {
+					t.Fatalf("Failed to parse the file descriptor: %v", err)
+				}
+				for _, service := range file.GetService() {
+					if file.GetPackage()+"."+service.GetName() != ServiceName {
+						continue
+					}
+					for _, method := range service.GetMethod() {
+						methods[method.GetName()] = true
+					}
+				}
+			}
+			for _, method := range pb.CacheService_ServiceDesc.Methods {
+				if !methods[method.MethodName] {
+					t.Errorf("Expected method %s to be listed", method.MethodName)
+				}
+			}
+			for _, method := range []string{"Stream", "Watch"} {
+				if !methods[method] {
+					t.Errorf("Expected method %s to be listed", method)
+				}
+			}
+		})
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	panicOnPing := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasSuffix(info.FullMethod, "/Ping") {
+			panic("boom")
+		}
+		return handler(ctx, req)
+	}
+	server := NewServer(nil, grpc.ChainUnaryInterceptor(panicOnPing))
+	var logs syncBuffer
+	server.Logger = zerolog.New(&logs)
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Ping(context.Background(), &pb.PingRequest{})
+		if code := status.Code(err); code != codes.Internal {
+			t.Errorf("Expected code %v, got %v instead", codes.Internal, code)
+		}
+		reply, err := client.Set(context.Background(), &pb.SetRequest{Key: "key", Value: []byte("value")})
+		if err != nil || !reply.Ok {
+			t.Errorf("Expected the server to keep serving after a panic, got %v, %v instead", reply, err)
+		}
+	}
+
+	out := logs.String()
+	for _, want := range []string{
+		`"panic":"boom"`,
+		`"method":"/rcs.CacheService/Set"`,
+		`"code":"OK"`,
+		`"code":"Internal"`,
+		`"message":"handled grpc request"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected the log to contain %s, got %s instead", want, out)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, e.g. as the output of a
+// logger written to by the server while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAPIKey(t *testing.T) {
+	server := NewServer(nil)
+	server.APIKey = "secret"
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	client, conn := newTestClient(serverAddr, t)
+	defer conn.Close()
+	defer server.Close()
+
+	testCases := []struct {
+		name string
+		md   []string
+		code codes.Code
+	}{
+		{name: "Missing", md: nil, code: codes.Unauthenticated},
+		{name: "Wrong", md: []string{"authorization", "Bearer wrong"}, code: codes.Unauthenticated},
+		{name: "Valid", md: []string{"authorization", "Bearer secret"}, code: codes.OK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), tc.md...)
+			_, err := client.Ping(ctx, &pb.PingRequest{})
+			if code := status.Code(err); code != tc.code {
+				t.Errorf("Expected code %v, got %v instead", tc.code, code)
+			}
+
+			stream, err := client.Stream(ctx)
+			if err != nil {
+				t.Fatalf("Failed to open the stream: %v", err)
+			}
+			stream.Send(&pb.StreamRequest{Op: &pb.StreamRequest_Get{Get: &pb.GetRequest{Key: "key"}}})
+			_, err = stream.Recv()
+			if code := status.Code(err); code != tc.code {
+				t.Errorf("Expected stream code %v, got %v instead", tc.code, code)
+			}
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	server := NewServer(nil)
+	server.APIKey = "secret" // Probes do not authenticate.
+	serverAddr := "localhost:6122"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	_, conn := newTestClient(serverAddr, t)
+
+	client := healthpb.NewHealthClient(conn)
+	reply, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected status %v, got %v instead", healthpb.HealthCheckResponse_SERVING, reply.Status)
+	}
+
+	server.SetReady(false)
+	reply, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	if reply.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected status %v once not ready, got %v instead", healthpb.HealthCheckResponse_NOT_SERVING, reply.Status)
+	}
+	server.SetReady(true)
+
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Failed to shut down the server: %v", err)
+	}
+	if resp, _ := server.health.Check(context.Background(), &healthpb.HealthCheckRequest{}); resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected status %v after shutdown, got %v instead", healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+	}
+}
+
+func newTestClient(serverAddr string, t *testing.T) (pb.CacheServiceClient, *grpc.ClientConn) {
+	// Block until the server is reachable, otherwise a dial that races the
+	// listener leaves the connection in reconnect backoff and calls fail fast.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var opts = []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	}
+	conn, err := grpc.DialContext(ctx, serverAddr, opts...)
+	if err != nil {
+		t.Errorf("Failed to connect to the server: %v", err)
+	}
+	client := pb.NewCacheServiceClient(conn)
+	return client, conn
+}
+
+func waitForConns(server *Server, expected int, t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for server.ActiveConns() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d active connections, got %d instead", expected, server.ActiveConns())
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	client := pb.NewCacheServiceClient(conn)
-	return client, conn
 }
@@ -0,0 +1,162 @@
+//go:build !rmgrpc
+
+package grpcsrv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	pb "github.com/nmezhenskyi/rcs/internal/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ServiceName is the fully qualified name of CacheService. gRPC-Web requests are
+// sent to "/<ServiceName>/<Method>".
+const ServiceName = "rcs.CacheService"
+
+const (
+	// maxWebMessageSize bounds the size of a gRPC-Web request message,
+	// matching the default receive limit of grpc.Server.
+	maxWebMessageSize = 4 << 20
+
+	webContentType = "application/grpc-web+proto"
+	webTrailerFlag = 0x80
+)
+
+// WebHandler returns an http.Handler that serves CacheService to gRPC-Web clients,
+// so that browsers can use it without a separate proxy. Requests are dispatched to
+// the server directly, so it does not need to be listening.
+//
+// Only the binary format (application/grpc-web+proto) without compression is
+// supported. Cross-origin requests are allowed only from the given origins,
+// "*" allows any origin.
+func (s *Server) WebHandler(allowedOrigins ...string) http.Handler {
+	return &webHandler{server: s, allowedOrigins: allowedOrigins}
+}
+
+type webHandler struct {
+	server         *Server
+	allowedOrigins []string
+}
+
+func (h *webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc-web" && !strings.HasPrefix(ct, webContentType) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", webContentType)
+	service, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	desc := findMethod(service, method)
+	if desc == nil {
+		writeWebTrailer(w, status.New(codes.Unimplemented, "unknown method "+r.URL.Path))
+		return
+	}
+	msg, err := readWebMessage(r.Body)
+	if err != nil {
+		writeWebTrailer(w, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	ctx := peer.NewContext(r.Context(), &peer.Peer{Addr: webAddr(r.RemoteAddr)})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", r.Header.Get("Authorization")))
+	dec := func(v interface{}) error { return proto.Unmarshal(msg, v.(proto.Message)) }
+	reply, err := desc.Handler(h.server, ctx, dec, h.server.intercept)
+	if err != nil {
+		writeWebTrailer(w, status.Convert(err))
+		return
+	}
+	data, err := proto.Marshal(reply.(proto.Message))
+	if err != nil {
+		writeWebTrailer(w, status.New(codes.Internal, err.Error()))
+		return
+	}
+	w.Write(webFrame(0, data))
+	writeWebTrailer(w, status.New(codes.OK, ""))
+}
+
+func (h *webHandler) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	for _, allowed := range h.allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Grpc-Web, X-User-Agent, Grpc-Timeout")
+			w.Header().Set("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message")
+			w.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+}
+
+func findMethod(service, method string) *grpc.MethodDesc {
+	if service != pb.CacheService_ServiceDesc.ServiceName {
+		return nil
+	}
+	for i := range pb.CacheService_ServiceDesc.Methods {
+		if pb.CacheService_ServiceDesc.Methods[i].MethodName == method {
+			return &pb.CacheService_ServiceDesc.Methods[i]
+		}
+	}
+	return nil
+}
+
+// readWebMessage reads a single uncompressed length-prefixed message.
+func readWebMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read message header: %w", err)
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("unsupported message flags %#x", header[0])
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxWebMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds limit of %d bytes", size, maxWebMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	return msg, nil
+}
+
+// writeWebTrailer writes the trailer frame that ends every gRPC-Web response.
+func writeWebTrailer(w http.ResponseWriter, st *status.Status) {
+	trailer := fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n",
+		st.Code(), url.PathEscape(st.Message()))
+	w.Write(webFrame(webTrailerFlag, []byte(trailer)))
+}
+
+func webFrame(flag byte, data []byte) []byte {
+	frame := make([]byte, 5, 5+len(data))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+type webAddr string
+
+func (a webAddr) Network() string { return "grpc-web" }
+func (a webAddr) String() string  { return string(a) }
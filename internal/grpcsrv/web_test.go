@@ -0,0 +1,111 @@
+//go:build !rmgrpc
+
+package grpcsrv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/nmezhenskyi/rcs/internal/genproto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWebHandler(t *testing.T) {
+	server := NewServer(nil)
+	ts := httptest.NewServer(server.WebHandler("http://app.example"))
+	defer ts.Close()
+
+	t.Run("Ping", func(t *testing.T) {
+		data, _ := proto.Marshal(&pb.PingRequest{})
+		frames := sendWebRequest(ts.URL+"/rcs.CacheService/Ping", webFrame(0, data), t)
+		if len(frames) != 2 {
+			t.Fatalf("Expected data and trailer frames, got %d frames instead", len(frames))
+		}
+		reply := &pb.PingReply{}
+		if err := proto.Unmarshal(frames[0], reply); err != nil {
+			t.Fatalf("Failed to decode reply: %v", err)
+		}
+		if !reply.Ok || reply.Message != "PONG" {
+			t.Errorf("Expected PONG, got %v instead", reply)
+		}
+		if !strings.Contains(string(frames[1]), "grpc-status: 0\r\n") {
+			t.Errorf("Expected OK status in trailer, got %q instead", frames[1])
+		}
+	})
+
+	t.Run("Unknown method", func(t *testing.T) {
+		frames := sendWebRequest(ts.URL+"/rcs.CacheService/Missing", webFrame(0, nil), t)
+		if len(frames) != 1 || !strings.Contains(string(frames[0]), "grpc-status: 12\r\n") {
+			t.Errorf("Expected a single trailer with Unimplemented status, got %q instead", frames)
+		}
+	})
+
+	t.Run("CORS preflight", func(t *testing.T) {
+		for origin, allowed := range map[string]bool{"http://app.example": true, "http://evil.example": false} {
+			req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/rcs.CacheService/Ping", nil)
+			req.Header.Set("Origin", origin)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %v", err)
+			}
+			res.Body.Close()
+			if got := res.Header.Get("Access-Control-Allow-Origin") == origin; got != allowed {
+				t.Errorf("Expected origin %q to be allowed: %t, got %t instead", origin, allowed, got)
+			}
+		}
+	})
+}
+
+func TestWebHandlerAPIKey(t *testing.T) {
+	server := NewServer(nil)
+	server.APIKey = "secret"
+	ts := httptest.NewServer(server.WebHandler())
+	defer ts.Close()
+
+	data, _ := proto.Marshal(&pb.PingRequest{})
+	for authorization, expected := range map[string]string{
+		"":              "grpc-status: 16\r\n",
+		"Bearer wrong":  "grpc-status: 16\r\n",
+		"Bearer secret": "grpc-status: 0\r\n",
+	} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/rcs.CacheService/Ping", bytes.NewReader(webFrame(0, data)))
+		req.Header.Set("Content-Type", webContentType)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		raw, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("Expected %q for authorization %q, got %q instead", expected, authorization, raw)
+		}
+	}
+}
+
+// sendWebRequest posts a gRPC-Web request and returns the payloads of the response frames.
+func sendWebRequest(url string, body []byte, t *testing.T) [][]byte {
+	res, err := http.Post(url, webContentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	var frames [][]byte
+	for len(raw) >= 5 {
+		size := binary.BigEndian.Uint32(raw[1:5])
+		frames = append(frames, raw[5:5+size])
+		raw = raw[5+size:]
+	}
+	return frames
+}
@@ -6,25 +6,96 @@
 package httpsrv
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nmezhenskyi/rcs/internal/cache"
+	"github.com/nmezhenskyi/rcs/internal/version"
 	"github.com/rs/zerolog"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/net/websocket"
 )
 
+// DefaultMaxRawBytes is the default limit on the size of a value stored with PUT "/RAW/:key".
+const DefaultMaxRawBytes = 16 << 20
+
+// gzipMinBytes is the size below which responses are sent uncompressed, as the
+// gzip overhead would outweigh the savings.
+const gzipMinBytes = 1024
+
+// keysInfoLimit bounds the number of entries in KEYS?withsizes=true and EXPIRING
+// responses, like the KEYSINFO and EXPIRING commands of the native server.
+const keysInfoLimit = 1000
+
+// maxBatchKeys bounds the number of keys of MGET, MSET and MDELETE requests and
+// the number of ops of EXEC requests.
+const maxBatchKeys = 10000
+
+// maxTTLMillis is the largest TTL in milliseconds that fits in a time.Duration.
+const maxTTLMillis = math.MaxInt64 / int64(time.Millisecond)
+
+// msgpackContentType is the media type of MessagePack requests and responses,
+// see negotiate.
+const msgpackContentType = "application/msgpack"
+
 // Server implements RCS HTTP API according to specification.
 type Server struct {
-	server *http.Server
-	router *httprouter.Router
-	cache  *cache.CacheMap
+	server  *http.Server
+	router  *httprouter.Router
+	cache   *cache.CacheMap
+	started time.Time // Set by NewServer, uptime reported by "/HEALTH" is measured from it.
+
+	notReady atomic.Bool
+
+	mu    sync.Mutex
+	conns map[net.Conn]connInfo // Open connections, see trackConnState.
 
 	Logger zerolog.Logger // By defaut Logger is disabled, but can be manually attached.
+
+	// NotFoundOnMiss makes GET respond with 404 instead of 200 when the key is
+	// missing, the body still has ok false. Enabled by default.
+	NotFoundOnMiss bool
+
+	// MaxRawBytes limits the size of a value stored with PUT "/RAW/:key", larger
+	// bodies are rejected with 413. Set to DefaultMaxRawBytes by NewServer.
+	MaxRawBytes int64
+
+	// GzipLevel is the compression level of responses to clients that accept gzip,
+	// gzip.NoCompression disables compression. Set to gzip.DefaultCompression by
+	// NewServer, must not be changed once the server is started.
+	GzipLevel int
+	gzipPool  sync.Pool
+
+	// APIKey, if set, must be sent by every request in the "Authorization" header
+	// as "Bearer <key>", except for the health checks "/HEALTH" and "/readyz", so
+	// that probes need no credentials. Requests without it are rejected with 401,
+	// and "/HEALTH" reports only its status to them. Empty by default, which
+	// disables authentication.
+	APIKey string
+
+	// ConfirmPurge, if set, makes DELETE "/PURGE" refuse to empty the cache with 400
+	// unless the request has the query parameter "confirm=true", so that a stray
+	// request cannot wipe it. Disabled by default for compatibility.
+	ConfirmPurge bool
 }
 
 // NewServer initializes a new Server instance ready to be used and returns a pointer to it.
@@ -46,10 +117,19 @@ func NewServer(c *cache.CacheMap) *Server {
 				},
 			},
 		},
-		cache:  c,
-		Logger: zerolog.New(os.Stderr).Level(zerolog.Disabled),
+		cache:          c,
+		started:        time.Now(),
+		conns:          make(map[net.Conn]connInfo),
+		Logger:         zerolog.New(os.Stderr).Level(zerolog.Disabled),
+		NotFoundOnMiss: true,
+		MaxRawBytes:    DefaultMaxRawBytes,
+		GzipLevel:      gzip.DefaultCompression,
 	}
+	// Routes sharing a prefix, like /SET/:key and /SETNX/:key, would otherwise make
+	// the router redirect a request with an empty key to a path that does not exist.
+	s.router.RedirectTrailingSlash = false
 	s.server.Handler = s.router
+	s.server.ConnState = s.trackConnState
 	s.setupRoutes()
 	return s
 }
@@ -124,14 +204,83 @@ func (s *Server) Close() error {
 	return err
 }
 
+// ActiveConns returns the number of open connections, including idle keep-alive ones.
+// Hijacked connections, e.g. WebSocket ones, are no longer counted.
+func (s *Server) ActiveConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// SetReady changes the status reported by the "/readyz" end-point. A server is
+// ready once created. Marking it as not ready lets load balancers stop routing
+// to it before Shutdown starts draining connections.
+func (s *Server) SetReady(ready bool) {
+	s.notReady.Store(!ready)
+}
+
+// EnableWebSocket registers the "/ws" end-point. Every accepted WebSocket connection is
+// passed to serveConn, which is expected to block until the connection is done, e.g.
+// nativesrv.Server.ServeConn to tunnel RCSP. Each RCSP message travels in a single frame
+// and responses are sent as binary frames. Must be called before the server is started.
+//
+// Browsers do not preflight WebSocket handshakes, so connections with an Origin header
+// are accepted only if it matches the requested host. Clients that send no Origin,
+// i.e. non-browser clients, are always accepted.
+func (s *Server) EnableWebSocket(serveConn func(net.Conn)) {
+	s.router.Handler(http.MethodGet, "/ws", websocket.Server{
+		Handshake: checkSameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			s.Logger.Debug().Msg("received websocket connection from " + ws.Request().RemoteAddr)
+			ws.PayloadType = websocket.BinaryFrame
+			serveConn(&wsConn{Conn: ws, remoteAddr: wsAddr(ws.Request().RemoteAddr)})
+		},
+	})
+}
+
+// EnableGRPCWeb routes POST and OPTIONS (CORS preflight) requests for "/<service>/:method"
+// to handler, e.g. grpcsrv.Server.WebHandler to serve gRPC-Web. Must be called before
+// the server is started.
+func (s *Server) EnableGRPCWeb(service string, handler http.Handler) {
+	s.router.Handler(http.MethodPost, "/"+service+"/:method", handler)
+	s.router.Handler(http.MethodOptions, "/"+service+"/:method", handler)
+}
+
 func (s *Server) setupRoutes() {
-	s.router.PUT("/SET/:key", s.handleSet())
-	s.router.GET("/GET/:key", s.handleGet())
-	s.router.DELETE("/DELETE/:key", s.handleDelete())
-	s.router.DELETE("/PURGE", s.handlePurge())
-	s.router.GET("/LENGTH", s.handleLength())
-	s.router.GET("/KEYS", s.handleKeys())
-	s.router.GET("/PING", s.handlePing())
+	// All routes but the health checks require the API key, if one is set.
+	api := func(h httprouter.Handle) httprouter.Handle { return s.compress(s.negotiate(s.authenticate(h))) }
+	s.router.PUT("/SET/:key", api(s.handleSet()))
+	s.router.GET("/GET/:key", api(s.handleGet()))
+	s.router.GET("/RAW/:key", api(s.handleGetRaw()))
+	s.router.PUT("/RAW/:key", api(s.handleSetRaw()))
+	s.router.POST("/MGET", api(s.handleGetMany()))
+	s.router.PUT("/MSET", api(s.handleSetMany()))
+	s.router.POST("/MDELETE", api(s.handleDeleteMany()))
+	s.router.POST("/EXEC", api(s.handleExec()))
+	s.router.GET("/EXISTS/:key", api(s.handleExists()))
+	s.router.GET("/TTL/:key", api(s.handleTTL()))
+	s.router.POST("/TOUCH/:key", api(s.handleTouch()))
+	s.router.POST("/PERSIST/:key", api(s.handlePersist()))
+	s.router.PUT("/SETNX/:key", api(s.handleSetNX()))
+	s.router.PUT("/GETSET/:key", api(s.handleGetSet()))
+	s.router.POST("/CAS/:key", api(s.handleCompareAndSwap()))
+	s.router.DELETE("/DELETE/:key", api(s.handleDelete()))
+	s.router.POST("/INCR/:key", api(s.handleIncrDecr("INCR")))
+	s.router.POST("/DECR/:key", api(s.handleIncrDecr("DECR")))
+	s.router.DELETE("/PURGE", api(s.handlePurge()))
+	s.router.DELETE("/DELEXPIRED", api(s.handleDeleteExpired()))
+	s.router.POST("/EXPIREMATCHING", api(s.handleExpireMatching()))
+	s.router.GET("/LENGTH", api(s.handleLength()))
+	s.router.GET("/STATS", api(s.handleStats()))
+	s.router.GET("/KEYS", api(s.handleKeys()))
+	s.router.GET("/SCAN", api(s.handleScan()))
+	s.router.GET("/EXPIRING", api(s.handleExpiring()))
+	s.router.GET("/TTLHIST", api(s.handleTTLHistogram()))
+	s.router.GET("/CLIENTS", api(s.handleClients()))
+	s.router.GET("/PING", api(s.handlePing()))
+	s.router.GET("/INFO", api(s.handleInfo()))
+	s.router.GET("/HEALTH", s.compress(s.negotiate(s.handleHealth())))
+	s.router.GET("/readyz", s.compress(s.negotiate(s.handleReadyz())))
 }
 
 func (s *Server) handleSet() httprouter.Handle {
@@ -142,12 +291,12 @@ func (s *Server) handleSet() httprouter.Handle {
 		s.Logger.Debug().Msg("received http PUT \"/SET/:key\" request from " + req.RemoteAddr)
 
 		key := p.ByName("key")
-		if key == "" {
-			sendBadRequest(w, "SET", "Key cannot be empty")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "SET", keyMessage(err))
 			return
 		}
 		reqData := request{}
-		err := json.NewDecoder(req.Body).Decode(&reqData)
+		err := decodeBody(req, &reqData)
 		if err != nil {
 			sendBadRequest(w, "SET", "Failed to decode request body")
 			return
@@ -156,15 +305,154 @@ func (s *Server) handleSet() httprouter.Handle {
 			sendBadRequest(w, "SET", "Value cannot be empty")
 			return
 		}
+		if s.cache.CheckValueSize([]byte(reqData.Value)) != nil {
+			sendValueTooLarge(w, "SET", key)
+			return
+		}
 
-		s.cache.Set(key, []byte(reqData.Value))
+		keepTTL := req.URL.Query().Get("keepttl") == "true"
+		xx := req.URL.Query().Get("xx") == "true"
+		if keepTTL && xx {
+			sendBadRequest(w, "SET", "keepttl cannot be combined with xx")
+			return
+		}
+
+		var existed bool
+		if xx {
+			if !s.cache.SetXX(key, []byte(reqData.Value)) {
+				send(w, 200, httpResponse{Command: "SET", Message: "Key does not exist", Key: key, Ok: false})
+				return
+			}
+			existed = true
+		} else if keepTTL {
+			existed = s.cache.SetKeepTTL(key, []byte(reqData.Value))
+		} else {
+			existed = s.cache.SetReportExisting(key, []byte(reqData.Value))
+		}
 
 		res := httpResponse{
 			Command: "SET",
 			Key:     key,
+			Existed: existed,
 			Ok:      true,
 		}
-		sendJSON(w, 200, res)
+		send(w, 200, res)
+	}
+}
+
+func (s *Server) handleSetNX() httprouter.Handle {
+	type request struct {
+		Value string `json:"value"`
+		TTL   int64  `json:"ttl"` // In milliseconds, if zero, the key never expires.
+	}
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http PUT \"/SETNX/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "SETNX", keyMessage(err))
+			return
+		}
+		reqData := request{}
+		err := decodeBody(req, &reqData)
+		if err != nil {
+			sendBadRequest(w, "SETNX", "Failed to decode request body")
+			return
+		}
+		if len(reqData.Value) == 0 {
+			sendBadRequest(w, "SETNX", "Value cannot be empty")
+			return
+		}
+		if s.cache.CheckValueSize([]byte(reqData.Value)) != nil {
+			sendValueTooLarge(w, "SETNX", key)
+			return
+		}
+		if reqData.TTL < 0 {
+			sendBadRequest(w, "SETNX", "TTL cannot be negative")
+			return
+		}
+		if reqData.TTL > maxTTLMillis {
+			sendBadRequest(w, "SETNX", "TTL is too large")
+			return
+		}
+
+		if !s.cache.SetNXEx(key, []byte(reqData.Value), time.Duration(reqData.TTL)*time.Millisecond) {
+			send(w, 200, httpResponse{Command: "SETNX", Message: "Key already exists", Key: key, Ok: false})
+			return
+		}
+		send(w, 200, httpResponse{Command: "SETNX", Key: key, Ok: true})
+	}
+}
+
+func (s *Server) handleGetSet() httprouter.Handle {
+	type request struct {
+		Value string `json:"value"`
+	}
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http PUT \"/GETSET/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "GETSET", keyMessage(err))
+			return
+		}
+		reqData := request{}
+		err := decodeBody(req, &reqData)
+		if err != nil {
+			sendBadRequest(w, "GETSET", "Failed to decode request body")
+			return
+		}
+		if len(reqData.Value) == 0 {
+			sendBadRequest(w, "GETSET", "Value cannot be empty")
+			return
+		}
+		if s.cache.CheckValueSize([]byte(reqData.Value)) != nil {
+			sendValueTooLarge(w, "GETSET", key)
+			return
+		}
+
+		old, existed := s.cache.GetSet(key, []byte(reqData.Value))
+		res := httpResponse{Command: "GETSET", Key: key, Existed: existed, Ok: true}
+		if existed {
+			res.Value = wireValue(w, old)
+		}
+		send(w, 200, res)
+	}
+}
+
+func (s *Server) handleCompareAndSwap() httprouter.Handle {
+	type request struct {
+		Expected string `json:"expected"`
+		Value    string `json:"value"`
+	}
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http POST \"/CAS/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "CAS", keyMessage(err))
+			return
+		}
+		reqData := request{}
+		err := decodeBody(req, &reqData)
+		if err != nil {
+			sendBadRequest(w, "CAS", "Failed to decode request body")
+			return
+		}
+		if len(reqData.Value) == 0 {
+			sendBadRequest(w, "CAS", "Value cannot be empty")
+			return
+		}
+		if s.cache.CheckValueSize([]byte(reqData.Value)) != nil {
+			sendValueTooLarge(w, "CAS", key)
+			return
+		}
+
+		if !s.cache.CompareAndSwap(key, []byte(reqData.Expected), []byte(reqData.Value)) {
+			send(w, 200, httpResponse{Command: "CAS", Message: "Value does not match", Key: key, Ok: false})
+			return
+		}
+		send(w, 200, httpResponse{Command: "CAS", Key: key, Ok: true})
 	}
 }
 
@@ -173,20 +461,347 @@ func (s *Server) handleGet() httprouter.Handle {
 		s.Logger.Debug().Msg("received http GET \"/GET/:key\" request from " + req.RemoteAddr)
 
 		key := p.ByName("key")
-		if key == "" {
-			sendBadRequest(w, "GET", "Key cannot be empty")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "GET", keyMessage(err))
 			return
 		}
 
-		value, ok := s.cache.Get(key)
+		value, info, ok := s.cache.GetInfo(key)
+		if ok && notModified(w, req, weakETag(value)) {
+			return
+		}
 
 		res := httpResponse{
 			Command: "GET",
 			Key:     key,
-			Value:   string(value),
+			Value:   wireValue(w, value),
 			Ok:      ok,
 		}
-		sendJSON(w, 200, res)
+		if ok {
+			ttl, modified := info.TTL.Milliseconds(), info.Modified.UnixMilli()
+			res.TTL = &ttl
+			res.Modified = &modified
+		}
+		if !ok && s.NotFoundOnMiss {
+			send(w, 404, res)
+			return
+		}
+		send(w, 200, res)
+	}
+}
+
+func (s *Server) handleGetRaw() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/RAW/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			http.Error(w, keyMessage(err), http.StatusBadRequest)
+			return
+		}
+		value, ok := s.cache.Get(key)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if notModified(w, req, etag(value)) {
+			return
+		}
+
+		contentType := req.URL.Query().Get("type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			http.Error(w, "Invalid type", http.StatusBadRequest)
+			return
+		}
+		if scriptable(mediaType) {
+			// Stored values must not run as a page of this origin.
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(value)
+	}
+}
+
+// scriptable reports whether browsers may run scripts of a document of the given
+// media type, e.g. text/html or image/svg+xml.
+func scriptable(mediaType string) bool {
+	return mediaType == "text/html" || strings.HasSuffix(mediaType, "/xml") ||
+		strings.HasSuffix(mediaType, "+xml") || strings.Contains(mediaType, "javascript") ||
+		strings.Contains(mediaType, "ecmascript")
+}
+
+func (s *Server) handleSetRaw() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http PUT \"/RAW/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			http.Error(w, keyMessage(err), http.StatusBadRequest)
+			return
+		}
+		value, err := io.ReadAll(http.MaxBytesReader(w, req.Body, s.MaxRawBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Value is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(value) == 0 {
+			http.Error(w, "Value cannot be empty", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.cache.Set(key, value); err != nil {
+			http.Error(w, "Value is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleGetMany() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http POST \"/MGET\" request from " + req.RemoteAddr)
+
+		var keys []string
+		err := decodeBody(req, &keys)
+		if err != nil {
+			sendBadRequest(w, "MGET", "Failed to decode request body")
+			return
+		}
+		if len(keys) > maxBatchKeys {
+			sendBadRequest(w, "MGET", "Too many keys")
+			return
+		}
+		for _, key := range keys {
+			if err := s.cache.ValidateKey(key); err != nil {
+				send(w, 400, httpResponse{Command: "MGET", Message: keyMessage(err), Key: key, Ok: false})
+				return
+			}
+		}
+
+		send(w, 200, httpResponse{Command: "MGET", Value: s.cache.GetMany(keys), Ok: true})
+	}
+}
+
+func (s *Server) handleSetMany() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http PUT \"/MSET\" request from " + req.RemoteAddr)
+
+		var items map[string][]byte
+		err := decodeBody(req, &items)
+		if err != nil {
+			sendBadRequest(w, "MSET", "Failed to decode request body")
+			return
+		}
+		if len(items) > maxBatchKeys {
+			sendBadRequest(w, "MSET", "Too many keys")
+			return
+		}
+		for key, value := range items {
+			if len(value) == 0 {
+				send(w, 400, httpResponse{Command: "MSET", Message: "Value cannot be empty", Key: key, Ok: false})
+				return
+			}
+		}
+
+		if err := s.cache.SetMany(items); err == cache.ErrValueTooLarge {
+			sendValueTooLarge(w, "MSET", "")
+			return
+		} else if err != nil {
+			sendBadRequest(w, "MSET", keyMessage(err))
+			return
+		}
+		send(w, 200, httpResponse{Command: "MSET", Ok: true})
+	}
+}
+
+func (s *Server) handleDeleteMany() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http POST \"/MDELETE\" request from " + req.RemoteAddr)
+
+		var keys []string
+		err := decodeBody(req, &keys)
+		if err != nil {
+			sendBadRequest(w, "MDELETE", "Failed to decode request body")
+			return
+		}
+		if len(keys) > maxBatchKeys {
+			sendBadRequest(w, "MDELETE", "Too many keys")
+			return
+		}
+		for _, key := range keys {
+			if err := s.cache.ValidateKey(key); err != nil {
+				send(w, 400, httpResponse{Command: "MDELETE", Message: keyMessage(err), Key: key, Ok: false})
+				return
+			}
+		}
+
+		deleted := int64(s.cache.DeleteMany(keys))
+		send(w, 200, httpResponse{Command: "MDELETE", Count: &deleted, Ok: true})
+	}
+}
+
+func (s *Server) handleExec() httprouter.Handle {
+	type op struct {
+		Op       string `json:"op"`
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		Expected string `json:"expected"`
+		TTL      int64  `json:"ttl"` // In milliseconds, if zero, the key never expires.
+	}
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http POST \"/EXEC\" request from " + req.RemoteAddr)
+
+		var reqData []op
+		err := decodeBody(req, &reqData)
+		if err != nil {
+			sendBadRequest(w, "EXEC", "Failed to decode request body")
+			return
+		}
+		if len(reqData) > maxBatchKeys {
+			sendBadRequest(w, "EXEC", "Too many ops")
+			return
+		}
+		ops := make([]cache.Op, 0, len(reqData))
+		for _, o := range reqData {
+			opType, ok := execOpTypes[o.Op]
+			if !ok {
+				send(w, 400, httpResponse{Command: "EXEC", Message: "Unknown op", Key: o.Key, Ok: false})
+				return
+			}
+			if err := s.cache.ValidateKey(o.Key); err != nil {
+				sendBadRequest(w, "EXEC", keyMessage(err))
+				return
+			}
+			if opType != cache.OpDelete {
+				if len(o.Value) == 0 {
+					send(w, 400, httpResponse{Command: "EXEC", Message: "Value cannot be empty", Key: o.Key, Ok: false})
+					return
+				}
+				if s.cache.CheckValueSize([]byte(o.Value)) != nil {
+					sendValueTooLarge(w, "EXEC", o.Key)
+					return
+				}
+			}
+			if o.TTL < 0 {
+				send(w, 400, httpResponse{Command: "EXEC", Message: "TTL cannot be negative", Key: o.Key, Ok: false})
+				return
+			}
+			if o.TTL > maxTTLMillis {
+				send(w, 400, httpResponse{Command: "EXEC", Message: "TTL is too large", Key: o.Key, Ok: false})
+				return
+			}
+			ops = append(ops, cache.Op{
+				Type:     opType,
+				Key:      o.Key,
+				Value:    []byte(o.Value),
+				Expected: []byte(o.Expected),
+				TTL:      time.Duration(o.TTL) * time.Millisecond,
+			})
+		}
+
+		n, err := s.cache.Transaction(ops)
+		count := int64(n)
+		if err != nil {
+			res := httpResponse{Command: "EXEC", Message: "Precondition failed", Key: ops[n].Key, Count: &count, Ok: false}
+			send(w, 200, res)
+			return
+		}
+		send(w, 200, httpResponse{Command: "EXEC", Count: &count, Ok: true})
+	}
+}
+
+func (s *Server) handleExists() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/EXISTS/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "EXISTS", keyMessage(err))
+			return
+		}
+
+		send(w, 200, httpResponse{Command: "EXISTS", Key: key, Ok: s.cache.Exists(key)})
+	}
+}
+
+func (s *Server) handleTTL() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/TTL/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "TTL", keyMessage(err))
+			return
+		}
+
+		ttl, ok := s.cache.TTL(key)
+		if !ok {
+			send(w, 200, httpResponse{Command: "TTL", Message: "Not found", Key: key, Ok: false})
+			return
+		}
+		ms := ttl.Milliseconds()
+		send(w, 200, httpResponse{Command: "TTL", Key: key, Count: &ms, Ok: true})
+	}
+}
+
+func (s *Server) handleTouch() httprouter.Handle {
+	type request struct {
+		TTL int64 `json:"ttl"` // In milliseconds.
+	}
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http POST \"/TOUCH/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "TOUCH", keyMessage(err))
+			return
+		}
+		reqData := request{}
+		err := decodeBody(req, &reqData)
+		if err != nil {
+			sendBadRequest(w, "TOUCH", "Failed to decode request body")
+			return
+		}
+		if reqData.TTL <= 0 || reqData.TTL > maxTTLMillis {
+			sendBadRequest(w, "TOUCH", "TTL is not a positive integer")
+			return
+		}
+
+		if !s.cache.Touch(key, time.Duration(reqData.TTL)*time.Millisecond) {
+			send(w, 200, httpResponse{Command: "TOUCH", Message: "Not found", Key: key, Ok: false})
+			return
+		}
+		send(w, 200, httpResponse{Command: "TOUCH", Key: key, Ok: true})
+	}
+}
+
+func (s *Server) handlePersist() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http POST \"/PERSIST/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "PERSIST", keyMessage(err))
+			return
+		}
+
+		if !s.cache.Persist(key) {
+			send(w, 200, httpResponse{Command: "PERSIST", Message: "Not found", Key: key, Ok: false})
+			return
+		}
+		send(w, 200, httpResponse{Command: "PERSIST", Key: key, Ok: true})
 	}
 }
 
@@ -195,8 +810,8 @@ func (s *Server) handleDelete() httprouter.Handle {
 		s.Logger.Debug().Msg("received http DELETE \"/DELETE/:key\" request from " + req.RemoteAddr)
 
 		key := p.ByName("key")
-		if key == "" {
-			sendBadRequest(w, "DELETE", "Key cannot be empty")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, "DELETE", keyMessage(err))
 			return
 		}
 
@@ -207,71 +822,691 @@ func (s *Server) handleDelete() httprouter.Handle {
 			Key:     key,
 			Ok:      true,
 		}
-		sendJSON(w, 200, res)
+		send(w, 200, res)
+	}
+}
+
+// handleIncrDecr handles both INCR and DECR, which only differ in the sign of the delta.
+func (s *Server) handleIncrDecr(command string) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		s.Logger.Debug().Msg("received http POST \"/" + command + "/:key\" request from " + req.RemoteAddr)
+
+		key := p.ByName("key")
+		if err := s.cache.ValidateKey(key); err != nil {
+			sendBadRequest(w, command, keyMessage(err))
+			return
+		}
+		delta := int64(1)
+		if param := req.URL.Query().Get("delta"); param != "" {
+			var err error
+			delta, err = strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				sendBadRequest(w, command, "Invalid delta")
+				return
+			}
+		}
+
+		var n int64
+		var err error
+		if command == "INCR" {
+			n, err = s.cache.Increment(key, delta)
+		} else {
+			n, err = s.cache.Decrement(key, delta)
+		}
+		if err == cache.ErrOverflow {
+			send(w, 200, httpResponse{Command: command, Message: "Value would overflow", Key: key, Ok: false})
+			return
+		}
+		if err != nil {
+			send(w, 200, httpResponse{Command: command, Message: "Value is not an integer", Key: key, Ok: false})
+			return
+		}
+		send(w, 200, httpResponse{Command: command, Key: key, Count: &n, Ok: true})
 	}
 }
 
 func (s *Server) handlePurge() httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		s.Logger.Debug().Msg("received http DELETE \"/PURGE\" request from " + req.RemoteAddr)
+
+		if s.ConfirmPurge && req.URL.Query().Get("confirm") != "true" {
+			sendBadRequest(w, "PURGE", "Purge must be confirmed")
+			return
+		}
+
 		s.cache.Purge()
 		res := httpResponse{
-			Command: "FLUSH",
+			Command: "PURGE",
 			Ok:      true,
 		}
-		sendJSON(w, 200, res)
+		send(w, 200, res)
+	}
+}
+
+func (s *Server) handleDeleteExpired() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http DELETE \"/DELEXPIRED\" request from " + req.RemoteAddr)
+
+		pattern := req.URL.Query().Get("pattern")
+		if pattern == "" {
+			sendBadRequest(w, "DELEXPIRED", "Pattern cannot be empty")
+			return
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			sendBadRequest(w, "DELEXPIRED", "Invalid pattern")
+			return
+		}
+
+		deleted := int64(s.cache.DeleteExpiredMatching(pattern))
+		send(w, 200, httpResponse{Command: "DELEXPIRED", Count: &deleted, Ok: true})
+	}
+}
+
+func (s *Server) handleExpireMatching() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http POST \"/EXPIREMATCHING\" request from " + req.RemoteAddr)
+
+		query := req.URL.Query()
+		pattern := query.Get("pattern")
+		if pattern == "" {
+			sendBadRequest(w, "EXPIREMATCHING", "Pattern cannot be empty")
+			return
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			sendBadRequest(w, "EXPIREMATCHING", "Invalid pattern")
+			return
+		}
+		ms, err := strconv.ParseInt(query.Get("ttl"), 10, 64)
+		if err != nil || ms <= 0 || ms > maxTTLMillis {
+			sendBadRequest(w, "EXPIREMATCHING", "TTL is not a positive integer")
+			return
+		}
+
+		updated := int64(s.cache.ExpireMatching(pattern, time.Duration(ms)*time.Millisecond))
+		send(w, 200, httpResponse{Command: "EXPIREMATCHING", Count: &updated, Ok: true})
 	}
 }
 
 func (s *Server) handleLength() httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		s.Logger.Debug().Msg("received http GET \"/LENGTH\" request from " + req.RemoteAddr)
-		length := s.cache.Length()
+		length := int64(s.cache.Length())
 		res := httpResponse{
 			Command: "LENGTH",
-			Value:   length,
+			Count:   &length,
 			Ok:      true,
 		}
-		sendJSON(w, 200, res)
+		send(w, 200, res)
+	}
+}
+
+func (s *Server) handleStats() httprouter.Handle {
+	type stats struct {
+		Hits      uint64 `json:"hits"`
+		Misses    uint64 `json:"misses"`
+		Length    int    `json:"length"`
+		Evictions uint64 `json:"evictions"`
+
+		TTLHistogram map[string]int `json:"ttlHistogram"`
+	}
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/STATS\" request from " + req.RemoteAddr)
+		st := s.cache.Stats()
+		value := stats{
+			Hits:         st.Hits,
+			Misses:       st.Misses,
+			Length:       st.Length,
+			Evictions:    st.Evictions,
+			TTLHistogram: histogramLabels(s.cache.TTLHistogram(cache.DefaultTTLBuckets)),
+		}
+		send(w, 200, httpResponse{Command: "STATS", Value: value, Ok: true})
 	}
 }
 
 func (s *Server) handleKeys() httprouter.Handle {
+	type keyInfo struct {
+		Key  string `json:"key"`
+		Size int    `json:"size"`
+		TTL  int64  `json:"ttl"` // In milliseconds, zero if the key never expires.
+	}
 	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		s.Logger.Debug().Msg("received http GET \"/KEYS\" request from " + req.RemoteAddr)
-		keys := s.cache.Keys()
+
+		query := req.URL.Query()
+		if query.Get("withsizes") == "true" {
+			limit := keysInfoLimit
+			if l := query.Get("limit"); l != "" {
+				n, err := strconv.Atoi(l)
+				if err != nil || n < 0 {
+					sendBadRequest(w, "KEYS", "Invalid limit")
+					return
+				}
+				if n > 0 && n < keysInfoLimit {
+					limit = n
+				}
+			}
+			infos := s.cache.KeysInfo(limit)
+			value := make([]keyInfo, len(infos))
+			for i, info := range infos {
+				value[i] = keyInfo{Key: info.Key, Size: info.Size, TTL: info.TTL.Milliseconds()}
+			}
+			send(w, 200, httpResponse{Command: "KEYS", Value: value, Ok: true})
+			return
+		}
+
+		var keys []string
+		if pattern := query.Get("pattern"); pattern == "" {
+			keys = s.cache.Keys()
+		} else {
+			if _, err := path.Match(pattern, ""); err != nil {
+				sendBadRequest(w, "KEYS", "Invalid pattern")
+				return
+			}
+			keys = s.cache.KeysMatching(pattern)
+		}
 		res := httpResponse{
 			Command: "KEYS",
 			Value:   keys,
 			Ok:      true,
 		}
-		sendJSON(w, 200, res)
+		send(w, 200, res)
+	}
+}
+
+func (s *Server) handleScan() httprouter.Handle {
+	type scanPage struct {
+		Cursor int      `json:"cursor"` // Zero once the iteration is complete.
+		Keys   []string `json:"keys"`
+	}
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/SCAN\" request from " + req.RemoteAddr)
+
+		query := req.URL.Query()
+		cursor, count := 0, 0
+		if c := query.Get("cursor"); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil || n < 0 {
+				sendBadRequest(w, "SCAN", "Invalid cursor")
+				return
+			}
+			cursor = n
+		}
+		if c := query.Get("count"); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil || n < 0 || n > cache.MaxScanCount {
+				sendBadRequest(w, "SCAN", "Invalid count")
+				return
+			}
+			count = n
+		}
+		keys, next, err := s.cache.Scan(cursor, count)
+		if err != nil {
+			sendBadRequest(w, "SCAN", "Invalid or expired cursor")
+			return
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+		send(w, 200, httpResponse{Command: "SCAN", Value: scanPage{Cursor: next, Keys: keys}, Ok: true})
+	}
+}
+
+func (s *Server) handleExpiring() httprouter.Handle {
+	type keyTTL struct {
+		Key string `json:"key"`
+		TTL int64  `json:"ttl"` // In milliseconds.
+	}
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/EXPIRING\" request from " + req.RemoteAddr)
+
+		n, err := strconv.Atoi(req.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			sendBadRequest(w, "EXPIRING", "Invalid n")
+			return
+		}
+		if n > keysInfoLimit {
+			n = keysInfoLimit
+		}
+		expiring := s.cache.ExpiringSoon(n)
+		value := make([]keyTTL, len(expiring))
+		for i, e := range expiring {
+			value[i] = keyTTL{Key: e.Key, TTL: e.TTL.Milliseconds()}
+		}
+		send(w, 200, httpResponse{Command: "EXPIRING", Value: value, Ok: true})
+	}
+}
+
+func (s *Server) handleTTLHistogram() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/TTLHIST\" request from " + req.RemoteAddr)
+
+		buckets := cache.DefaultTTLBuckets
+		if param := req.URL.Query().Get("buckets"); param != "" {
+			buckets = nil
+			for _, field := range strings.Split(param, ",") {
+				ms, err := strconv.ParseInt(field, 10, 64)
+				if err != nil || ms <= 0 || ms > maxTTLMillis {
+					sendBadRequest(w, "TTLHIST", "Invalid buckets")
+					return
+				}
+				buckets = append(buckets, time.Duration(ms)*time.Millisecond)
+			}
+		}
+		value := histogramLabels(s.cache.TTLHistogram(buckets))
+		send(w, 200, httpResponse{Command: "TTLHIST", Value: value, Ok: true})
+	}
+}
+
+func (s *Server) handleClients() httprouter.Handle {
+	type client struct {
+		Address   string `json:"address"`
+		Connected int64  `json:"connected"` // In milliseconds since the Unix epoch.
+	}
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/CLIENTS\" request from " + req.RemoteAddr)
+
+		clients := s.clients()
+		value := make([]client, len(clients))
+		for i, info := range clients {
+			value[i] = client{Address: info.remoteAddr, Connected: info.connected.UnixMilli()}
+		}
+		send(w, 200, httpResponse{Command: "CLIENTS", Value: value, Ok: true})
 	}
 }
 
 func (s *Server) handlePing() httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 		s.Logger.Debug().Msg("received http GET \"/PING\" request from " + req.RemoteAddr)
-		sendJSON(w, 200, httpResponse{Command: "PING", Message: "PONG", Ok: true})
+		send(w, 200, httpResponse{Command: "PING", Message: "PONG", Ok: true})
 	}
 }
 
+func (s *Server) handleInfo() httprouter.Handle {
+	type info struct {
+		Version     string `json:"version"`
+		Commit      string `json:"commit"`
+		BuildDate   string `json:"buildDate"`
+		Connections int    `json:"connections"` // Open connections of this server, see ActiveConns.
+	}
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		s.Logger.Debug().Msg("received http GET \"/INFO\" request from " + req.RemoteAddr)
+		value := info{
+			Version:     version.Version,
+			Commit:      version.Commit,
+			BuildDate:   version.BuildDate,
+			Connections: s.ActiveConns(),
+		}
+		send(w, 200, httpResponse{Command: "INFO", Value: value, Ok: true})
+	}
+}
+
+func (s *Server) handleHealth() httprouter.Handle {
+	type response struct {
+		Status      string `json:"status"`
+		Uptime      *int64 `json:"uptime,omitempty"` // In milliseconds.
+		CacheLength *int   `json:"cacheLength,omitempty"`
+	}
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		res := response{Status: "ok"}
+		// Unlike the status, the details are only reported with the API key.
+		if s.authorized(req) {
+			uptime, length := time.Since(s.started).Milliseconds(), s.cache.Length()
+			res.Uptime, res.CacheLength = &uptime, &length
+		}
+		send(w, 200, res)
+	}
+}
+
+func (s *Server) handleReadyz() httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		if s.notReady.Load() {
+			send(w, 503, httpResponse{Command: "READYZ", Message: "Not ready", Ok: false})
+			return
+		}
+		send(w, 200, httpResponse{Command: "READYZ", Message: "Ready", Ok: true})
+	}
+}
+
+func (s *Server) trackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		s.mu.Lock()
+		s.conns[conn] = connInfo{remoteAddr: conn.RemoteAddr().String(), connected: time.Now()}
+		s.mu.Unlock()
+	case http.StateHijacked, http.StateClosed:
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}
+}
+
+// connInfo describes an open connection, see "/CLIENTS".
+type connInfo struct {
+	remoteAddr string
+	connected  time.Time
+}
+
+// clients returns copies of the descriptions of the open connections, from the
+// longest to the most recently connected.
+func (s *Server) clients() []connInfo {
+	s.mu.Lock()
+	clients := make([]connInfo, 0, len(s.conns))
+	for _, info := range s.conns {
+		clients = append(clients, info)
+	}
+	s.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].connected.Before(clients[j].connected) })
+	return clients
+}
+
+// authenticate wraps h so that requests without the API key are rejected, if
+// one is set.
+func (s *Server) authenticate(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		if !s.authorized(req) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			send(w, 401, httpResponse{Command: "AUTH", Message: "Invalid API key", Ok: false})
+			return
+		}
+		h(w, req, p)
+	}
+}
+
+// authorized reports whether req carries the API key, or none is set.
+func (s *Server) authorized(req *http.Request) bool {
+	return s.APIKey == "" || subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+s.APIKey)) == 1
+}
+
+// negotiate wraps h so that its response is encoded as MessagePack instead of
+// JSON if the Accept header of the request asks for it.
+func (s *Server) negotiate(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		w.Header().Add("Vary", "Accept")
+		if acceptsMsgpack(req) {
+			w = msgpackResponseWriter{w}
+		}
+		h(w, req, p)
+	}
+}
+
+// acceptsMsgpack reports whether the Accept header of req lists MessagePack.
+func acceptsMsgpack(req *http.Request) bool {
+	for _, header := range req.Header.Values("Accept") {
+		for _, accepted := range strings.Split(header, ",") {
+			if mediaType(accepted) == msgpackContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mediaType returns the media type of a Content-Type or Accept entry without
+// its parameters, in lower case.
+func mediaType(value string) string {
+	name, _, _ := strings.Cut(value, ";")
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// msgpackResponseWriter marks the response of a client that accepts MessagePack,
+// so that send encodes it as such.
+type msgpackResponseWriter struct {
+	http.ResponseWriter
+}
+
+// compress wraps h so that its response is gzip-compressed if the client accepts
+// gzip and the response is at least gzipMinBytes long.
+func (s *Server) compress(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		if s.GzipLevel == gzip.NoCompression {
+			h(w, req, p)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(req) {
+			h(w, req, p)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, pool: &s.gzipPool, level: s.GzipLevel}
+		defer gw.close()
+		h(gw, req, p)
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of req allows gzip.
+func acceptsGzip(req *http.Request) bool {
+	for _, header := range req.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if strings.TrimSpace(name) != "gzip" {
+				continue
+			}
+			key, value, ok := strings.Cut(params, "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				return true
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the response until it reaches gzipMinBytes, then
+// compresses it. Shorter responses are written as they are by close.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	pool  *sync.Pool
+	level int
+
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	plain  bool // Set if the level is invalid, the response is then sent uncompressed.
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	if w.plain {
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < gzipMinBytes {
+		return len(p), nil
+	}
+
+	buf := w.buf
+	w.buf = nil
+	if gz, ok := w.pool.Get().(*gzip.Writer); ok {
+		gz.Reset(w.ResponseWriter)
+		w.gz = gz
+	} else if gz, err := gzip.NewWriterLevel(w.ResponseWriter, w.level); err == nil {
+		w.gz = gz
+	} else {
+		w.plain = true
+		w.writeHeader()
+		if _, err := w.ResponseWriter.Write(buf); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	h := w.ResponseWriter.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	// The compressed body differs from the uncompressed one byte for byte.
+	if tag := h.Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+		h.Set("ETag", "W/"+tag)
+	}
+	w.writeHeader()
+	if _, err := w.gz.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *gzipResponseWriter) writeHeader() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		w.pool.Put(w.gz)
+		return
+	}
+	if w.plain {
+		return
+	}
+	w.writeHeader()
+	if len(w.buf) > 0 {
+		w.ResponseWriter.Write(w.buf)
+	}
+}
+
+func checkSameOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != req.Host {
+		return errCrossOrigin
+	}
+	config.Origin = origin
+	return nil
+}
+
+// wsConn reports the address of the peer as its RemoteAddr, since
+// websocket.Conn returns the Origin of the handshake on the server side.
+type wsConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+var errCrossOrigin = errors.New("cross-origin websocket connection")
+
 type httpResponse struct {
-	Command string `json:"command"`
-	Message string `json:"message,omitempty"`
-	Key     string `json:"key,omitempty"`
-	Value   any    `json:"value,omitempty"`
-	Ok      bool   `json:"ok"`
+	Command  string `json:"command"`
+	Message  string `json:"message,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Value    any    `json:"value,omitempty"`
+	Count    *int64 `json:"count,omitempty"` // Used by numeric responses instead of Value, sent even if zero.
+	Existed  bool   `json:"existed,omitempty"`
+	TTL      *int64 `json:"ttl_ms,omitempty"`      // Remaining time to live of a found key, 0 if it never expires.
+	Modified *int64 `json:"modified_ms,omitempty"` // Time a found key was last written, in Unix milliseconds.
+	Ok       bool   `json:"ok"`
 }
 
-func sendJSON(w http.ResponseWriter, statusCode int, body any) {
+// send writes body as JSON, or as MessagePack if the client has asked for it,
+// see negotiate.
+func send(w http.ResponseWriter, statusCode int, body any) {
+	if body == nil {
+		body = struct{}{}
+	}
+	if _, ok := w.(msgpackResponseWriter); ok {
+		w.Header().Set("Content-Type", msgpackContentType)
+		w.WriteHeader(statusCode)
+		enc := msgpack.NewEncoder(w)
+		enc.SetCustomStructTag("json")
+		enc.Encode(body)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(statusCode)
-	if body != nil {
-		json.NewEncoder(w).Encode(body)
-	} else {
-		json.NewEncoder(w).Encode(struct{}{})
+	json.NewEncoder(w).Encode(body)
+}
+
+// wireValue returns a stored value in the form it is sent in: as raw bytes with
+// MessagePack, and as a string with JSON.
+func wireValue(w http.ResponseWriter, value []byte) any {
+	if _, ok := w.(msgpackResponseWriter); ok {
+		return value
+	}
+	return string(value)
+}
+
+// decodeBody decodes the body of req into v as MessagePack if its Content-Type
+// says so, and as JSON otherwise. Struct fields are named by their json tags in
+// both formats.
+func decodeBody(req *http.Request, v any) error {
+	if mediaType(req.Header.Get("Content-Type")) == msgpackContentType {
+		dec := msgpack.NewDecoder(req.Body)
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	}
+	return json.NewDecoder(req.Body).Decode(v)
+}
+
+// etag returns a strong entity tag of value. Hashing a value on read is no more
+// expensive than sending it, so tags are not stored alongside the items.
+func etag(value []byte) string {
+	h := fnv.New64a()
+	h.Write(value)
+	return `"` + strconv.FormatUint(h.Sum64(), 16) + `"`
+}
+
+// weakETag returns a weak entity tag of value, for responses that carry more than
+// the value, e.g. its TTL, or that are encoded differently depending on the request.
+// Such responses are equivalent rather than identical while the value is unchanged.
+func weakETag(value []byte) string {
+	return "W/" + etag(value)
+}
+
+// notModified sets the ETag header of the response to tag and, if the
+// If-None-Match header of req matches it, responds with 304 and reports true.
+// Tags are compared weakly, as If-None-Match requires.
+func notModified(w http.ResponseWriter, req *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	opaque := strings.TrimPrefix(tag, "W/")
+	for _, candidate := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == opaque || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// execOpTypes maps the names of the ops accepted by EXEC to their types.
+var execOpTypes = map[string]cache.OpType{
+	"SET":    cache.OpSet,
+	"DELETE": cache.OpDelete,
+	"SETNX":  cache.OpSetNX,
+	"CAS":    cache.OpCAS,
+}
+
+// histogramLabels keys a TTL histogram by bucket bound in milliseconds, "+Inf" for
+// keys beyond the largest bound and "never" for keys that never expire.
+func histogramLabels(histogram map[time.Duration]int) map[string]int {
+	labels := make(map[string]int, len(histogram))
+	for bound, count := range histogram {
+		switch bound {
+		case cache.NoExpiryBucket:
+			labels["never"] = count
+		case cache.OverflowBucket:
+			labels["+Inf"] = count
+		default:
+			labels[strconv.FormatInt(bound.Milliseconds(), 10)] = count
+		}
 	}
+	return labels
 }
 
 func sendBadRequest(w http.ResponseWriter, command, message string) {
@@ -280,5 +1515,18 @@ func sendBadRequest(w http.ResponseWriter, command, message string) {
 		Message: message,
 		Ok:      false,
 	}
-	sendJSON(w, 400, res)
+	send(w, 400, res)
+}
+
+// keyMessage returns the message of the response to a key rejected by ValidateKey.
+func keyMessage(err error) string {
+	if err == cache.ErrKeyTooLong {
+		return "Key is too long"
+	}
+	return "Key cannot be empty"
+}
+
+// sendValueTooLarge responds with 413 to a write of a value over the limit of the cache.
+func sendValueTooLarge(w http.ResponseWriter, command, key string) {
+	send(w, 413, httpResponse{Command: command, Message: "Value is too large", Key: key, Ok: false})
 }
@@ -4,17 +4,24 @@ package httpsrv
 
 import (
 	"context"
+	"net"
+	"net/http"
 
 	"github.com/nmezhenskyi/rcs/internal/cache"
 	"github.com/rs/zerolog"
 )
 
 type Server struct {
-	Logger zerolog.Logger
+	Logger         zerolog.Logger
+	NotFoundOnMiss bool
+	MaxRawBytes    int64
+	GzipLevel      int
+	APIKey         string
+	ConfirmPurge   bool
 }
 
 func NewServer(_ *cache.CacheMap) *Server {
-	return &Server{}
+	return &Server{NotFoundOnMiss: true}
 }
 
 func (s *Server) ListenAndServe(addr string) error {
@@ -32,3 +39,13 @@ func (s *Server) Shutdown(ctx context.Context) error {
 func (s *Server) Close(ctx context.Context) error {
 	return nil
 }
+
+func (s *Server) ActiveConns() int {
+	return 0
+}
+
+func (s *Server) SetReady(ready bool) {}
+
+func (s *Server) EnableWebSocket(serveConn func(net.Conn)) {}
+
+func (s *Server) EnableGRPCWeb(service string, handler http.Handler) {}
@@ -4,16 +4,26 @@ package httpsrv
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/nmezhenskyi/rcs/internal/cache"
+	"github.com/nmezhenskyi/rcs/internal/nativesrv"
+	"github.com/nmezhenskyi/rcs/internal/version"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/net/websocket"
 )
 
 func TestNewServer(t *testing.T) {
@@ -76,6 +86,75 @@ func TestShutdown(t *testing.T) {
 	}
 }
 
+func TestActiveConns(t *testing.T) {
+	srv := NewServer(nil)
+	go srv.ListenAndServe("localhost:6123")
+	defer srv.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", "localhost:6123")
+		if err != nil {
+			t.Fatalf("Failed to connect to the server: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitForConns(srv, 3, t)
+
+	conns[0].Close()
+	waitForConns(srv, 2, t)
+}
+
+func TestClients(t *testing.T) {
+	srv := NewServer(nil)
+	go srv.ListenAndServe("localhost:6123")
+	defer srv.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "localhost:6123")
+		if err != nil {
+			t.Fatalf("Failed to connect to the server: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitForConns(srv, 2, t)
+
+	res, err := http.Get("http://localhost:6123/CLIENTS")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer res.Body.Close()
+	resData := struct {
+		Value []struct {
+			Address   string `json:"address"`
+			Connected int64  `json:"connected"`
+		} `json:"value"`
+		Ok bool `json:"ok"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	listed := make(map[string]bool)
+	for _, client := range resData.Value {
+		if client.Connected <= 0 {
+			t.Errorf("Expected the time of the connection, got %v instead", client)
+		}
+		listed[client.Address] = true
+	}
+	// The connection that sent the request is listed as well.
+	if !resData.Ok || len(listed) != 3 {
+		t.Errorf("Expected 3 clients, got %v instead", resData)
+	}
+	for _, conn := range conns {
+		if !listed[conn.LocalAddr().String()] {
+			t.Errorf("Expected %s to be listed, got %v instead", conn.LocalAddr(), resData.Value)
+		}
+	}
+}
+
 func TestSet(t *testing.T) {
 	server := NewServer(nil)
 
@@ -84,6 +163,7 @@ func TestSet(t *testing.T) {
 		key          string
 		value        []byte
 		expectedCode int
+		existed      bool
 	}{
 		{
 			name:         "Empty key, no value",
@@ -103,6 +183,13 @@ func TestSet(t *testing.T) {
 			value:        []byte("10"),
 			expectedCode: http.StatusOK,
 		},
+		{
+			name:         "Valid key, valid value, overwrite",
+			key:          "key1",
+			value:        []byte("20"),
+			expectedCode: http.StatusOK,
+			existed:      true,
+		},
 	}
 
 	type request struct {
@@ -124,10 +211,70 @@ func TestSet(t *testing.T) {
 			if code := res.Result().StatusCode; code != tc.expectedCode {
 				t.Errorf("Expected response status code %d, got %d instead", tc.expectedCode, code)
 			}
+			resData := struct {
+				Existed bool `json:"existed"`
+			}{}
+			json.NewDecoder(res.Body).Decode(&resData)
+			if resData.Existed != tc.existed {
+				t.Errorf("Expected existed to be %t, got %t instead", tc.existed, resData.Existed)
+			}
 		})
 	}
 }
 
+func TestSetKeepTTL(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.SetEx("key1", []byte("10"), time.Minute)
+
+	for _, url := range []string{"/SET/key1?keepttl=true", "/SET/key1"} {
+		byteData, _ := json.Marshal(map[string]string{"value": base64.StdEncoding.EncodeToString([]byte("20"))})
+		res, err := sendRequest("PUT", url, bytes.NewReader(byteData), server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != http.StatusOK {
+			t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+		}
+		info := server.cache.KeysInfo(0)
+		if url == "/SET/key1" {
+			if len(info) != 1 || info[0].TTL != 0 {
+				t.Errorf("Expected SET without keepttl to clear the TTL, got %v instead", info)
+			}
+		} else if len(info) != 1 || info[0].TTL <= 0 || info[0].TTL > time.Minute {
+			t.Errorf("Expected TTL within (0, 1m] to survive the overwrite, got %v instead", info)
+		}
+	}
+}
+
+func TestSetXX(t *testing.T) {
+	server := NewServer(nil)
+	byteData, _ := json.Marshal(map[string]string{"value": base64.StdEncoding.EncodeToString([]byte("20"))})
+
+	res, err := sendRequest("PUT", "/SET/key1?xx=true", bytes.NewReader(byteData), server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	resData := httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if resData.Ok {
+		t.Error("Expected SET with xx to refuse a missing key")
+	}
+	if server.cache.Length() != 0 {
+		t.Error("Expected missing key not to be created")
+	}
+
+	server.cache.Set("key1", []byte("10"))
+	res, err = sendRequest("PUT", "/SET/key1?xx=true", bytes.NewReader(byteData), server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	resData = httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if !resData.Ok || !resData.Existed {
+		t.Errorf("Expected ok and existed to be true, got %t and %t instead", resData.Ok, resData.Existed)
+	}
+}
+
 func TestGet(t *testing.T) {
 	server := NewServer(nil)
 
@@ -135,6 +282,7 @@ func TestGet(t *testing.T) {
 		name          string
 		key           string
 		ok            bool
+		missing       bool
 		expectedValue []byte
 		expectedCode  int
 	}{
@@ -157,11 +305,17 @@ func TestGet(t *testing.T) {
 			expectedValue: []byte("10"),
 			expectedCode:  http.StatusOK,
 		},
+		{
+			name:         "Missing key",
+			key:          "missing",
+			missing:      true,
+			expectedCode: http.StatusNotFound,
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			if tc.key != "" {
+			if tc.key != "" && !tc.missing {
 				server.cache.Set(tc.key, tc.expectedValue)
 			}
 
@@ -183,137 +337,1633 @@ func TestGet(t *testing.T) {
 			if !bytes.Equal([]byte(val), tc.expectedValue) {
 				t.Errorf("Expected value %v, got %v instead", tc.expectedValue, []byte(val))
 			}
+			if tc.missing && resData.Ok {
+				t.Error("Expected ok to be false")
+			}
 		})
 	}
 }
 
-func TestDelete(t *testing.T) {
+func TestGetNotFoundOnMiss(t *testing.T) {
+	testCases := []struct {
+		name           string
+		notFoundOnMiss bool
+		expectedCode   int
+	}{
+		{name: "Default", notFoundOnMiss: true, expectedCode: http.StatusNotFound},
+		{name: "Disabled", notFoundOnMiss: false, expectedCode: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(nil)
+			server.NotFoundOnMiss = tc.notFoundOnMiss
+			res, err := sendRequest("GET", "/GET/missing", nil, server)
+			if err != nil {
+				t.Errorf("Failed to send request: %v", err)
+			}
+			if code := res.Result().StatusCode; code != tc.expectedCode {
+				t.Errorf("Expected response status code %d, got %d instead", tc.expectedCode, code)
+			}
+			resData := httpResponse{}
+			json.NewDecoder(res.Body).Decode(&resData)
+			if resData.Ok {
+				t.Error("Expected ok to be false")
+			}
+		})
+	}
+}
+
+func TestRaw(t *testing.T) {
 	server := NewServer(nil)
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
-	lengthBefore := server.cache.Length()
+	server.MaxRawBytes = 1 << 10
 
-	url := fmt.Sprintf("/DELETE/%s", "key1")
-	res, err := sendRequest("DELETE", url, nil, server)
+	value := make([]byte, 256)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	res, err := sendRequest("PUT", "/RAW/image", bytes.NewReader(value), server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusNoContent {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusNoContent, code)
+	}
+
+	res, err = sendRequest("GET", "/RAW/image", nil, server)
 	if err != nil {
 		t.Errorf("Failed to send request: %v", err)
 	}
 	if code := res.Result().StatusCode; code != http.StatusOK {
 		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
 	}
-	if server.cache.Length() != lengthBefore-1 {
-		t.Errorf("Cache length has not changed")
+	if ct := res.Result().Header.Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Expected Content-Type \"application/octet-stream\", got \"%s\" instead", ct)
+	}
+	if !bytes.Equal(res.Body.Bytes(), value) {
+		t.Errorf("Expected value to round-trip byte-for-byte, got %v instead", res.Body.Bytes())
+	}
+
+	res, err = sendRequest("GET", "/RAW/image?type=image/png", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if ct := res.Result().Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Expected Content-Type \"image/png\", got \"%s\" instead", ct)
+	}
+	if nosniff := res.Result().Header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+		t.Errorf("Expected X-Content-Type-Options \"nosniff\", got \"%s\" instead", nosniff)
+	}
+	if cd := res.Result().Header.Get("Content-Disposition"); cd != "" {
+		t.Errorf("Expected no Content-Disposition for an image, got \"%s\" instead", cd)
+	}
+
+	// Types that browsers run scripts of are sent as attachments.
+	for _, contentType := range []string{"text/html", "text/html; charset=utf-8", "image/svg+xml", "application/javascript"} {
+		res, _ = sendRequest("GET", "/RAW/image?type="+url.QueryEscape(contentType), nil, server)
+		if cd := res.Result().Header.Get("Content-Disposition"); cd != "attachment" {
+			t.Errorf("Expected Content-Disposition \"attachment\" for %s, got \"%s\" instead", contentType, cd)
+		}
+	}
+	res, _ = sendRequest("GET", "/RAW/image?type=text/", nil, server)
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d for an invalid type, got %d instead", http.StatusBadRequest, code)
+	}
+
+	testCases := []struct {
+		name string
+		body []byte
+		code int
+	}{
+		{name: "At limit", body: bytes.Repeat([]byte{0xff}, 1<<10), code: http.StatusNoContent},
+		{name: "Over limit", body: bytes.Repeat([]byte{0xff}, 1<<10+1), code: http.StatusRequestEntityTooLarge},
+		{name: "Empty", body: nil, code: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := sendRequest("PUT", "/RAW/large", bytes.NewReader(tc.body), server)
+			if err != nil {
+				t.Errorf("Failed to send request: %v", err)
+			}
+			if code := res.Result().StatusCode; code != tc.code {
+				t.Errorf("Expected response status code %d, got %d instead", tc.code, code)
+			}
+		})
+	}
+	if stored, _ := server.cache.Get("large"); len(stored) != 1<<10 {
+		t.Errorf("Expected a value of %d bytes to be stored, got %d bytes instead", 1<<10, len(stored))
+	}
+
+	res, err = sendRequest("GET", "/RAW/missing", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusNotFound {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusNotFound, code)
 	}
 }
 
-func TestPurge(t *testing.T) {
+func TestETag(t *testing.T) {
 	server := NewServer(nil)
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
+	server.cache.Set("key1", []byte("value1"))
 
-	res, err := sendRequest("DELETE", "/PURGE", nil, server)
+	// The JSON body of /GET also carries the TTL and can be encoded in several ways,
+	// so only the raw value gets a strong tag.
+	for url, weak := range map[string]bool{"/GET/key1": true, "/RAW/key1": false} {
+		t.Run(url, func(t *testing.T) {
+			res, err := sendRequest("GET", url, nil, server)
+			if err != nil {
+				t.Fatalf("Failed to send request: %v", err)
+			}
+			tag := res.Result().Header.Get("ETag")
+			if code := res.Result().StatusCode; code != http.StatusOK || tag == "" {
+				t.Fatalf("Expected status code %d with an ETag, got %d and \"%s\" instead", http.StatusOK, code, tag)
+			}
+			if strings.HasPrefix(tag, "W/") != weak {
+				t.Errorf("Expected a weak tag to be %v, got \"%s\" instead", weak, tag)
+			}
+			opaque := strings.TrimPrefix(tag, "W/")
+
+			for _, ifNoneMatch := range []string{tag, opaque, `"other", W/` + opaque, "*"} {
+				req, err := http.NewRequest("GET", url, nil)
+				if err != nil {
+					t.Fatalf("Failed to create request: %v", err)
+				}
+				req.Header.Set("If-None-Match", ifNoneMatch)
+				res = httptest.NewRecorder()
+				server.ServeHTTP(res, req)
+				if code := res.Result().StatusCode; code != http.StatusNotModified {
+					t.Errorf("%s: expected response status code %d, got %d instead", ifNoneMatch, http.StatusNotModified, code)
+				}
+				if res.Body.Len() != 0 {
+					t.Errorf("%s: expected no body, got %q instead", ifNoneMatch, res.Body.String())
+				}
+			}
+
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("If-None-Match", `"other"`)
+			res = httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+			if code := res.Result().StatusCode; code != http.StatusOK {
+				t.Errorf("Expected response status code %d for a stale ETag, got %d instead", http.StatusOK, code)
+			}
+		})
+	}
+
+	res, err := sendRequest("GET", "/GET/key1", nil, server)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	tag := res.Result().Header.Get("ETag")
+	server.cache.Set("key1", []byte("value2"))
+	res, err = sendRequest("GET", "/GET/key1", nil, server)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if newTag := res.Result().Header.Get("ETag"); newTag == tag {
+		t.Errorf("Expected the ETag to change with the value, got \"%s\" twice", tag)
+	}
+
+	// A compressed raw value is no longer identical to the stored one.
+	server.cache.Set("large", bytes.Repeat([]byte("x"), 2*gzipMinBytes))
+	res, _ = sendRequest("GET", "/RAW/large", nil, server)
+	strong := res.Result().Header.Get("ETag")
+	req, err := http.NewRequest("GET", "/RAW/large", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if tag := res.Result().Header.Get("ETag"); tag != "W/"+strong {
+		t.Errorf("Expected the weak tag W/%s for a compressed value, got \"%s\" instead", strong, tag)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("key1", []byte("value1"))
+	server.cache.Set("key2", []byte("value2"))
+	server.cache.SetEx("expired", []byte("value3"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	body := strings.NewReader(`["key1", "missing", "key2", "expired"]`)
+	res, err := sendRequest("POST", "/MGET", body, server)
 	if err != nil {
 		t.Errorf("Failed to send request: %v", err)
 	}
 	if code := res.Result().StatusCode; code != http.StatusOK {
 		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
 	}
-	if server.cache.Length() != 0 {
-		t.Errorf("Cache is not empty")
+	resData := struct {
+		Value map[string][]byte `json:"value"`
+		Ok    bool              `json:"ok"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if !resData.Ok || len(resData.Value) != 2 ||
+		string(resData.Value["key1"]) != "value1" || string(resData.Value["key2"]) != "value2" {
+		t.Errorf("Expected only \"key1\" and \"key2\", got %q instead", resData.Value)
+	}
+
+	res, err = sendRequest("POST", "/MGET", strings.NewReader(`{"key": "key1"}`), server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+	}
+
+	tooMany, _ := json.Marshal(make([]string, maxBatchKeys+1))
+	for name, body := range map[string]string{
+		"Empty key": `["key1", ""]`,
+		"Too many":  strings.ReplaceAll(string(tooMany), `""`, `"key1"`),
+	} {
+		res, _ := sendRequest("POST", "/MGET", strings.NewReader(body), server)
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("%s: expected response status code %d, got %d instead", name, http.StatusBadRequest, code)
+		}
 	}
 }
 
-func TestLength(t *testing.T) {
+func TestSetMany(t *testing.T) {
 	server := NewServer(nil)
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
-	server.cache.Set("key4", []byte("40"))
-	server.cache.Set("key5", []byte("50"))
 
-	res, err := sendRequest("GET", "/LENGTH", nil, server)
+	body := strings.NewReader(`{"key1": "dmFsdWUx", "key2": "dmFsdWUy"}`)
+	res, err := sendRequest("PUT", "/MSET", body, server)
 	if err != nil {
 		t.Errorf("Failed to send request: %v", err)
 	}
 	if code := res.Result().StatusCode; code != http.StatusOK {
 		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
 	}
+	values := server.cache.GetMany([]string{"key1", "key2"})
+	if len(values) != 2 || string(values["key1"]) != "value1" || string(values["key2"]) != "value2" {
+		t.Errorf("Expected both pairs to be stored, got %q instead", values)
+	}
 
-	resData := httpResponse{}
-	json.NewDecoder(res.Body).Decode(&resData)
-	val, ok := resData.Value.(float64)
-	if !ok {
-		t.Error("Returned value is not a number")
+	for name, body := range map[string]string{
+		"Empty key":   `{"key3": "dmFsdWUz", "": "dmFsdWU0"}`,
+		"Empty value": `{"key3": "dmFsdWUz", "key4": ""}`,
+		"Not object":  `["key3"]`,
+	} {
+		res, err := sendRequest("PUT", "/MSET", strings.NewReader(body), server)
+		if err != nil {
+			t.Errorf("%s: failed to send request: %v", name, err)
+		}
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("%s: expected response status code %d, got %d instead", name, http.StatusBadRequest, code)
+		}
 	}
-	actualLength := server.cache.Length()
-	if int(val) != actualLength {
-		t.Errorf("Expected length %d, got %d instead", actualLength, int(val))
+	if server.cache.Length() != 2 {
+		t.Errorf("Expected no pairs of rejected batches to be stored, got length %d instead", server.cache.Length())
 	}
 }
 
-func TestKeys(t *testing.T) {
+func TestDeleteMany(t *testing.T) {
 	server := NewServer(nil)
-	server.cache.Set("key1", []byte("10"))
-	server.cache.Set("key2", []byte("20"))
-	server.cache.Set("key3", []byte("30"))
-	server.cache.Set("key4", []byte("40"))
-	server.cache.Set("key5", []byte("50"))
+	server.cache.Set("key1", []byte("value1"))
+	server.cache.Set("key2", []byte("value2"))
+	server.cache.Set("key3", []byte("value3"))
 
-	res, err := sendRequest("GET", "/KEYS", nil, server)
+	body := strings.NewReader(`["key1", "missing", "key2"]`)
+	res, err := sendRequest("POST", "/MDELETE", body, server)
 	if err != nil {
 		t.Errorf("Failed to send request: %v", err)
 	}
 	if code := res.Result().StatusCode; code != http.StatusOK {
 		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
 	}
-
-	expectedKeys := server.cache.Keys()
-	resData := httpResponse{}
+	resData := struct {
+		Count int64 `json:"count"`
+		Ok    bool  `json:"ok"`
+	}{}
 	json.NewDecoder(res.Body).Decode(&resData)
-	val, ok := resData.Value.([]any)
-	if !ok {
-		t.Errorf("Returned value is not an array")
+	if !resData.Ok || resData.Count != 2 {
+		t.Errorf("Expected 2 deleted keys, got %d instead", resData.Count)
 	}
-	keys := make([]string, len(val))
-	for i := range val {
-		keys[i], ok = val[i].(string)
-		if !ok {
-			t.Errorf("Returned key is not a string: %v", val[i])
-		}
+	if server.cache.Length() != 1 {
+		t.Errorf("Expected only \"key3\" to remain, got length %d instead", server.cache.Length())
 	}
-	receivedKeys := strings.Join(keys, ",")
-	for i := range expectedKeys {
-		if !strings.Contains(receivedKeys, expectedKeys[i]) {
-			t.Errorf("Key \"%s\" not found", expectedKeys[i])
+
+	tooMany, _ := json.Marshal(make([]string, maxBatchKeys+1))
+	for name, body := range map[string]string{
+		"Empty key": `["key3", ""]`,
+		"Too many":  strings.ReplaceAll(string(tooMany), `""`, `"key3"`),
+	} {
+		res, _ := sendRequest("POST", "/MDELETE", strings.NewReader(body), server)
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("%s: expected response status code %d, got %d instead", name, http.StatusBadRequest, code)
 		}
 	}
+	if !server.cache.Exists("key3") {
+		t.Error("Expected \"key3\" to remain after rejected batches")
+	}
+
+	res, err = sendRequest("POST", "/MDELETE", strings.NewReader(`{"key": "key3"}`), server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+	}
 }
 
-func TestPing(t *testing.T) {
+func TestExec(t *testing.T) {
 	server := NewServer(nil)
-	res, err := sendRequest("GET", "/PING", nil, server)
+	server.cache.Set("counter", []byte("1"))
+	server.cache.Set("lock", []byte("owner"))
+
+	type response struct {
+		Message string `json:"message"`
+		Key     string `json:"key"`
+		Count   int64  `json:"count"`
+		Ok      bool   `json:"ok"`
+	}
+
+	// The CAS fails, so neither the SET nor the DELETE is applied.
+	body := strings.NewReader(`[
+		{"op": "SET", "key": "new", "value": "a"},
+		{"op": "DELETE", "key": "lock"},
+		{"op": "CAS", "key": "counter", "expected": "5", "value": "6"}
+	]`)
+	res, err := sendRequest("POST", "/EXEC", body, server)
 	if err != nil {
 		t.Errorf("Failed to send request: %v", err)
 	}
 	if code := res.Result().StatusCode; code != http.StatusOK {
 		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
 	}
+	resData := response{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if resData.Ok || resData.Count != 2 || resData.Key != "counter" {
+		t.Errorf("Expected op 2 on \"counter\" to fail, got %+v instead", resData)
+	}
+	if server.cache.Exists("new") || !server.cache.Exists("lock") {
+		t.Errorf("Expected no op to be applied, got keys %q instead", server.cache.Keys())
+	}
+
+	body = strings.NewReader(`[
+		{"op": "CAS", "key": "counter", "expected": "1", "value": "2"},
+		{"op": "DELETE", "key": "lock"},
+		{"op": "SETNX", "key": "lock", "value": "other", "ttl": 60000}
+	]`)
+	res, err = sendRequest("POST", "/EXEC", body, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	resData = response{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if !resData.Ok || resData.Count != 3 {
+		t.Errorf("Expected all 3 ops to be applied, got %+v instead", resData)
+	}
+	if value, _ := server.cache.Get("counter"); string(value) != "2" {
+		t.Errorf("Expected counter to be \"2\", got %q instead", value)
+	}
+	if value, ttl, _ := server.cache.GetWithTTL("lock"); string(value) != "other" || ttl <= 0 {
+		t.Errorf("Expected lock to be \"other\" with a TTL, got %q and %v instead", value, ttl)
+	}
+
+	res, err = sendRequest("POST", "/EXEC", strings.NewReader(`[{"op": "INCR", "key": "counter"}]`), server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+	}
 }
 
-func sendRequest(
-	method, url string,
-	body io.Reader,
-	server *Server,
-) (*httptest.ResponseRecorder, error) {
-	req, err := http.NewRequest(method, url, body)
+func TestDeleteExpired(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.SetEx("session:1", []byte("value1"), time.Millisecond)
+	server.cache.Set("session:2", []byte("value2"))
+	server.cache.SetEx("user:1", []byte("value3"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	res, err := sendRequest("DELETE", "/DELEXPIRED?pattern=session:*", nil, server)
 	if err != nil {
-		return nil, err
+		t.Errorf("Failed to send request: %v", err)
+	}
+	resData := httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if !resData.Ok || resData.Count == nil || *resData.Count != 1 {
+		t.Errorf("Expected 1 deleted key, got %+v instead", resData)
+	}
+	if server.cache.Length() != 2 {
+		t.Errorf("Expected only the expired key matching the pattern to be deleted, got length %d", server.cache.Length())
 	}
 
-	rr := httptest.NewRecorder()
-	server.ServeHTTP(rr, req)
+	for _, query := range []string{"", "?pattern=%5Bsession"} {
+		res, err := sendRequest("DELETE", "/DELEXPIRED"+query, nil, server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("Expected response status code %d for %q, got %d instead", http.StatusBadRequest, query, code)
+		}
+	}
+}
 
-	return rr, nil
+func TestExpireMatching(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("tenant:5:a", []byte("value1"))
+	server.cache.Set("tenant:6:a", []byte("value2"))
+
+	res, err := sendRequest("POST", "/EXPIREMATCHING?pattern=tenant:5:*&ttl=60000", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	resData := httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if !resData.Ok || resData.Count == nil || *resData.Count != 1 {
+		t.Errorf("Expected 1 updated key, got %+v instead", resData)
+	}
+	if ttl, _ := server.cache.TTL("tenant:5:a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected matching key to expire within a minute, got TTL %v instead", ttl)
+	}
+	if ttl, _ := server.cache.TTL("tenant:6:a"); ttl != 0 {
+		t.Errorf("Expected non-matching key to keep no TTL, got %v instead", ttl)
+	}
+
+	for _, query := range []string{"?ttl=60000", "?pattern=tenant:5:*", "?pattern=tenant:5:*&ttl=-1"} {
+		res, err := sendRequest("POST", "/EXPIREMATCHING"+query, nil, server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("Expected response status code %d for %q, got %d instead", http.StatusBadRequest, query, code)
+		}
+	}
+}
+
+func TestExists(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("live", []byte("value1"))
+	server.cache.SetEx("expired", []byte("value2"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	for key, expected := range map[string]bool{"live": true, "expired": false} {
+		res, err := sendRequest("GET", "/EXISTS/"+key, nil, server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		resData := httpResponse{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		if resData.Ok != expected {
+			t.Errorf("Expected ok for %q to be %t, got %t instead", key, expected, resData.Ok)
+		}
+		if resData.Value != nil {
+			t.Errorf("Expected no value for %q, got %v instead", key, resData.Value)
+		}
+	}
+	if value, _ := server.cache.Get("live"); string(value) != "value1" || server.cache.Length() != 2 {
+		t.Error("Expected EXISTS not to mutate the cache")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("permanent", []byte("value1"))
+	server.cache.SetEx("expiring", []byte("value2"), time.Minute)
+	server.cache.SetEx("expired", []byte("value3"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	testCases := []struct {
+		key    string
+		ok     bool
+		minTTL int64
+		maxTTL int64
+	}{
+		{key: "permanent", ok: true},
+		{key: "expiring", ok: true, minTTL: 1, maxTTL: 60000},
+		{key: "expired", ok: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			res, err := sendRequest("GET", "/TTL/"+tc.key, nil, server)
+			if err != nil {
+				t.Errorf("Failed to send request: %v", err)
+			}
+			resData := struct {
+				Count int64 `json:"count"`
+				Ok    bool  `json:"ok"`
+			}{}
+			json.NewDecoder(res.Body).Decode(&resData)
+			if resData.Ok != tc.ok {
+				t.Errorf("Expected ok to be %t, got %t instead", tc.ok, resData.Ok)
+			}
+			if resData.Count < tc.minTTL || resData.Count > tc.maxTTL {
+				t.Errorf("Expected TTL within [%d, %d], got %d instead", tc.minTTL, tc.maxTTL, resData.Count)
+			}
+		})
+	}
+}
+
+func TestSetNX(t *testing.T) {
+	server := NewServer(nil)
+
+	testCases := []struct {
+		body string
+		code int
+		ok   bool
+	}{
+		{body: `{"value": "owner1", "ttl": 60000}`, code: http.StatusOK, ok: true},
+		{body: `{"value": "owner2", "ttl": 60000}`, code: http.StatusOK, ok: false},
+		{body: `{"value": "owner2"}`, code: http.StatusOK, ok: false},
+		{body: `{"value": "owner2", "ttl": -1}`, code: http.StatusBadRequest, ok: false},
+		{body: `{"value": ""}`, code: http.StatusBadRequest, ok: false},
+		{body: `value`, code: http.StatusBadRequest, ok: false},
+	}
+	for _, tc := range testCases {
+		res, err := sendRequest("PUT", "/SETNX/lock", strings.NewReader(tc.body), server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != tc.code {
+			t.Errorf("%s: expected response status code %d, got %d instead", tc.body, tc.code, code)
+		}
+		resData := struct {
+			Ok bool `json:"ok"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		if resData.Ok != tc.ok {
+			t.Errorf("%s: expected ok to be %t, got %t instead", tc.body, tc.ok, resData.Ok)
+		}
+	}
+	if owner, _ := server.cache.Get("lock"); !bytes.Equal(owner, []byte("owner1")) {
+		t.Errorf("Expected lock to be owned by \"owner1\", got \"%s\" instead", owner)
+	}
+	if ttl, ok := server.cache.TTL("lock"); !ok || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected lock to carry a TTL within (0, 1m], got %v instead", ttl)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	server := NewServer(nil)
+
+	testCases := []struct {
+		body     string
+		code     int
+		existed  bool
+		expected string
+	}{
+		{body: `{"value": "value1"}`, code: http.StatusOK},
+		{body: `{"value": "value2"}`, code: http.StatusOK, existed: true, expected: "value1"},
+		{body: `{"value": ""}`, code: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		res, err := sendRequest("PUT", "/GETSET/key1", strings.NewReader(tc.body), server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != tc.code {
+			t.Errorf("%s: expected response status code %d, got %d instead", tc.body, tc.code, code)
+		}
+		resData := struct {
+			Value   string `json:"value"`
+			Existed bool   `json:"existed"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		if resData.Existed != tc.existed || resData.Value != tc.expected {
+			t.Errorf("%s: expected %q (existed: %t), got %q (existed: %t) instead",
+				tc.body, tc.expected, tc.existed, resData.Value, resData.Existed)
+		}
+	}
+	if value, _ := server.cache.Get("key1"); !bytes.Equal(value, []byte("value2")) {
+		t.Errorf("Expected \"value2\" to be stored, got \"%s\" instead", value)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	server := NewServer(nil)
+
+	testCases := []struct {
+		body string
+		code int
+		ok   bool
+	}{
+		{body: `{"expected": "value1", "value": "value2"}`, code: http.StatusOK, ok: false},
+		{body: `{"value": "value1"}`, code: http.StatusOK, ok: true},
+		{body: `{"value": "value2"}`, code: http.StatusOK, ok: false},
+		{body: `{"expected": "other", "value": "value2"}`, code: http.StatusOK, ok: false},
+		{body: `{"expected": "value1", "value": "value2"}`, code: http.StatusOK, ok: true},
+		{body: `{"expected": "value2", "value": ""}`, code: http.StatusBadRequest, ok: false},
+		{body: `value`, code: http.StatusBadRequest, ok: false},
+	}
+	for _, tc := range testCases {
+		res, err := sendRequest("POST", "/CAS/key1", strings.NewReader(tc.body), server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != tc.code {
+			t.Errorf("%s: expected response status code %d, got %d instead", tc.body, tc.code, code)
+		}
+		resData := struct {
+			Ok bool `json:"ok"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		if resData.Ok != tc.ok {
+			t.Errorf("%s: expected ok to be %t, got %t instead", tc.body, tc.ok, resData.Ok)
+		}
+	}
+	if value, _ := server.cache.Get("key1"); !bytes.Equal(value, []byte("value2")) {
+		t.Errorf("Expected \"value2\" to be stored, got \"%s\" instead", value)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.SetEx("session", []byte("value1"), time.Second)
+	server.cache.SetEx("expired", []byte("value2"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	testCases := []struct {
+		key  string
+		body string
+		code int
+		ok   bool
+	}{
+		{key: "session", body: `{"ttl": 60000}`, code: http.StatusOK, ok: true},
+		{key: "expired", body: `{"ttl": 60000}`, code: http.StatusOK, ok: false},
+		{key: "missing", body: `{"ttl": 60000}`, code: http.StatusOK, ok: false},
+		{key: "session", body: `{"ttl": 0}`, code: http.StatusBadRequest, ok: false},
+		{key: "session", body: `{"ttl": 9223372036855}`, code: http.StatusBadRequest, ok: false},
+		{key: "session", body: `ttl`, code: http.StatusBadRequest, ok: false},
+	}
+	for _, tc := range testCases {
+		res, err := sendRequest("POST", "/TOUCH/"+tc.key, strings.NewReader(tc.body), server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != tc.code {
+			t.Errorf("%s %s: expected response status code %d, got %d instead", tc.key, tc.body, tc.code, code)
+		}
+		resData := struct {
+			Ok bool `json:"ok"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		if resData.Ok != tc.ok {
+			t.Errorf("%s %s: expected ok to be %t, got %t instead", tc.key, tc.body, tc.ok, resData.Ok)
+		}
+	}
+
+	if ttl, ok := server.cache.TTL("session"); !ok || ttl <= time.Second {
+		t.Errorf("Expected expiration to move forward, got TTL %v instead", ttl)
+	}
+	if value, _ := server.cache.Get("session"); !bytes.Equal(value, []byte("value1")) {
+		t.Errorf("Expected value to be unchanged, got %q instead", value)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.SetEx("key1", []byte("value1"), 50*time.Millisecond)
+
+	testCases := []struct {
+		key string
+		ok  bool
+	}{
+		{key: "key1", ok: true},
+		{key: "missing", ok: false},
+	}
+	for _, tc := range testCases {
+		res, err := sendRequest("POST", "/PERSIST/"+tc.key, nil, server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		resData := struct {
+			Ok bool `json:"ok"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		if resData.Ok != tc.ok {
+			t.Errorf("%s: expected ok to be %t, got %t instead", tc.key, tc.ok, resData.Ok)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if value, ok := server.cache.Get("key1"); !ok || !bytes.Equal(value, []byte("value1")) {
+		t.Errorf("Expected persisted key to resolve to \"value1\", got %q, %t instead", value, ok)
+	}
+	if ttl, ok := server.cache.TTL("key1"); !ok || ttl != 0 {
+		t.Errorf("Expected TTL 0 for a persisted key, got %v, %t instead", ttl, ok)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+	lengthBefore := server.cache.Length()
+
+	url := fmt.Sprintf("/DELETE/%s", "key1")
+	res, err := sendRequest("DELETE", url, nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+	if server.cache.Length() != lengthBefore-1 {
+		t.Errorf("Cache length has not changed")
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("text", []byte("abc"))
+
+	testCases := []struct {
+		url          string
+		expectedCode int
+		ok           bool
+		value        int64
+	}{
+		{url: "/INCR/counter", expectedCode: http.StatusOK, ok: true, value: 1},
+		{url: "/INCR/counter?delta=10", expectedCode: http.StatusOK, ok: true, value: 11},
+		{url: "/DECR/counter?delta=20", expectedCode: http.StatusOK, ok: true, value: -9},
+		{url: "/INCR/counter?delta=x", expectedCode: http.StatusBadRequest},
+		{url: "/INCR/text", expectedCode: http.StatusOK, ok: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			res, err := sendRequest("POST", tc.url, nil, server)
+			if err != nil {
+				t.Errorf("Failed to send request: %v", err)
+			}
+			if code := res.Result().StatusCode; code != tc.expectedCode {
+				t.Errorf("Expected response status code %d, got %d instead", tc.expectedCode, code)
+			}
+			resData := struct {
+				Count int64 `json:"count"`
+				Ok    bool  `json:"ok"`
+			}{}
+			json.NewDecoder(res.Body).Decode(&resData)
+			if resData.Ok != tc.ok || resData.Count != tc.value {
+				t.Errorf("Expected ok %t and value %d, got %t and %d instead",
+					tc.ok, tc.value, resData.Ok, resData.Count)
+			}
+		})
+	}
+
+	// Counters beyond 2^53 are sent as exact integers.
+	server.cache.Set("large", []byte("9007199254740992"))
+	res, _ := sendRequest("POST", "/INCR/large", nil, server)
+	resData := httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if resData.Count == nil || *resData.Count != 9007199254740993 {
+		t.Errorf("Expected 9007199254740993, got %+v instead", resData)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+
+	res, err := sendRequest("DELETE", "/PURGE", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+	resData := httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if resData.Command != "PURGE" || !resData.Ok {
+		t.Errorf("Expected command \"PURGE\" with ok, got %+v instead", resData)
+	}
+	if server.cache.Length() != 0 {
+		t.Errorf("Cache is not empty")
+	}
+}
+
+func TestConfirmPurge(t *testing.T) {
+	server := NewServer(nil)
+	server.ConfirmPurge = true
+	server.cache.Set("key1", []byte("10"))
+
+	for _, url := range []string{"/PURGE", "/PURGE?confirm=false"} {
+		res, err := sendRequest("DELETE", url, nil, server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("%s: expected response status code %d, got %d instead", url, http.StatusBadRequest, code)
+		}
+	}
+	if server.cache.Length() != 1 {
+		t.Fatalf("Expected an unconfirmed purge to keep the cache, got length %d instead", server.cache.Length())
+	}
+
+	res, err := sendRequest("DELETE", "/PURGE?confirm=true", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+	if server.cache.Length() != 0 {
+		t.Errorf("Cache is not empty")
+	}
+}
+
+func TestLength(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+	server.cache.Set("key4", []byte("40"))
+	server.cache.Set("key5", []byte("50"))
+
+	res, err := sendRequest("GET", "/LENGTH", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+
+	resData := httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if resData.Value != nil {
+		t.Errorf("Expected value to be empty, got %v instead", resData.Value)
+	}
+	actualLength := int64(server.cache.Length())
+	if resData.Count == nil || *resData.Count != actualLength {
+		t.Errorf("Expected length %d, got %+v instead", actualLength, resData)
+	}
+
+	server.cache.Purge()
+	res, _ = sendRequest("GET", "/LENGTH", nil, server)
+	resData = httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if resData.Count == nil || *resData.Count != 0 {
+		t.Errorf("Expected length 0 for empty cache, got %+v instead", resData)
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	server := NewServer(nil)
+	value := []byte{0x00, 0xff, 0xfe, '"', '\n', 0x80}
+
+	body, err := msgpack.Marshal(map[string]any{"value": value})
+	if err != nil {
+		t.Fatalf("Failed to encode the request: %v", err)
+	}
+	req, err := http.NewRequest("PUT", "/SET/key1", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set("Accept", "application/msgpack")
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Fatalf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+	if stored, _ := server.cache.Get("key1"); !bytes.Equal(stored, value) {
+		t.Errorf("Expected value %v to be stored, got %v instead", value, stored)
+	}
+
+	req, err = http.NewRequest("GET", "/GET/key1", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json;q=0.5, application/msgpack")
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if contentType := res.Result().Header.Get("Content-Type"); contentType != "application/msgpack" {
+		t.Errorf("Expected Content-Type \"application/msgpack\", got \"%s\" instead", contentType)
+	}
+	resData := struct {
+		Command string `msgpack:"command"`
+		Value   []byte `msgpack:"value"`
+		Ok      bool   `msgpack:"ok"`
+	}{}
+	if err := msgpack.NewDecoder(res.Body).Decode(&resData); err != nil {
+		t.Fatalf("Failed to decode the response: %v", err)
+	}
+	if !resData.Ok || resData.Command != "GET" || !bytes.Equal(resData.Value, value) {
+		t.Errorf("Expected value %v, got %+v instead", value, resData)
+	}
+
+	// Without the headers, requests and responses stay JSON.
+	res, err = sendRequest("GET", "/GET/key1", nil, server)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if contentType := res.Result().Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		t.Errorf("Expected a JSON response, got Content-Type \"%s\" instead", contentType)
+	}
+
+	req, err = http.NewRequest("PUT", "/SET/key2", bytes.NewReader([]byte("not msgpack")))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/msgpack")
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	server := NewServer(nil)
+	for i := 0; i < 200; i++ {
+		server.cache.Set("key"+strconv.Itoa(i), []byte("value"))
+	}
+
+	testCases := []struct {
+		name           string
+		url            string
+		acceptEncoding string
+		level          int
+		compressed     bool
+	}{
+		{name: "Large response", url: "/KEYS", acceptEncoding: "gzip", level: gzip.DefaultCompression, compressed: true},
+		{name: "Quality value", url: "/KEYS", acceptEncoding: "deflate, gzip;q=0.5", level: gzip.BestSpeed, compressed: true},
+		{name: "Without header", url: "/KEYS", level: gzip.DefaultCompression, compressed: false},
+		{name: "Refused", url: "/KEYS", acceptEncoding: "gzip;q=0", level: gzip.DefaultCompression, compressed: false},
+		{name: "Tiny response", url: "/PING", acceptEncoding: "gzip", level: gzip.DefaultCompression, compressed: false},
+		{name: "Disabled", url: "/KEYS", acceptEncoding: "gzip", level: gzip.NoCompression, compressed: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server.GzipLevel = tc.level
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+
+			if code := res.Result().StatusCode; code != http.StatusOK {
+				t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+			}
+			encoding := res.Result().Header.Get("Content-Encoding")
+			if tc.compressed != (encoding == "gzip") {
+				t.Errorf("Expected compressed to be %t, got Content-Encoding \"%s\" instead", tc.compressed, encoding)
+			}
+			var body io.Reader = res.Body
+			if tc.compressed {
+				gz, err := gzip.NewReader(res.Body)
+				if err != nil {
+					t.Fatalf("Failed to decompress the response: %v", err)
+				}
+				body = gz
+			}
+			resData := httpResponse{}
+			if err := json.NewDecoder(body).Decode(&resData); err != nil {
+				t.Fatalf("Failed to decode the response: %v", err)
+			}
+			if !resData.Ok {
+				t.Error("Expected ok to be true")
+			}
+			if keys, ok := resData.Value.([]any); tc.url == "/KEYS" && (!ok || len(keys) != 200) {
+				t.Errorf("Expected 200 keys, got %v instead", resData.Value)
+			}
+		})
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	server := NewServer(nil)
+	server.APIKey = "secret"
+
+	testCases := []struct {
+		name          string
+		url           string
+		authorization string
+		code          int
+	}{
+		{name: "Missing", url: "/PING", code: http.StatusUnauthorized},
+		{name: "Wrong", url: "/PING", authorization: "Bearer wrong", code: http.StatusUnauthorized},
+		{name: "Wrong scheme", url: "/PING", authorization: "Basic secret", code: http.StatusUnauthorized},
+		{name: "Valid", url: "/PING", authorization: "Bearer secret", code: http.StatusOK},
+		{name: "Health check", url: "/readyz", code: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, req)
+			if code := res.Result().StatusCode; code != tc.code {
+				t.Errorf("Expected response status code %d, got %d instead", tc.code, code)
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("key1", []byte("10"))
+	server.cache.Set("key2", []byte("20"))
+	server.cache.Set("key3", []byte("30"))
+	server.cache.Set("key4", []byte("40"))
+	server.cache.Set("key5", []byte("50"))
+
+	res, err := sendRequest("GET", "/KEYS", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+
+	expectedKeys := server.cache.Keys()
+	resData := httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	val, ok := resData.Value.([]any)
+	if !ok {
+		t.Errorf("Returned value is not an array")
+	}
+	keys := make([]string, len(val))
+	for i := range val {
+		keys[i], ok = val[i].(string)
+		if !ok {
+			t.Errorf("Returned key is not a string: %v", val[i])
+		}
+	}
+	receivedKeys := strings.Join(keys, ",")
+	for i := range expectedKeys {
+		if !strings.Contains(receivedKeys, expectedKeys[i]) {
+			t.Errorf("Key \"%s\" not found", expectedKeys[i])
+		}
+	}
+}
+
+func TestKeysPattern(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("user:1", []byte("value"))
+	server.cache.Set("session:1", []byte("value"))
+	server.cache.SetEx("user:2", []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	res, err := sendRequest("GET", "/KEYS?pattern=user:*", nil, server)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+	resData := httpResponse{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if keys, ok := resData.Value.([]any); !ok || len(keys) != 1 || keys[0] != "user:1" {
+		t.Errorf("Expected only key user:1, got %v instead", resData.Value)
+	}
+
+	res, err = sendRequest("GET", "/KEYS?pattern=%5B", nil, server)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.SetMaxValueBytes(5)
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{"SET at the limit", "PUT", "/SET/key1", `{"value":"12345"}`, http.StatusOK},
+		{"SET over the limit", "PUT", "/SET/key2", `{"value":"123456"}`, http.StatusRequestEntityTooLarge},
+		{"SETNX over the limit", "PUT", "/SETNX/key2", `{"value":"123456"}`, http.StatusRequestEntityTooLarge},
+		{"GETSET over the limit", "PUT", "/GETSET/key1", `{"value":"123456"}`, http.StatusRequestEntityTooLarge},
+		{"CAS over the limit", "POST", "/CAS/key1", `{"expected":"12345","value":"123456"}`, http.StatusRequestEntityTooLarge},
+		{"RAW at the limit", "PUT", "/RAW/key3", "12345", http.StatusNoContent},
+		{"RAW over the limit", "PUT", "/RAW/key2", "123456", http.StatusRequestEntityTooLarge},
+		{"MSET over the limit", "PUT", "/MSET", `{"key2":"MTIzNDU2"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := sendRequest(tc.method, tc.path, strings.NewReader(tc.body), server)
+			if err != nil {
+				t.Fatalf("Failed to send request: %v", err)
+			}
+			if code := res.Result().StatusCode; code != tc.expected {
+				t.Errorf("Expected response status code %d, got %d instead", tc.expected, code)
+			}
+		})
+	}
+	if value, _ := server.cache.Get("key1"); string(value) != "12345" {
+		t.Errorf("Expected the value at the limit to be kept, got %q instead", value)
+	}
+	if server.cache.Exists("key2") {
+		t.Error("Expected no value over the limit to be stored")
+	}
+}
+
+func TestGetTTL(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.SetEx("expiring", []byte("value"), time.Minute)
+	server.cache.Set("persistent", []byte("value"))
+	server.cache.SetEx("expired", []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	get := func(key string) map[string]any {
+		res, err := sendRequest("GET", "/GET/"+key, nil, server)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resData := map[string]any{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		return resData
+	}
+
+	resData := get("expiring")
+	if ttl, ok := resData["ttl_ms"].(float64); !ok || ttl <= 0 || ttl > float64(time.Minute.Milliseconds()) {
+		t.Errorf("Expected ttl_ms of up to a minute, got %v instead", resData)
+	}
+	if resData := get("persistent"); resData["ttl_ms"] != float64(0) || resData["ok"] != true {
+		t.Errorf("Expected ttl_ms of 0 for a key that never expires, got %v instead", resData)
+	}
+	resData = get("expired")
+	if _, present := resData["ttl_ms"]; present || resData["ok"] != false {
+		t.Errorf("Expected an expired key to report not-ok without ttl_ms, got %v instead", resData)
+	}
+}
+
+func TestGetModified(t *testing.T) {
+	server := NewServer(nil)
+
+	modified := func() int64 {
+		res, err := sendRequest("GET", "/GET/key1", nil, server)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resData := httpResponse{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		if resData.Modified == nil {
+			t.Fatalf("Expected modified_ms in the response, got %v instead", resData)
+		}
+		return *resData.Modified
+	}
+
+	before := time.Now().UnixMilli()
+	server.cache.Set("key1", []byte("value1"))
+	first := modified()
+	if first < before || first > time.Now().UnixMilli() {
+		t.Errorf("Expected modified_ms between %d and now, got %d instead", before, first)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if again := modified(); again != first {
+		t.Errorf("Expected modified_ms to stay %d on read, got %d instead", first, again)
+	}
+	server.cache.Set("key1", []byte("value2"))
+	if next := modified(); next <= first {
+		t.Errorf("Expected modified_ms to advance past %d on overwrite, got %d instead", first, next)
+	}
+}
+
+func TestKeyTooLong(t *testing.T) {
+	server := NewServer(nil)
+	longKey := strings.Repeat("k", cache.DefaultMaxKeyBytes+1)
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"SET", "PUT", "/SET/" + longKey, `{"value":"dmFsdWU="}`},
+		{"GET", "GET", "/GET/" + longKey, ""},
+		{"MSET", "PUT", "/MSET", `{"` + longKey + `":"dmFsdWU="}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := sendRequest(tc.method, tc.path, strings.NewReader(tc.body), server)
+			if err != nil {
+				t.Fatalf("Failed to send request: %v", err)
+			}
+			if code := res.Result().StatusCode; code != http.StatusBadRequest {
+				t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+			}
+			resData := httpResponse{}
+			json.NewDecoder(res.Body).Decode(&resData)
+			if resData.Message != "Key is too long" {
+				t.Errorf("Expected message \"Key is too long\", got %q instead", resData.Message)
+			}
+		})
+	}
+	if server.cache.Length() != 0 {
+		t.Error("Expected the over-long key not to be stored")
+	}
+}
+
+func TestScan(t *testing.T) {
+	server := NewServer(nil)
+	for i := 0; i < 1000; i++ {
+		server.cache.Set("key"+strconv.Itoa(i), []byte("value"))
+	}
+
+	seen := make(map[string]bool)
+	cursor := 0
+	for pages := 1; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Expected the scan to complete in 10 pages")
+		}
+		res, err := sendRequest("GET", "/SCAN?count=100&cursor="+strconv.Itoa(cursor), nil, server)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != http.StatusOK {
+			t.Fatalf("Expected response status code %d, got %d instead", http.StatusOK, code)
+		}
+		var resData struct {
+			Value struct {
+				Cursor int      `json:"cursor"`
+				Keys   []string `json:"keys"`
+			} `json:"value"`
+		}
+		json.NewDecoder(res.Body).Decode(&resData)
+		for _, k := range resData.Value.Keys {
+			if seen[k] {
+				t.Errorf("Key %s returned more than once", k)
+			}
+			seen[k] = true
+		}
+		if cursor = resData.Value.Cursor; cursor == 0 {
+			break
+		}
+	}
+	if len(seen) != 1000 {
+		t.Errorf("Expected 1000 keys, got %d instead", len(seen))
+	}
+
+	for _, query := range []string{"cursor=abc", "cursor=12345", "count=-1", "count=100000"} {
+		res, err := sendRequest("GET", "/SCAN?"+query, nil, server)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("Expected response status code %d for %s, got %d instead", http.StatusBadRequest, query, code)
+		}
+	}
+}
+
+func TestKeysWithSizes(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("key1", []byte("1"))
+	server.cache.Set("key2", []byte("22"))
+	server.cache.SetEx("key3", []byte("333"), time.Minute)
+
+	res, err := sendRequest("GET", "/KEYS?withsizes=true", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+
+	resData := struct {
+		Value []struct {
+			Key  string `json:"key"`
+			Size int    `json:"size"`
+			TTL  int64  `json:"ttl"`
+		} `json:"value"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if len(resData.Value) != 3 {
+		t.Fatalf("Expected 3 entries, got %d instead", len(resData.Value))
+	}
+	for _, info := range resData.Value {
+		stored, _ := server.cache.Get(info.Key)
+		if info.Size != len(stored) {
+			t.Errorf("Expected size of \"%s\" to be %d, got %d instead", info.Key, len(stored), info.Size)
+		}
+		if info.Key == "key3" && (info.TTL <= 0 || info.TTL > 60000) {
+			t.Errorf("Expected TTL of \"key3\" to be within (0, 60000], got %d instead", info.TTL)
+		}
+	}
+
+	res, _ = sendRequest("GET", "/KEYS?withsizes=true&limit=2", nil, server)
+	json.NewDecoder(res.Body).Decode(&resData)
+	if len(resData.Value) != 2 {
+		t.Errorf("Expected 2 entries with limit, got %d instead", len(resData.Value))
+	}
+	res, _ = sendRequest("GET", "/KEYS?withsizes=true&limit=abc", nil, server)
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+	}
+
+	// Without a limit, or with a larger one, at most keysInfoLimit entries are sent.
+	for i := 0; i < keysInfoLimit; i++ {
+		server.cache.Set("extra"+strconv.Itoa(i), []byte("v"))
+	}
+	for _, query := range []string{"", "&limit=0", "&limit=5000"} {
+		res, _ = sendRequest("GET", "/KEYS?withsizes=true"+query, nil, server)
+		json.NewDecoder(res.Body).Decode(&resData)
+		if len(resData.Value) != keysInfoLimit {
+			t.Errorf("Expected %d entries for %q, got %d instead", keysInfoLimit, query, len(resData.Value))
+		}
+	}
+}
+
+func TestExpiring(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("permanent", []byte("v"))
+	server.cache.SetEx("later", []byte("v"), time.Hour)
+	server.cache.SetEx("soon", []byte("v"), time.Minute)
+	server.cache.SetEx("soonest", []byte("v"), 30*time.Second)
+
+	res, err := sendRequest("GET", "/EXPIRING?n=2", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+	resData := struct {
+		Value []struct {
+			Key string `json:"key"`
+			TTL int64  `json:"ttl"`
+		} `json:"value"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if len(resData.Value) != 2 || resData.Value[0].Key != "soonest" || resData.Value[1].Key != "soon" {
+		t.Errorf("Expected \"soonest\" and \"soon\", got %v instead", resData.Value)
+	}
+
+	// Large counts are capped rather than allocated.
+	res, _ = sendRequest("GET", "/EXPIRING?n=1000000000000", nil, server)
+	resData.Value = nil
+	json.NewDecoder(res.Body).Decode(&resData)
+	if code := res.Result().StatusCode; code != http.StatusOK || len(resData.Value) != 3 {
+		t.Errorf("Expected all 3 expiring keys, got status %d and %v instead", code, resData.Value)
+	}
+
+	res, _ = sendRequest("GET", "/EXPIRING", nil, server)
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := NewServer(nil)
+	res, err := sendRequest("GET", "/PING", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+}
+
+func TestStats(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("key1", []byte("value1"))
+	for _, key := range []string{"key1", "key1", "missing"} {
+		if _, err := sendRequest("GET", "/GET/"+key, nil, server); err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+	}
+
+	res, err := sendRequest("GET", "/STATS", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	resData := struct {
+		Value map[string]json.RawMessage `json:"value"`
+		Ok    bool                       `json:"ok"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	expected := map[string]string{
+		"hits":         "2",
+		"misses":       "1",
+		"length":       "1",
+		"evictions":    "0",
+		"ttlHistogram": `{"+Inf":0,"3600000":0,"60000":0,"86400000":0,"never":1}`,
+	}
+	if !resData.Ok || len(resData.Value) != len(expected) {
+		t.Fatalf("Expected %v, got %v instead", expected, resData.Value)
+	}
+	for field, value := range expected {
+		if string(resData.Value[field]) != value {
+			t.Errorf("Expected %s to be %s, got %s instead", field, value, resData.Value[field])
+		}
+	}
+}
+
+func TestTTLHistogram(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.Set("permanent", []byte("v"))
+	server.cache.SetEx("seconds", []byte("v"), 30*time.Second)
+	server.cache.SetEx("minutes", []byte("v"), 30*time.Minute)
+	server.cache.SetEx("days", []byte("v"), 48*time.Hour)
+
+	tests := []struct {
+		url      string
+		expected map[string]int
+	}{
+		{"/TTLHIST", map[string]int{"60000": 1, "3600000": 1, "86400000": 0, "+Inf": 1, "never": 1}},
+		{"/TTLHIST?buckets=3600000,60000000000", map[string]int{"3600000": 2, "60000000000": 1, "+Inf": 0, "never": 1}},
+	}
+	for _, tt := range tests {
+		res, err := sendRequest("GET", tt.url, nil, server)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+		}
+		resData := struct {
+			Value map[string]int `json:"value"`
+			Ok    bool           `json:"ok"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&resData)
+		if !resData.Ok || fmt.Sprint(resData.Value) != fmt.Sprint(tt.expected) {
+			t.Errorf("%s: expected %v, got %v instead", tt.url, tt.expected, resData.Value)
+		}
+	}
+
+	res, err := sendRequest("GET", "/TTLHIST?buckets=60000,abc", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusBadRequest, code)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	server := NewServer(nil)
+	res, err := sendRequest("GET", "/INFO", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	resData := struct {
+		Value map[string]any `json:"value"`
+		Ok    bool           `json:"ok"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&resData)
+	if !resData.Ok || resData.Value["version"] != version.Version ||
+		resData.Value["commit"] != version.Commit || resData.Value["buildDate"] != version.BuildDate {
+		t.Errorf("Expected build information, got %v instead", resData.Value)
+	}
+	// The recorder does not open a connection.
+	if resData.Value["connections"] != float64(0) {
+		t.Errorf("Expected no connections, got %v instead", resData.Value["connections"])
+	}
+}
+
+func TestHealth(t *testing.T) {
+	server := NewServer(nil)
+	server.APIKey = "secret" // Probes do not authenticate.
+	server.cache.Set("key1", []byte("value1"))
+	server.cache.Set("key2", []byte("value2"))
+	time.Sleep(10 * time.Millisecond)
+
+	res, err := sendRequest("GET", "/HEALTH", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+	resData := struct {
+		Status      string `json:"status"`
+		Uptime      int64  `json:"uptime"`
+		CacheLength int    `json:"cacheLength"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&resData); err != nil {
+		t.Fatalf("Failed to decode the response: %v", err)
+	}
+	if resData.Status != "ok" {
+		t.Errorf("Expected status \"ok\", got \"%s\" instead", resData.Status)
+	}
+	if resData.Uptime != 0 || resData.CacheLength != 0 {
+		t.Errorf("Expected no details without the API key, got %+v instead", resData)
+	}
+
+	req, _ := http.NewRequest("GET", "/HEALTH", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if err := json.NewDecoder(rr.Body).Decode(&resData); err != nil {
+		t.Fatalf("Failed to decode the response: %v", err)
+	}
+	if resData.Uptime < 10 {
+		t.Errorf("Expected uptime of at least 10ms, got %dms instead", resData.Uptime)
+	}
+	if resData.CacheLength != 2 {
+		t.Errorf("Expected cache length 2, got %d instead", resData.CacheLength)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	server := NewServer(nil)
+	res, err := sendRequest("GET", "/readyz", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+
+	server.SetReady(false)
+	res, err = sendRequest("GET", "/readyz", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusServiceUnavailable, code)
+	}
+
+	// Requests are still served until the server is shut down.
+	res, err = sendRequest("GET", "/PING", nil, server)
+	if err != nil {
+		t.Errorf("Failed to send request: %v", err)
+	}
+	if code := res.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("Expected response status code %d, got %d instead", http.StatusOK, code)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	server := NewServer(nil)
+	native := nativesrv.NewServer(server.cache)
+	server.EnableWebSocket(native.ServeConn)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer native.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	ws, err := websocket.Dial(wsURL, "", ts.URL)
+	if err != nil {
+		t.Fatalf("Failed to open websocket: %v", err)
+	}
+	defer ws.Close()
+
+	if _, err = ws.Write([]byte("RCSP/1.0 PING\r\n")); err != nil {
+		t.Fatalf("Failed to send frame: %v", err)
+	}
+	var reply []byte
+	if err = websocket.Message.Receive(ws, &reply); err != nil {
+		t.Fatalf("Failed to receive frame: %v", err)
+	}
+	expected := "RCSP/1.0 PING OK\r\nMESSAGE: PONG\r\n"
+	if string(reply) != expected {
+		t.Errorf("Expected reply %q, got %q instead", expected, string(reply))
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	server := NewServer(nil)
+	native := nativesrv.NewServer(server.cache)
+	server.EnableWebSocket(native.ServeConn)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer native.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	ws, err := websocket.Dial(wsURL, "", "http://evil.example")
+	if err == nil {
+		ws.Close()
+		t.Fatal("Expected cross-origin websocket connection to be rejected")
+	}
+}
+
+func sendRequest(
+	method, url string,
+	body io.Reader,
+	server *Server,
+) (*httptest.ResponseRecorder, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+
+	return rr, nil
+}
+
+func waitForConns(srv *Server, expected int, t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for srv.ActiveConns() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d active connections, got %d instead", expected, srv.ActiveConns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
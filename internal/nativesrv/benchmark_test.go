@@ -3,6 +3,7 @@ package nativesrv
 import (
 	"net"
 	"testing"
+	"time"
 )
 
 func BenchmarkSet(b *testing.B) {
@@ -36,10 +37,49 @@ func BenchmarkSet(b *testing.B) {
 	}
 }
 
+// BenchmarkSetSameConn sends requests over a single connection. Run it with
+// -benchmem to see allocations per request, which include the ones of the server.
+func BenchmarkSetSameConn(b *testing.B) {
+	server := NewServer(nil)
+	serverAddr := "localhost:5000"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			b.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	req := request{
+		command: []byte("SET"),
+		key:     []byte("apollo"),
+		value:   []byte("Apollo is one of the Olympian deities in classical Greek and Roman religion and Greek and Roman mythology. (From Wikipedia, the free encyclopedia)"),
+	}
+	respBuf := [1024]byte{}
+	conn, err := net.Dial("tcp", serverAddr)
+	for i := 0; err != nil && i < 10; i++ {
+		time.Sleep(50 * time.Millisecond)
+		conn, err = net.Dial("tcp", serverAddr)
+	}
+	if err != nil {
+		b.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		req.write(conn)
+		n, err := conn.Read(respBuf[:])
+		if err != nil || n == 0 {
+			b.Fatalf("Error while reading from server")
+		}
+	}
+}
+
 func BenchmarkParseRequest(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		parseRequest([]byte(
 			"RCSP/1.0 SET\r\nKEY: apollo\r\nVALUE: Apollo is one of the Olympian deities in classical Greek and Roman religion and Greek and Roman mythology. (From Wikipedia, the free encyclopedia)\r\n",
-		))
+		), false)
 	}
 }
@@ -2,7 +2,9 @@ package nativesrv
 
 import (
 	"bytes"
+	"io"
 	"net"
+	"strconv"
 )
 
 const (
@@ -11,16 +13,34 @@ const (
 	ErrUnknownProtocol   = messageError("unknown protocol")
 	ErrInvalidKey        = messageError("invalid key")
 	ErrInvalidValue      = messageError("invalid value")
+	ErrMessageTooLarge   = messageError("message too large")
+	ErrIncompleteRequest = messageError("incomplete request")
 )
 
 type request struct {
 	command []byte
 	key     []byte
+	ttl     []byte // Optional time to live in milliseconds.
+	flags   []byte // Optional space separated list of command modifiers, e.g. NX.
 	value   []byte
+	framed  bool // RCSP/1.1 request, whose VALUE is preceded by VALUE-LENGTH.
+}
+
+// hasFlag reports whether flag is present in the FLAGS header of the request.
+func (r *request) hasFlag(flag string) bool {
+	for _, f := range bytes.Fields(r.flags) {
+		if string(f) == flag {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *request) write(conn net.Conn) (n int, err error) {
 	msg := []byte("RCSP/1.0")
+	if r.framed {
+		msg = []byte("RCSP/1.1")
+	}
 	if r.command != nil {
 		msg = append(msg, ' ')
 		msg = append(msg, r.command...)
@@ -31,60 +51,245 @@ func (r *request) write(conn net.Conn) (n int, err error) {
 		msg = append(msg, r.key...)
 		msg = append(msg, []byte("\r\n")...)
 	}
-	if r.value != nil {
-		msg = append(msg, []byte("VALUE: ")...)
-		msg = append(msg, r.value...)
+	if r.ttl != nil {
+		msg = append(msg, []byte("TTL: ")...)
+		msg = append(msg, r.ttl...)
+		msg = append(msg, []byte("\r\n")...)
+	}
+	if r.flags != nil {
+		msg = append(msg, []byte("FLAGS: ")...)
+		msg = append(msg, r.flags...)
 		msg = append(msg, []byte("\r\n")...)
 	}
+	if r.value != nil {
+		msg = appendValue(msg, r.value, r.framed)
+	}
 	return conn.Write(msg)
 }
 
-func parseRequest(msg []byte) (request, error) {
-	if len(msg) == 0 {
-		return request{}, ErrMalformedRequest
+// appendValue appends the VALUE line to msg, preceded by VALUE-LENGTH if framed.
+func appendValue(msg, value []byte, framed bool) []byte {
+	if framed {
+		msg = append(msg, []byte("VALUE-LENGTH: ")...)
+		msg = strconv.AppendInt(msg, int64(len(value)), 10)
+		msg = append(msg, []byte("\r\n")...)
 	}
+	msg = append(msg, []byte("VALUE: ")...)
+	msg = append(msg, value...)
+	return append(msg, []byte("\r\n")...)
+}
 
-	msgLines := bytes.SplitN(msg, []byte("\r\n"), 3)
-	linesCount := len(msgLines)
-	if linesCount != 0 && len(msgLines[linesCount-1]) == 0 {
-		msgLines = msgLines[:linesCount-1]
-		linesCount -= 1
+// maxEmptyReads is the number of consecutive reads returning neither bytes nor an
+// error after which readMessage fails with io.ErrNoProgress.
+const maxEmptyReads = 100
+
+// readMessage reads from r up to the end of a line, using buf for individual reads.
+// A read that stops in the middle of a line, e.g. because a large value spans
+// several TCP segments, is followed by further reads. The returned bytes may still
+// hold only a part of a message, e.g. when a client writes the header lines and
+// the VALUE separately, which parseRequest reports with ErrIncompleteRequest.
+//
+// A message longer than MaxMessageSize is discarded up to its end and
+// ErrMessageTooLarge is returned, so that the next message can still be read.
+func readMessage(r io.Reader, buf []byte) ([]byte, error) {
+	var msg []byte
+	tooLarge := false
+	for empty := 0; ; {
+		n, err := r.Read(buf)
+		if n == 0 && err == nil {
+			// Readers should not return zero bytes without an error, but give up on
+			// the ones that keep doing so rather than spinning, like bufio does.
+			if empty++; empty == maxEmptyReads {
+				return nil, io.ErrNoProgress
+			}
+			continue
+		}
+		empty = 0
+		msg = append(msg, buf[:n]...)
+		complete := n > 0 && bytes.HasSuffix(msg, []byte("\r\n"))
+		if len(msg) > MaxMessageSize {
+			// Keep the last byte in case CRLF is split between reads.
+			msg = append(msg[:0], msg[len(msg)-1])
+			tooLarge = true
+		}
+		if complete {
+			if tooLarge {
+				return nil, ErrMessageTooLarge
+			}
+			return msg, nil
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
-	msgLines[linesCount-1] = bytes.TrimSuffix(msgLines[linesCount-1], []byte("\r\n"))
-	headerTokens := bytes.Split(msgLines[0], []byte(" "))
-	if len(headerTokens) != 2 || !bytes.Equal(headerTokens[0], []byte("RCSP/1.0")) {
-		return request{}, ErrUnknownProtocol
+}
+
+// parseRequest parses the first request in buf and returns it together with the
+// number of bytes it takes. Requests are delimited by the start line of the next
+// one, so that clients can pipeline them, which means that an RCSP/1.0 VALUE cannot
+// contain "\r\nRCSP/1.0 " or "\r\nRCSP/1.1 ". An RCSP/1.1 VALUE is preceded by
+// VALUE-LENGTH and may contain any bytes; ErrIncompleteRequest is returned if buf
+// ends before it does.
+//
+// A request that runs to the end of buf is also incomplete while it lacks a line
+// its command requires, see requiredLines, unless atEOF reports that no more bytes
+// follow, in which case it is returned as it is for its handler to reject.
+func parseRequest(buf []byte, atEOF bool) (request, int, error) {
+	if len(buf) == 0 {
+		return request{}, 0, ErrMalformedRequest
+	}
+	n := len(buf)
+	if i := nextStartLine(buf); i >= 0 {
+		n = i + len("\r\n")
+	}
+	framed := bytes.HasPrefix(buf, []byte("RCSP/1.1 "))
+	var value []byte
+	head := buf[:n]
+	if i := bytes.Index(head, []byte("\r\nVALUE-LENGTH: ")); framed && i >= 0 {
+		head = buf[:i+len("\r\n")]
+		var end int
+		var err error
+		value, end, err = cutFramedValue(buf[len(head):])
+		if err == ErrIncompleteRequest {
+			return request{}, 0, err
+		}
+		if err != nil {
+			return request{}, len(buf), err
+		}
+		n = len(head) + end
 	}
 
-	var (
-		parsedReq      request
-		encounteredErr error
-	)
+	msg := bytes.TrimSuffix(head, []byte("\r\n"))
+	if len(bytes.TrimSpace(msg)) == 0 {
+		// Nothing but whitespace, e.g. a stray CRLF sent by a client.
+		return request{}, n, ErrMalformedRequest
+	}
+	headerLine, rest, _ := bytes.Cut(msg, []byte("\r\n"))
+	headerTokens := bytes.Split(headerLine, []byte(" "))
+	if len(headerTokens) != 2 || !isProtocol(headerTokens[0]) {
+		return request{}, n, ErrUnknownProtocol
+	}
+
+	parsedReq := request{framed: framed, value: value}
 
 	// Parse Command:
 	parsedReq.command = headerTokens[1]
-	// Parse Key:
-	if linesCount > 1 {
-		keyTokens := bytes.SplitN(msgLines[1], []byte(": "), 2)
-		if len(keyTokens) != 2 {
-			encounteredErr = ErrInvalidKey
-		} else if !bytes.Equal(keyTokens[0], []byte("KEY")) {
-			encounteredErr = ErrMalformedRequest
-		} else {
-			parsedReq.key = keyTokens[1]
+	// Parse Key, optional TTL and FLAGS, and Value. KEY, when present, must come
+	// first. VALUE is always last and takes the remainder of the message, so it
+	// may contain CRLF.
+	for i := 0; len(rest) > 0; i++ {
+		if bytes.HasPrefix(rest, []byte("VALUE: ")) {
+			if framed {
+				return parsedReq, n, ErrMalformedRequest
+			}
+			parsedReq.value = rest[len("VALUE: "):]
+			break
 		}
-	}
-	// Parse Value:
-	if linesCount > 2 {
-		valueTokens := bytes.SplitN(msgLines[2], []byte(": "), 2)
-		if len(valueTokens) != 2 || !bytes.Equal(valueTokens[0], []byte("VALUE")) {
-			encounteredErr = ErrMalformedRequest
-		} else {
-			parsedReq.value = valueTokens[1]
+		var line []byte
+		line, rest, _ = bytes.Cut(rest, []byte("\r\n"))
+		tokenName, tokenValue, found := bytes.Cut(line, []byte(": "))
+		if !found {
+			if i == 0 {
+				return parsedReq, n, ErrInvalidKey
+			}
+			return parsedReq, n, ErrMalformedRequest
+		}
+		switch {
+		case i == 0 && bytes.Equal(tokenName, []byte("KEY")):
+			parsedReq.key = tokenValue
+		case bytes.Equal(tokenName, []byte("TTL")) && parsedReq.ttl == nil:
+			parsedReq.ttl = tokenValue
+		case bytes.Equal(tokenName, []byte("FLAGS")) && parsedReq.flags == nil:
+			parsedReq.flags = tokenValue
+		default:
+			return parsedReq, n, ErrMalformedRequest
 		}
 	}
 
-	return parsedReq, encounteredErr
+	if n == len(buf) && !atEOF && !hasRequiredLines(&parsedReq) {
+		return request{}, 0, ErrIncompleteRequest
+	}
+	return parsedReq, n, nil
+}
+
+// requiredLines lists the lines that a request of the given command must contain.
+// A request is not complete without them, as there is no other way to tell the
+// end of an RCSP message that is not followed by another one.
+var requiredLines = map[string]struct{ key, ttl, value bool }{
+	"AUTH":           {value: true},
+	"SET":            {key: true, value: true},
+	"SETEX":          {key: true, ttl: true, value: true},
+	"SETNX":          {key: true, value: true},
+	"GET":            {key: true},
+	"DELETE":         {key: true},
+	"MGET":           {key: true},
+	"MDELETE":        {key: true},
+	"EXISTS":         {key: true},
+	"TTL":            {key: true},
+	"TOUCH":          {key: true, ttl: true},
+	"PERSIST":        {key: true},
+	"GETORSET":       {key: true, value: true},
+	"GETSET":         {key: true, value: true},
+	"DECREAP":        {key: true},
+	"INCR":           {key: true},
+	"DECR":           {key: true},
+	"DELEXPIRED":     {key: true},
+	"EXPIREMATCHING": {key: true, ttl: true},
+	"EXPIRING":       {value: true},
+	"DEFAULTTTL":     {value: true},
+}
+
+// hasRequiredLines reports whether req contains the lines listed for its command
+// in requiredLines.
+func hasRequiredLines(req *request) bool {
+	required := requiredLines[string(req.command)]
+	return (!required.key || req.key != nil) &&
+		(!required.ttl || req.ttl != nil) &&
+		(!required.value || req.value != nil)
+}
+
+// nextStartLine returns the index of the CRLF that precedes the start line of the
+// next message in buf, or -1 if there is none.
+func nextStartLine(buf []byte) int {
+	i := bytes.Index(buf, []byte("\r\nRCSP/1.0 "))
+	if j := bytes.Index(buf, []byte("\r\nRCSP/1.1 ")); j >= 0 && (i < 0 || j < i) {
+		i = j
+	}
+	return i
+}
+
+func isProtocol(token []byte) bool {
+	return bytes.Equal(token, []byte("RCSP/1.0")) || bytes.Equal(token, []byte("RCSP/1.1"))
+}
+
+// cutFramedValue parses the VALUE-LENGTH and VALUE lines at the start of buf and
+// returns the value together with the number of bytes both lines take.
+func cutFramedValue(buf []byte) ([]byte, int, error) {
+	line, rest, found := bytes.Cut(buf, []byte("\r\n"))
+	if !found {
+		return nil, 0, ErrIncompleteRequest
+	}
+	length, err := strconv.Atoi(string(line[len("VALUE-LENGTH: "):]))
+	if err != nil || length < 0 {
+		return nil, 0, ErrInvalidValue
+	}
+	if length > MaxMessageSize {
+		return nil, 0, ErrMessageTooLarge
+	}
+	if !bytes.HasPrefix(rest, []byte("VALUE: ")) {
+		if bytes.HasPrefix([]byte("VALUE: "), rest) {
+			return nil, 0, ErrIncompleteRequest
+		}
+		return nil, 0, ErrMalformedRequest
+	}
+	rest = rest[len("VALUE: "):]
+	if len(rest) < length+len("\r\n") {
+		return nil, 0, ErrIncompleteRequest
+	}
+	if !bytes.HasPrefix(rest[length:], []byte("\r\n")) {
+		return nil, 0, ErrInvalidValue
+	}
+	return rest[:length], len(buf) - len(rest) + length + len("\r\n"), nil
 }
 
 type response struct {
@@ -93,10 +298,14 @@ type response struct {
 	message []byte
 	key     []byte
 	value   []byte
+	framed  bool // Reply to an RCSP/1.1 request, see request.framed.
 }
 
 func (r *response) write(conn net.Conn) (n int, err error) {
 	msg := []byte("RCSP/1.0")
+	if r.framed {
+		msg = []byte("RCSP/1.1")
+	}
 	if r.command != nil {
 		msg = append(msg, ' ')
 		msg = append(msg, r.command...)
@@ -117,9 +326,7 @@ func (r *response) write(conn net.Conn) (n int, err error) {
 		msg = append(msg, []byte("\r\n")...)
 	}
 	if r.value != nil {
-		msg = append(msg, []byte("VALUE: ")...)
-		msg = append(msg, r.value...)
-		msg = append(msg, []byte("\r\n")...)
+		msg = appendValue(msg, r.value, r.framed)
 	}
 	return conn.Write(msg)
 }
@@ -146,6 +353,15 @@ func parseResponse(msg []byte) (response, error) {
 	if len(msg) == 0 {
 		return response{}, ErrMalformedResponse
 	}
+	framed := bytes.HasPrefix(msg, []byte("RCSP/1.1 "))
+	var value []byte
+	if i := bytes.Index(msg, []byte("\r\nVALUE-LENGTH: ")); framed && i >= 0 {
+		var err error
+		if value, _, err = cutFramedValue(msg[i+len("\r\n"):]); err != nil {
+			return response{}, ErrMalformedResponse
+		}
+		msg = msg[:i+len("\r\n")]
+	}
 
 	msgLines := bytes.SplitN(msg, []byte("\r\n"), 4)
 	linesCount := len(msgLines)
@@ -158,12 +374,12 @@ func parseResponse(msg []byte) (response, error) {
 	if len(headerTokens) < 2 {
 		return response{}, ErrMalformedResponse
 	}
-	if !bytes.Equal(headerTokens[0], []byte("RCSP/1.0")) {
+	if !isProtocol(headerTokens[0]) {
 		return response{}, ErrUnknownProtocol
 	}
 
 	var (
-		parsedResp     response
+		parsedResp     = response{framed: framed, value: value}
 		encounteredErr error
 	)
 
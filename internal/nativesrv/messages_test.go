@@ -2,6 +2,8 @@ package nativesrv
 
 import (
 	"bytes"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -24,6 +26,24 @@ func TestParseRequest(t *testing.T) {
 			expectedReq: request{},
 			expectedErr: ErrMalformedRequest,
 		},
+		{
+			name:        "Lone CRLF",
+			msg:         []byte("\r\n"),
+			expectedReq: request{},
+			expectedErr: ErrMalformedRequest,
+		},
+		{
+			name:        "Single space",
+			msg:         []byte(" "),
+			expectedReq: request{},
+			expectedErr: ErrMalformedRequest,
+		},
+		{
+			name:        "Whitespace only",
+			msg:         []byte(" \t\r\n\r\n"),
+			expectedReq: request{},
+			expectedErr: ErrMalformedRequest,
+		},
 		{
 			name:        "Invalid protocol",
 			msg:         []byte("ABCD SET\r\n"),
@@ -40,6 +60,71 @@ func TestParseRequest(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name: "Valid SET request with CRLF in value",
+			msg:  []byte("RCSP/1.0 SET\r\nKEY: key1\r\nVALUE: a\r\nb\r\n"),
+			expectedReq: request{
+				command: []byte("SET"),
+				key:     []byte("key1"),
+				value:   []byte("a\r\nb"),
+			},
+			expectedErr: nil,
+		},
+		{
+			name: "Valid RCSP/1.1 SET request with binary value",
+			msg:  []byte("RCSP/1.1 SET\r\nKEY: key1\r\nVALUE-LENGTH: 20\r\nVALUE: a\r\n\x00b\r\nRCSP/1.0 PING\r\n"),
+			expectedReq: request{
+				command: []byte("SET"),
+				key:     []byte("key1"),
+				value:   []byte("a\r\n\x00b\r\nRCSP/1.0 PING"),
+			},
+			expectedErr: nil,
+		},
+		{
+			name:        "Incomplete RCSP/1.1 value",
+			msg:         []byte("RCSP/1.1 SET\r\nKEY: key1\r\nVALUE-LENGTH: 10\r\nVALUE: a\r\n"),
+			expectedReq: request{},
+			expectedErr: ErrIncompleteRequest,
+		},
+		{
+			name:        "Invalid RCSP/1.1 value length",
+			msg:         []byte("RCSP/1.1 SET\r\nKEY: key1\r\nVALUE-LENGTH: x\r\nVALUE: a\r\n"),
+			expectedReq: request{},
+			expectedErr: ErrInvalidValue,
+		},
+		{
+			name:        "RCSP/1.1 value without length",
+			msg:         []byte("RCSP/1.1 SET\r\nKEY: key1\r\nVALUE: a\r\n"),
+			expectedReq: request{command: []byte("SET"), key: []byte("key1")},
+			expectedErr: ErrMalformedRequest,
+		},
+		{
+			name: "Valid DEFAULTTTL request",
+			msg:  []byte("RCSP/1.0 DEFAULTTTL\r\nVALUE: 1000\r\n"),
+			expectedReq: request{
+				command: []byte("DEFAULTTTL"),
+				value:   []byte("1000"),
+			},
+			expectedErr: nil,
+		},
+		{
+			name: "Valid SET request with TTL and FLAGS",
+			msg:  []byte("RCSP/1.0 SET\r\nKEY: lock\r\nTTL: 5000\r\nFLAGS: NX\r\nVALUE: owner\r\n"),
+			expectedReq: request{
+				command: []byte("SET"),
+				key:     []byte("lock"),
+				ttl:     []byte("5000"),
+				flags:   []byte("NX"),
+				value:   []byte("owner"),
+			},
+			expectedErr: nil,
+		},
+		{
+			name:        "Duplicate TTL header",
+			msg:         []byte("RCSP/1.0 SET\r\nKEY: lock\r\nTTL: 1\r\nTTL: 2\r\nVALUE: owner\r\n"),
+			expectedReq: request{command: []byte("SET"), key: []byte("lock"), ttl: []byte("1")},
+			expectedErr: ErrMalformedRequest,
+		},
 		{
 			name: "Valid GET request",
 			msg:  []byte("RCSP/1.0 GET\r\nKEY: key1\r\n"),
@@ -114,7 +199,7 @@ func TestParseRequest(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			req, err := parseRequest(tc.msg)
+			req, _, err := parseRequest(tc.msg, false)
 			if err != tc.expectedErr {
 				t.Errorf("Expected error value \"%v\", got \"%v\" instead",
 					tc.expectedErr, err)
@@ -127,6 +212,14 @@ func TestParseRequest(t *testing.T) {
 				t.Errorf("Expected key \"%s\", got \"%s\" instead",
 					string(tc.expectedReq.key), string(req.key))
 			}
+			if !bytes.Equal(req.ttl, tc.expectedReq.ttl) {
+				t.Errorf("Expected TTL \"%s\", got \"%s\" instead",
+					string(tc.expectedReq.ttl), string(req.ttl))
+			}
+			if !bytes.Equal(req.flags, tc.expectedReq.flags) {
+				t.Errorf("Expected flags \"%s\", got \"%s\" instead",
+					string(tc.expectedReq.flags), string(req.flags))
+			}
 			if !bytes.Equal(req.value, tc.expectedReq.value) {
 				t.Errorf("Expected value \"%s\", got \"%s\" instead",
 					string(tc.expectedReq.value), string(req.value))
@@ -135,6 +228,92 @@ func TestParseRequest(t *testing.T) {
 	}
 }
 
+func TestParseRequestPipelined(t *testing.T) {
+	buf := []byte("RCSP/1.0 SET\r\nKEY: key1\r\nVALUE: a\r\nb\r\nRCSP/1.0 GET\r\nKEY: key1\r\nRCSP/1.0 PING\r\n")
+	expected := []request{
+		{command: []byte("SET"), key: []byte("key1"), value: []byte("a\r\nb")},
+		{command: []byte("GET"), key: []byte("key1")},
+		{command: []byte("PING")},
+	}
+	for i, exp := range expected {
+		req, n, err := parseRequest(buf, false)
+		if err != nil {
+			t.Fatalf("Request %d: expected no error, got %v instead", i, err)
+		}
+		if !bytes.Equal(req.command, exp.command) || !bytes.Equal(req.key, exp.key) || !bytes.Equal(req.value, exp.value) {
+			t.Errorf("Request %d: expected %s %s %q, got %s %s %q instead",
+				i, exp.command, exp.key, exp.value, req.command, req.key, req.value)
+		}
+		buf = buf[n:]
+	}
+	if len(buf) != 0 {
+		t.Errorf("Expected all bytes to be consumed, %q left", buf)
+	}
+}
+
+func TestParseRequestSplit(t *testing.T) {
+	messages := []string{
+		"RCSP/1.0 SET\r\nKEY: key1\r\nTTL: 1000\r\nVALUE: a\r\n",
+		"RCSP/1.0 TOUCH\r\nKEY: key1\r\nTTL: 1000\r\n",
+		"RCSP/1.0 AUTH\r\nVALUE: secret\r\n",
+		"RCSP/1.1 GETSET\r\nKEY: key1\r\nVALUE-LENGTH: 1\r\nVALUE: a\r\n",
+	}
+	for _, msg := range messages {
+		// A split at any line boundary before VALUE-LENGTH or the last line leaves
+		// the request incomplete.
+		end := strings.Index(msg, "VALUE-LENGTH")
+		if end < 0 {
+			end = len(msg) - 1
+		}
+		for i := 1; i < end; i++ {
+			if !strings.HasSuffix(msg[:i], "\r\n") {
+				continue
+			}
+			part := []byte(msg[:i])
+			if _, n, err := parseRequest(part, false); err != ErrIncompleteRequest || n != 0 {
+				t.Errorf("Expected %q to be incomplete, got n %d and error %v instead", part, n, err)
+			}
+			// Unless the client has closed the connection or sent the next request.
+			if _, n, err := parseRequest(part, true); err == ErrIncompleteRequest || n != len(part) {
+				t.Errorf("Expected %q to be parsed at EOF, got n %d and error %v instead", part, n, err)
+			}
+			next := append(part, "RCSP/1.0 PING\r\n"...)
+			if _, n, err := parseRequest(next, false); err == ErrIncompleteRequest || n != len(part) {
+				t.Errorf("Expected %q to end before the next request, got n %d and error %v instead", next, n, err)
+			}
+		}
+		if _, n, err := parseRequest([]byte(msg), false); err != nil || n != len(msg) {
+			t.Errorf("Expected %q to be complete, got n %d and error %v instead", msg, n, err)
+		}
+	}
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte("RCSP/1.0 SET\r\nKEY: key1\r\nTTL: 1000\r\nFLAGS: NX\r\nVALUE: a\r\nb\r\n"))
+	f.Add([]byte("RCSP/1.0 GET\r\nKEY: key1\r\nRCSP/1.0 PING\r\n"))
+	f.Add([]byte("\r\n"))
+	f.Add([]byte(" "))
+	f.Add([]byte("RCSP/1.0 \r\nKEY\r\n"))
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		_, n, err := parseRequest(buf, false)
+		if len(buf) == 0 {
+			if err == nil {
+				t.Errorf("Expected an error for an empty message")
+			}
+			return
+		}
+		if err == ErrIncompleteRequest {
+			if n != 0 {
+				t.Errorf("Expected n to be 0 for an incomplete request, got %d instead", n)
+			}
+			return
+		}
+		if n <= 0 || n > len(buf) {
+			t.Errorf("Expected 0 < n <= %d, got %d instead", len(buf), n)
+		}
+	})
+}
+
 func TestParseResponse(t *testing.T) {
 	testCases := []struct {
 		name         string
@@ -172,6 +351,17 @@ func TestParseResponse(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name: "Valid RCSP/1.1 GET response with binary value",
+			msg:  []byte("RCSP/1.1 GET OK\r\nKEY: key1\r\nVALUE-LENGTH: 7\r\nVALUE: a\r\n\x00b\r\n\r\n"),
+			expectedResp: response{
+				command: []byte("GET"),
+				ok:      true,
+				key:     []byte("key1"),
+				value:   []byte("a\r\n\x00b\r\n"),
+			},
+			expectedErr: nil,
+		},
 		{
 			name: "Valid unsuccessful SET response",
 			msg:  []byte("RCSP/1.0 SET NOT_OK\r\nMESSAGE: Failed to set the key\r\nKEY: key1\r\n"),
@@ -276,3 +466,15 @@ func TestParseResponse(t *testing.T) {
 		})
 	}
 }
+
+// emptyReader returns neither bytes nor an error, which io.Reader discourages.
+type emptyReader struct{}
+
+func (emptyReader) Read([]byte) (int, error) { return 0, nil }
+
+func TestReadMessageNoProgress(t *testing.T) {
+	buf := make([]byte, DefaultMessageSize)
+	if _, err := readMessage(emptyReader{}, buf); err != io.ErrNoProgress {
+		t.Errorf("Expected io.ErrNoProgress, got %v instead", err)
+	}
+}
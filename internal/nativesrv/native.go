@@ -5,12 +5,21 @@
 package nativesrv
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"net"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +27,7 @@ import (
 	"time"
 
 	"github.com/nmezhenskyi/rcs/internal/cache"
+	"github.com/nmezhenskyi/rcs/internal/version"
 	"github.com/rs/zerolog"
 )
 
@@ -30,19 +40,79 @@ const (
 	//
 	// See implementation of https://pkg.go.dev/net/http#Server.Shutdown.
 	shutdownPollIntervalMax = 500000000 // 500ms
+
+	// keysInfoLimit bounds the number of entries in KEYSINFO and EXPIRING responses,
+	// so that it stays well below MaxMessageSize for large caches.
+	keysInfoLimit = 1000
+
+	// maxTTLMillis is the largest TTL in milliseconds that fits in a time.Duration.
+	maxTTLMillis = math.MaxInt64 / int64(time.Millisecond)
+
+	// traceFrameLimit bounds the number of bytes of a single message dumped
+	// when enabled by Server.SetTraceFrames.
+	traceFrameLimit = 512
+)
+
+// ConnLimitPolicy determines what happens to a new connection while Server.MaxConns
+// connections are served.
+type ConnLimitPolicy int
+
+const (
+	// RejectOverLimit answers the connection with NOT_OK and closes it. This is the default.
+	RejectOverLimit ConnLimitPolicy = iota
+	// WaitOverLimit holds the connection, and stops accepting others, until one of
+	// the served connections is closed.
+	WaitOverLimit
 )
 
 // Server implements RCS Native TCP Protocol.
 type Server struct {
 	cache *cache.CacheMap
 
-	inShutdown atomicBool
+	inShutdown  atomicBool
+	traceFrames atomicBool // See SetTraceFrames.
 
 	mu          sync.Mutex
 	listener    *srvListener
-	activeConns map[net.Conn]struct{}
+	activeConns map[net.Conn]connInfo
+	migration   *migration
 
 	Logger zerolog.Logger // By defaut Logger is disabled, but can be manually attached.
+
+	// ConnLogSampling, if greater than 1, logs only every Nth accepted and every Nth
+	// closed connection, so that a connection storm does not flood the debug log.
+	ConnLogSampling uint64
+
+	// APIKey, if set, must be sent with AUTH before any other command is accepted
+	// on a connection. Empty by default, which disables authentication.
+	APIKey string
+
+	// ConfirmPurge, if set, makes PURGE refuse to empty the cache unless the request
+	// carries "CONFIRM" as VALUE, so that a stray request cannot wipe it. Disabled by
+	// default for compatibility with existing clients.
+	ConfirmPurge bool
+
+	// IdleTimeout, if positive, closes a connection that sends nothing for that long,
+	// so that abandoned connections do not hold on to their goroutines. Zero by
+	// default, which keeps connections open until the client closes them.
+	IdleTimeout time.Duration
+
+	// WriteTimeout, if positive, limits how long writing a response may take. A client
+	// that stops reading its responses fails the write, which closes the connection.
+	// Zero by default, which lets writes block until the client reads.
+	WriteTimeout time.Duration
+
+	// MaxConns, if positive, limits the number of connections served at once, including
+	// the ones passed to ServeConn. ConnLimitPolicy decides what happens to the ones over
+	// the limit. Both must be set before the server starts serving.
+	MaxConns        int
+	ConnLimitPolicy ConnLimitPolicy
+
+	slots     chan struct{} // Semaphore of MaxConns, see acquireSlot.
+	slotsOnce sync.Once
+
+	acceptedConns atomic.Uint64 // Counts accepted connections for ConnLogSampling.
+	closedConns   atomic.Uint64 // Counts closed connections for ConnLogSampling.
 }
 
 // NewServer initializes a new Server instance ready to be used and returns a pointer to it.
@@ -53,7 +123,7 @@ func NewServer(c *cache.CacheMap) *Server {
 	}
 	return &Server{
 		cache:       c,
-		activeConns: make(map[net.Conn]struct{}),
+		activeConns: make(map[net.Conn]connInfo),
 		Logger:      zerolog.New(os.Stderr).Level(zerolog.Disabled),
 	}
 }
@@ -62,7 +132,7 @@ func NewServer(c *cache.CacheMap) *Server {
 // handles requests on incoming connections according to RCSP.
 func (s *Server) ListenAndServe(addr string) error {
 	if s.inShutdown.isSet() {
-		s.Logger.Info().Msg("ListenAndServeTLS aborted: Server is in shutdown mode")
+		s.Logger.Info().Msg("ListenAndServe aborted: Server is in shutdown mode")
 		return nil
 	}
 	s.Logger.Info().Msg("Starting native server on " + addr)
@@ -120,7 +190,7 @@ func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
 // a context error.
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.inShutdown.setTrue()
-	err := s.listener.Close()
+	err := s.closeListener()
 	if err != nil {
 		s.Logger.Error().Err(err).Msg("underlying tcp listener errored while closing")
 	}
@@ -145,7 +215,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		s.Logger.Info().Msg("native server has been shutdown")
 	}()
 	for {
-		if s.numConns() == 0 {
+		if s.ActiveConns() == 0 {
 			return err
 		}
 		select {
@@ -164,7 +234,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 // Close returns any error returned from closing the Server's underlying listener.
 func (s *Server) Close() error {
 	s.inShutdown.setTrue()
-	err := s.listener.Close()
+	err := s.closeListener()
 	if err != nil {
 		s.Logger.Error().Err(err).Msg("underlying tcp listener errored while closing")
 	}
@@ -180,14 +250,78 @@ func (s *Server) Close() error {
 	return err
 }
 
+// Migrate makes the server answer writes to keys matching any of the given patterns
+// with "MOVED <addr>", so that clients retarget them to addr. This applies to every
+// command that writes a single key, e.g. SET or INCR, and to MDELETE if all of its
+// keys match. MDELETE of both matching and other keys, as well as PURGE, DELEXPIRED
+// and EXPIREMATCHING, which write keys by pattern, are refused with "Migration in
+// progress" until StopMigration is called. Reads are still served locally. Patterns
+// use the syntax of path.Match. Calling Migrate again replaces the previous migration.
+func (s *Server) Migrate(addr string, patterns ...string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.migration = &migration{addr: addr, patterns: patterns}
+	s.mu.Unlock()
+	return nil
+}
+
+// StopMigration makes the server serve all writes locally again.
+func (s *Server) StopMigration() {
+	s.mu.Lock()
+	s.migration = nil
+	s.mu.Unlock()
+}
+
+// SetTraceFrames enables or disables dumping of raw request and response bytes at
+// trace level, also on connections that are already being served. Each message is
+// dumped up to traceFrameLimit bytes, with the API key of AUTH requests masked.
+// Disabled by default.
+func (s *Server) SetTraceFrames(enabled bool) {
+	if enabled {
+		s.traceFrames.setTrue()
+	} else {
+		s.traceFrames.setFalse()
+	}
+}
+
+// ServeConn handles requests on an already established connection according
+// to RCSP, e.g. a connection tunneled over WebSocket. It blocks until the
+// connection is closed. The connection is tracked like the ones accepted by
+// ListenAndServe, so Shutdown waits for it and Close terminates it.
+func (s *Server) ServeConn(conn net.Conn) {
+	if !s.acquireSlot() {
+		s.rejectConn(conn)
+		return
+	}
+	defer s.releaseSlot()
+	if !s.trackConn(conn) {
+		conn.Close()
+		return
+	}
+	s.logConn(&s.acceptedConns, "Serving external connection", conn)
+	s.handleConnection(conn)
+}
+
 // serve accepts connections on the given listener and delegates them to
 // handleConnection for processing.
 func (s *Server) serve(lis net.Listener) error {
-	lis = &srvListener{Listener: lis}
+	srvLis := &srvListener{Listener: lis}
 	s.mu.Lock()
-	s.listener = lis.(*srvListener)
+	// Shutdown or Close may have run before the listener was registered,
+	// in which case nobody else is going to close it.
+	if s.inShutdown.isSet() {
+		s.mu.Unlock()
+		srvLis.Close()
+		return nil
+	}
+	s.listener = srvLis
 	s.mu.Unlock()
-	defer s.listener.Close()
+	lis = srvLis
+	defer srvLis.Close()
 	for {
 		if s.inShutdown.isSet() {
 			return nil
@@ -202,12 +336,79 @@ func (s *Server) serve(lis net.Listener) error {
 			}
 			return err
 		}
-		s.Logger.Debug().Msg("Received new connection (" + conn.RemoteAddr().String() + ")")
-		s.mu.Lock()
-		s.activeConns[conn] = struct{}{}
-		s.mu.Unlock()
-		go s.handleConnection(conn)
+		if !s.acquireSlot() {
+			s.rejectConn(conn)
+			continue
+		}
+		s.logConn(&s.acceptedConns, "Received new connection", conn)
+		if !s.trackConn(conn) {
+			conn.Close()
+			s.releaseSlot()
+			return nil
+		}
+		go func() {
+			defer s.releaseSlot()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// acquireSlot reserves one of MaxConns slots for a new connection. With
+// WaitOverLimit it blocks until a slot is free, with RejectOverLimit it returns
+// false if there is none.
+func (s *Server) acquireSlot() bool {
+	if s.MaxConns <= 0 {
+		return true
+	}
+	s.slotsOnce.Do(func() { s.slots = make(chan struct{}, s.MaxConns) })
+	if s.ConnLimitPolicy == WaitOverLimit {
+		s.slots <- struct{}{}
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseSlot frees the slot reserved by acquireSlot.
+func (s *Server) releaseSlot() {
+	if s.MaxConns > 0 {
+		<-s.slots
+	}
+}
+
+// rejectConn tells the client that the server is at MaxConns and closes the connection.
+func (s *Server) rejectConn(conn net.Conn) {
+	s.Logger.Debug().Msg("Rejected connection over the limit (" + conn.RemoteAddr().String() + ")")
+	var resp = response{}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	resp.writeError(conn, nil, []byte("Too many connections"))
+	conn.Close()
+}
+
+// readBufPool holds read buffers of DefaultMessageSize bytes, so that connections
+// do not allocate their own.
+var readBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, DefaultMessageSize)
+		return &buf
+	},
+}
+
+// logConn logs a connection event at debug level, subject to ConnLogSampling.
+// The message is only built if it is going to be written.
+func (s *Server) logConn(counter *atomic.Uint64, msg string, conn net.Conn) {
+	e := s.Logger.Debug()
+	if !e.Enabled() {
+		return
 	}
+	if n := s.ConnLogSampling; n > 1 && counter.Add(1)%n != 1 {
+		return
+	}
+	e.Msg(msg + " (" + conn.RemoteAddr().String() + ")")
 }
 
 // handleConnection exchanges messages with the given connection. It processes an
@@ -216,58 +417,199 @@ func (s *Server) serve(lis net.Listener) error {
 // connection for multiple requests.
 func (s *Server) handleConnection(conn net.Conn) {
 	defer func() {
-		conn.Close()
-		s.mu.Lock()
-		delete(s.activeConns, conn)
-		s.mu.Unlock()
-		s.Logger.Debug().Msg("Closed connection (" + conn.RemoteAddr().String() + ")")
+		s.closeConn(conn)
+		s.logConn(&s.closedConns, "Closed connection", conn)
 	}()
 
+	var session session
+	var rw net.Conn = conn
+	// Messages are copied out of buf by readMessage, so it can be shared with
+	// later connections once this one is closed.
+	bufp := readBufPool.Get().(*[]byte)
+	defer readBufPool.Put(bufp)
+	buf := *bufp
+	var wc *timeoutConn
+	if s.WriteTimeout > 0 {
+		wc = &timeoutConn{Conn: conn, timeout: s.WriteTimeout}
+		rw = wc
+	}
+	tc := &tracingConn{Conn: rw, logger: &s.Logger, enabled: &s.traceFrames}
+	rw = tc
+
+	// pending holds pipelined requests that have been read but not processed yet.
+	var pending []byte
+	// eof is set once the client has closed its side of the connection, after which
+	// the requests left in pending are processed as they are.
+	var eof bool
+
 MsgLoop:
 	for {
-		buf := make([]byte, DefaultMessageSize) // TODO: dynamically adjust buffer size
-		n, err := conn.Read(buf)
-		if n == 0 || err != nil {
-			s.Logger.Error().Err(err).Msg(fmt.Sprintf("error while reading from %s", conn.RemoteAddr()))
+		if wc != nil && wc.err != nil {
+			// Handlers ignore errors of their writes, a failed one ends the connection.
+			s.Logger.Error().Err(wc.err).Msg(fmt.Sprintf("error while writing to %s", rw.RemoteAddr()))
 			return
 		}
+		if len(pending) == 0 {
+			if eof {
+				return
+			}
+			var err error
+			pending, err = s.readMessage(rw, buf)
+			if err == ErrMessageTooLarge {
+				s.handleParsingError(rw, err)
+				continue MsgLoop
+			}
+			if err != nil {
+				s.logReadError(rw, err)
+				return
+			}
+		}
 
-		req, err := parseRequest(buf[:n])
+		req, n, err := parseRequest(pending, eof)
+		if n > 0 {
+			tc.dumpRequest(pending[:n])
+		}
+		pending = pending[n:]
+		if err == ErrIncompleteRequest {
+			// The rest of the request, e.g. its VALUE, is still being received.
+			if eof {
+				return
+			}
+			more, err := s.readMessage(rw, buf)
+			if errors.Is(err, io.EOF) {
+				s.logReadError(rw, err)
+				eof = true
+				continue MsgLoop
+			}
+			if err != nil {
+				s.logReadError(rw, err)
+				return
+			}
+			pending = append(pending, more...)
+			continue MsgLoop
+		}
 		if err != nil {
-			s.handleParsingError(conn, err)
+			s.handleParsingError(rw, err)
+			if err == ErrInvalidValue || err == ErrMessageTooLarge {
+				// The end of a message with an unusable VALUE-LENGTH is unknown,
+				// so the following bytes cannot be told apart from new requests.
+				return
+			}
+			continue MsgLoop
+		}
+		if s.APIKey != "" && !session.authenticated && !isAuthExempt(req.command) {
+			var resp = response{framed: req.framed}
+			resp.writeError(rw, req.command, []byte("Authentication required"))
+			continue MsgLoop
+		}
+		if refusal := s.migrationRefusal(&req); refusal != nil {
+			s.handleMoved(rw, &req, refusal)
+			continue MsgLoop
+		}
+		if err := s.cache.CheckValueSize(req.value); err != nil {
+			var resp = response{framed: req.framed}
+			resp.writeErrorWithKey(rw, req.command, []byte("Value is too large"), req.key)
 			continue MsgLoop
 		}
 
 		switch string(req.command) {
+		case "AUTH":
+			s.handleAuth(rw, &req, &session)
 		case "SET":
-			s.handleSet(conn, &req)
+			s.handleSet(rw, &req, &session)
+		case "SETEX":
+			s.handleSetEx(rw, &req)
+		case "SETNX":
+			s.handleSetNX(rw, &req, &session)
 		case "GET":
-			s.handleGet(conn, &req)
+			s.handleGet(rw, &req)
 		case "DELETE":
-			s.handleDelete(conn, &req)
+			s.handleDelete(rw, &req)
+		case "MGET":
+			s.handleGetMany(rw, &req)
+		case "MDELETE":
+			s.handleDeleteMany(rw, &req)
+		case "EXISTS":
+			s.handleExists(rw, &req)
+		case "TTL":
+			s.handleTTL(rw, &req)
+		case "TOUCH":
+			s.handleTouch(rw, &req)
+		case "PERSIST":
+			s.handlePersist(rw, &req)
+		case "GETORSET":
+			s.handleGetOrSet(rw, &req)
+		case "GETSET":
+			s.handleGetSet(rw, &req)
+		case "DECREAP":
+			s.handleDecrAndReap(rw, &req)
+		case "INCR", "DECR":
+			s.handleIncrDecr(rw, &req)
 		case "PURGE":
-			s.handlePurge(conn, &req)
+			s.handlePurge(rw, &req)
+		case "DELEXPIRED":
+			s.handleDeleteExpired(rw, &req)
+		case "EXPIREMATCHING":
+			s.handleExpireMatching(rw, &req)
 		case "LENGTH":
-			s.handleLength(conn, &req)
+			s.handleLength(rw, &req)
+		case "STATS":
+			s.handleStats(rw, &req)
 		case "KEYS":
-			s.handleKeys(conn, &req)
+			s.handleKeys(rw, &req)
+		case "KEYSINFO":
+			s.handleKeysInfo(rw, &req)
+		case "EXPIRING":
+			s.handleExpiring(rw, &req)
+		case "TTLHIST":
+			s.handleTTLHistogram(rw, &req)
+		case "DEFAULTTTL":
+			s.handleDefaultTTL(rw, &req, &session)
+		case "CLIENTS":
+			s.handleClients(rw, &req)
 		case "PING":
-			s.handlePing(conn, &req)
+			s.handlePing(rw, &req)
+		case "VERSION":
+			s.handleVersion(rw, &req)
 		case "CLOSE":
-			s.handleCloseConn(conn, &req)
+			s.handleCloseConn(rw, &req)
 			break MsgLoop
 		default:
-			s.handleInvalidCommand(conn, &req)
+			s.handleInvalidCommand(rw, &req)
 		}
 	}
 }
 
-func (s *Server) handleSet(conn net.Conn, req *request) {
+// readMessage reads the next message from conn, failing with os.ErrDeadlineExceeded
+// if none arrives within IdleTimeout.
+func (s *Server) readMessage(conn net.Conn, buf []byte) ([]byte, error) {
+	if s.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+	}
+	return readMessage(conn, buf)
+}
+
+// logReadError logs why reading from conn stopped. A client closing the connection
+// and IdleTimeout are logged at debug level, and connections closed by Close are
+// not logged at all, so that only genuine failures are reported as errors.
+func (s *Server) logReadError(conn net.Conn, err error) {
+	switch {
+	case errors.Is(err, io.EOF):
+		s.Logger.Debug().Msg("Client closed connection (" + conn.RemoteAddr().String() + ")")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		s.Logger.Debug().Msg("Closing idle connection (" + conn.RemoteAddr().String() + ")")
+	case s.inShutdown.isSet() && errors.Is(err, net.ErrClosed):
+	default:
+		s.Logger.Error().Err(err).Msg(fmt.Sprintf("error while reading from %s", conn.RemoteAddr()))
+	}
+}
+
+func (s *Server) handleSet(conn net.Conn, req *request, session *session) {
 	s.Logger.Debug().Msg("received SET request from " + conn.RemoteAddr().String())
-	var resp = response{}
+	var resp = response{framed: req.framed}
 
-	if len(req.key) == 0 {
-		resp.writeError(conn, []byte("SET"), []byte("Key is missing"))
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("SET"), keyMessage(err))
 		return
 	}
 	if len(req.value) == 0 {
@@ -275,19 +617,135 @@ func (s *Server) handleSet(conn net.Conn, req *request) {
 		return
 	}
 
-	s.cache.Set(string(req.key), req.value)
+	ttl := session.defaultTTL
+	if req.ttl != nil {
+		ms, err := strconv.ParseInt(string(req.ttl), 10, 64)
+		if err != nil || ms <= 0 || ms > maxTTLMillis {
+			resp.writeErrorWithKey(conn, []byte("SET"), []byte("TTL is not a positive integer"), req.key)
+			return
+		}
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+
+	if req.hasFlag("KEEPTTL") {
+		if req.ttl != nil || req.hasFlag("NX") || req.hasFlag("XX") {
+			resp.writeErrorWithKey(conn, []byte("SET"), []byte("KEEPTTL cannot be combined with TTL, NX or XX"), req.key)
+			return
+		}
+		resp.command = []byte("SET")
+		resp.ok = true
+		resp.key = req.key
+		if s.cache.SetKeepTTL(string(req.key), req.value) {
+			resp.message = []byte("Replaced")
+		}
+		resp.write(conn)
+		return
+	}
+
+	if req.hasFlag("XX") {
+		if req.hasFlag("NX") {
+			resp.writeErrorWithKey(conn, []byte("SET"), []byte("NX cannot be combined with XX"), req.key)
+			return
+		}
+		resp.command = []byte("SET")
+		resp.key = req.key
+		resp.ok = s.cache.SetXXEx(string(req.key), req.value, ttl)
+		if resp.ok {
+			resp.message = []byte("Replaced")
+		} else {
+			resp.message = []byte("Key does not exist")
+		}
+		resp.write(conn)
+		return
+	}
+
+	if req.hasFlag("NX") {
+		resp.command = []byte("SET")
+		resp.key = req.key
+		resp.ok = s.cache.SetNXEx(string(req.key), req.value, ttl)
+		if !resp.ok {
+			resp.message = []byte("Key already exists")
+		}
+		resp.write(conn)
+		return
+	}
+
+	existed := s.cache.SetExReportExisting(string(req.key), req.value, ttl)
 	resp.command = []byte("SET")
 	resp.ok = true
 	resp.key = req.key
+	if existed {
+		resp.message = []byte("Replaced")
+	}
+	resp.write(conn)
+}
+
+func (s *Server) handleSetEx(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received SETEX request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("SETEX"), keyMessage(err))
+		return
+	}
+	if len(req.value) == 0 {
+		resp.writeErrorWithKey(conn, []byte("SETEX"), []byte("Value is missing"), req.key)
+		return
+	}
+	if req.ttl == nil {
+		resp.writeErrorWithKey(conn, []byte("SETEX"), []byte("TTL is missing"), req.key)
+		return
+	}
+	ms, err := strconv.ParseInt(string(req.ttl), 10, 64)
+	if err != nil || ms <= 0 || ms > maxTTLMillis {
+		resp.writeErrorWithKey(conn, []byte("SETEX"), []byte("TTL is not a positive integer"), req.key)
+		return
+	}
+
+	s.cache.SetEx(string(req.key), req.value, time.Duration(ms)*time.Millisecond)
+	resp.command = []byte("SETEX")
+	resp.ok = true
+	resp.key = req.key
+	resp.write(conn)
+}
+
+func (s *Server) handleSetNX(conn net.Conn, req *request, session *session) {
+	s.Logger.Debug().Msg("received SETNX request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("SETNX"), keyMessage(err))
+		return
+	}
+	if len(req.value) == 0 {
+		resp.writeErrorWithKey(conn, []byte("SETNX"), []byte("Value is missing"), req.key)
+		return
+	}
+	ttl := session.defaultTTL
+	if req.ttl != nil {
+		ms, err := strconv.ParseInt(string(req.ttl), 10, 64)
+		if err != nil || ms <= 0 || ms > maxTTLMillis {
+			resp.writeErrorWithKey(conn, []byte("SETNX"), []byte("TTL is not a positive integer"), req.key)
+			return
+		}
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+
+	resp.command = []byte("SETNX")
+	resp.key = req.key
+	resp.ok = s.cache.SetNXEx(string(req.key), req.value, ttl)
+	if !resp.ok {
+		resp.message = []byte("Key already exists")
+	}
 	resp.write(conn)
 }
 
 func (s *Server) handleGet(conn net.Conn, req *request) {
 	s.Logger.Debug().Msg("received GET request from " + conn.RemoteAddr().String())
-	var resp = response{}
+	var resp = response{framed: req.framed}
 
-	if len(req.key) == 0 {
-		resp.writeError(conn, []byte("GET"), []byte("Key is missing"))
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("GET"), keyMessage(err))
 		return
 	}
 	if len(req.value) != 0 {
@@ -306,86 +764,642 @@ func (s *Server) handleGet(conn net.Conn, req *request) {
 	resp.write(conn)
 }
 
-func (s *Server) handleDelete(conn net.Conn, req *request) {
-	s.Logger.Debug().Msg("received DELETE request from " + conn.RemoteAddr().String())
-	var resp = response{}
+func (s *Server) handleGetMany(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received MGET request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
 
 	if len(req.key) == 0 {
-		resp.writeError(conn, []byte("DELETE"), []byte("Key is missing"))
+		resp.writeError(conn, []byte("MGET"), []byte("Key is missing"))
 		return
 	}
 	if len(req.value) != 0 {
-		resp.writeErrorWithKey(conn, []byte("DELETE"), []byte("Received unexpected value"), req.key)
+		resp.writeErrorWithKey(conn, []byte("MGET"), []byte("Received unexpected value"), req.key)
 		return
 	}
 
-	s.cache.Delete(string(req.key))
-	resp.command = []byte("DELETE")
-	resp.ok = true
+	keys := strings.Split(string(req.key), ",")
+	values := s.cache.GetMany(keys)
+	resp.command = []byte("MGET")
 	resp.key = req.key
-	resp.write(conn)
-}
-
-func (s *Server) handlePurge(conn net.Conn, req *request) {
-	s.Logger.Debug().Msg("received PURGE request from " + conn.RemoteAddr().String())
-	var resp = response{}
-	s.cache.Purge()
-	resp.command = []byte("PURGE")
+	if len(values) == 0 {
+		resp.ok = false
+		resp.message = []byte("Not found")
+		resp.write(conn)
+		return
+	}
+	var value []byte
+	for _, key := range keys {
+		data, ok := values[key]
+		if !ok {
+			continue
+		}
+		if len(value) > 0 {
+			value = append(value, ',')
+		}
+		value = append(value, key...)
+		value = append(value, ':')
+		value = append(value, base64.StdEncoding.EncodeToString(data)...)
+	}
 	resp.ok = true
+	resp.value = value
 	resp.write(conn)
 }
 
-func (s *Server) handleLength(conn net.Conn, req *request) {
-	s.Logger.Debug().Msg("received LENGTH request from " + conn.RemoteAddr().String())
-	var resp = response{}
-	length := s.cache.Length()
-	resp.command = []byte("LENGTH")
-	resp.ok = true
-	resp.value = []byte(strconv.Itoa(length))
+func (s *Server) handleExists(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received EXISTS request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("EXISTS"), keyMessage(err))
+		return
+	}
+	if len(req.value) != 0 {
+		resp.writeErrorWithKey(conn, []byte("EXISTS"), []byte("Received unexpected value"), req.key)
+		return
+	}
+
+	resp.command = []byte("EXISTS")
+	resp.ok = s.cache.Exists(string(req.key))
+	resp.key = req.key
+	if !resp.ok {
+		resp.message = []byte("Not found")
+	}
 	resp.write(conn)
 }
 
-func (s *Server) handleKeys(conn net.Conn, req *request) {
-	s.Logger.Debug().Msg("received KEYS request from " + conn.RemoteAddr().String())
-	var resp = response{}
-	resp.command = []byte("KEYS")
-	keys := s.cache.Keys()
-	if len(keys) != 0 {
-		resp.ok = true
-		resp.value = []byte(strings.Join(keys, ","))
+func (s *Server) handleTTL(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received TTL request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("TTL"), keyMessage(err))
+		return
+	}
+	if len(req.value) != 0 {
+		resp.writeErrorWithKey(conn, []byte("TTL"), []byte("Received unexpected value"), req.key)
+		return
+	}
+
+	ttl, ok := s.cache.TTL(string(req.key))
+	resp.command = []byte("TTL")
+	resp.ok = ok
+	resp.key = req.key
+	if ok {
+		resp.value = strconv.AppendInt(nil, ttl.Milliseconds(), 10)
 	} else {
-		resp.ok = false
-		resp.message = []byte("No keys")
+		resp.message = []byte("Not found")
 	}
 	resp.write(conn)
 }
 
-func (s *Server) handlePing(conn net.Conn, req *request) {
-	s.Logger.Debug().Msg("received PING request from " + conn.RemoteAddr().String())
-	var resp = response{}
-	resp.command = []byte("PING")
-	resp.ok = true
-	resp.message = []byte("PONG")
-	resp.write(conn)
-}
+func (s *Server) handleTouch(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received TOUCH request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
 
-func (s *Server) handleCloseConn(conn net.Conn, req *request) {
-	s.Logger.Debug().Msg("received CLOSE request from " + conn.RemoteAddr().String())
-	var resp = response{}
-	resp.command = []byte("CLOSE")
-	resp.ok = true
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("TOUCH"), keyMessage(err))
+		return
+	}
+	if len(req.value) != 0 {
+		resp.writeErrorWithKey(conn, []byte("TOUCH"), []byte("Received unexpected value"), req.key)
+		return
+	}
+	if req.ttl == nil {
+		resp.writeErrorWithKey(conn, []byte("TOUCH"), []byte("TTL is missing"), req.key)
+		return
+	}
+	ms, err := strconv.ParseInt(string(req.ttl), 10, 64)
+	if err != nil || ms <= 0 || ms > maxTTLMillis {
+		resp.writeErrorWithKey(conn, []byte("TOUCH"), []byte("TTL is not a positive integer"), req.key)
+		return
+	}
+
+	ok := s.cache.Touch(string(req.key), time.Duration(ms)*time.Millisecond)
+	resp.command = []byte("TOUCH")
+	resp.ok = ok
+	resp.key = req.key
+	if !ok {
+		resp.message = []byte("Not found")
+	}
 	resp.write(conn)
 }
 
-func (s *Server) handleInvalidCommand(conn net.Conn, req *request) {
-	s.Logger.Debug().Msg("received invalid command from " + conn.RemoteAddr().String())
-	var resp = response{}
-	resp.ok = false
-	resp.message = []byte("Received invalid command")
+func (s *Server) handlePersist(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received PERSIST request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("PERSIST"), keyMessage(err))
+		return
+	}
+	if len(req.value) != 0 {
+		resp.writeErrorWithKey(conn, []byte("PERSIST"), []byte("Received unexpected value"), req.key)
+		return
+	}
+
+	ok := s.cache.Persist(string(req.key))
+	resp.command = []byte("PERSIST")
+	resp.ok = ok
+	resp.key = req.key
+	if !ok {
+		resp.message = []byte("Not found")
+	}
 	resp.write(conn)
 }
 
-func (s *Server) handleParsingError(conn net.Conn, parsingErr error) {
+func (s *Server) handleDelete(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received DELETE request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("DELETE"), keyMessage(err))
+		return
+	}
+	if len(req.value) != 0 {
+		resp.writeErrorWithKey(conn, []byte("DELETE"), []byte("Received unexpected value"), req.key)
+		return
+	}
+
+	s.cache.Delete(string(req.key))
+	resp.command = []byte("DELETE")
+	resp.ok = true
+	resp.key = req.key
+	resp.write(conn)
+}
+
+func (s *Server) handleDeleteMany(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received MDELETE request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if len(req.key) == 0 {
+		resp.writeError(conn, []byte("MDELETE"), []byte("Key is missing"))
+		return
+	}
+	if len(req.value) != 0 {
+		resp.writeErrorWithKey(conn, []byte("MDELETE"), []byte("Received unexpected value"), req.key)
+		return
+	}
+
+	deleted := s.cache.DeleteMany(strings.Split(string(req.key), ","))
+	resp.command = []byte("MDELETE")
+	resp.ok = true
+	resp.key = req.key
+	resp.value = []byte(strconv.Itoa(deleted))
+	resp.write(conn)
+}
+
+func (s *Server) handleGetOrSet(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received GETORSET request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("GETORSET"), keyMessage(err))
+		return
+	}
+	if len(req.value) == 0 {
+		resp.writeErrorWithKey(conn, []byte("GETORSET"), []byte("Value is missing"), req.key)
+		return
+	}
+
+	val, existed := s.cache.GetOrSet(string(req.key), req.value)
+	resp.command = []byte("GETORSET")
+	resp.ok = true
+	resp.key = req.key
+	resp.value = val
+	if !existed {
+		resp.message = []byte("Created")
+	}
+	resp.write(conn)
+}
+
+func (s *Server) handleGetSet(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received GETSET request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("GETSET"), keyMessage(err))
+		return
+	}
+	if len(req.value) == 0 {
+		resp.writeErrorWithKey(conn, []byte("GETSET"), []byte("Value is missing"), req.key)
+		return
+	}
+
+	old, existed := s.cache.GetSet(string(req.key), req.value)
+	resp.command = []byte("GETSET")
+	resp.ok = true
+	resp.key = req.key
+	if existed {
+		resp.value = old
+	} else {
+		resp.message = []byte("Created")
+	}
+	resp.write(conn)
+}
+
+func (s *Server) handleDecrAndReap(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received DECREAP request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, []byte("DECREAP"), keyMessage(err))
+		return
+	}
+	if len(req.value) != 0 {
+		resp.writeErrorWithKey(conn, []byte("DECREAP"), []byte("Received unexpected value"), req.key)
+		return
+	}
+
+	n, reaped, err := s.cache.DecrAndReap(string(req.key))
+	if err == cache.ErrNotFound {
+		resp.writeErrorWithKey(conn, []byte("DECREAP"), []byte("Not found"), req.key)
+		return
+	}
+	if err == cache.ErrOverflow {
+		resp.writeErrorWithKey(conn, []byte("DECREAP"), []byte("Value would overflow"), req.key)
+		return
+	}
+	if err != nil {
+		resp.writeErrorWithKey(conn, []byte("DECREAP"), []byte("Value is not an integer"), req.key)
+		return
+	}
+	resp.command = []byte("DECREAP")
+	resp.ok = true
+	resp.key = req.key
+	resp.value = []byte(strconv.FormatInt(n, 10))
+	if reaped {
+		resp.message = []byte("Deleted")
+	}
+	resp.write(conn)
+}
+
+// handleIncrDecr handles both INCR and DECR, which only differ in the sign of the delta.
+func (s *Server) handleIncrDecr(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received " + string(req.command) + " request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if err := s.cache.ValidateKey(string(req.key)); err != nil {
+		resp.writeError(conn, req.command, keyMessage(err))
+		return
+	}
+	delta := int64(1)
+	if len(req.value) != 0 {
+		var err error
+		delta, err = strconv.ParseInt(string(req.value), 10, 64)
+		if err != nil {
+			resp.writeErrorWithKey(conn, req.command, []byte("Delta is not an integer"), req.key)
+			return
+		}
+	}
+
+	var n int64
+	var err error
+	if string(req.command) == "INCR" {
+		n, err = s.cache.Increment(string(req.key), delta)
+	} else {
+		n, err = s.cache.Decrement(string(req.key), delta)
+	}
+	if err == cache.ErrOverflow {
+		resp.writeErrorWithKey(conn, req.command, []byte("Value would overflow"), req.key)
+		return
+	}
+	if err != nil {
+		resp.writeErrorWithKey(conn, req.command, []byte("Value is not an integer"), req.key)
+		return
+	}
+	resp.command = req.command
+	resp.ok = true
+	resp.key = req.key
+	resp.value = []byte(strconv.FormatInt(n, 10))
+	resp.write(conn)
+}
+
+func (s *Server) handlePurge(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received PURGE request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if s.ConfirmPurge && string(req.value) != "CONFIRM" {
+		resp.writeError(conn, []byte("PURGE"), []byte("Purge must be confirmed"))
+		return
+	}
+
+	s.cache.Purge()
+	resp.command = []byte("PURGE")
+	resp.ok = true
+	resp.write(conn)
+}
+
+func (s *Server) handleDeleteExpired(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received DELEXPIRED request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if len(req.key) == 0 {
+		resp.writeError(conn, []byte("DELEXPIRED"), []byte("Key is missing"))
+		return
+	}
+	if _, err := path.Match(string(req.key), ""); err != nil {
+		resp.writeErrorWithKey(conn, []byte("DELEXPIRED"), []byte("Invalid pattern"), req.key)
+		return
+	}
+
+	deleted := s.cache.DeleteExpiredMatching(string(req.key))
+	resp.command = []byte("DELEXPIRED")
+	resp.ok = true
+	resp.key = req.key
+	resp.value = []byte(strconv.Itoa(deleted))
+	resp.write(conn)
+}
+
+func (s *Server) handleExpireMatching(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received EXPIREMATCHING request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if len(req.key) == 0 {
+		resp.writeError(conn, []byte("EXPIREMATCHING"), []byte("Key is missing"))
+		return
+	}
+	if _, err := path.Match(string(req.key), ""); err != nil {
+		resp.writeErrorWithKey(conn, []byte("EXPIREMATCHING"), []byte("Invalid pattern"), req.key)
+		return
+	}
+	if req.ttl == nil {
+		resp.writeErrorWithKey(conn, []byte("EXPIREMATCHING"), []byte("TTL is missing"), req.key)
+		return
+	}
+	ms, err := strconv.ParseInt(string(req.ttl), 10, 64)
+	if err != nil || ms <= 0 || ms > maxTTLMillis {
+		resp.writeErrorWithKey(conn, []byte("EXPIREMATCHING"), []byte("TTL is not a positive integer"), req.key)
+		return
+	}
+
+	updated := s.cache.ExpireMatching(string(req.key), time.Duration(ms)*time.Millisecond)
+	resp.command = []byte("EXPIREMATCHING")
+	resp.ok = true
+	resp.key = req.key
+	resp.value = []byte(strconv.Itoa(updated))
+	resp.write(conn)
+}
+
+func (s *Server) handleLength(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received LENGTH request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	length := s.cache.Length()
+	resp.command = []byte("LENGTH")
+	resp.ok = true
+	resp.value = []byte(strconv.Itoa(length))
+	resp.write(conn)
+}
+
+func (s *Server) handleStats(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received STATS request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	stats := s.cache.Stats()
+	resp.command = []byte("STATS")
+	resp.ok = true
+	resp.value = []byte("hits:" + strconv.FormatUint(stats.Hits, 10) +
+		",misses:" + strconv.FormatUint(stats.Misses, 10) +
+		",length:" + strconv.Itoa(stats.Length) +
+		",evictions:" + strconv.FormatUint(stats.Evictions, 10) +
+		",connections:" + strconv.Itoa(s.ActiveConns()))
+	resp.write(conn)
+}
+
+func (s *Server) handleKeys(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received KEYS request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	resp.command = []byte("KEYS")
+	var keys []string
+	if len(req.key) == 0 {
+		keys = s.cache.Keys()
+	} else if _, err := path.Match(string(req.key), ""); err != nil {
+		resp.ok = false
+		resp.message = []byte("Invalid pattern")
+		resp.write(conn)
+		return
+	} else {
+		keys = s.cache.KeysMatching(string(req.key))
+	}
+	if len(keys) != 0 {
+		resp.ok = true
+		resp.value = []byte(strings.Join(keys, ","))
+	} else {
+		resp.ok = false
+		resp.message = []byte("No keys")
+	}
+	resp.write(conn)
+}
+
+func (s *Server) handleKeysInfo(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received KEYSINFO request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	resp.command = []byte("KEYSINFO")
+	infos := s.cache.KeysInfo(keysInfoLimit)
+	if len(infos) == 0 {
+		resp.ok = false
+		resp.message = []byte("No keys")
+		resp.write(conn)
+		return
+	}
+	var value []byte
+	for i, info := range infos {
+		if i > 0 {
+			value = append(value, ',')
+		}
+		value = append(value, info.Key...)
+		value = append(value, ':')
+		value = strconv.AppendInt(value, int64(info.Size), 10)
+		value = append(value, ':')
+		value = strconv.AppendInt(value, info.TTL.Milliseconds(), 10)
+	}
+	resp.ok = true
+	resp.value = value
+	resp.write(conn)
+}
+
+func (s *Server) handleExpiring(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received EXPIRING request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if len(req.key) != 0 {
+		resp.writeErrorWithKey(conn, []byte("EXPIRING"), []byte("Received unexpected key"), req.key)
+		return
+	}
+	n, err := strconv.Atoi(string(req.value))
+	if err != nil || n <= 0 {
+		resp.writeError(conn, []byte("EXPIRING"), []byte("Value is not a positive integer"))
+		return
+	}
+	if n > keysInfoLimit {
+		n = keysInfoLimit
+	}
+
+	expiring := s.cache.ExpiringSoon(n)
+	resp.command = []byte("EXPIRING")
+	if len(expiring) == 0 {
+		resp.ok = false
+		resp.message = []byte("No keys")
+		resp.write(conn)
+		return
+	}
+	var value []byte
+	for i, e := range expiring {
+		if i > 0 {
+			value = append(value, ',')
+		}
+		value = append(value, e.Key...)
+		value = append(value, ':')
+		value = strconv.AppendInt(value, e.TTL.Milliseconds(), 10)
+	}
+	resp.ok = true
+	resp.value = value
+	resp.write(conn)
+}
+
+func (s *Server) handleTTLHistogram(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received TTLHIST request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if len(req.key) != 0 {
+		resp.writeErrorWithKey(conn, []byte("TTLHIST"), []byte("Received unexpected key"), req.key)
+		return
+	}
+	buckets := cache.DefaultTTLBuckets
+	if len(req.value) != 0 {
+		buckets = nil
+		for _, field := range strings.Split(string(req.value), ",") {
+			ms, err := strconv.ParseInt(field, 10, 64)
+			if err != nil || ms <= 0 || ms > maxTTLMillis {
+				resp.writeError(conn, []byte("TTLHIST"), []byte("Value is not a list of positive integers"))
+				return
+			}
+			buckets = append(buckets, time.Duration(ms)*time.Millisecond)
+		}
+	}
+
+	histogram := s.cache.TTLHistogram(buckets)
+	bounds := make([]time.Duration, 0, len(histogram))
+	for b := range histogram {
+		if b != cache.NoExpiryBucket && b != cache.OverflowBucket {
+			bounds = append(bounds, b)
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	var value []byte
+	for _, b := range bounds {
+		value = strconv.AppendInt(value, b.Milliseconds(), 10)
+		value = append(value, ':')
+		value = strconv.AppendInt(value, int64(histogram[b]), 10)
+		value = append(value, ',')
+	}
+	value = append(value, "+Inf:"...)
+	value = strconv.AppendInt(value, int64(histogram[cache.OverflowBucket]), 10)
+	value = append(value, ",never:"...)
+	value = strconv.AppendInt(value, int64(histogram[cache.NoExpiryBucket]), 10)
+	resp.command = []byte("TTLHIST")
+	resp.ok = true
+	resp.value = value
+	resp.write(conn)
+}
+
+func (s *Server) handleDefaultTTL(conn net.Conn, req *request, session *session) {
+	s.Logger.Debug().Msg("received DEFAULTTTL request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if len(req.key) != 0 {
+		resp.writeErrorWithKey(conn, []byte("DEFAULTTTL"), []byte("Received unexpected key"), req.key)
+		return
+	}
+	if len(req.value) == 0 {
+		resp.writeError(conn, []byte("DEFAULTTTL"), []byte("Value is missing"))
+		return
+	}
+	ms, err := strconv.ParseInt(string(req.value), 10, 64)
+	if err != nil || ms < 0 || ms > maxTTLMillis {
+		resp.writeError(conn, []byte("DEFAULTTTL"), []byte("Value is not a valid TTL"))
+		return
+	}
+
+	session.defaultTTL = time.Duration(ms) * time.Millisecond
+	resp.command = []byte("DEFAULTTTL")
+	resp.ok = true
+	resp.value = req.value
+	resp.write(conn)
+}
+
+func (s *Server) handleAuth(conn net.Conn, req *request, session *session) {
+	s.Logger.Debug().Msg("received AUTH request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+
+	if s.APIKey != "" && subtle.ConstantTimeCompare(req.value, []byte(s.APIKey)) != 1 {
+		session.authenticated = false
+		resp.writeError(conn, []byte("AUTH"), []byte("Invalid API key"))
+		return
+	}
+	session.authenticated = true
+	resp.command = []byte("AUTH")
+	resp.ok = true
+	resp.write(conn)
+}
+
+func (s *Server) handleClients(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received CLIENTS request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	resp.command = []byte("CLIENTS")
+	var value []byte
+	for i, client := range s.clients() {
+		if i > 0 {
+			value = append(value, ',')
+		}
+		value = append(value, client.remoteAddr...)
+		value = append(value, ':')
+		value = strconv.AppendInt(value, client.connected.UnixMilli(), 10)
+	}
+	resp.ok = true
+	resp.value = value
+	resp.write(conn)
+}
+
+func (s *Server) handlePing(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received PING request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	resp.command = []byte("PING")
+	resp.ok = true
+	resp.message = []byte("PONG")
+	resp.write(conn)
+}
+
+func (s *Server) handleVersion(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received VERSION request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	resp.command = []byte("VERSION")
+	resp.ok = true
+	resp.value = []byte(version.String())
+	resp.write(conn)
+}
+
+func (s *Server) handleCloseConn(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received CLOSE request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	resp.command = []byte("CLOSE")
+	resp.ok = true
+	resp.write(conn)
+}
+
+func (s *Server) handleMoved(conn net.Conn, req *request, refusal []byte) {
+	s.Logger.Debug().Msg("redirected " + string(req.command) + " request from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	resp.writeErrorWithKey(conn, req.command, refusal, req.key)
+}
+
+func (s *Server) handleInvalidCommand(conn net.Conn, req *request) {
+	s.Logger.Debug().Msg("received invalid command from " + conn.RemoteAddr().String())
+	var resp = response{framed: req.framed}
+	resp.ok = false
+	resp.message = []byte("Received invalid command")
+	resp.write(conn)
+}
+
+func (s *Server) handleParsingError(conn net.Conn, parsingErr error) {
 	s.Logger.Error().Err(parsingErr).
 		Msg(fmt.Sprintf("error while parsing request from %s", conn.RemoteAddr()))
 	var resp = response{}
@@ -398,34 +1412,167 @@ func (s *Server) handleParsingError(conn net.Conn, parsingErr error) {
 		resp.writeError(conn, nil, []byte("Received invalid key"))
 	case ErrInvalidValue:
 		resp.writeError(conn, nil, []byte("Received invalid value"))
+	case ErrMessageTooLarge:
+		resp.writeError(conn, nil, []byte("Message too large"))
 	default:
 		resp.writeError(conn, nil, []byte("Unexpected error while parsing request"))
 	}
 }
 
-func (s *Server) numConns() int {
+// keyMessage returns the message of the response to a key rejected by ValidateKey.
+func keyMessage(err error) []byte {
+	if err == cache.ErrKeyTooLong {
+		return []byte("Key is too long")
+	}
+	return []byte("Key is missing")
+}
+
+// migration describes keys whose writes are redirected to another server.
+type migration struct {
+	addr     string
+	patterns []string
+}
+
+// migrationRefusal returns the message refusing req if it writes keys that are
+// being migrated, see Migrate, or nil if req can be served locally.
+func (s *Server) migrationRefusal(req *request) []byte {
+	var keys []string
+	switch string(req.command) {
+	case "SET", "SETEX", "SETNX", "TOUCH", "PERSIST", "DELETE", "GETORSET", "GETSET", "DECREAP", "INCR", "DECR":
+		keys = []string{string(req.key)}
+	case "MDELETE":
+		keys = strings.Split(string(req.key), ",")
+	case "PURGE", "DELEXPIRED", "EXPIREMATCHING":
+	default:
+		return nil
+	}
+	s.mu.Lock()
+	m := s.migration
+	s.mu.Unlock()
+	if m == nil || len(req.key) == 0 && keys != nil {
+		return nil
+	}
+	if keys == nil {
+		// Writes by pattern may touch migrated keys, which cannot be redirected
+		// without also redirecting the others.
+		return []byte("Migration in progress")
+	}
+	moved := 0
+	for _, key := range keys {
+		if m.matches(key) {
+			moved++
+		}
+	}
+	switch moved {
+	case 0:
+		return nil
+	case len(keys):
+		return []byte("MOVED " + m.addr)
+	}
+	return []byte("Migration in progress")
+}
+
+// matches reports whether key is being migrated.
+func (m *migration) matches(key string) bool {
+	for _, pattern := range m.patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// session holds the state of a single connection that lives across requests.
+type session struct {
+	defaultTTL    time.Duration // TTL applied to SET and SETNX requests, zero means keys never expire.
+	authenticated bool          // Set by a successful AUTH, only checked if APIKey is set.
+}
+
+// isAuthExempt reports whether command is accepted before the connection is
+// authenticated.
+func isAuthExempt(command []byte) bool {
+	switch string(command) {
+	case "AUTH", "CLOSE":
+		return true
+	}
+	return false
+}
+
+// closeListener closes the listener registered by serve, if any.
+func (s *Server) closeListener() error {
+	s.mu.Lock()
+	lis := s.listener
+	s.mu.Unlock()
+	if lis == nil {
+		return nil
+	}
+	return lis.Close()
+}
+
+// trackConn registers the connection as active. Returns false if the server
+// is shutting down, as Close may have already swept activeConns.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown.isSet() {
+		return false
+	}
+	s.activeConns[conn] = connInfo{remoteAddr: conn.RemoteAddr().String(), connected: time.Now()}
+	return true
+}
+
+// closeConn closes the connection unless Close has already done so.
+func (s *Server) closeConn(conn net.Conn) {
+	s.mu.Lock()
+	_, active := s.activeConns[conn]
+	delete(s.activeConns, conn)
+	s.mu.Unlock()
+	if active {
+		conn.Close()
+	}
+}
+
+// ActiveConns returns the number of connections currently served, including
+// the ones passed to ServeConn.
+func (s *Server) ActiveConns() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return len(s.activeConns)
 }
 
+// connInfo describes an active connection, see CLIENTS.
+type connInfo struct {
+	remoteAddr string
+	connected  time.Time
+}
+
+// clients returns copies of the descriptions of the active connections, from
+// the longest to the most recently connected.
+func (s *Server) clients() []connInfo {
+	s.mu.Lock()
+	clients := make([]connInfo, 0, len(s.activeConns))
+	for _, info := range s.activeConns {
+		clients = append(clients, info)
+	}
+	s.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].connected.Before(clients[j].connected) })
+	return clients
+}
+
 // srvListener wraps a net.Listener to protect it from multiple Close() calls.
+// Only the call that actually closes the listener receives its error.
 type srvListener struct {
 	net.Listener
-	once     sync.Once
-	closeErr error
+	once sync.Once
 }
 
 func (l *srvListener) Close() error {
 	if l == nil {
 		return nil
 	}
-	l.once.Do(l.close)
-	return l.closeErr
-}
-
-func (l *srvListener) close() {
-	l.closeErr = l.Listener.Close()
+	var err error
+	l.once.Do(func() { err = l.Listener.Close() })
+	return err
 }
 
 type atomicBool int32
@@ -438,6 +1585,65 @@ func (b *atomicBool) setTrue() {
 	atomic.StoreInt32((*int32)(b), 1)
 }
 
-// func (b *atomicBool) setFalse() {
-// 	atomic.StoreInt32((*int32)(b), 0)
-// }
+func (b *atomicBool) setFalse() {
+	atomic.StoreInt32((*int32)(b), 0)
+}
+
+// timeoutConn sets a write deadline of timeout before every write and keeps the
+// error of the first failed write, after which all writes fail, since a timed out
+// write may have sent part of a response.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	err     error
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(b)
+	c.err = err
+	return n, err
+}
+
+// tracingConn dumps every request parsed from and every message written to the
+// underlying connection at trace level, while enabled is set.
+type tracingConn struct {
+	net.Conn
+	logger  *zerolog.Logger
+	enabled *atomicBool
+}
+
+func (c *tracingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && c.enabled.isSet() {
+		c.dump("response to", b[:n])
+	}
+	return n, err
+}
+
+// dumpRequest dumps the raw bytes of a single request. Everything following the
+// start line of an AUTH request is masked, so that the API key is not logged.
+func (c *tracingConn) dumpRequest(raw []byte) {
+	if !c.enabled.isSet() {
+		return
+	}
+	if bytes.HasPrefix(raw, []byte("RCSP/1.0 AUTH\r\n")) || bytes.HasPrefix(raw, []byte("RCSP/1.1 AUTH\r\n")) {
+		masked := bytes.Repeat([]byte("*"), len(raw))
+		copy(masked, raw[:len("RCSP/1.x AUTH\r\n")])
+		raw = masked
+	}
+	c.dump("request from", raw)
+}
+
+func (c *tracingConn) dump(direction string, frame []byte) {
+	header := fmt.Sprintf("--- %s %s (%d bytes) ---", direction, c.RemoteAddr(), len(frame))
+	if len(frame) > traceFrameLimit {
+		header = fmt.Sprintf("--- %s %s (%d bytes, truncated to %d) ---",
+			direction, c.RemoteAddr(), len(frame), traceFrameLimit)
+		frame = frame[:traceFrameLimit]
+	}
+	c.logger.Trace().Msg(header + "\n" + hex.Dump(frame) + "--- end ---")
+}
@@ -3,12 +3,19 @@ package nativesrv
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/nmezhenskyi/rcs/internal/cache"
+	"github.com/nmezhenskyi/rcs/internal/version"
+	"github.com/rs/zerolog"
 )
 
 func TestNewServer(t *testing.T) {
@@ -47,6 +54,28 @@ func TestShutdown(t *testing.T) {
 	}
 }
 
+func TestStopNotServing(t *testing.T) {
+	server := NewServer(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Expected Shutdown of a server that never served to succeed, got %v instead", err)
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("Expected Close of a server that never served to succeed, got %v instead", err)
+	}
+
+	// A server that has been shut down does not start serving anymore.
+	serverAddr := "localhost:6121"
+	if err := server.ListenAndServe(serverAddr); err != nil {
+		t.Errorf("Expected ListenAndServe to be aborted, got %v instead", err)
+	}
+	if conn, err := net.Dial("tcp", serverAddr); err == nil {
+		conn.Close()
+		t.Error("Expected connection to fail after shutdown, but Dial was successful")
+	}
+}
+
 func TestSet(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6121"
@@ -126,6 +155,19 @@ func TestSet(t *testing.T) {
 			},
 			verifyInCache: true,
 		},
+		{
+			name:  "Valid key, valid value, overwrite",
+			key:   []byte("key1"),
+			value: []byte("val2"),
+			expectedResponse: response{
+				command: []byte("SET"),
+				message: []byte("Replaced"),
+				ok:      true,
+				key:     []byte("key1"),
+				value:   nil,
+			},
+			verifyInCache: true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -140,6 +182,7 @@ func TestSet(t *testing.T) {
 				t.Errorf("Failed to connect to the server: %v", err)
 			}
 			req.write(conn)
+			conn.(*net.TCPConn).CloseWrite()
 
 			respBuf := [1024]byte{}
 			n, err := conn.Read(respBuf[:])
@@ -187,6 +230,334 @@ func TestSet(t *testing.T) {
 	}
 }
 
+func TestSetEx(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	testCases := []struct {
+		name             string
+		req              request
+		expectedResponse response
+	}{
+		{
+			name: "Nil key",
+			req:  request{command: []byte("SETEX"), ttl: []byte("100"), value: []byte("value1")},
+			expectedResponse: response{
+				command: []byte("SETEX"),
+				message: []byte("Key is missing"),
+			},
+		},
+		{
+			name: "Nil value",
+			req:  request{command: []byte("SETEX"), key: []byte("key1"), ttl: []byte("100")},
+			expectedResponse: response{
+				command: []byte("SETEX"),
+				message: []byte("Value is missing"),
+				key:     []byte("key1"),
+			},
+		},
+		{
+			name: "Missing TTL",
+			req:  request{command: []byte("SETEX"), key: []byte("key1"), value: []byte("value1")},
+			expectedResponse: response{
+				command: []byte("SETEX"),
+				message: []byte("TTL is missing"),
+				key:     []byte("key1"),
+			},
+		},
+		{
+			name: "Malformed TTL",
+			req:  request{command: []byte("SETEX"), key: []byte("key1"), ttl: []byte("-5"), value: []byte("value1")},
+			expectedResponse: response{
+				command: []byte("SETEX"),
+				message: []byte("TTL is not a positive integer"),
+				key:     []byte("key1"),
+			},
+		},
+		{
+			name: "TTL overflowing time.Duration",
+			req:  request{command: []byte("SETEX"), key: []byte("key1"), ttl: []byte("9223372036855"), value: []byte("value1")},
+			expectedResponse: response{
+				command: []byte("SETEX"),
+				message: []byte("TTL is not a positive integer"),
+				key:     []byte("key1"),
+			},
+		},
+		{
+			name: "Valid key, value and TTL",
+			req:  request{command: []byte("SETEX"), key: []byte("key1"), ttl: []byte("100"), value: []byte("value1")},
+			expectedResponse: response{
+				command: []byte("SETEX"),
+				ok:      true,
+				key:     []byte("key1"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := sendTestRequest(serverAddr, tc.req, t)
+			compareResponses(tc.expectedResponse, resp, t)
+		})
+	}
+
+	if value, ok := server.cache.Get("key1"); !ok || string(value) != "value1" {
+		t.Errorf("Expected value \"value1\" in Server.cache, got \"%s\" instead", value)
+	}
+	time.Sleep(150 * time.Millisecond)
+	resp := sendTestRequest(serverAddr, request{command: []byte("GET"), key: []byte("key1")}, t)
+	if resp.ok {
+		t.Errorf("Expected \"key1\" to expire, got \"%s\" instead", resp.value)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("key1", []byte("value1"))
+	server.cache.Set("key2", []byte("a,b:c"))
+	server.cache.SetEx("expired", []byte("value3"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("MGET"), key: []byte("key2,missing,key1,expired")}, t)
+	compareResponses(response{
+		command: []byte("MGET"),
+		ok:      true,
+		key:     []byte("key2,missing,key1,expired"),
+		value:   []byte("key2:YSxiOmM=,key1:dmFsdWUx"),
+	}, resp, t)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("MGET"), key: []byte("missing,expired")}, t)
+	compareResponses(response{
+		command: []byte("MGET"),
+		message: []byte("Not found"),
+		key:     []byte("missing,expired"),
+	}, resp, t)
+}
+
+func TestDeleteMany(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("key1", []byte("value1"))
+	server.cache.Set("key2", []byte("value2"))
+	server.cache.Set("key3", []byte("value3"))
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("MDELETE"), key: []byte("key1,missing,key2")}, t)
+	compareResponses(response{
+		command: []byte("MDELETE"),
+		ok:      true,
+		key:     []byte("key1,missing,key2"),
+		value:   []byte("2"),
+	}, resp, t)
+	if server.cache.Length() != 1 {
+		t.Errorf("Expected only \"key3\" to remain, got length %d instead", server.cache.Length())
+	}
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("MDELETE")}, t)
+	compareResponses(response{
+		command: []byte("MDELETE"),
+		message: []byte("Key is missing"),
+	}, resp, t)
+}
+
+func TestDeleteExpired(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.SetEx("session:1", []byte("value1"), time.Millisecond)
+	server.cache.Set("session:2", []byte("value2"))
+	server.cache.SetEx("user:1", []byte("value3"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("DELEXPIRED"), key: []byte("session:*")}, t)
+	compareResponses(response{command: []byte("DELEXPIRED"), ok: true, key: []byte("session:*"), value: []byte("1")}, resp, t)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("DELEXPIRED"), key: []byte("[session")}, t)
+	compareResponses(response{command: []byte("DELEXPIRED"), message: []byte("Invalid pattern"), key: []byte("[session")}, resp, t)
+
+	if server.cache.Length() != 2 {
+		t.Errorf("Expected only the expired key matching the pattern to be deleted, got length %d", server.cache.Length())
+	}
+}
+
+func TestExpireMatching(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("tenant:5:a", []byte("value1"))
+	server.cache.Set("tenant:6:a", []byte("value2"))
+
+	req := request{command: []byte("EXPIREMATCHING"), key: []byte("tenant:5:*"), ttl: []byte("60000")}
+	resp := sendTestRequest(serverAddr, req, t)
+	compareResponses(response{command: []byte("EXPIREMATCHING"), ok: true, key: []byte("tenant:5:*"), value: []byte("1")}, resp, t)
+	if ttl, _ := server.cache.TTL("tenant:5:a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected matching key to expire within a minute, got TTL %v instead", ttl)
+	}
+	if ttl, _ := server.cache.TTL("tenant:6:a"); ttl != 0 {
+		t.Errorf("Expected non-matching key to keep no TTL, got %v instead", ttl)
+	}
+
+	req.ttl = nil
+	resp = sendTestRequest(serverAddr, req, t)
+	compareResponses(response{command: []byte("EXPIREMATCHING"), message: []byte("TTL is missing"), key: []byte("tenant:5:*")}, resp, t)
+}
+
+func TestExists(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("live", []byte("value1"))
+	server.cache.SetEx("expired", []byte("value2"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("EXISTS"), key: []byte("live")}, t)
+	compareResponses(response{command: []byte("EXISTS"), ok: true, key: []byte("live")}, resp, t)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("EXISTS"), key: []byte("expired")}, t)
+	compareResponses(response{command: []byte("EXISTS"), message: []byte("Not found"), key: []byte("expired")}, resp, t)
+
+	if value, _ := server.cache.Get("live"); string(value) != "value1" || server.cache.Length() != 2 {
+		t.Error("Expected EXISTS not to mutate the cache")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("permanent", []byte("value1"))
+	server.cache.SetEx("expiring", []byte("value2"), time.Minute)
+	server.cache.SetEx("expired", []byte("value3"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("TTL"), key: []byte("permanent")}, t)
+	compareResponses(response{command: []byte("TTL"), ok: true, key: []byte("permanent"), value: []byte("0")}, resp, t)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("TTL"), key: []byte("expiring")}, t)
+	if ms, err := strconv.Atoi(string(resp.value)); !resp.ok || err != nil || ms <= 0 || ms > 60000 {
+		t.Errorf("Expected TTL within (0, 60000], got \"%s\" instead", resp.value)
+	}
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("TTL"), key: []byte("expired")}, t)
+	compareResponses(response{command: []byte("TTL"), message: []byte("Not found"), key: []byte("expired")}, resp, t)
+}
+
+func TestTouch(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.SetEx("session", []byte("value1"), time.Second)
+	server.cache.SetEx("expired", []byte("value2"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("TOUCH"), key: []byte("session"), ttl: []byte("60000")}, t)
+	compareResponses(response{command: []byte("TOUCH"), ok: true, key: []byte("session")}, resp, t)
+	if ttl, ok := server.cache.TTL("session"); !ok || ttl <= time.Second {
+		t.Errorf("Expected expiration to move forward, got TTL %v instead", ttl)
+	}
+	if value, _ := server.cache.Get("session"); !bytes.Equal(value, []byte("value1")) {
+		t.Errorf("Expected value to be unchanged, got %q instead", value)
+	}
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("TOUCH"), key: []byte("expired"), ttl: []byte("60000")}, t)
+	compareResponses(response{command: []byte("TOUCH"), message: []byte("Not found"), key: []byte("expired")}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("TOUCH"), key: []byte("missing"), ttl: []byte("60000")}, t)
+	compareResponses(response{command: []byte("TOUCH"), message: []byte("Not found"), key: []byte("missing")}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("TOUCH"), key: []byte("session")}, t)
+	compareResponses(response{command: []byte("TOUCH"), message: []byte("TTL is missing"), key: []byte("session")}, resp, t)
+}
+
+func TestPersist(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.SetEx("key1", []byte("value1"), 50*time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("PERSIST"), key: []byte("key1")}, t)
+	compareResponses(response{command: []byte("PERSIST"), ok: true, key: []byte("key1")}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("PERSIST"), key: []byte("missing")}, t)
+	compareResponses(response{command: []byte("PERSIST"), message: []byte("Not found"), key: []byte("missing")}, resp, t)
+
+	time.Sleep(60 * time.Millisecond)
+	resp = sendTestRequest(serverAddr, request{command: []byte("TTL"), key: []byte("key1")}, t)
+	compareResponses(response{command: []byte("TTL"), ok: true, key: []byte("key1"), value: []byte("0")}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("GET"), key: []byte("key1")}, t)
+	compareResponses(response{command: []byte("GET"), ok: true, key: []byte("key1"), value: []byte("value1")}, resp, t)
+}
+
 func TestGet(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6121"
@@ -266,6 +637,7 @@ func TestGet(t *testing.T) {
 				t.Errorf("Failed to connect to the server: %v", err)
 			}
 			req.write(conn)
+			conn.(*net.TCPConn).CloseWrite()
 
 			respBuf := [1024]byte{}
 			n, err := conn.Read(respBuf[:])
@@ -369,6 +741,7 @@ func TestDelete(t *testing.T) {
 				t.Errorf("Failed to connect to the server: %v", err)
 			}
 			req.write(conn)
+			conn.(*net.TCPConn).CloseWrite()
 
 			respBuf := [1024]byte{}
 			n, err := conn.Read(respBuf[:])
@@ -408,7 +781,7 @@ func TestDelete(t *testing.T) {
 	}
 }
 
-func TestPurge(t *testing.T) {
+func TestIncrDecr(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6121"
 	go func() {
@@ -420,19 +793,95 @@ func TestPurge(t *testing.T) {
 
 	time.Sleep(500 * time.Millisecond)
 
-	expectedResponse := response{
-		command: []byte("PURGE"),
-		message: nil,
-		ok:      true,
-		key:     nil,
-		value:   nil,
+	server.cache.Set("text", []byte("abc"))
+	testCases := []struct {
+		name             string
+		req              request
+		expectedResponse response
+	}{
+		{
+			name: "Missing key, default delta",
+			req:  request{command: []byte("INCR"), key: []byte("counter")},
+			expectedResponse: response{
+				command: []byte("INCR"),
+				ok:      true,
+				key:     []byte("counter"),
+				value:   []byte("1"),
+			},
+		},
+		{
+			name: "Existing key, custom delta",
+			req:  request{command: []byte("INCR"), key: []byte("counter"), value: []byte("10")},
+			expectedResponse: response{
+				command: []byte("INCR"),
+				ok:      true,
+				key:     []byte("counter"),
+				value:   []byte("11"),
+			},
+		},
+		{
+			name: "Decrement",
+			req:  request{command: []byte("DECR"), key: []byte("counter"), value: []byte("20")},
+			expectedResponse: response{
+				command: []byte("DECR"),
+				ok:      true,
+				key:     []byte("counter"),
+				value:   []byte("-9"),
+			},
+		},
+		{
+			name: "Invalid delta",
+			req:  request{command: []byte("INCR"), key: []byte("counter"), value: []byte("x")},
+			expectedResponse: response{
+				command: []byte("INCR"),
+				message: []byte("Delta is not an integer"),
+				key:     []byte("counter"),
+			},
+		},
+		{
+			name: "Non-integer value",
+			req:  request{command: []byte("DECR"), key: []byte("text")},
+			expectedResponse: response{
+				command: []byte("DECR"),
+				message: []byte("Value is not an integer"),
+				key:     []byte("text"),
+			},
+		},
 	}
 
-	server.cache.Set("key1", []byte("value1"))
-	server.cache.Set("key2", []byte("value2"))
-	server.cache.Set("key3", []byte("value3"))
-
-	req := request{command: []byte("PURGE")}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := sendTestRequest(serverAddr, tc.req, t)
+			compareResponses(tc.expectedResponse, resp, t)
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	expectedResponse := response{
+		command: []byte("PURGE"),
+		message: nil,
+		ok:      true,
+		key:     nil,
+		value:   nil,
+	}
+
+	server.cache.Set("key1", []byte("value1"))
+	server.cache.Set("key2", []byte("value2"))
+	server.cache.Set("key3", []byte("value3"))
+
+	req := request{command: []byte("PURGE")}
 	conn, err := net.Dial("tcp", serverAddr)
 	if err != nil {
 		t.Errorf("Failed to connect to the server: %v", err)
@@ -475,6 +924,38 @@ func TestPurge(t *testing.T) {
 	}
 }
 
+func TestConfirmPurge(t *testing.T) {
+	server := NewServer(nil)
+	server.ConfirmPurge = true
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("key1", []byte("value1"))
+	for _, value := range []string{"", "confirm"} {
+		resp := sendTestRequest(serverAddr, request{command: []byte("PURGE"), value: []byte(value)}, t)
+		compareResponses(response{
+			command: []byte("PURGE"),
+			message: []byte("Purge must be confirmed"),
+		}, resp, t)
+	}
+	if server.cache.Length() != 1 {
+		t.Fatalf("Expected an unconfirmed purge to keep the cache, got length %d instead", server.cache.Length())
+	}
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("PURGE"), value: []byte("CONFIRM")}, t)
+	compareResponses(response{command: []byte("PURGE"), ok: true}, resp, t)
+	if server.cache.Length() != 0 {
+		t.Errorf("Cache is not empty")
+	}
+}
+
 func TestLength(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6121"
@@ -619,6 +1100,372 @@ func TestKeys(t *testing.T) {
 	}
 }
 
+func TestKeysPattern(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("user:1", []byte("value"))
+	server.cache.Set("session:1", []byte("value"))
+	server.cache.SetEx("user:2", []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	testCases := []struct {
+		name     string
+		req      request
+		expected response
+	}{
+		{
+			name:     "Matching live key",
+			req:      request{command: []byte("KEYS"), key: []byte("user:*")},
+			expected: response{command: []byte("KEYS"), ok: true, value: []byte("user:1")},
+		},
+		{
+			name:     "No match",
+			req:      request{command: []byte("KEYS"), key: []byte("missing:*")},
+			expected: response{command: []byte("KEYS"), ok: false, message: []byte("No keys")},
+		},
+		{
+			name:     "Invalid pattern",
+			req:      request{command: []byte("KEYS"), key: []byte("[")},
+			expected: response{command: []byte("KEYS"), ok: false, message: []byte("Invalid pattern")},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			compareResponses(tc.expected, sendTestRequest(serverAddr, tc.req, t), t)
+		})
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	server := NewServer(nil)
+	server.cache.SetMaxValueBytes(5)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	testCases := []struct {
+		name     string
+		req      request
+		expected response
+	}{
+		{
+			name:     "SET at the limit",
+			req:      request{command: []byte("SET"), key: []byte("key1"), value: []byte("12345")},
+			expected: response{command: []byte("SET"), ok: true, key: []byte("key1")},
+		},
+		{
+			name:     "SET over the limit",
+			req:      request{command: []byte("SET"), key: []byte("key2"), value: []byte("123456")},
+			expected: response{command: []byte("SET"), ok: false, message: []byte("Value is too large"), key: []byte("key2")},
+		},
+		{
+			name:     "GETSET over the limit",
+			req:      request{command: []byte("GETSET"), key: []byte("key1"), value: []byte("123456")},
+			expected: response{command: []byte("GETSET"), ok: false, message: []byte("Value is too large"), key: []byte("key1")},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			compareResponses(tc.expected, sendTestRequest(serverAddr, tc.req, t), t)
+		})
+	}
+	if value, _ := server.cache.Get("key1"); string(value) != "12345" {
+		t.Errorf("Expected the value at the limit to be kept, got %q instead", value)
+	}
+	if server.cache.Exists("key2") {
+		t.Error("Expected the value over the limit not to be stored")
+	}
+}
+
+func TestKeyTooLong(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	longKey := []byte(strings.Repeat("k", cache.DefaultMaxKeyBytes+1))
+	for _, command := range []string{"SET", "GET", "DELETE"} {
+		t.Run(command, func(t *testing.T) {
+			req := request{command: []byte(command), key: longKey, value: []byte("value")}
+			resp := sendTestRequest(serverAddr, req, t)
+			compareResponses(response{command: []byte(command), ok: false, message: []byte("Key is too long")}, resp, t)
+		})
+	}
+	if server.cache.Length() != 0 {
+		t.Error("Expected the over-long key not to be stored")
+	}
+}
+
+func TestKeysInfo(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("KEYSINFO")}, t)
+	compareResponses(response{command: []byte("KEYSINFO"), message: []byte("No keys")}, resp, t)
+
+	server.cache.Set("key1", []byte("v"))
+	server.cache.Set("key2", []byte("value2"))
+	server.cache.SetEx("key3", []byte("value3"), time.Minute)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("KEYSINFO")}, t)
+	if !resp.ok {
+		t.Fatalf("Expected ok to be true, got false instead (message: %s)", resp.message)
+	}
+	entries := strings.Split(string(resp.value), ",")
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d instead: %s", len(entries), resp.value)
+	}
+	for _, entry := range entries {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 {
+			t.Fatalf("Malformed entry \"%s\"", entry)
+		}
+		stored, _ := server.cache.Get(fields[0])
+		if fields[1] != strconv.Itoa(len(stored)) {
+			t.Errorf("Expected size of \"%s\" to be %d, got %s instead", fields[0], len(stored), fields[1])
+		}
+		ttl, err := strconv.Atoi(fields[2])
+		if err != nil {
+			t.Errorf("Malformed TTL in entry \"%s\"", entry)
+		}
+		if fields[0] == "key3" && (ttl <= 0 || ttl > 60000) {
+			t.Errorf("Expected TTL of \"key3\" to be within (0, 60000], got %d instead", ttl)
+		}
+		if fields[0] != "key3" && ttl != 0 {
+			t.Errorf("Expected TTL of \"%s\" to be 0, got %d instead", fields[0], ttl)
+		}
+	}
+
+	for i := 0; i < keysInfoLimit+10; i++ {
+		server.cache.Set("bulk"+strconv.Itoa(i), []byte("v"))
+	}
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+	(&request{command: []byte("KEYSINFO")}).write(conn)
+	respBuf := make([]byte, MaxMessageSize)
+	n, err := io.ReadAtLeast(conn, respBuf, 1)
+	for err == nil && bytes.Count(respBuf[:n], []byte("\r\n")) < 2 { // Header and VALUE lines.
+		var m int
+		m, err = conn.Read(respBuf[n:])
+		n += m
+	}
+	resp, err = parseResponse(respBuf[:n])
+	if err != nil {
+		t.Fatalf("Error while parsing response: %v", err)
+	}
+	if entries := strings.Split(string(resp.value), ","); len(entries) != keysInfoLimit {
+		t.Errorf("Expected %d entries, got %d instead", keysInfoLimit, len(entries))
+	}
+}
+
+func TestExpiring(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("EXPIRING"), value: []byte("2")}, t)
+	compareResponses(response{command: []byte("EXPIRING"), message: []byte("No keys")}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("EXPIRING"), value: []byte("abc")}, t)
+	compareResponses(response{command: []byte("EXPIRING"), message: []byte("Value is not a positive integer")}, resp, t)
+
+	server.cache.Set("permanent", []byte("v"))
+	server.cache.SetEx("later", []byte("v"), time.Hour)
+	server.cache.SetEx("soon", []byte("v"), time.Minute)
+	server.cache.SetEx("soonest", []byte("v"), time.Second*30)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("EXPIRING"), value: []byte("2")}, t)
+	if !resp.ok {
+		t.Fatalf("Expected ok to be true, got false instead (message: %s)", resp.message)
+	}
+	entries := strings.Split(string(resp.value), ",")
+	if len(entries) != 2 || !strings.HasPrefix(entries[0], "soonest:") || !strings.HasPrefix(entries[1], "soon:") {
+		t.Errorf("Expected \"soonest\" and \"soon\", got \"%s\" instead", resp.value)
+	}
+}
+
+func TestTTLHistogram(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("permanent", []byte("v"))
+	server.cache.SetEx("seconds", []byte("v"), 30*time.Second)
+	server.cache.SetEx("minutes", []byte("v"), 30*time.Minute)
+	server.cache.SetEx("days", []byte("v"), 48*time.Hour)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("TTLHIST")}, t)
+	compareResponses(response{
+		command: []byte("TTLHIST"),
+		ok:      true,
+		value:   []byte("60000:1,3600000:1,86400000:0,+Inf:1,never:1"),
+	}, resp, t)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("TTLHIST"), value: []byte("3600000,60000000000")}, t)
+	compareResponses(response{
+		command: []byte("TTLHIST"),
+		ok:      true,
+		value:   []byte("3600000:2,60000000000:1,+Inf:0,never:1"),
+	}, resp, t)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("TTLHIST"), value: []byte("60000,-1")}, t)
+	compareResponses(response{command: []byte("TTLHIST"), message: []byte("Value is not a list of positive integers")}, resp, t)
+}
+
+func TestDefaultTTL(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+	other, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer other.Close()
+
+	exchange := func(conn net.Conn, req request) response {
+		req.write(conn)
+		respBuf := [1024]byte{}
+		n, err := conn.Read(respBuf[:])
+		if err != nil {
+			t.Fatalf("Error while reading from server: %v", err)
+		}
+		resp, err := parseResponse(respBuf[:n])
+		if err != nil {
+			t.Fatalf("Error while parsing response: %v", err)
+		}
+		return resp
+	}
+
+	resp := exchange(conn, request{command: []byte("DEFAULTTTL"), value: []byte("abc")})
+	compareResponses(response{command: []byte("DEFAULTTTL"), message: []byte("Value is not a valid TTL")}, resp, t)
+
+	resp = exchange(conn, request{command: []byte("DEFAULTTTL"), value: []byte("50")})
+	compareResponses(response{command: []byte("DEFAULTTTL"), ok: true, value: []byte("50")}, resp, t)
+
+	exchange(conn, request{command: []byte("SET"), key: []byte("short"), value: []byte("1")})
+	exchange(conn, request{command: []byte("SETNX"), key: []byte("shortnx"), value: []byte("1")})
+	exchange(other, request{command: []byte("SET"), key: []byte("long"), value: []byte("1")})
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok := server.cache.Get("short"); ok {
+		t.Error("Expected key set with connection default TTL to expire")
+	}
+	if _, ok := server.cache.Get("shortnx"); ok {
+		t.Error("Expected key set by SETNX with connection default TTL to expire")
+	}
+	if _, ok := server.cache.Get("long"); !ok {
+		t.Error("Expected key set on another connection not to expire")
+	}
+
+	exchange(conn, request{command: []byte("DEFAULTTTL"), value: []byte("0")})
+	exchange(conn, request{command: []byte("SET"), key: []byte("short"), value: []byte("1")})
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := server.cache.Get("short"); !ok {
+		t.Error("Expected key not to expire after default TTL was disabled")
+	}
+}
+
+func TestStats(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("key1", []byte("value1"))
+	sendTestRequest(serverAddr, request{command: []byte("GET"), key: []byte("key1")}, t)
+	sendTestRequest(serverAddr, request{command: []byte("GET"), key: []byte("key1")}, t)
+	sendTestRequest(serverAddr, request{command: []byte("GET"), key: []byte("missing")}, t)
+
+	// Only the connection sending STATS is counted once the others are closed.
+	deadline := time.Now().Add(time.Second)
+	for server.ActiveConns() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp := sendTestRequest(serverAddr, request{command: []byte("STATS")}, t)
+	compareResponses(response{command: []byte("STATS"), ok: true, value: []byte("hits:2,misses:1,length:1,evictions:0,connections:1")}, resp, t)
+}
+
+func TestVersion(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("VERSION")}, t)
+	compareResponses(response{command: []byte("VERSION"), ok: true, value: []byte(version.String())}, resp, t)
+}
+
 func TestPing(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6121"
@@ -679,7 +1526,7 @@ func TestPing(t *testing.T) {
 	}
 }
 
-func TestClose(t *testing.T) {
+func TestActiveConns(t *testing.T) {
 	server := NewServer(nil)
 	serverAddr := "localhost:6121"
 	go func() {
@@ -691,10 +1538,578 @@ func TestClose(t *testing.T) {
 
 	time.Sleep(500 * time.Millisecond)
 
-	expectedResponse := response{
-		command: []byte("CLOSE"),
-		message: nil,
-		ok:      true,
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", serverAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to the server: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitForConns(server, 3, t)
+
+	conns[0].Close()
+	waitForConns(server, 2, t)
+}
+
+func TestClients(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", serverAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to the server: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitForConns(server, 2, t)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("CLIENTS")}, t)
+	if !resp.ok {
+		t.Fatalf("Expected ok, got message %q instead", resp.message)
+	}
+	listed := make(map[string]bool)
+	for _, entry := range strings.Split(string(resp.value), ",") {
+		sep := strings.LastIndexByte(entry, ':')
+		if ms, err := strconv.ParseInt(entry[sep+1:], 10, 64); sep < 0 || err != nil || ms <= 0 {
+			t.Errorf("Expected an entry of the form <address>:<connected>, got %q instead", entry)
+			continue
+		}
+		listed[entry[:sep]] = true
+	}
+	// The connection that sent CLIENTS is listed as well.
+	if len(listed) != 3 {
+		t.Errorf("Expected 3 clients, got %q instead", resp.value)
+	}
+	for _, conn := range conns {
+		if !listed[conn.LocalAddr().String()] {
+			t.Errorf("Expected %s to be listed, got %q instead", conn.LocalAddr(), resp.value)
+		}
+	}
+}
+
+func TestConnLogSampling(t *testing.T) {
+	var logs lockedBuffer
+	server := NewServer(nil)
+	server.Logger = zerolog.New(&logs).Level(zerolog.DebugLevel)
+	server.ConnLogSampling = 3
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	for i := 0; i < 6; i++ {
+		server.logConn(&server.acceptedConns, "Received new connection", conn)
+	}
+	if n := strings.Count(logs.String(), "Received new connection"); n != 2 {
+		t.Errorf("Expected 2 of 6 connections to be logged, got %d instead", n)
+	}
+
+	server.Logger = zerolog.New(&logs).Level(zerolog.Disabled)
+	server.ConnLogSampling = 0
+	allocs := testing.AllocsPerRun(100, func() {
+		server.logConn(&server.acceptedConns, "Received new connection", conn)
+		server.logConn(&server.closedConns, "Closed connection", conn)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations with logging disabled, got %v per connection instead", allocs)
+	}
+}
+
+func TestLargeMessage(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+	exchange := func(req request) response {
+		req.write(conn)
+		respBuf := [1024]byte{}
+		n, err := conn.Read(respBuf[:])
+		if err != nil {
+			t.Fatalf("Error while reading from server: %v", err)
+		}
+		resp, err := parseResponse(respBuf[:n])
+		if err != nil {
+			t.Fatalf("Error while parsing response: %v", err)
+		}
+		return resp
+	}
+
+	// "RCSP/1.0 SET\r\nKEY: big\r\nVALUE: " and the final CRLF take 33 bytes.
+	value := bytes.Repeat([]byte("x"), MaxMessageSize-33)
+	resp := exchange(request{command: []byte("SET"), key: []byte("big"), value: value})
+	compareResponses(response{command: []byte("SET"), ok: true, key: []byte("big")}, resp, t)
+	if stored, _ := server.cache.Get("big"); !bytes.Equal(stored, value) {
+		t.Errorf("Expected value of %d bytes to be stored, got %d bytes instead", len(value), len(stored))
+	}
+
+	value = append(value, 'x')
+	resp = exchange(request{command: []byte("SET"), key: []byte("big"), value: value})
+	compareResponses(response{message: []byte("Message too large")}, resp, t)
+	if stored, _ := server.cache.Get("big"); len(stored) != len(value)-1 {
+		t.Errorf("Expected rejected value not to be stored, got %d bytes instead", len(stored))
+	}
+
+	resp = exchange(request{command: []byte("PING")})
+	compareResponses(response{command: []byte("PING"), message: []byte("PONG"), ok: true}, resp, t)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	var logs lockedBuffer
+	server := NewServer(nil)
+	server.Logger = zerolog.New(&logs).Level(zerolog.DebugLevel)
+	server.IdleTimeout = 200 * time.Millisecond
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+	ping := request{command: []byte("PING")}
+	ping.write(conn)
+	respBuf := [1024]byte{}
+	if _, err := conn.Read(respBuf[:]); err != nil {
+		t.Fatalf("Expected a response before the connection is idle, got %v instead", err)
+	}
+
+	// The connection stays idle past the timeout, after which the server closes it.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(respBuf[:]); err != io.EOF {
+		t.Fatalf("Expected the server to close the idle connection, got %v instead", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected the connection to be closed after the timeout, got closed after %v", elapsed)
+	}
+	if !strings.Contains(logs.String(), "Closing idle connection") {
+		t.Error("Expected the idle connection to be logged")
+	}
+	if strings.Contains(logs.String(), "error") {
+		t.Errorf("Expected the timeout not to be logged as an error, got %s", logs.String())
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy ConnLimitPolicy
+	}{
+		{"Reject", RejectOverLimit},
+		{"Wait", WaitOverLimit},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(nil)
+			server.MaxConns = 2
+			server.ConnLimitPolicy = tc.policy
+			serverAddr := "localhost:6121"
+			go func() {
+				if err := server.ListenAndServe(serverAddr); err != nil {
+					t.Errorf("Server failed: %v", err)
+				}
+			}()
+			defer server.Close()
+
+			time.Sleep(500 * time.Millisecond)
+
+			ping := func(conn net.Conn) (response, error) {
+				req := request{command: []byte("PING")}
+				req.write(conn)
+				respBuf := [1024]byte{}
+				n, err := conn.Read(respBuf[:])
+				if err != nil {
+					return response{}, err
+				}
+				return parseResponse(respBuf[:n])
+			}
+			var conns []net.Conn
+			for i := 0; i < 3; i++ {
+				conn, err := net.Dial("tcp", serverAddr)
+				if err != nil {
+					t.Fatalf("Failed to connect to the server: %v", err)
+				}
+				defer conn.Close()
+				conns = append(conns, conn)
+			}
+			for _, conn := range conns[:2] {
+				if _, err := ping(conn); err != nil {
+					t.Fatalf("Expected connections up to the limit to be served, got %v instead", err)
+				}
+			}
+
+			pong := response{command: []byte("PING"), message: []byte("PONG"), ok: true}
+			over := conns[2]
+			over.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			resp, err := ping(over)
+			if tc.policy == RejectOverLimit {
+				if err != nil {
+					t.Fatalf("Expected a response to the connection over the limit, got %v instead", err)
+				}
+				compareResponses(response{message: []byte("Too many connections")}, resp, t)
+				return
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("Expected the connection over the limit to wait, got %v, %v instead", resp, err)
+			}
+			conns[0].Close()
+			over.SetReadDeadline(time.Now().Add(2 * time.Second))
+			respBuf := [1024]byte{}
+			n, err := over.Read(respBuf[:])
+			if err != nil {
+				t.Fatalf("Expected the waiting connection to be served once a slot is free, got %v instead", err)
+			}
+			resp, _ = parseResponse(respBuf[:n])
+			compareResponses(pong, resp, t)
+		})
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	var logs lockedBuffer
+	server := NewServer(nil)
+	server.Logger = zerolog.New(&logs).Level(zerolog.DebugLevel)
+	server.WriteTimeout = 200 * time.Millisecond
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("big", bytes.Repeat([]byte("x"), 512*1024))
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+
+	// The client requests far more than the socket buffers hold and never reads.
+	var reqs []byte
+	for i := 0; i < 200; i++ {
+		reqs = append(reqs, "RCSP/1.0 GET\r\nKEY: big\r\n"...)
+	}
+	go conn.Write(reqs)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "error while writing") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the server to give up writing to a client that does not read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForConns(server, 0, t)
+}
+
+func TestReadErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		send     string
+		expected string // Message expected in the log once the connection is closed.
+		isError  bool
+	}{
+		{"Clean close", "RCSP/1.0 PING\r\n", "Client closed connection", false},
+		{"Garbage", "garbage\r\n", "error while parsing request", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs lockedBuffer
+			server := NewServer(nil)
+			server.Logger = zerolog.New(&logs).Level(zerolog.DebugLevel)
+			serverAddr := "localhost:6121"
+			go func() {
+				if err := server.ListenAndServe(serverAddr); err != nil {
+					t.Errorf("Server failed: %v", err)
+				}
+			}()
+			defer server.Close()
+
+			time.Sleep(500 * time.Millisecond)
+
+			conn, err := net.Dial("tcp", serverAddr)
+			if err != nil {
+				t.Fatalf("Failed to connect to the server: %v", err)
+			}
+			conn.Write([]byte(tc.send))
+			respBuf := [1024]byte{}
+			if _, err := conn.Read(respBuf[:]); err != nil {
+				t.Fatalf("Expected a response, got %v instead", err)
+			}
+			conn.Close()
+			waitForConns(server, 0, t)
+
+			if !strings.Contains(logs.String(), tc.expected) {
+				t.Errorf("Expected %q to be logged, got %s", tc.expected, logs.String())
+			}
+			if isError := strings.Contains(logs.String(), `"level":"error"`); isError != tc.isError {
+				t.Errorf("Expected an error to be logged to be %t, got %s", tc.isError, logs.String())
+			}
+			if strings.Contains(logs.String(), "error while reading") {
+				t.Errorf("Expected the client closing the connection not to be a read error, got %s", logs.String())
+			}
+		})
+	}
+
+	t.Run("Shutdown", func(t *testing.T) {
+		var logs lockedBuffer
+		server := NewServer(nil)
+		server.Logger = zerolog.New(&logs).Level(zerolog.DebugLevel)
+		serverAddr := "localhost:6121"
+		go func() {
+			if err := server.ListenAndServe(serverAddr); err != nil {
+				t.Errorf("Server failed: %v", err)
+			}
+		}()
+
+		time.Sleep(500 * time.Millisecond)
+
+		conn, err := net.Dial("tcp", serverAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to the server: %v", err)
+		}
+		defer conn.Close()
+		waitForConns(server, 1, t)
+		server.Close()
+		waitForConns(server, 0, t)
+		time.Sleep(100 * time.Millisecond)
+		if strings.Contains(logs.String(), "error while reading") {
+			t.Errorf("Expected connections closed by Close not to be logged as errors, got %s", logs.String())
+		}
+	})
+}
+
+func TestPipelining(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("RCSP/1.0 SET\r\nKEY: key1\r\nVALUE: value1\r\n" +
+		"RCSP/1.0 SET\r\nKEY: key2\r\nVALUE: value2\r\n" +
+		"RCSP/1.0 GET\r\nKEY: key1\r\n"))
+
+	var respBuf []byte
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for bytes.Count(respBuf, []byte("RCSP/1.0 ")) < 3 {
+		chunk := [1024]byte{}
+		n, err := conn.Read(chunk[:])
+		if err != nil {
+			t.Fatalf("Error while reading from server: %v, received %q", err, respBuf)
+		}
+		respBuf = append(respBuf, chunk[:n]...)
+	}
+	var responses []response
+	for _, msg := range bytes.Split(respBuf, []byte("RCSP/1.0 "))[1:] {
+		resp, err := parseResponse(append([]byte("RCSP/1.0 "), msg...))
+		if err != nil {
+			t.Fatalf("Error while parsing response %q: %v", msg, err)
+		}
+		responses = append(responses, resp)
+	}
+	compareResponses(response{command: []byte("SET"), ok: true, key: []byte("key1")}, responses[0], t)
+	compareResponses(response{command: []byte("SET"), ok: true, key: []byte("key2")}, responses[1], t)
+	compareResponses(response{command: []byte("GET"), ok: true, key: []byte("key1"), value: []byte("value1")}, responses[2], t)
+
+	// Header lines and VALUE written separately make up a single request.
+	conn.Write([]byte("RCSP/1.0 SET\r\nKEY: key3\r\n"))
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("VALUE: value3\r\n"))
+
+	chunk := [1024]byte{}
+	n, err := conn.Read(chunk[:])
+	if err != nil {
+		t.Fatalf("Error while reading from server: %v", err)
+	}
+	resp, err := parseResponse(chunk[:n])
+	if err != nil {
+		t.Fatalf("Error while parsing response %q: %v", chunk[:n], err)
+	}
+	compareResponses(response{command: []byte("SET"), ok: true, key: []byte("key3")}, resp, t)
+	if stored, _ := server.cache.Get("key3"); string(stored) != "value3" {
+		t.Errorf("Expected %q to be stored, got %q instead", "value3", stored)
+	}
+}
+
+func TestFramedValue(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	value := []byte("line1\r\n\x00line2\r\nRCSP/1.0 PING\r\n")
+	resp := sendTestRequest(serverAddr, request{command: []byte("SET"), key: []byte("key1"), value: value, framed: true}, t)
+	compareResponses(response{command: []byte("SET"), ok: true, key: []byte("key1")}, resp, t)
+	if !resp.framed {
+		t.Errorf("Expected an RCSP/1.1 response")
+	}
+	if stored, _ := server.cache.Get("key1"); !bytes.Equal(stored, value) {
+		t.Errorf("Expected %q to be stored, got %q instead", value, stored)
+	}
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("GET"), key: []byte("key1"), framed: true}, t)
+	compareResponses(response{command: []byte("GET"), ok: true, key: []byte("key1"), value: value}, resp, t)
+
+	// A value whose first part ends with CRLF is read until VALUE-LENGTH is reached.
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("RCSP/1.1 SET\r\nKEY: key2\r\nVALUE-LENGTH: 10\r\nVALUE: ab\r\n"))
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("cd\r\nef\r\n"))
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	respBuf := [1024]byte{}
+	n, err := conn.Read(respBuf[:])
+	if err != nil {
+		t.Fatalf("Error while reading from server: %v", err)
+	}
+	resp, err = parseResponse(respBuf[:n])
+	if err != nil {
+		t.Fatalf("Error while parsing response %q: %v", respBuf[:n], err)
+	}
+	compareResponses(response{command: []byte("SET"), ok: true, key: []byte("key2")}, resp, t)
+	if stored, _ := server.cache.Get("key2"); !bytes.Equal(stored, []byte("ab\r\ncd\r\nef")) {
+		t.Errorf("Expected %q to be stored, got %q instead", "ab\r\ncd\r\nef", stored)
+	}
+}
+
+func TestTraceFrames(t *testing.T) {
+	var logs lockedBuffer
+	server := NewServer(nil)
+	server.Logger = zerolog.New(&logs).Level(zerolog.TraceLevel)
+	server.SetTraceFrames(true)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("PING")}, t)
+	compareResponses(response{command: []byte("PING"), message: []byte("PONG"), ok: true}, resp, t)
+
+	expected := []string{
+		"--- request from",
+		"|RCSP/1.0 PING..|",
+		"--- response to",
+		"|RCSP/1.0 PING OK|",
+		"--- end ---",
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		out := logs.String()
+		missing := ""
+		for _, s := range expected {
+			if !strings.Contains(out, s) {
+				missing = s
+				break
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected trace log to contain %q, got:\n%s", missing, out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The API key sent with AUTH is masked.
+	resp = sendTestRequest(serverAddr, request{command: []byte("AUTH"), value: []byte("secret")}, t)
+	compareResponses(response{command: []byte("AUTH"), ok: true}, resp, t)
+	if out := logs.String(); !strings.Contains(out, "|RCSP/1.0 AUTH..*|") || strings.Contains(out, "secret") {
+		t.Errorf("Expected the AUTH value to be masked, got:\n%s", out)
+	}
+
+	// Disabling takes effect without reconnecting.
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+	server.SetTraceFrames(false)
+	before := logs.String()
+	(&request{command: []byte("PING")}).write(conn)
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("Error while reading from server: %v", err)
+	}
+	if after := logs.String()[len(before):]; strings.Contains(after, "--- ") {
+		t.Errorf("Expected nothing to be dumped once disabled, got:\n%s", after)
+	}
+}
+
+func TestClose(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	expectedResponse := response{
+		command: []byte("CLOSE"),
+		message: nil,
+		ok:      true,
 		key:     nil,
 		value:   nil,
 	}
@@ -748,3 +2163,646 @@ func TestClose(t *testing.T) {
 		t.Errorf("Expected read from server to fail with EOF after CLOSE but got different error: %v", err)
 	}
 }
+
+func TestConcurrentShutdownAndClose(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", serverAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to the server: %v", err)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	done := make(chan error, 2)
+	go func() { done <- server.Shutdown(ctx) }()
+	go func() { done <- server.Close() }()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Expected no error, got %v instead", err)
+		}
+	}
+
+	if n := server.ActiveConns(); n != 0 {
+		t.Errorf("Expected no active connections, got %d instead", n)
+	}
+	_, err := net.Dial("tcp", serverAddr)
+	if err == nil {
+		t.Error("Expected connection to fail after shutdown, but Dial was successful")
+	}
+}
+
+func TestDecrAndReap(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.Set("refs", []byte("2"))
+	server.cache.Set("text", []byte("abc"))
+
+	testCases := []struct {
+		name             string
+		key              []byte
+		expectedResponse response
+	}{
+		{
+			name: "Nil key",
+			key:  nil,
+			expectedResponse: response{
+				command: []byte("DECREAP"),
+				message: []byte("Key is missing"),
+			},
+		},
+		{
+			name: "Decrement above zero",
+			key:  []byte("refs"),
+			expectedResponse: response{
+				command: []byte("DECREAP"),
+				ok:      true,
+				key:     []byte("refs"),
+				value:   []byte("1"),
+			},
+		},
+		{
+			name: "Decrement to zero",
+			key:  []byte("refs"),
+			expectedResponse: response{
+				command: []byte("DECREAP"),
+				ok:      true,
+				message: []byte("Deleted"),
+				key:     []byte("refs"),
+				value:   []byte("0"),
+			},
+		},
+		{
+			name: "Missing key",
+			key:  []byte("refs"),
+			expectedResponse: response{
+				command: []byte("DECREAP"),
+				message: []byte("Not found"),
+				key:     []byte("refs"),
+			},
+		},
+		{
+			name: "Non-integer value",
+			key:  []byte("text"),
+			expectedResponse: response{
+				command: []byte("DECREAP"),
+				message: []byte("Value is not an integer"),
+				key:     []byte("text"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := request{command: []byte("DECREAP"), key: tc.key}
+			resp := sendTestRequest(serverAddr, req, t)
+			compareResponses(tc.expectedResponse, resp, t)
+		})
+	}
+
+	if _, ok := server.cache.Get("refs"); ok {
+		t.Error("Expected \"refs\" to be deleted, found it instead")
+	}
+}
+
+func TestSetNX(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	acquire := request{
+		command: []byte("SET"),
+		key:     []byte("lock"),
+		ttl:     []byte("60000"),
+		flags:   []byte("NX"),
+		value:   []byte("owner1"),
+	}
+	resp := sendTestRequest(serverAddr, acquire, t)
+	compareResponses(response{command: []byte("SET"), ok: true, key: []byte("lock")}, resp, t)
+
+	acquire.value = []byte("owner2")
+	resp = sendTestRequest(serverAddr, acquire, t)
+	compareResponses(response{
+		command: []byte("SET"),
+		message: []byte("Key already exists"),
+		key:     []byte("lock"),
+	}, resp, t)
+
+	if owner, _ := server.cache.Get("lock"); string(owner) != "owner1" {
+		t.Errorf("Expected lock to be owned by \"owner1\", got \"%s\" instead", owner)
+	}
+	if info := server.cache.KeysInfo(0); len(info) != 1 || info[0].TTL <= 0 || info[0].TTL > time.Minute {
+		t.Errorf("Expected lock to carry a TTL within (0, 1m], got %v instead", info)
+	}
+
+	acquire.ttl = []byte("abc")
+	resp = sendTestRequest(serverAddr, acquire, t)
+	compareResponses(response{
+		command: []byte("SET"),
+		message: []byte("TTL is not a positive integer"),
+		key:     []byte("lock"),
+	}, resp, t)
+}
+
+func TestSetNXCommand(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	// Two clients race to acquire the same lock, exactly one of them succeeds.
+	var wg sync.WaitGroup
+	results := make([]response, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", serverAddr)
+			if err != nil {
+				t.Errorf("Failed to connect to the server: %v", err)
+				return
+			}
+			defer conn.Close()
+			req := request{
+				command: []byte("SETNX"),
+				key:     []byte("lock"),
+				ttl:     []byte("60000"),
+				value:   []byte("owner" + strconv.Itoa(i)),
+			}
+			req.write(conn)
+			respBuf := [1024]byte{}
+			n, err := conn.Read(respBuf[:])
+			if err != nil {
+				t.Errorf("Error while reading from server: %v", err)
+				return
+			}
+			results[i], _ = parseResponse(respBuf[:n])
+		}(i)
+	}
+	wg.Wait()
+
+	if results[0].ok == results[1].ok {
+		t.Fatalf("Expected exactly one client to acquire the lock, got ok %t and %t instead", results[0].ok, results[1].ok)
+	}
+	winner, loser := 0, 1
+	if results[1].ok {
+		winner, loser = 1, 0
+	}
+	compareResponses(response{
+		command: []byte("SETNX"),
+		message: []byte("Key already exists"),
+		key:     []byte("lock"),
+	}, results[loser], t)
+	if owner, _ := server.cache.Get("lock"); string(owner) != "owner"+strconv.Itoa(winner) {
+		t.Errorf("Expected lock to be owned by \"owner%d\", got \"%s\" instead", winner, owner)
+	}
+	if ttl, ok := server.cache.TTL("lock"); !ok || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected lock to carry a TTL within (0, 1m], got %v instead", ttl)
+	}
+
+	testCases := []struct {
+		name     string
+		req      request
+		expected response
+	}{
+		{
+			name:     "Without TTL",
+			req:      request{command: []byte("SETNX"), key: []byte("key1"), value: []byte("value1")},
+			expected: response{command: []byte("SETNX"), ok: true, key: []byte("key1")},
+		},
+		{
+			name:     "Invalid TTL",
+			req:      request{command: []byte("SETNX"), key: []byte("key2"), ttl: []byte("abc"), value: []byte("value2")},
+			expected: response{command: []byte("SETNX"), message: []byte("TTL is not a positive integer"), key: []byte("key2")},
+		},
+		{
+			name:     "No value",
+			req:      request{command: []byte("SETNX"), key: []byte("key2")},
+			expected: response{command: []byte("SETNX"), message: []byte("Value is missing"), key: []byte("key2")},
+		},
+		{
+			name:     "No key",
+			req:      request{command: []byte("SETNX"), value: []byte("value2")},
+			expected: response{command: []byte("SETNX"), message: []byte("Key is missing")},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := sendTestRequest(serverAddr, tc.req, t)
+			compareResponses(tc.expected, resp, t)
+		})
+	}
+	if _, ok := server.cache.TTL("key1"); !ok {
+		t.Error("Expected key1 to be stored")
+	}
+	if server.cache.Length() != 2 {
+		t.Errorf("Expected 2 keys, got %d instead", server.cache.Length())
+	}
+}
+
+func TestSetKeepTTL(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	server.cache.SetEx("key1", []byte("value1"), time.Minute)
+
+	req := request{
+		command: []byte("SET"),
+		key:     []byte("key1"),
+		flags:   []byte("KEEPTTL"),
+		value:   []byte("value2"),
+	}
+	resp := sendTestRequest(serverAddr, req, t)
+	compareResponses(response{
+		command: []byte("SET"),
+		message: []byte("Replaced"),
+		ok:      true,
+		key:     []byte("key1"),
+	}, resp, t)
+	if info := server.cache.KeysInfo(0); len(info) != 1 || info[0].TTL <= 0 || info[0].TTL > time.Minute {
+		t.Errorf("Expected TTL within (0, 1m] to survive the overwrite, got %v instead", info)
+	}
+
+	req.flags = nil
+	req.value = []byte("value3")
+	sendTestRequest(serverAddr, req, t)
+	if info := server.cache.KeysInfo(0); len(info) != 1 || info[0].TTL != 0 {
+		t.Errorf("Expected SET without KEEPTTL to clear the TTL, got %v instead", info)
+	}
+
+	req.flags = []byte("KEEPTTL")
+	req.ttl = []byte("1000")
+	resp = sendTestRequest(serverAddr, req, t)
+	compareResponses(response{
+		command: []byte("SET"),
+		message: []byte("KEEPTTL cannot be combined with TTL, NX or XX"),
+		key:     []byte("key1"),
+	}, resp, t)
+}
+
+func TestSetXX(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	req := request{
+		command: []byte("SET"),
+		key:     []byte("key1"),
+		flags:   []byte("XX"),
+		value:   []byte("value1"),
+	}
+	resp := sendTestRequest(serverAddr, req, t)
+	compareResponses(response{
+		command: []byte("SET"),
+		message: []byte("Key does not exist"),
+		key:     []byte("key1"),
+	}, resp, t)
+	if _, ok := server.cache.Get("key1"); ok {
+		t.Error("Expected missing key not to be created")
+	}
+
+	server.cache.Set("key1", []byte("value0"))
+	resp = sendTestRequest(serverAddr, req, t)
+	compareResponses(response{
+		command: []byte("SET"),
+		message: []byte("Replaced"),
+		ok:      true,
+		key:     []byte("key1"),
+	}, resp, t)
+	if value, _ := server.cache.Get("key1"); string(value) != "value1" {
+		t.Errorf("Expected value \"value1\", got \"%s\" instead", value)
+	}
+
+	req.flags = []byte("NX XX")
+	resp = sendTestRequest(serverAddr, req, t)
+	compareResponses(response{
+		command: []byte("SET"),
+		message: []byte("NX cannot be combined with XX"),
+		key:     []byte("key1"),
+	}, resp, t)
+}
+
+func TestGetOrSet(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	testCases := []struct {
+		name             string
+		key              []byte
+		value            []byte
+		expectedResponse response
+	}{
+		{
+			name:  "Valid key, nil value",
+			key:   []byte("key1"),
+			value: nil,
+			expectedResponse: response{
+				command: []byte("GETORSET"),
+				message: []byte("Value is missing"),
+				key:     []byte("key1"),
+			},
+		},
+		{
+			name:  "Missing key",
+			key:   []byte("key1"),
+			value: []byte("default"),
+			expectedResponse: response{
+				command: []byte("GETORSET"),
+				ok:      true,
+				message: []byte("Created"),
+				key:     []byte("key1"),
+				value:   []byte("default"),
+			},
+		},
+		{
+			name:  "Existing key",
+			key:   []byte("key1"),
+			value: []byte("other"),
+			expectedResponse: response{
+				command: []byte("GETORSET"),
+				ok:      true,
+				key:     []byte("key1"),
+				value:   []byte("default"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := request{command: []byte("GETORSET"), key: tc.key, value: tc.value}
+			resp := sendTestRequest(serverAddr, req, t)
+			compareResponses(tc.expectedResponse, resp, t)
+		})
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("GETSET"), key: []byte("key1"), value: []byte("value1")}, t)
+	compareResponses(response{command: []byte("GETSET"), ok: true, message: []byte("Created"), key: []byte("key1")}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("GETSET"), key: []byte("key1"), value: []byte("value2")}, t)
+	compareResponses(response{command: []byte("GETSET"), ok: true, key: []byte("key1"), value: []byte("value1")}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("GETSET"), key: []byte("key1")}, t)
+	compareResponses(response{command: []byte("GETSET"), message: []byte("Value is missing"), key: []byte("key1")}, resp, t)
+	if value, _ := server.cache.Get("key1"); !bytes.Equal(value, []byte("value2")) {
+		t.Errorf("Expected \"value2\" to be stored, got \"%s\" instead", value)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	server := NewServer(nil)
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	if err := server.Migrate("10.0.0.2:6121", "[user"); err == nil {
+		t.Error("Expected malformed pattern to be rejected")
+	}
+	server.cache.Set("user:1", []byte("old"))
+	if err := server.Migrate("10.0.0.2:6121", "user:*"); err != nil {
+		t.Fatalf("Failed to start migration: %v", err)
+	}
+
+	resp := sendTestRequest(serverAddr, request{command: []byte("SET"), key: []byte("user:1"), value: []byte("new")}, t)
+	compareResponses(response{
+		command: []byte("SET"),
+		message: []byte("MOVED 10.0.0.2:6121"),
+		key:     []byte("user:1"),
+	}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("DELETE"), key: []byte("user:1")}, t)
+	if resp.ok || string(resp.message) != "MOVED 10.0.0.2:6121" {
+		t.Errorf("Expected DELETE to be redirected, got \"%s\" instead", resp.message)
+	}
+	resp = sendTestRequest(serverAddr, request{command: []byte("GET"), key: []byte("user:1")}, t)
+	compareResponses(response{command: []byte("GET"), ok: true, key: []byte("user:1"), value: []byte("old")}, resp, t)
+	resp = sendTestRequest(serverAddr, request{command: []byte("SET"), key: []byte("order:1"), value: []byte("1")}, t)
+	compareResponses(response{command: []byte("SET"), ok: true, key: []byte("order:1")}, resp, t)
+
+	resp = sendTestRequest(serverAddr, request{command: []byte("MDELETE"), key: []byte("user:1,user:2")}, t)
+	if resp.ok || string(resp.message) != "MOVED 10.0.0.2:6121" {
+		t.Errorf("Expected MDELETE of migrated keys to be redirected, got \"%s\" instead", resp.message)
+	}
+	// Keys written together with others or by pattern cannot be redirected.
+	for _, req := range []request{
+		{command: []byte("MDELETE"), key: []byte("user:1,order:1")},
+		{command: []byte("EXPIREMATCHING"), key: []byte("*"), value: []byte("1")},
+		{command: []byte("DELEXPIRED"), key: []byte("*")},
+		{command: []byte("PURGE")},
+	} {
+		resp = sendTestRequest(serverAddr, req, t)
+		if resp.ok || string(resp.message) != "Migration in progress" {
+			t.Errorf("Expected %s to be refused, got \"%s\" instead", req.command, resp.message)
+		}
+	}
+	if !server.cache.Exists("user:1") {
+		t.Error("Expected the migrated key to be kept")
+	}
+
+	server.StopMigration()
+	resp = sendTestRequest(serverAddr, request{command: []byte("SET"), key: []byte("user:1"), value: []byte("new")}, t)
+	compareResponses(response{command: []byte("SET"), ok: true, message: []byte("Replaced"), key: []byte("user:1")}, resp, t)
+}
+
+// sendTestRequest writes req to a new connection and returns the parsed response.
+func TestAuth(t *testing.T) {
+	server := NewServer(nil)
+	server.APIKey = "secret"
+	serverAddr := "localhost:6121"
+	go func() {
+		if err := server.ListenAndServe(serverAddr); err != nil {
+			t.Errorf("Server failed: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+
+	exchange := func(req request) response {
+		req.write(conn)
+		respBuf := [1024]byte{}
+		n, err := conn.Read(respBuf[:])
+		if err != nil {
+			t.Fatalf("Error while reading from server: %v", err)
+		}
+		resp, err := parseResponse(respBuf[:n])
+		if err != nil {
+			t.Fatalf("Error while parsing response: %v", err)
+		}
+		return resp
+	}
+
+	resp := exchange(request{command: []byte("SET"), key: []byte("key1"), value: []byte("value1")})
+	compareResponses(response{command: []byte("SET"), message: []byte("Authentication required")}, resp, t)
+	if server.cache.Length() != 0 {
+		t.Error("Expected unauthenticated SET not to be applied")
+	}
+
+	resp = exchange(request{command: []byte("AUTH"), value: []byte("wrong")})
+	compareResponses(response{command: []byte("AUTH"), message: []byte("Invalid API key")}, resp, t)
+	resp = exchange(request{command: []byte("PING")})
+	compareResponses(response{command: []byte("PING"), message: []byte("Authentication required")}, resp, t)
+
+	resp = exchange(request{command: []byte("AUTH"), value: []byte("secret")})
+	compareResponses(response{command: []byte("AUTH"), ok: true}, resp, t)
+	resp = exchange(request{command: []byte("PING")})
+	compareResponses(response{command: []byte("PING"), ok: true, message: []byte("PONG")}, resp, t)
+
+	// Authentication is per connection.
+	resp = sendTestRequest(serverAddr, request{command: []byte("PING")}, t)
+	compareResponses(response{command: []byte("PING"), message: []byte("Authentication required")}, resp, t)
+}
+
+func sendTestRequest(serverAddr string, req request, t *testing.T) response {
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	defer conn.Close()
+	req.write(conn)
+	// Requests lacking a line their command requires are only processed once the
+	// server knows that nothing else follows.
+	conn.(*net.TCPConn).CloseWrite()
+
+	respBuf := [1024]byte{}
+	n, err := conn.Read(respBuf[:])
+	if err != nil {
+		t.Errorf("Error while reading from server")
+	}
+	resp, err := parseResponse(respBuf[:n])
+	if err != nil {
+		t.Logf("Response buffer:\n%s", string(respBuf[:n]))
+		t.Logf("Error while parsing response: %v", err)
+	}
+	return resp
+}
+
+func compareResponses(expected, actual response, t *testing.T) {
+	if actual.ok != expected.ok {
+		t.Errorf("Expected ok to be \"%v\", got \"%v\" instead",
+			expected.ok, actual.ok)
+	}
+	if !bytes.Equal(actual.command, expected.command) {
+		t.Errorf("Expected command to be \"%s\", got \"%s\" instead",
+			string(expected.command), string(actual.command))
+	}
+	if !bytes.Equal(actual.message, expected.message) {
+		t.Errorf("Expected message to be \"%s\", got \"%s\" instead",
+			string(expected.message), string(actual.message))
+	}
+	if !bytes.Equal(actual.key, expected.key) {
+		t.Errorf("Expected key to be \"%s\", got \"%s\" instead",
+			string(expected.key), string(actual.key))
+	}
+	if !bytes.Equal(actual.value, expected.value) {
+		t.Errorf("Expected value to be \"%s\", got \"%s\" instead",
+			string(expected.value), string(actual.value))
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use by the server logger and the test.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitForConns(server *Server, expected int, t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for server.ActiveConns() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d active connections, got %d instead", expected, server.ActiveConns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,16 @@
+// Package version holds build information of RCS. The variables are meant to be
+// set at build time, e.g.:
+//
+//	go build -ldflags "-X github.com/nmezhenskyi/rcs/internal/version.Version=v1.2.0" ./cmd
+package version
+
+var (
+	Version   = "dev"     // Release version.
+	Commit    = "unknown" // Git commit the binary was built from.
+	BuildDate = "unknown" // Build time in RFC 3339 format.
+)
+
+// String returns the build information in a single human-readable line.
+func String() string {
+	return Version + " (commit " + Commit + ", built " + BuildDate + ")"
+}
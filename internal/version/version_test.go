@@ -0,0 +1,14 @@
+package version
+
+import "testing"
+
+func TestDefaults(t *testing.T) {
+	for name, value := range map[string]string{"Version": Version, "Commit": Commit, "BuildDate": BuildDate} {
+		if value == "" {
+			t.Errorf("Expected %s to have a non-empty default", name)
+		}
+	}
+	if expected := "dev (commit unknown, built unknown)"; String() != expected {
+		t.Errorf("Expected %q, got %q instead", expected, String())
+	}
+}
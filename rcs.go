@@ -0,0 +1,139 @@
+// Package rcs allows embedding RCS in a Go program. An Instance runs the native,
+// gRPC, and HTTP servers on top of a single cache, like the rcs binary does.
+package rcs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nmezhenskyi/rcs/internal/cache"
+	"github.com/nmezhenskyi/rcs/internal/grpcsrv"
+	"github.com/nmezhenskyi/rcs/internal/httpsrv"
+	"github.com/nmezhenskyi/rcs/internal/nativesrv"
+	"github.com/rs/zerolog"
+)
+
+// ErrNoServers is returned by Start if no server is activated in Options.
+var ErrNoServers = errors.New("rcs: no server activated")
+
+// ServerOptions configures one of the servers of an Instance.
+type ServerOptions struct {
+	Addr     string // TCP network address to listen on, e.g. "localhost:6121".
+	CertFile string // Path to the TLS certificate file, TLS is enabled if both files are set.
+	KeyFile  string // Path to the TLS key file.
+}
+
+// Options configures an Instance. Servers left nil are not started.
+type Options struct {
+	Native *ServerOptions
+	GRPC   *ServerOptions
+	HTTP   *ServerOptions
+
+	CleanupInterval time.Duration   // How often expired keys are removed, if zero, never.
+	APIKey          string          // Shared secret required by all servers, if empty, authentication is disabled.
+	Logger          *zerolog.Logger // Each server logs with a "scope" field added, if nil, logging is disabled.
+}
+
+// Instance runs the activated servers, all backed by the same cache.
+type Instance struct {
+	opts  Options
+	cache *cache.CacheMap
+
+	native *nativesrv.Server
+	grpc   *grpcsrv.Server
+	http   *httpsrv.Server
+
+	errs chan error
+}
+
+// New returns an Instance configured with opts. Servers are started by Start.
+func New(opts Options) *Instance {
+	if opts.Logger == nil {
+		nop := zerolog.Nop()
+		opts.Logger = &nop
+	}
+	return &Instance{
+		opts:  opts,
+		cache: cache.NewCacheMapWithCleanup(opts.CleanupInterval),
+		errs:  make(chan error, 3),
+	}
+}
+
+// Cache returns the cache shared by the servers, e.g. to access it in-process.
+func (i *Instance) Cache() *cache.CacheMap {
+	return i.cache
+}
+
+// Start starts the activated servers in the background and returns. A server that
+// fails, e.g. because its address is in use, reports the error through Errors.
+// Start may be called only once.
+func (i *Instance) Start() error {
+	if i.opts.Native == nil && i.opts.GRPC == nil && i.opts.HTTP == nil {
+		return ErrNoServers
+	}
+	if o := i.opts.Native; o != nil {
+		i.native = nativesrv.NewServer(i.cache)
+		i.native.Logger = i.opts.Logger.With().Str("scope", "native").Logger()
+		i.native.APIKey = i.opts.APIKey
+		i.serve(o, i.native.ListenAndServe, i.native.ListenAndServeTLS)
+	}
+	if o := i.opts.GRPC; o != nil {
+		i.grpc = grpcsrv.NewServer(i.cache)
+		i.grpc.Logger = i.opts.Logger.With().Str("scope", "grpc").Logger()
+		i.grpc.APIKey = i.opts.APIKey
+		i.serve(o, i.grpc.ListenAndServe, i.grpc.ListenAndServeTLS)
+	}
+	if o := i.opts.HTTP; o != nil {
+		i.http = httpsrv.NewServer(i.cache)
+		i.http.Logger = i.opts.Logger.With().Str("scope", "http").Logger()
+		i.http.APIKey = i.opts.APIKey
+		i.serve(o, i.http.ListenAndServe, i.http.ListenAndServeTLS)
+	}
+	return nil
+}
+
+// Errors returns a channel that receives the errors of servers that have failed.
+func (i *Instance) Errors() <-chan error {
+	return i.errs
+}
+
+// Shutdown gracefully shuts down the started servers, waiting for active
+// connections until ctx is done. It returns the first error encountered.
+// Once Shutdown has been called, the Instance may not be reused.
+func (i *Instance) Shutdown(ctx context.Context) error {
+	var err error
+	record := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	if i.http != nil {
+		i.http.SetReady(false)
+	}
+	if i.native != nil {
+		record(i.native.Shutdown(ctx))
+	}
+	if i.http != nil {
+		record(i.http.Shutdown(ctx))
+	}
+	if i.grpc != nil {
+		record(i.grpc.Shutdown(ctx))
+	}
+	i.cache.StopCleanup()
+	return err
+}
+
+func (i *Instance) serve(o *ServerOptions, listen func(string) error, listenTLS func(string, string, string) error) {
+	go func() {
+		var err error
+		if o.CertFile != "" && o.KeyFile != "" {
+			err = listenTLS(o.Addr, o.CertFile, o.KeyFile)
+		} else {
+			err = listen(o.Addr)
+		}
+		if err != nil {
+			i.errs <- err
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package rcs
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInstance(t *testing.T) {
+	nativeAddr, httpAddr := "localhost:6131", "localhost:6133"
+	instance := New(Options{
+		Native: &ServerOptions{Addr: nativeAddr},
+		HTTP:   &ServerOptions{Addr: httpAddr},
+	})
+	if err := instance.Start(); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+
+	conn := dialUntil(nativeAddr, t)
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte("RCSP/1.0 PING\r\n"))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || !bytes.HasPrefix(buf[:n], []byte("RCSP/1.0 PING OK\r\n")) {
+		t.Errorf("Expected native PING OK, got %q (%v) instead", buf[:n], err)
+	}
+	conn.Close()
+
+	dialUntil(httpAddr, t).Close()
+	res, err := http.Get("http://" + httpAddr + "/PING")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected HTTP PING to return %d, got %d instead", http.StatusOK, res.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := instance.Shutdown(ctx); err != nil {
+		t.Errorf("Expected clean shutdown, got %v instead", err)
+	}
+	select {
+	case err := <-instance.Errors():
+		t.Errorf("Expected no server errors, got %v instead", err)
+	default:
+	}
+	if _, err := net.DialTimeout("tcp", nativeAddr, time.Second); err == nil {
+		t.Error("Expected native server to stop listening")
+	}
+}
+
+func TestInstanceWithoutServers(t *testing.T) {
+	if err := New(Options{}).Start(); err != ErrNoServers {
+		t.Errorf("Expected ErrNoServers, got %v instead", err)
+	}
+}
+
+// dialUntil connects to addr, retrying until the server listens or 3 seconds pass.
+func dialUntil(addr string, t *testing.T) net.Conn {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Failed to connect to %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}